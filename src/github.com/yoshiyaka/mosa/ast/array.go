@@ -29,3 +29,36 @@ func (a Array) String() string {
 
 	return str
 }
+
+// A part of an array, for instance $ports[1:3] or $ports[-2:]. Like for
+// indexes, negative bounds count from the end of the array. The element at To
+// is not included.
+type Slice struct {
+	Pos   Pos
+	Value Value
+
+	// The bounds of the slice. Nil if left out, meaning the start and the end
+	// of the array respectively.
+	From Value
+	To   Value
+}
+
+func (s Slice) String() string {
+	from, to := "", ""
+	if s.From != nil {
+		from = valToStr(s.From)
+	}
+	if s.To != nil {
+		to = valToStr(s.To)
+	}
+
+	return fmt.Sprintf("%s[%s:%s]", valToStr(s.Value), from, to)
+}
+
+// Returns whether the slices are equal. Positions are not taken into
+// consideration.
+func SliceEquals(s1, s2 Slice) bool {
+	return ValueEquals(s1.Value, s2.Value) &&
+		ValueEquals(s1.From, s2.From) &&
+		ValueEquals(s1.To, s2.To)
+}
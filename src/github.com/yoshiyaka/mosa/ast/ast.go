@@ -3,6 +3,9 @@ package ast
 import (
 	"fmt"
 	"reflect"
+	"sort"
+	"strconv"
+	"strings"
 )
 
 type stringable interface {
@@ -13,28 +16,133 @@ type AST struct {
 	Classes []Class
 	Defines []Define
 	Nodes   []Node
+	Funcs   []Func
+	Facters []Facter
+	Imports []Import
+
+	Layout Layout
+}
+
+// Details of how a manifest was written which don't change its meaning. They
+// are only kept so that parsed manifests can be printed back to source.
+type Layout struct {
+	// All comments, in the order they were written
+	Comments []Comment
+
+	// The positions of all tokens and comments preceded by a blank line
+	BlankLines []Pos
+
+	// The positions of all strings written as heredocs
+	Heredocs []Pos
+}
+
+// An import of another manifest file, for instance import 'lib/users.ms'
+type Import struct {
+	Pos Pos
+
+	// The path of the imported file. Relative paths are resolved relative to
+	// the directory of the file containing the import.
+	Path string
+
+	// The path as it was written in the manifest
+	Written string
+}
+
+func (i *Import) String() string {
+	return "import " + QuotedString(i.Written).String()
+}
+
+// A comment, for instance // Installs nginx or /* ... */
+type Comment struct {
+	Pos Pos
+
+	// The text of the comment, including the // or the /* and */
+	Text string
+
+	// Whether the comment follows code on the same line, as in $a = 5 // five
+	Trailing bool
 }
 
 func NewAST() *AST {
 	return &AST{}
 }
 
+// Appends all classes, defines, nodes, functions, facters, imports and layout
+// of other to f.
+// This is used to combine the ASTs of several files that were parsed
+// independently.
+func (f *AST) Merge(other *AST) {
+	f.Classes = append(f.Classes, other.Classes...)
+	f.Defines = append(f.Defines, other.Defines...)
+	f.Nodes = append(f.Nodes, other.Nodes...)
+	f.Funcs = append(f.Funcs, other.Funcs...)
+	f.Facters = append(f.Facters, other.Facters...)
+	f.Imports = append(f.Imports, other.Imports...)
+	f.Layout.Comments = append(f.Layout.Comments, other.Layout.Comments...)
+	f.Layout.BlankLines = append(f.Layout.BlankLines, other.Layout.BlankLines...)
+	f.Layout.Heredocs = append(f.Layout.Heredocs, other.Layout.Heredocs...)
+}
+
+// Returns all definitions of the manifest, grouped by type. Comments are left
+// out. Use the printer package to get formatted source.
 func (f *AST) String() string {
 	s := ""
+	for _, imp := range f.Imports {
+		s += imp.String() + "\n"
+	}
 	for _, class := range f.Classes {
-		s = class.String() + "\n"
+		s += class.String() + "\n"
+	}
+	for _, define := range f.Defines {
+		s += define.String() + "\n"
+	}
+	for _, node := range f.Nodes {
+		s += node.String() + "\n"
+	}
+	for _, fn := range f.Funcs {
+		s += fn.String() + "\n"
+	}
+	for _, facter := range f.Facters {
+		s += facter.String() + "\n"
 	}
 
 	return s
 }
 
 type Block struct {
-	Filename string
-	LineNum  int
+	Pos Pos
+
+	// The position of the closing brace
+	End Pos
+
+	// The statements of the block in the order they were written. The slices
+	// by type below hold the same statements, and are what the resolver uses.
+	Statements []Statement
+
+	// The comments after the last statement of the block
+	EndComments []Comment
 
 	VariableDefs []VariableDef
 	Declarations []Declaration
 	Ifs          []If
+	Cases        []Case
+	Fors         []For
+	Includes     []Include
+
+	// Only allowed in the blocks of functions, where it holds the value to
+	// return.
+	Return *Return
+}
+
+// A statement of a block, along with the comments written next to it
+type Statement struct {
+	// A *VariableDef, *Declaration, *If, *Case, *For, *Include or *Return
+	// pointing into the slices of the block
+	Stmt interface{}
+
+	// The comments on the lines before the statement, followed by the
+	// comments trailing its code on the same lines
+	Comments []Comment
 }
 
 type DefineType int
@@ -44,23 +152,63 @@ const (
 	DefineTypeMultiple
 )
 
+func (dt DefineType) String() string {
+	if dt == DefineTypeMultiple {
+		return "multiple"
+	}
+	return "single"
+}
+
 type Define struct {
-	Filename string
-	LineNum  int
-	Name     string
-	ArgDefs  []VariableDef
-	Block    Block
-	Type     DefineType
+	Pos     Pos
+	Name    string
+	ArgDefs []VariableDef
+	Block   Block
+	Type    DefineType
+}
+
+func (d *Define) String() string {
+	return fmt.Sprintf(
+		"define %s %s%s %s", d.Type, d.Name, argDefsToStr(d.ArgDefs),
+		d.Block.String(),
+	)
+}
+
+// Determines whether realizations of the define with the same name are already
+// satisfied on the target system, for instance
+//
+//	facter single file($name, $content,) {
+//		return md5sum($content) == $currentMd5
+//	}
+//
+// A single facter returns a bool, which is true if the realization is
+// satisfied. A multiple facter is given all names realized with the same
+// arguments in $names, and returns either a bool for all of them, or an array
+// holding the names which are not yet satisfied.
+//
+// Like functions, the blocks of facters may not contain any declarations.
+type Facter struct {
+	Pos     Pos
+	Name    string
+	ArgDefs []VariableDef
+	Block   Block
+	Type    DefineType
+}
+
+func (f *Facter) String() string {
+	return fmt.Sprintf(
+		"facter %s %s%s %s", f.Type, f.Name, argDefsToStr(f.ArgDefs),
+		f.Block.String(),
+	)
 }
 
 type Node Class
 
 type Class struct {
-	Filename string
-	LineNum  int
-	Name     string
-	ArgDefs  []VariableDef
-	Block    Block
+	Pos     Pos
+	Name    string
+	ArgDefs []VariableDef
+	Block   Block
 }
 
 // Returns whether the blocks are equal. Line numbers and filenames are not
@@ -72,26 +220,151 @@ func BlockEquals(b1, b2 *Block) bool {
 
 	return VariableDefsEquals(b1.VariableDefs, b2.VariableDefs) &&
 		DeclarationsEquals(b1.Declarations, b2.Declarations) &&
-		IfsEquals(b1.Ifs, b2.Ifs)
+		IfsEquals(b1.Ifs, b2.Ifs) &&
+		CasesEquals(b1.Cases, b2.Cases) &&
+		ForsEquals(b1.Fors, b2.Fors) &&
+		IncludesEquals(b1.Includes, b2.Includes) &&
+		ReturnEquals(b1.Return, b2.Return)
 }
 
-func (b *Block) String() string {
-	defs := ""
-	ifs := ""
-	decls := ""
-	for _, def := range b.VariableDefs {
-		defs += fmt.Sprintf("\t%s\n", def.String())
+// Returns a block holding stmts in order, each being a VariableDef,
+// Declaration, If, Case, For, Include or Return. The statements are sorted into
+// the slices by type, which Statements points into.
+func NewBlock(pos, end Pos, stmts []interface{}) Block {
+	b := Block{
+		Pos:          pos,
+		End:          end,
+		VariableDefs: []VariableDef{},
+		Declarations: []Declaration{},
+		Ifs:          []If{},
+	}
+
+	// The slices must be complete before pointing into them, since appending
+	// may move them.
+	indexes := make([]int, len(stmts))
+	var returns []*Return
+	for i, stmt := range stmts {
+		switch stmt := stmt.(type) {
+		case VariableDef:
+			indexes[i] = len(b.VariableDefs)
+			b.VariableDefs = append(b.VariableDefs, stmt)
+		case Declaration:
+			indexes[i] = len(b.Declarations)
+			b.Declarations = append(b.Declarations, stmt)
+		case If:
+			indexes[i] = len(b.Ifs)
+			b.Ifs = append(b.Ifs, stmt)
+		case Case:
+			indexes[i] = len(b.Cases)
+			b.Cases = append(b.Cases, stmt)
+		case For:
+			indexes[i] = len(b.Fors)
+			b.Fors = append(b.Fors, stmt)
+		case Include:
+			indexes[i] = len(b.Includes)
+			b.Includes = append(b.Includes, stmt)
+		case Return:
+			indexes[i] = len(returns)
+			returns = append(returns, &stmt)
+			b.Return = &stmt
+		default:
+			panic(fmt.Sprintf("Not a statement: %#v", stmt))
+		}
 	}
 
-	for _, _if := range b.Ifs {
-		ifs += fmt.Sprintf("\t%s\n", _if.String())
+	b.Statements = make([]Statement, len(stmts))
+	for i, stmt := range stmts {
+		var ptr interface{}
+		switch stmt.(type) {
+		case VariableDef:
+			ptr = &b.VariableDefs[indexes[i]]
+		case Declaration:
+			ptr = &b.Declarations[indexes[i]]
+		case If:
+			ptr = &b.Ifs[indexes[i]]
+		case Case:
+			ptr = &b.Cases[indexes[i]]
+		case For:
+			ptr = &b.Fors[indexes[i]]
+		case Include:
+			ptr = &b.Includes[indexes[i]]
+		case Return:
+			ptr = returns[indexes[i]]
+		}
+		b.Statements[i] = Statement{Stmt: ptr}
+	}
+
+	return b
+}
+
+// Returns the statements of the block in order. Blocks which weren't created
+// by NewBlock, such as the ones built by hand in tests, only have the slices
+// by type. Their statements are sorted by position, and grouped by type if
+// they lack positions.
+func (b *Block) OrderedStatements() []Statement {
+	if len(b.Statements) > 0 {
+		return b.Statements
+	}
+
+	var stmts []Statement
+	for i := range b.VariableDefs {
+		stmts = append(stmts, Statement{Stmt: &b.VariableDefs[i]})
+	}
+	for i := range b.Declarations {
+		stmts = append(stmts, Statement{Stmt: &b.Declarations[i]})
+	}
+	for i := range b.Ifs {
+		stmts = append(stmts, Statement{Stmt: &b.Ifs[i]})
+	}
+	for i := range b.Cases {
+		stmts = append(stmts, Statement{Stmt: &b.Cases[i]})
+	}
+	for i := range b.Fors {
+		stmts = append(stmts, Statement{Stmt: &b.Fors[i]})
+	}
+	for i := range b.Includes {
+		stmts = append(stmts, Statement{Stmt: &b.Includes[i]})
+	}
+	if b.Return != nil {
+		stmts = append(stmts, Statement{Stmt: b.Return})
+	}
+
+	sort.SliceStable(stmts, func(i, j int) bool {
+		return stmts[i].Pos().Before(stmts[j].Pos())
+	})
+
+	return stmts
+}
+
+// Returns the position where the statement starts.
+func (s *Statement) Pos() Pos {
+	switch stmt := s.Stmt.(type) {
+	case *VariableDef:
+		return stmt.Pos
+	case *Declaration:
+		return stmt.Pos
+	case *If:
+		return stmt.Pos
+	case *Case:
+		return stmt.Pos
+	case *For:
+		return stmt.Pos
+	case *Include:
+		return stmt.Pos
+	case *Return:
+		return stmt.Pos
 	}
 
-	for _, decl := range b.Declarations {
-		decls += fmt.Sprintf("\t%s\n", decl.String())
+	panic(fmt.Sprintf("Not a statement: %#v", s.Stmt))
+}
+
+func (b *Block) String() string {
+	stmts := ""
+	for _, stmt := range b.OrderedStatements() {
+		stmts += fmt.Sprintf("\t%s\n", stmt.Stmt.(stringable).String())
 	}
 
-	return fmt.Sprintf("{\n%s\n%s\n%s\n}\n", defs, ifs, decls)
+	return fmt.Sprintf("{\n%s}\n", stmts)
 }
 
 // Returns whether the classes are equal. Line numbers and filenames are not
@@ -102,16 +375,69 @@ func (c *Class) Equals(c2 *Class) bool {
 		BlockEquals(&c.Block, &c2.Block)
 }
 
+// A function defined in a manifest, for instance
+//
+//	func vhost_path($name,) {
+//		return "/etc/nginx/sites-available/$name.conf"
+//	}
+//
+// Functions are pure. Their blocks may define variables and contain if
+// statements, but may not contain any declarations.
+type Func struct {
+	Pos     Pos
+	Name    string
+	ArgDefs []VariableDef
+	Block   Block
+}
+
+// Returns whether the functions are equal. Line numbers and filenames are not
+// taken into consideration.
+func (f *Func) Equals(f2 *Func) bool {
+	return f.Name == f2.Name &&
+		VariableDefsEquals(f.ArgDefs, f2.ArgDefs) &&
+		BlockEquals(&f.Block, &f2.Block)
+}
+
+func (f *Func) String() string {
+	return fmt.Sprintf(
+		"func %s%s %s", f.Name, argDefsToStr(f.ArgDefs), f.Block.String(),
+	)
+}
+
 func (n *Node) String() string {
-	return fmt.Sprintf("node '%s' %s", n.Name, n.Block.String())
+	return fmt.Sprintf(
+		"node %s %s", QuotedString(n.Name).String(), n.Block.String(),
+	)
 }
 
 func (c *Class) String() string {
-	return fmt.Sprintf("class %s %s", c.Name, c.Block.String())
+	args := ""
+	if len(c.ArgDefs) > 0 {
+		args = argDefsToStr(c.ArgDefs)
+	}
+
+	return fmt.Sprintf("class %s%s %s", c.Name, args, c.Block.String())
+}
+
+// Returns argument definitions on the form ($name, $port = 80,)
+func argDefsToStr(argDefs []VariableDef) string {
+	s := "("
+	for i, def := range argDefs {
+		if i > 0 {
+			s += " "
+		}
+		if def.Val == nil {
+			s += def.VariableName.String() + ","
+		} else {
+			s += def.String() + ","
+		}
+	}
+
+	return s + ")"
 }
 
 type VariableDef struct {
-	LineNum      int
+	Pos          Pos
 	VariableName VariableName
 	Val          Value
 }
@@ -140,16 +466,15 @@ func (d *VariableDef) String() string {
 }
 
 type VariableName struct {
-	LineNum int
-	Str     string
+	Pos Pos
+	Str string
 }
 
 func (vn VariableName) String() string { return vn.Str }
 
 // A used type, for instance package { 'nginx': ensure => 'latest' }
 type Declaration struct {
-	Filename string
-	LineNum  int
+	Pos Pos
 
 	// The type of declaration, 'package' in the example above
 	Type string
@@ -197,9 +522,9 @@ func (d *Declaration) String() string {
 
 // A property in declaration, for instance ensure => 'latest'
 type Prop struct {
-	LineNum int
-	Name    string
-	Value   Value
+	Pos   Pos
+	Name  string
+	Value Value
 }
 
 func (p *Prop) Equals(p2 *Prop) bool {
@@ -229,10 +554,19 @@ func (p *Prop) String() string {
 	}
 }
 
-// A value, for instance 1, 'foo', $bar or [ 1, 'five', ]
+// A value, for instance 1, 'foo', $bar, [ 1, 'five', ] or { 'port' => 80 }
 type Value interface{}
 
+// Returns whether the values are equal. Positions are not taken into
+// consideration, and literals are considered equal to the values they wrap.
 func ValueEquals(v1, v2 Value) bool {
+	if l, ok := v1.(Literal); ok {
+		v1 = l.Val
+	}
+	if l, ok := v2.(Literal); ok {
+		v2 = l.Val
+	}
+
 	switch v1.(type) {
 	case Reference:
 		if ref2, ok := v2.(Reference); ok {
@@ -247,6 +581,71 @@ func ValueEquals(v1, v2 Value) bool {
 		} else {
 			return false
 		}
+	case Hash:
+		if h2, ok := v2.(Hash); ok {
+			return HashEquals(v1.(Hash), h2)
+		} else {
+			return false
+		}
+	case Index:
+		if i2, ok := v2.(Index); ok {
+			return IndexEquals(v1.(Index), i2)
+		} else {
+			return false
+		}
+	case Slice:
+		if s2, ok := v2.(Slice); ok {
+			return SliceEquals(v1.(Slice), s2)
+		} else {
+			return false
+		}
+	case VariableName:
+		if vn2, ok := v2.(VariableName); ok {
+			return v1.(VariableName).Str == vn2.Str
+		} else {
+			return false
+		}
+	case Expression:
+		if e2, ok := v2.(Expression); ok {
+			e1 := v1.(Expression)
+			return ExpressionEquals(&e1, &e2)
+		} else {
+			return false
+		}
+	case UnaryExpression:
+		if e2, ok := v2.(UnaryExpression); ok {
+			e1 := v1.(UnaryExpression)
+			return UnaryExpressionEquals(&e1, &e2)
+		} else {
+			return false
+		}
+	case InterpolatedString:
+		if is2, ok := v2.(InterpolatedString); ok {
+			return InterpolatedStringEquals(v1.(InterpolatedString), is2)
+		} else {
+			return false
+		}
+	case FunctionCall:
+		if fc2, ok := v2.(FunctionCall); ok {
+			fc1 := v1.(FunctionCall)
+			return FunctionCallEquals(&fc1, &fc2)
+		} else {
+			return false
+		}
+	case Selector:
+		if s2, ok := v2.(Selector); ok {
+			s1 := v1.(Selector)
+			return SelectorEquals(&s1, &s2)
+		} else {
+			return false
+		}
+	case Probe:
+		if p2, ok := v2.(Probe); ok {
+			p1 := v1.(Probe)
+			return ProbeEquals(&p1, &p2)
+		} else {
+			return false
+		}
 	default:
 		return reflect.DeepEqual(v1, v2)
 	}
@@ -254,9 +653,9 @@ func ValueEquals(v1, v2 Value) bool {
 
 // A reference, for instance package['nginx'] or package[$webserver]
 type Reference struct {
-	LineNum int
-	Type    string
-	Scalar  Value
+	Pos    Pos
+	Type   string
+	Scalar Value
 }
 
 func (r Reference) String() string {
@@ -289,3 +688,17 @@ func valToStr(i interface{}) string {
 }
 
 type Bool bool
+
+// A floating point number, for instance 0.75
+type Float float64
+
+// Returns the float in decimal notation. There will always be at least one
+// decimal, so that the float can't be confused with an int.
+func (f Float) String() string {
+	str := strconv.FormatFloat(float64(f), 'f', -1, 64)
+	if !strings.ContainsAny(str, ".IN") {
+		// Add a decimal unless the number is NaN or infinite
+		str += ".0"
+	}
+	return str
+}
@@ -2,12 +2,13 @@ package ast
 
 import "fmt"
 
-// Operation. Supported values are: + - * / < > != ==
+// Operation. Supported values are: + - * / % < <= > >= != == =~ !~ && || in
+// and the unary ! and -
 type ExpOp string
 
 // A binary expression tree, for instance $foo + 5 or 1 == 2.
 type Expression struct {
-	LineNum int
+	Pos Pos
 
 	Operation ExpOp
 
@@ -36,3 +37,28 @@ func ExpressionEquals(e1, e2 *Expression) bool {
 		ValueEquals(e1.Left, e2.Left) &&
 		ValueEquals(e1.Right, e2.Right)
 }
+
+// An expression with a single operand, for instance !$enabled or -5.
+type UnaryExpression struct {
+	Pos Pos
+
+	// Either ! or -
+	Operation ExpOp
+
+	// The operand. May be either an expression or a value.
+	Value Value
+}
+
+func (e UnaryExpression) String() string {
+	val := valToStr(e.Value)
+	switch e.Value.(type) {
+	case Expression, UnaryExpression:
+		val = "(" + val + ")"
+	}
+
+	return fmt.Sprintf("%s%s", e.Operation, val)
+}
+
+func UnaryExpressionEquals(e1, e2 *UnaryExpression) bool {
+	return e1.Operation == e2.Operation && ValueEquals(e1.Value, e2.Value)
+}
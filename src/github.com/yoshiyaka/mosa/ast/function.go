@@ -0,0 +1,41 @@
+package ast
+
+import (
+	"fmt"
+	"strings"
+)
+
+// A call to a function, for instance implode($names, ' ') or len($content)
+type FunctionCall struct {
+	Pos  Pos
+	Name string
+
+	// The arguments passed to the function, in order. Each argument may be any
+	// value or expression.
+	Args []interface{}
+}
+
+func (fc FunctionCall) String() string {
+	args := make([]string, len(fc.Args))
+	for i, arg := range fc.Args {
+		args[i] = valToStr(arg)
+	}
+
+	return fmt.Sprintf("%s(%s)", fc.Name, strings.Join(args, ", "))
+}
+
+// Returns whether the function calls are equal. Positions are not taken into
+// consideration.
+func FunctionCallEquals(fc1, fc2 *FunctionCall) bool {
+	if fc1.Name != fc2.Name || len(fc1.Args) != len(fc2.Args) {
+		return false
+	}
+
+	for i, _ := range fc1.Args {
+		if !ValueEquals(fc1.Args[i], fc2.Args[i]) {
+			return false
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,119 @@
+package ast
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+)
+
+// A hash, for instance { 'port' => 80, 'ssl' => true }. The entries are kept in
+// the order they were written in the manifest.
+//
+// In a parsed manifest, both the keys and the values may be any expression.
+// Once resolved, all keys are unique QuotedStrings.
+type Hash []HashEntry
+
+// A single key => value pair in a hash.
+type HashEntry struct {
+	Pos Pos
+	Key Value
+	Val Value
+}
+
+// Returns the value stored for key, and whether it was found. Keys are compared
+// using ValueEquals().
+func (h Hash) Get(key Value) (Value, bool) {
+	for _, entry := range h {
+		if ValueEquals(entry.Key, key) {
+			return entry.Val, true
+		}
+	}
+
+	return nil, false
+}
+
+// Returns whether the hashes hold the same keys and values. The order of the
+// entries and positions are not taken into consideration.
+func HashEquals(h1, h2 Hash) bool {
+	if len(h1) != len(h2) {
+		return false
+	}
+
+	for _, entry := range h1 {
+		if val, found := h2.Get(entry.Key); !found || !ValueEquals(entry.Val, val) {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (h Hash) String() string {
+	str := "{"
+	for _, entry := range h {
+		str += fmt.Sprintf(" %s => %s,", valToStr(entry.Key), valToStr(entry.Val))
+	}
+	str += " }"
+
+	return str
+}
+
+// Encodes the hash as a JSON object, keeping the order of the entries. Keys
+// which aren't strings are encoded using their manifest representation.
+func (h Hash) MarshalJSON() ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+
+	for i, entry := range h {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+
+		key := entry.Key
+		if l, ok := key.(Literal); ok {
+			key = l.Val
+		}
+
+		var keyStr string
+		if qs, ok := key.(QuotedString); ok {
+			keyStr = string(qs)
+		} else {
+			keyStr = valToStr(key)
+		}
+
+		keyJson, err := json.Marshal(keyStr)
+		if err != nil {
+			return nil, err
+		}
+		valJson, err := json.Marshal(entry.Val)
+		if err != nil {
+			return nil, err
+		}
+
+		buf.Write(keyJson)
+		buf.WriteByte(':')
+		buf.Write(valJson)
+	}
+
+	buf.WriteByte('}')
+	return buf.Bytes(), nil
+}
+
+// A lookup of a key in a hash or an element in an array, for instance
+// $vhost['port'] or $ports[0]. Negative array indexes count from the end, so
+// $ports[-1] is the last element.
+type Index struct {
+	Pos   Pos
+	Value Value
+	Key   Value
+}
+
+func (i Index) String() string {
+	return fmt.Sprintf("%s[%s]", valToStr(i.Value), valToStr(i.Key))
+}
+
+// Returns whether the lookups are equal. Positions are not taken into
+// consideration.
+func IndexEquals(i1, i2 Index) bool {
+	return ValueEquals(i1.Value, i2.Value) && ValueEquals(i1.Key, i2.Key)
+}
@@ -0,0 +1,367 @@
+package ast
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strconv"
+)
+
+// The version of the JSON encoding written by EncodeJSON. It is increased
+// whenever the encoding changes in a way that older decoders can't read.
+const JSONVersion = 1
+
+// The names of the types which values may have, as written in the "Type" tags
+// of the JSON encoding.
+var jsonValueTypes = map[string]reflect.Type{
+	"int":                reflect.TypeOf(0),
+	"int64":              reflect.TypeOf(int64(0)),
+	"string":             reflect.TypeOf(""),
+	"Bool":               reflect.TypeOf(Bool(false)),
+	"Float":              reflect.TypeOf(Float(0)),
+	"QuotedString":       reflect.TypeOf(QuotedString("")),
+	"Regex":              reflect.TypeOf(Regex("")),
+	"Literal":            reflect.TypeOf(Literal{}),
+	"VariableName":       reflect.TypeOf(VariableName{}),
+	"InterpolatedString": reflect.TypeOf(InterpolatedString{}),
+	"Expression":         reflect.TypeOf(Expression{}),
+	"UnaryExpression":    reflect.TypeOf(UnaryExpression{}),
+	"Selector":           reflect.TypeOf(Selector{}),
+	"Array":              reflect.TypeOf(Array{}),
+	"Hash":               reflect.TypeOf(Hash{}),
+	"Reference":          reflect.TypeOf(Reference{}),
+	"Index":              reflect.TypeOf(Index{}),
+	"Slice":              reflect.TypeOf(Slice{}),
+	"FunctionCall":       reflect.TypeOf(FunctionCall{}),
+	"Probe":              reflect.TypeOf(Probe{}),
+}
+
+// The names of the types which statements of blocks may have
+var jsonStatementTypes = map[string]reflect.Type{
+	"VariableDef": reflect.TypeOf(VariableDef{}),
+	"Declaration": reflect.TypeOf(Declaration{}),
+	"If":          reflect.TypeOf(If{}),
+	"Case":        reflect.TypeOf(Case{}),
+	"For":         reflect.TypeOf(For{}),
+	"Include":     reflect.TypeOf(Include{}),
+	"Return":      reflect.TypeOf(Return{}),
+}
+
+var (
+	jsonTypeNames = map[reflect.Type]string{}
+	blockType     = reflect.TypeOf(Block{})
+)
+
+func init() {
+	for _, types := range []map[string]reflect.Type{jsonValueTypes, jsonStatementTypes} {
+		for name, t := range types {
+			jsonTypeNames[t] = name
+		}
+	}
+}
+
+// Encodes ast as JSON which DecodeJSON can read back into an identical AST.
+// Unlike the plain encoding of json.Marshal, each value is tagged with its
+// type, for instance
+//
+//	{ "Type": "QuotedString", "Value": "nginx" }
+//
+// so that 'nginx' can be told from "nginx" or /nginx/. Structs are encoded as
+// objects holding their fields, and floats as strings since JSON lacks NaN and
+// infinities. Blocks hold their statements in order, with the comments
+// attached to them. The AST is wrapped in an object along with JSONVersion:
+//
+//	{ "Version": 1, "AST": { "Classes": [ ... ], ... } }
+func EncodeJSON(ast *AST) ([]byte, error) {
+	encoded, err := encodeJSONValue(reflect.ValueOf(ast).Elem())
+	if err != nil {
+		return nil, err
+	}
+
+	return json.Marshal(map[string]interface{}{
+		"Version": JSONVersion,
+		"AST":     encoded,
+	})
+}
+
+// Decodes an AST encoded by EncodeJSON. Fields missing from the JSON are left
+// unset, so that ASTs encoded before fields were added can still be read.
+func DecodeJSON(data []byte) (*AST, error) {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+
+	var envelope struct {
+		Version json.Number
+		AST     interface{}
+	}
+	if err := decoder.Decode(&envelope); err != nil {
+		return nil, err
+	}
+	if envelope.Version.String() != strconv.Itoa(JSONVersion) {
+		return nil, fmt.Errorf(
+			"Unsupported version of the JSON encoding: '%s', expected %d",
+			envelope.Version, JSONVersion,
+		)
+	}
+
+	decoded, err := decodeJSONValue(envelope.AST, reflect.TypeOf(AST{}))
+	if err != nil {
+		return nil, err
+	}
+
+	ast := decoded.Interface().(AST)
+	return &ast, nil
+}
+
+// Returns v as a value which encoding/json encodes as described by EncodeJSON.
+func encodeJSONValue(v reflect.Value) (interface{}, error) {
+	switch v.Kind() {
+	case reflect.Interface:
+		if v.IsNil() {
+			return nil, nil
+		}
+		return encodeJSONTagged(v.Elem())
+	case reflect.Ptr:
+		if v.IsNil() {
+			return nil, nil
+		}
+		return encodeJSONValue(v.Elem())
+	case reflect.Slice:
+		if v.IsNil() {
+			return nil, nil
+		}
+
+		a := make([]interface{}, v.Len())
+		for i := range a {
+			encoded, err := encodeJSONValue(v.Index(i))
+			if err != nil {
+				return nil, err
+			}
+			a[i] = encoded
+		}
+		return a, nil
+	case reflect.Struct:
+		if v.Type() == blockType {
+			block := v.Interface().(Block)
+			return encodeJSONBlock(&block)
+		}
+
+		m := map[string]interface{}{}
+		for i := 0; i < v.NumField(); i++ {
+			encoded, err := encodeJSONValue(v.Field(i))
+			if err != nil {
+				return nil, err
+			}
+			m[v.Type().Field(i).Name] = encoded
+		}
+		return m, nil
+	case reflect.Float64:
+		return strconv.FormatFloat(v.Float(), 'g', -1, 64), nil
+	case reflect.Bool:
+		return v.Bool(), nil
+	case reflect.Int, reflect.Int64:
+		return v.Int(), nil
+	case reflect.String:
+		return v.String(), nil
+	}
+
+	return nil, fmt.Errorf("Can't encode %s as JSON", v.Type())
+}
+
+// Encodes a value along with the name of its type.
+func encodeJSONTagged(v reflect.Value) (map[string]interface{}, error) {
+	name, known := jsonTypeNames[v.Type()]
+	if !known {
+		return nil, fmt.Errorf("Can't encode values of type %s as JSON", v.Type())
+	}
+
+	encoded, err := encodeJSONValue(v)
+	if err != nil {
+		return nil, err
+	}
+
+	return map[string]interface{}{"Type": name, "Value": encoded}, nil
+}
+
+// Encodes a block as its statements in order. The slices of statements by type
+// are left out, since they are rebuilt by NewBlock when decoding.
+func encodeJSONBlock(b *Block) (interface{}, error) {
+	stmts := []interface{}{}
+	for _, stmt := range b.OrderedStatements() {
+		encoded, err := encodeJSONTagged(reflect.ValueOf(stmt.Stmt).Elem())
+		if err != nil {
+			return nil, err
+		}
+		if encoded["Comments"], err = encodeJSONValue(reflect.ValueOf(stmt.Comments)); err != nil {
+			return nil, err
+		}
+		stmts = append(stmts, encoded)
+	}
+
+	pos, _ := encodeJSONValue(reflect.ValueOf(b.Pos))
+	end, _ := encodeJSONValue(reflect.ValueOf(b.End))
+	endComments, err := encodeJSONValue(reflect.ValueOf(b.EndComments))
+	if err != nil {
+		return nil, err
+	}
+
+	return map[string]interface{}{
+		"Pos":         pos,
+		"End":         end,
+		"Statements":  stmts,
+		"EndComments": endComments,
+	}, nil
+}
+
+// Decodes data, as unserialized by encoding/json with numbers kept as
+// json.Number, into a value of type t.
+func decodeJSONValue(data interface{}, t reflect.Type) (reflect.Value, error) {
+	v := reflect.New(t).Elem()
+	if data == nil {
+		// Nil interfaces, pointers and slices
+		return v, nil
+	}
+
+	badType := fmt.Errorf("Expected %s in JSON, got %v", t, data)
+
+	switch t.Kind() {
+	case reflect.Interface:
+		elem, err := decodeJSONTagged(data, jsonValueTypes, "value")
+		if err != nil {
+			return v, err
+		}
+		v.Set(elem)
+	case reflect.Ptr:
+		elem, err := decodeJSONValue(data, t.Elem())
+		if err != nil {
+			return v, err
+		}
+		v.Set(reflect.New(t.Elem()))
+		v.Elem().Set(elem)
+	case reflect.Slice:
+		a, ok := data.([]interface{})
+		if !ok {
+			return v, badType
+		}
+
+		v.Set(reflect.MakeSlice(t, len(a), len(a)))
+		for i, elemData := range a {
+			elem, err := decodeJSONValue(elemData, t.Elem())
+			if err != nil {
+				return v, err
+			}
+			v.Index(i).Set(elem)
+		}
+	case reflect.Struct:
+		m, ok := data.(map[string]interface{})
+		if !ok {
+			return v, badType
+		}
+		if t == blockType {
+			return decodeJSONBlock(m)
+		}
+
+		for i := 0; i < t.NumField(); i++ {
+			field, err := decodeJSONValue(m[t.Field(i).Name], t.Field(i).Type)
+			if err != nil {
+				return v, err
+			}
+			v.Field(i).Set(field)
+		}
+	case reflect.Float64:
+		str, ok := data.(string)
+		if !ok {
+			return v, badType
+		}
+		f, err := strconv.ParseFloat(str, 64)
+		if err != nil {
+			return v, err
+		}
+		v.SetFloat(f)
+	case reflect.Bool:
+		b, ok := data.(bool)
+		if !ok {
+			return v, badType
+		}
+		v.SetBool(b)
+	case reflect.Int, reflect.Int64:
+		n, ok := data.(json.Number)
+		if !ok {
+			return v, badType
+		}
+		i, err := n.Int64()
+		if err != nil {
+			return v, err
+		}
+		v.SetInt(i)
+	case reflect.String:
+		str, ok := data.(string)
+		if !ok {
+			return v, badType
+		}
+		v.SetString(str)
+	default:
+		return v, fmt.Errorf("Can't decode %s from JSON", t)
+	}
+
+	return v, nil
+}
+
+// Decodes a value or statement encoded along with the name of its type, which
+// must be one of types. kind names what is decoded in errors.
+func decodeJSONTagged(
+	data interface{}, types map[string]reflect.Type, kind string,
+) (reflect.Value, error) {
+	m, _ := data.(map[string]interface{})
+	name, _ := m["Type"].(string)
+	t, known := types[name]
+	if !known {
+		return reflect.Value{}, fmt.Errorf("Unknown type of %s in JSON: %v", kind, data)
+	}
+
+	return decodeJSONValue(m["Value"], t)
+}
+
+func decodeJSONBlock(m map[string]interface{}) (reflect.Value, error) {
+	stmtsData, _ := m["Statements"].([]interface{})
+	stmts := make([]interface{}, len(stmtsData))
+	comments := make([][]Comment, len(stmtsData))
+	for i, stmtData := range stmtsData {
+		stmt, err := decodeJSONTagged(stmtData, jsonStatementTypes, "statement")
+		if err != nil {
+			return reflect.Value{}, err
+		}
+		stmts[i] = stmt.Interface()
+
+		stmtComments, err := decodeJSONValue(
+			stmtData.(map[string]interface{})["Comments"],
+			reflect.TypeOf([]Comment{}),
+		)
+		if err != nil {
+			return reflect.Value{}, err
+		}
+		comments[i] = stmtComments.Interface().([]Comment)
+	}
+
+	pos, err := decodeJSONValue(m["Pos"], reflect.TypeOf(Pos{}))
+	if err != nil {
+		return reflect.Value{}, err
+	}
+	end, err := decodeJSONValue(m["End"], reflect.TypeOf(Pos{}))
+	if err != nil {
+		return reflect.Value{}, err
+	}
+	endComments, err := decodeJSONValue(m["EndComments"], reflect.TypeOf([]Comment{}))
+	if err != nil {
+		return reflect.Value{}, err
+	}
+
+	block := NewBlock(pos.Interface().(Pos), end.Interface().(Pos), stmts)
+	for i := range block.Statements {
+		block.Statements[i].Comments = comments[i]
+	}
+	block.EndComments = endComments.Interface().([]Comment)
+
+	return reflect.ValueOf(block), nil
+}
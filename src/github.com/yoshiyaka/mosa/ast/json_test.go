@@ -0,0 +1,165 @@
+package ast_test
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	. "github.com/yoshiyaka/mosa/ast"
+	"github.com/yoshiyaka/mosa/parser"
+)
+
+var jsonManifests = []string{
+	`
+	// Tells quoted strings, raw strings and regexes apart
+	class A($x = 'a',) {
+		$y = "a$x ${ $x[1:] } b"
+		$z = $x =~ /a/ ? { 'a' => 0.5, default => -1, }
+		$h = { 'k' => [ 1, true, package['nginx'], ], }
+		if !$x { include B } /* trailing */
+		return exec { 'ls': timeout => 5, }
+	}
+	`,
+	`
+	import 'lib/users.ms'
+
+	node 'web01.example.com' {
+		class { 'A': x => "b", }
+	}
+
+	define multiple package($names, $ensure = 'installed',) {
+		exec { "apt-get install $names": }
+	}
+
+	func vhost_path($name,) {
+		// Returns the path
+		return "/etc/nginx/sites-available/$name.conf"
+	}
+
+	facter single file($name, $content,) {
+		return md5sum($content) == 'x'
+	}
+	`,
+	`
+	class C {
+		case $os {
+			'debian', 'ubuntu': { $pkg = 'apache2' }
+			default: { $pkg = 'httpd' }
+		}
+		for $i, $u in $users {
+			user { $u: uid => 1000 + $i, }
+		}
+		if $a > 1 { $b = 1 } elsif $a < -1 { $b = 2 } else { $b = 3 }
+		file { '/etc/motd':
+			content => <<EOT
+				Welcome to $host
+				EOT,
+			depends => [ package['a'], package['b'], ],
+		}
+	}
+	`,
+}
+
+func parseJSONManifest(t *testing.T, filename, manifest string) *AST {
+	ast := NewAST()
+	if err := parser.Parse(ast, filename, strings.NewReader(manifest)); err != nil {
+		t.Fatal(manifest, err)
+	}
+	return ast
+}
+
+// Makes sure that parsed ASTs are decoded from JSON exactly as they were
+// before being encoded.
+func TestJSONRoundTrip(t *testing.T) {
+	manifests := append([]string{}, jsonManifests...)
+	paths, _ := filepath.Glob("../testdata/*.ms")
+	for _, path := range paths {
+		manifest, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		manifests = append(manifests, string(manifest))
+	}
+
+	for _, manifest := range manifests {
+		ast := parseJSONManifest(t, "json.ms", manifest)
+
+		encoded, err := EncodeJSON(ast)
+		if err != nil {
+			t.Error(manifest, err)
+			continue
+		}
+		decoded, err := DecodeJSON(encoded)
+		if err != nil {
+			t.Error(manifest, err)
+		} else if !reflect.DeepEqual(decoded, ast) {
+			t.Errorf("%s was decoded from\n%s\nas\n%#v", manifest, encoded, decoded)
+		}
+	}
+}
+
+func TestDecodeJSONVersion(t *testing.T) {
+	encoded, err := EncodeJSON(parseJSONManifest(t, "json.ms", "class A {}"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	versions := map[string]string{
+		`"Version":2`:   "Unsupported version of the JSON encoding: '2', expected 1",
+		`"Version":0.5`: "Unsupported version of the JSON encoding: '0.5', expected 1",
+	}
+	for version, expected := range versions {
+		data := strings.Replace(string(encoded), `"Version":1`, version, 1)
+		if _, err := DecodeJSON([]byte(data)); err == nil || err.Error() != expected {
+			t.Errorf("Decoding %s got error %v, expected %s", data, err, expected)
+		}
+	}
+
+	expected := "Unsupported version of the JSON encoding: '', expected 1"
+	if _, err := DecodeJSON([]byte(`{"AST":{}}`)); err == nil || err.Error() != expected {
+		t.Errorf("Decoding without a version got error %v, expected %s", err, expected)
+	}
+}
+
+func TestDecodeJSONUnknownType(t *testing.T) {
+	bad := []struct {
+		data, expected string
+	}{
+		{
+			`{"Version":1,"AST":{"Classes":[{"ArgDefs":[{"Val":{"Type":"Nope"}}]}]}}`,
+			"Unknown type of value in JSON: map[Type:Nope]",
+		},
+		{
+			`{"Version":1,"AST":{"Classes":[{"ArgDefs":[{"Val":{"Value":1}}]}]}}`,
+			"Unknown type of value in JSON: map[Value:1]",
+		},
+		{
+			`{"Version":1,"AST":{"Imports":{}}}`,
+			"Expected []ast.Import in JSON, got map[]",
+		},
+
+		// Statements can't be values, nor values statements
+		{
+			`{"Version":1,"AST":{"Classes":[{"ArgDefs":[{"Val":{"Type":"Declaration","Value":{}}}]}]}}`,
+			"Unknown type of value in JSON: map[Type:Declaration Value:map[]]",
+		},
+		{
+			`{"Version":1,"AST":{"Classes":[{"Name":"A","Block":{"Statements":[` +
+				`{"Type":"Declaration","Value":{"Type":"exec","Props":[` +
+				`{"Name":"x","Value":{"Type":"If","Value":{}}}]}}]}}]}}`,
+			"Unknown type of value in JSON: map[Type:If Value:map[]]",
+		},
+		{
+			`{"Version":1,"AST":{"Classes":[{"Name":"A","Block":{"Statements":[{"Type":"int","Value":1}]}}]}}`,
+			"Unknown type of statement in JSON: map[Type:int Value:1]",
+		},
+	}
+
+	for _, test := range bad {
+		if _, err := DecodeJSON([]byte(test.data)); err == nil || err.Error() != test.expected {
+			t.Errorf("Decoding %s got error %v, expected %s", test.data, err, test.expected)
+		}
+	}
+}
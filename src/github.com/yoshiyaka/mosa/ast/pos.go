@@ -0,0 +1,43 @@
+package ast
+
+import "fmt"
+
+// A position in a manifest file. Lines and columns both start at 1, and
+// columns are counted in bytes.
+type Pos struct {
+	File string
+	Line int
+	Col  int
+}
+
+// Returns whether the position has been set.
+func (p Pos) IsValid() bool {
+	return p.Line > 0
+}
+
+// Returns whether p comes before other. Both positions must be in the same
+// file.
+func (p Pos) Before(other Pos) bool {
+	return p.Line < other.Line || p.Line == other.Line && p.Col < other.Col
+}
+
+// Returns the position on the form file:line:col.
+func (p Pos) String() string {
+	return fmt.Sprintf("%s:%d:%d", p.File, p.Line, p.Col)
+}
+
+// A scalar value as it was written in the manifest, for instance 5, true or
+// 'foo'. This is used to keep track of where in the manifest the value was
+// defined. The wrapped value will be an int, a Float, a Bool or a QuotedString,
+// or a string for the raw text segments of an InterpolatedString.
+//
+// Literals only exist in parsed manifests. The resolver unwraps them, so all
+// resolved values are plain values.
+type Literal struct {
+	Pos Pos
+	Val Value
+}
+
+func (l Literal) String() string {
+	return valToStr(l.Val)
+}
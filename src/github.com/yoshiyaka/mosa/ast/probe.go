@@ -0,0 +1,37 @@
+package ast
+
+import "fmt"
+
+// A read-only command which is run while the manifest is resolved, in order
+// to find out something about the target system, for instance
+//
+//	$installed = exec { "dpkg -l | grep '^ii' | wc -l": timeout => 5, }
+//
+// Probes must not have side effects, since they may be run any number of
+// times, or not at all when mosa runs in compile only mode. A probe resolves
+// to a hash holding the trimmed output of the command as 'stdout' and its exit
+// status as 'status'.
+type Probe struct {
+	Pos Pos
+
+	// The command to run
+	Command Value
+
+	// Settings for the probe, such as timeout => 5
+	Props []Prop
+}
+
+func (p Probe) String() string {
+	props := ""
+	for _, prop := range p.Props {
+		props += fmt.Sprintf(" %s,", prop.String())
+	}
+
+	return fmt.Sprintf("exec { %s:%s }", valToStr(p.Command), props)
+}
+
+// Returns whether the probes are equal. Positions are not taken into
+// consideration.
+func ProbeEquals(p1, p2 *Probe) bool {
+	return ValueEquals(p1.Command, p2.Command) && PropsEquals(p1.Props, p2.Props)
+}
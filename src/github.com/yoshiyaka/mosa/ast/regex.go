@@ -0,0 +1,11 @@
+package ast
+
+import "strings"
+
+// A regular expression, for instance /^www\d+\./. The syntax is the one of Go's
+// regexp package.
+type Regex string
+
+func (r Regex) String() string {
+	return "/" + strings.Replace(string(r), "/", "\\/", -1) + "/"
+}
@@ -0,0 +1,62 @@
+package ast
+
+import "fmt"
+
+// Picks a value depending on another value, for instance
+//
+//	$pkg = $os ? {
+//		'debian' => 'apache2',
+//		/^(redhat|centos)$/ => 'httpd',
+//		default => 'httpd',
+//	}
+//
+// The cases are tried in order, and the value of the first one matching Value
+// is used. Matching works like for the branches of a case statement.
+type Selector struct {
+	Pos Pos
+
+	Value Value
+	Cases []SelectorCase
+
+	// Used if none of the cases match. Nil if the selector has no default.
+	Default Value
+}
+
+// A case of a selector, for instance 'debian' => 'apache2'
+type SelectorCase struct {
+	Pos Pos
+
+	Match Value
+	Val   Value
+}
+
+func (s Selector) String() string {
+	cases := ""
+	for _, c := range s.Cases {
+		cases += fmt.Sprintf(" %s => %s,", valToStr(c.Match), valToStr(c.Val))
+	}
+	if s.Default != nil {
+		cases += fmt.Sprintf(" default => %s,", valToStr(s.Default))
+	}
+
+	return fmt.Sprintf("%s ? {%s }", valToStr(s.Value), cases)
+}
+
+// Returns whether the selectors are equal. Positions are not taken into
+// consideration.
+func SelectorEquals(s1, s2 *Selector) bool {
+	if !ValueEquals(s1.Value, s2.Value) ||
+		!ValueEquals(s1.Default, s2.Default) ||
+		len(s1.Cases) != len(s2.Cases) {
+		return false
+	}
+
+	for i, _ := range s1.Cases {
+		if !ValueEquals(s1.Cases[i].Match, s2.Cases[i].Match) ||
+			!ValueEquals(s1.Cases[i].Val, s2.Cases[i].Val) {
+			return false
+		}
+	}
+
+	return true
+}
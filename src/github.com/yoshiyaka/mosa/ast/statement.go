@@ -1,30 +1,63 @@
 package ast
 
-import "fmt"
+import (
+	"fmt"
+	"strings"
+)
 
 type If struct {
-	LineNum int
+	Pos Pos
+
+	Expression Value
+	Block      Block
+
+	// The elsif branches, which are tried in order if Expression is false
+	ElseIfs []ElseIf
+
+	// Taken if neither Expression nor any of the elsif expressions are true
+	Else *Block
+}
+
+// An elsif branch of an if statement, for instance
+//
+//	elsif $os == 'redhat' { ... }
+type ElseIf struct {
+	Pos Pos
 
 	Expression Value
 	Block      Block
-	Else       *Block
 }
 
 func (i *If) String() string {
-	if i.Else == nil {
-		return fmt.Sprintf("if %s %s", valToStr(i.Expression), i.Block.String())
-	} else {
-		return fmt.Sprintf(
-			"if %s %s else %s", valToStr(i.Expression), i.Block.String(),
-			i.Else.String(),
+	s := fmt.Sprintf("if %s %s", valToStr(i.Expression), i.Block.String())
+	for _, elseIf := range i.ElseIfs {
+		s += fmt.Sprintf(
+			" elsif %s %s", valToStr(elseIf.Expression), elseIf.Block.String(),
 		)
 	}
+	if i.Else != nil {
+		s += fmt.Sprintf(" else %s", i.Else.String())
+	}
+
+	return s
 }
 
-// Returns whether the if statements are equal. Line numbers and filenames are
-// not taken into consideration.
+// Returns whether the if statements are equal. Positions are not taken into
+// consideration.
 func IfEquals(i1, i2 *If) bool {
-	return ValueEquals(&i1.Expression, &i2.Expression) &&
+	if len(i1.ElseIfs) != len(i2.ElseIfs) {
+		return false
+	}
+
+	for i, _ := range i1.ElseIfs {
+		e1, e2 := &i1.ElseIfs[i], &i2.ElseIfs[i]
+		if !ValueEquals(e1.Expression, e2.Expression) ||
+			!BlockEquals(&e1.Block, &e2.Block) {
+			return false
+		}
+	}
+
+	return ValueEquals(i1.Expression, i2.Expression) &&
 		BlockEquals(&i1.Block, &i2.Block) &&
 		BlockEquals(i1.Else, i2.Else)
 }
@@ -43,3 +76,206 @@ func IfsEquals(i1, i2 []If) bool {
 
 	return true
 }
+
+// A case statement, for instance
+//
+//	case $os {
+//		'debian', 'ubuntu': { ... }
+//		/^(redhat|centos)$/: { ... }
+//		default: { ... }
+//	}
+//
+// The branches are tried in order, and only the first one matching Value is
+// taken. If none of them matches, Default is taken.
+type Case struct {
+	Pos Pos
+
+	Value    Value
+	Branches []CaseBranch
+	Default  *Block
+}
+
+// A branch of a case statement. The branch is taken if any of the values in
+// Matches equals the value of the case statement. A Regex in Matches matches
+// any string it matches.
+type CaseBranch struct {
+	Pos Pos
+
+	Matches []Value
+	Block   Block
+}
+
+func (c *Case) String() string {
+	branches := ""
+	for _, branch := range c.Branches {
+		matches := make([]string, len(branch.Matches))
+		for i, match := range branch.Matches {
+			matches[i] = valToStr(match)
+		}
+		branches += fmt.Sprintf(
+			"\t%s: %s", strings.Join(matches, ", "), branch.Block.String(),
+		)
+	}
+	if c.Default != nil {
+		branches += fmt.Sprintf("\tdefault: %s", c.Default.String())
+	}
+
+	return fmt.Sprintf("case %s {\n%s}", valToStr(c.Value), branches)
+}
+
+// Returns whether the case statements are equal. Positions are not taken into
+// consideration.
+func CaseEquals(c1, c2 *Case) bool {
+	if !ValueEquals(c1.Value, c2.Value) ||
+		len(c1.Branches) != len(c2.Branches) ||
+		!BlockEquals(c1.Default, c2.Default) {
+		return false
+	}
+
+	for i, _ := range c1.Branches {
+		b1, b2 := &c1.Branches[i], &c2.Branches[i]
+		if len(b1.Matches) != len(b2.Matches) ||
+			!BlockEquals(&b1.Block, &b2.Block) {
+			return false
+		}
+
+		for j, _ := range b1.Matches {
+			if !ValueEquals(b1.Matches[j], b2.Matches[j]) {
+				return false
+			}
+		}
+	}
+
+	return true
+}
+
+// Returns whether the case lists are equal. Order is important.
+func CasesEquals(c1, c2 []Case) bool {
+	if len(c1) != len(c2) {
+		return false
+	}
+
+	for i, _ := range c1 {
+		if !CaseEquals(&c1[i], &c2[i]) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// A for loop, for instance
+//
+//	for $user in $users { ... }
+//	for $name, $shell in $shells { ... }
+//
+// The block is resolved once for each element of Collection, which must be an
+// array or a hash. With a single variable, it holds each element of an array
+// or each key of a hash. With two variables, the first one holds the index or
+// key and the second one the element or value.
+type For struct {
+	Pos Pos
+
+	// nil unless two variables are given
+	Key   *VariableName
+	Value VariableName
+
+	Collection Value
+	Block      Block
+
+	// The resolved block of each iteration, in order. Only set by the
+	// resolver.
+	Iterations []Block
+}
+
+func (f *For) String() string {
+	vars := f.Value.String()
+	if f.Key != nil {
+		vars = f.Key.String() + ", " + vars
+	}
+
+	return fmt.Sprintf(
+		"for %s in %s %s", vars, valToStr(f.Collection), f.Block.String(),
+	)
+}
+
+// Returns whether the for loops are equal. Positions are not taken into
+// consideration.
+func ForEquals(f1, f2 *For) bool {
+	if (f1.Key == nil) != (f2.Key == nil) ||
+		(f1.Key != nil && f1.Key.Str != f2.Key.Str) ||
+		f1.Value.Str != f2.Value.Str ||
+		len(f1.Iterations) != len(f2.Iterations) {
+		return false
+	}
+
+	for i := range f1.Iterations {
+		if !BlockEquals(&f1.Iterations[i], &f2.Iterations[i]) {
+			return false
+		}
+	}
+
+	return ValueEquals(f1.Collection, f2.Collection) &&
+		BlockEquals(&f1.Block, &f2.Block)
+}
+
+// Returns whether the for loop lists are equal. Order is important.
+func ForsEquals(f1, f2 []For) bool {
+	if len(f1) != len(f2) {
+		return false
+	}
+
+	for i := range f1 {
+		if !ForEquals(&f1[i], &f2[i]) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Realizes a class unless it's already realized, for instance include Nginx.
+// Unlike class { 'Nginx': }, including a class more than once isn't an error.
+type Include struct {
+	Pos   Pos
+	Class string
+}
+
+func (i *Include) String() string {
+	return "include " + i.Class
+}
+
+// Returns whether the include lists are equal. Order is important.
+func IncludesEquals(i1, i2 []Include) bool {
+	if len(i1) != len(i2) {
+		return false
+	}
+
+	for i := range i1 {
+		if i1[i].Class != i2[i].Class {
+			return false
+		}
+	}
+
+	return true
+}
+
+// A return statement in a function, for instance return $name + '.conf'
+type Return struct {
+	Pos   Pos
+	Value Value
+}
+
+func (r *Return) String() string {
+	return fmt.Sprintf("return %s", valToStr(r.Value))
+}
+
+// Returns whether the return statements are equal. Positions are not taken
+// into consideration.
+func ReturnEquals(r1, r2 *Return) bool {
+	if r1 == nil || r2 == nil {
+		return r1 == r2
+	}
+
+	return ValueEquals(r1.Value, r2.Value)
+}
@@ -1,38 +1,112 @@
 package ast
 
-import "fmt"
+import (
+	"fmt"
+	"strings"
+)
 
 type QuotedString string
 
-func (qs QuotedString) String() string { return fmt.Sprintf("'%s'", string(qs)) }
+var quotedEscaper = strings.NewReplacer(`\`, `\\`, `'`, `\'`)
 
-// A double-quoted interpolated string which may contain variables. For instance
-// "php5-$module" or "/home/$user".
+// Returns the string single-quoted, with backslashes and quotes escaped.
+func (qs QuotedString) String() string {
+	return fmt.Sprintf("'%s'", quotedEscaper.Replace(string(qs)))
+}
+
+// A double-quoted interpolated string which may contain variables and
+// expressions. For instance "php5-$module", "/home/$user" or
+// "port ${ $port + 1 }".
 //
 // It consists of a number of segments which are parsed directly in bison, where
-// each segment is either a raw string, or a variable name. For instance, the
-// string "/home/$user/.config-{$app}" will be interpreted as
-// [ "/home/", $user, "/.config-", $app ].
+// each segment is either a raw string, a variable name or an expression. For
+// instance, the string "/home/$user/.config-${app}-${ $n + 1 }" will be
+// interpreted as [ "/home/", $user, "/.config-", $app, "-", $n + 1 ].
 type InterpolatedString struct {
-	LineNum int
+	Pos Pos
 
-	// Each segment will be either a string, or a VariableName.
+	// Each segment will be either a Literal holding a raw string, a
+	// VariableName, or any other value for expressions such as ${ $a[0] }.
 	Segments []interface{}
 }
 
+var interpolatedEscaper = strings.NewReplacer(
+	`\`, `\\`, `"`, `\"`, `$`, `\$`, "\n", `\n`, "\t", `\t`, "\r", `\r`,
+)
+
+// Escapes the text of a double-quoted string, so that it parses back to the
+// same text. This is the inverse of the escapes decoded by the parser.
+func EscapeInterpolated(text string) string {
+	return interpolatedEscaper.Replace(text)
+}
+
+// Returns the variable which is segment i of an interpolated string as source.
+// The variable is written as ${name} if the following text would otherwise be
+// taken as part of its name, and captures such as $1 are always written as
+// ${1} since $1 is text in strings.
+func InterpolatedVariable(segments []interface{}, i int) string {
+	name := segments[i].(VariableName).Str
+	if isCapture(name) || i+1 < len(segments) && startsWithIdentifierChar(segments[i+1]) {
+		return "${" + name[1:] + "}"
+	}
+	return name
+}
+
+// Returns the string double-quoted, with text escaped so that it parses back
+// to the same segments.
 func (is InterpolatedString) String() string {
 	str := `"`
-	for _, seg := range is.Segments {
+	for i, seg := range is.Segments {
+		if l, isLiteral := seg.(Literal); isLiteral {
+			seg = l.Val
+		}
+
 		switch seg.(type) {
 		case string:
-			str += seg.(string)
+			str += EscapeInterpolated(seg.(string))
 		case VariableName:
-			str += seg.(VariableName).Str
+			str += InterpolatedVariable(is.Segments, i)
 		default:
-			panic("Bad segment type")
+			str += "${ " + valToStr(seg) + " }"
 		}
 	}
 	str += `"`
 
 	return str
 }
+
+func startsWithIdentifierChar(seg interface{}) bool {
+	if l, isLiteral := seg.(Literal); isLiteral {
+		seg = l.Val
+	}
+	text, isText := seg.(string)
+	if !isText || text == "" {
+		return false
+	}
+
+	c := text[0]
+	return c == '_' || c >= '0' && c <= '9' || c >= 'a' && c <= 'z' ||
+		c >= 'A' && c <= 'Z'
+}
+
+// Returns whether a variable holds a capture group of a regex match, such as
+// $0 or $1.
+func isCapture(name string) bool {
+	return len(name) > 1 && name[1] >= '0' && name[1] <= '9'
+}
+
+// Returns whether the interpolated strings have the same segments. Positions
+// are not taken into consideration.
+func InterpolatedStringEquals(is1, is2 InterpolatedString) bool {
+	if len(is1.Segments) != len(is2.Segments) {
+		return false
+	}
+
+	for i, _ := range is1.Segments {
+		if !ValueEquals(is1.Segments[i], is2.Segments[i]) {
+			return false
+		}
+	}
+
+	return true
+}
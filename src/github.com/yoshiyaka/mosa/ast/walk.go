@@ -0,0 +1,433 @@
+package ast
+
+import "fmt"
+
+// A Visitor's Visit method is called by Walk for each node it encounters. If
+// the returned visitor w is not nil, Walk visits each of the children of node
+// with w, followed by a call of w.Visit(nil).
+type Visitor interface {
+	Visit(node interface{}) (w Visitor)
+}
+
+// Traverses an AST in depth-first order. It starts by calling v.Visit(node),
+// where node may be an *AST, any definition, statement or value, or any of the
+// other nodes listed below.
+//
+// Definitions (*Import, *Class, *Define, *Node, *Func, *Facter), blocks
+// (*Block) and statements (*VariableDef, *Declaration, *If, *Case, *For,
+// *Include, *Return) are visited as pointers into the AST, as are their parts
+// *Prop, *ElseIf and *CaseBranch. Statements are visited in the order they were
+// written. Values are visited as they are stored, for instance as Literal,
+// VariableName or Expression, along with their parts *SelectorCase and
+// *HashEntry. The segments of interpolated strings are visited like any other
+// values.
+func Walk(v Visitor, node interface{}) {
+	if v = v.Visit(node); v == nil {
+		return
+	}
+
+	switch n := node.(type) {
+	case *AST:
+		for i := range n.Imports {
+			Walk(v, &n.Imports[i])
+		}
+		for i := range n.Classes {
+			Walk(v, &n.Classes[i])
+		}
+		for i := range n.Defines {
+			Walk(v, &n.Defines[i])
+		}
+		for i := range n.Nodes {
+			Walk(v, &n.Nodes[i])
+		}
+		for i := range n.Funcs {
+			Walk(v, &n.Funcs[i])
+		}
+		for i := range n.Facters {
+			Walk(v, &n.Facters[i])
+		}
+
+	// Definitions
+	case *Import:
+		// Nothing to walk
+	case *Class:
+		walkVariableDefs(v, n.ArgDefs)
+		Walk(v, &n.Block)
+	case *Define:
+		walkVariableDefs(v, n.ArgDefs)
+		Walk(v, &n.Block)
+	case *Node:
+		Walk(v, &n.Block)
+	case *Func:
+		walkVariableDefs(v, n.ArgDefs)
+		Walk(v, &n.Block)
+	case *Facter:
+		walkVariableDefs(v, n.ArgDefs)
+		Walk(v, &n.Block)
+
+	// Blocks and statements
+	case *Block:
+		for _, stmt := range n.OrderedStatements() {
+			Walk(v, stmt.Stmt)
+		}
+	case *VariableDef:
+		Walk(v, n.VariableName)
+		walkValue(v, n.Val)
+	case *Declaration:
+		Walk(v, n.Scalar)
+		walkProps(v, n.Props)
+	case *Prop:
+		Walk(v, n.Value)
+	case *If:
+		Walk(v, n.Expression)
+		Walk(v, &n.Block)
+		for i := range n.ElseIfs {
+			Walk(v, &n.ElseIfs[i])
+		}
+		if n.Else != nil {
+			Walk(v, n.Else)
+		}
+	case *ElseIf:
+		Walk(v, n.Expression)
+		Walk(v, &n.Block)
+	case *Case:
+		Walk(v, n.Value)
+		for i := range n.Branches {
+			Walk(v, &n.Branches[i])
+		}
+		if n.Default != nil {
+			Walk(v, n.Default)
+		}
+	case *CaseBranch:
+		for _, match := range n.Matches {
+			Walk(v, match)
+		}
+		Walk(v, &n.Block)
+	case *For:
+		if n.Key != nil {
+			Walk(v, *n.Key)
+		}
+		Walk(v, n.Value)
+		Walk(v, n.Collection)
+		Walk(v, &n.Block)
+		for i := range n.Iterations {
+			Walk(v, &n.Iterations[i])
+		}
+	case *Include:
+		// Nothing to walk
+	case *Return:
+		Walk(v, n.Value)
+
+	// Values
+	case Literal:
+		Walk(v, n.Val)
+	case InterpolatedString:
+		for _, segment := range n.Segments {
+			Walk(v, segment)
+		}
+	case Expression:
+		Walk(v, n.Left)
+		Walk(v, n.Right)
+	case UnaryExpression:
+		Walk(v, n.Value)
+	case Selector:
+		Walk(v, n.Value)
+		for i := range n.Cases {
+			Walk(v, &n.Cases[i])
+		}
+		walkValue(v, n.Default)
+	case *SelectorCase:
+		Walk(v, n.Match)
+		Walk(v, n.Val)
+	case Array:
+		for _, val := range n {
+			Walk(v, val)
+		}
+	case Hash:
+		for i := range n {
+			Walk(v, &n[i])
+		}
+	case *HashEntry:
+		Walk(v, n.Key)
+		Walk(v, n.Val)
+	case Reference:
+		Walk(v, n.Scalar)
+	case Index:
+		Walk(v, n.Value)
+		Walk(v, n.Key)
+	case Slice:
+		Walk(v, n.Value)
+		walkValue(v, n.From)
+		walkValue(v, n.To)
+	case FunctionCall:
+		for _, arg := range n.Args {
+			Walk(v, arg)
+		}
+	case Probe:
+		Walk(v, n.Command)
+		walkProps(v, n.Props)
+	case VariableName, QuotedString, string, int, int64, Float, Bool, Regex:
+		// Nothing to walk
+
+	default:
+		panic(fmt.Sprintf("ast.Walk: unexpected node type %T", n))
+	}
+
+	v.Visit(nil)
+}
+
+func walkVariableDefs(v Visitor, defs []VariableDef) {
+	for i := range defs {
+		Walk(v, &defs[i])
+	}
+}
+
+func walkProps(v Visitor, props []Prop) {
+	for i := range props {
+		Walk(v, &props[i])
+	}
+}
+
+// Walks a value which may be left out, such as the value of an argument
+// without a default.
+func walkValue(v Visitor, val Value) {
+	if val != nil {
+		Walk(v, val)
+	}
+}
+
+type inspector func(interface{}) bool
+
+func (f inspector) Visit(node interface{}) Visitor {
+	if f(node) {
+		return f
+	}
+	return nil
+}
+
+// Traverses an AST in depth-first order like Walk. It starts by calling
+// f(node), and if f returns true, Inspect calls itself for each of the children
+// of node, followed by a call of f(nil).
+//
+// For instance, all variables used in a class are found by
+//
+//	ast.Inspect(&class, func(node interface{}) bool {
+//		if name, isVariable := node.(ast.VariableName); isVariable {
+//			used[name.Str] = true
+//		}
+//		return true
+//	})
+func Inspect(node interface{}, f func(interface{}) bool) {
+	Walk(inspector(f), node)
+}
+
+// Rewrites all values in node bottom-up, replacing each value with the one
+// returned by f. f is called for each value after its parts have been rewritten,
+// so that for instance the operands of an expression are rewritten before the
+// expression.
+//
+// Definitions, blocks and statements are changed in place. If node is a value,
+// which can't be changed in place, the rewritten value is returned. Otherwise
+// node itself is returned. Only values can be replaced, so the names of
+// variables being defined, such as $port in $port = 80, are not passed to f.
+//
+// For instance, all variables named $old are renamed by
+//
+//	ast.Rewrite(&class, func(val ast.Value) ast.Value {
+//		if name, isVariable := val.(ast.VariableName); isVariable && name.Str == "$old" {
+//			name.Str = "$new"
+//			return name
+//		}
+//		return val
+//	})
+func Rewrite(node interface{}, f func(Value) Value) interface{} {
+	switch n := node.(type) {
+	case *AST:
+		for i := range n.Classes {
+			Rewrite(&n.Classes[i], f)
+		}
+		for i := range n.Defines {
+			Rewrite(&n.Defines[i], f)
+		}
+		for i := range n.Nodes {
+			Rewrite(&n.Nodes[i], f)
+		}
+		for i := range n.Funcs {
+			Rewrite(&n.Funcs[i], f)
+		}
+		for i := range n.Facters {
+			Rewrite(&n.Facters[i], f)
+		}
+
+	// Definitions
+	case *Import:
+		// Nothing to rewrite
+	case *Class:
+		rewriteVariableDefs(n.ArgDefs, f)
+		Rewrite(&n.Block, f)
+	case *Define:
+		rewriteVariableDefs(n.ArgDefs, f)
+		Rewrite(&n.Block, f)
+	case *Node:
+		Rewrite(&n.Block, f)
+	case *Func:
+		rewriteVariableDefs(n.ArgDefs, f)
+		Rewrite(&n.Block, f)
+	case *Facter:
+		rewriteVariableDefs(n.ArgDefs, f)
+		Rewrite(&n.Block, f)
+
+	// Blocks and statements
+	case *Block:
+		for _, stmt := range n.OrderedStatements() {
+			Rewrite(stmt.Stmt, f)
+		}
+	case *VariableDef:
+		n.Val = rewriteValue(n.Val, f)
+	case *Declaration:
+		n.Scalar = rewriteValue(n.Scalar, f)
+		rewriteProps(n.Props, f)
+	case *Prop:
+		n.Value = rewriteValue(n.Value, f)
+	case *If:
+		n.Expression = rewriteValue(n.Expression, f)
+		Rewrite(&n.Block, f)
+		for i := range n.ElseIfs {
+			Rewrite(&n.ElseIfs[i], f)
+		}
+		if n.Else != nil {
+			Rewrite(n.Else, f)
+		}
+	case *ElseIf:
+		n.Expression = rewriteValue(n.Expression, f)
+		Rewrite(&n.Block, f)
+	case *Case:
+		n.Value = rewriteValue(n.Value, f)
+		for i := range n.Branches {
+			Rewrite(&n.Branches[i], f)
+		}
+		if n.Default != nil {
+			Rewrite(n.Default, f)
+		}
+	case *CaseBranch:
+		for i, match := range n.Matches {
+			n.Matches[i] = rewriteValue(match, f)
+		}
+		Rewrite(&n.Block, f)
+	case *For:
+		n.Collection = rewriteValue(n.Collection, f)
+		Rewrite(&n.Block, f)
+		for i := range n.Iterations {
+			Rewrite(&n.Iterations[i], f)
+		}
+	case *Include:
+		// Nothing to rewrite
+	case *Return:
+		n.Value = rewriteValue(n.Value, f)
+
+	default:
+		return rewriteValue(node, f)
+	}
+
+	return node
+}
+
+func rewriteVariableDefs(defs []VariableDef, f func(Value) Value) {
+	for i := range defs {
+		defs[i].Val = rewriteValue(defs[i].Val, f)
+	}
+}
+
+func rewriteProps(props []Prop, f func(Value) Value) {
+	for i := range props {
+		props[i].Value = rewriteValue(props[i].Value, f)
+	}
+}
+
+// Returns the value rewritten by f. The slices of arrays, hashes and other
+// values are copied rather than changed, since values may be shared. Values
+// which are left out, such as the bounds of slices, stay nil.
+func rewriteValue(v Value, f func(Value) Value) Value {
+	switch val := v.(type) {
+	case nil:
+		return nil
+	case Literal:
+		val.Val = rewriteValue(val.Val, f)
+		v = val
+	case InterpolatedString:
+		segments := make([]interface{}, len(val.Segments))
+		for i, segment := range val.Segments {
+			segments[i] = rewriteValue(segment, f)
+		}
+		val.Segments = segments
+		v = val
+	case Expression:
+		val.Left = rewriteValue(val.Left, f)
+		val.Right = rewriteValue(val.Right, f)
+		v = val
+	case UnaryExpression:
+		val.Value = rewriteValue(val.Value, f)
+		v = val
+	case Selector:
+		val.Value = rewriteValue(val.Value, f)
+		cases := make([]SelectorCase, len(val.Cases))
+		for i, c := range val.Cases {
+			cases[i] = SelectorCase{
+				Pos:   c.Pos,
+				Match: rewriteValue(c.Match, f),
+				Val:   rewriteValue(c.Val, f),
+			}
+		}
+		val.Cases = cases
+		val.Default = rewriteValue(val.Default, f)
+		v = val
+	case Array:
+		a := make(Array, len(val))
+		for i, elem := range val {
+			a[i] = rewriteValue(elem, f)
+		}
+		v = a
+	case Hash:
+		h := make(Hash, len(val))
+		for i, entry := range val {
+			h[i] = HashEntry{
+				Pos: entry.Pos,
+				Key: rewriteValue(entry.Key, f),
+				Val: rewriteValue(entry.Val, f),
+			}
+		}
+		v = h
+	case Reference:
+		val.Scalar = rewriteValue(val.Scalar, f)
+		v = val
+	case Index:
+		val.Value = rewriteValue(val.Value, f)
+		val.Key = rewriteValue(val.Key, f)
+		v = val
+	case Slice:
+		val.Value = rewriteValue(val.Value, f)
+		val.From = rewriteValue(val.From, f)
+		val.To = rewriteValue(val.To, f)
+		v = val
+	case FunctionCall:
+		args := make([]interface{}, len(val.Args))
+		for i, arg := range val.Args {
+			args[i] = rewriteValue(arg, f)
+		}
+		val.Args = args
+		v = val
+	case Probe:
+		val.Command = rewriteValue(val.Command, f)
+		props := make([]Prop, len(val.Props))
+		copy(props, val.Props)
+		rewriteProps(props, f)
+		val.Props = props
+		v = val
+	case VariableName, QuotedString, string, int, int64, Float, Bool, Regex:
+		// Nothing to rewrite but the value itself
+	default:
+		panic(fmt.Sprintf("ast.Rewrite: unexpected value type %T", val))
+	}
+
+	return f(v)
+}
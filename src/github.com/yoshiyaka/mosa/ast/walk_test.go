@@ -0,0 +1,158 @@
+package ast_test
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	. "github.com/yoshiyaka/mosa/ast"
+	"github.com/yoshiyaka/mosa/parser"
+)
+
+func valueString(val Value) string {
+	if l, isLiteral := val.(Literal); isLiteral {
+		val = l.Val
+	}
+	return fmt.Sprint(val)
+}
+
+func parseWalkManifest(t *testing.T, manifest string) *AST {
+	ast := NewAST()
+	if err := parser.Parse(ast, "walk.ms", strings.NewReader(manifest)); err != nil {
+		t.Fatal(err)
+	}
+	return ast
+}
+
+type countingVisitor struct {
+	types []string
+	ends  *int
+}
+
+func (cv *countingVisitor) Visit(node interface{}) Visitor {
+	if node == nil {
+		*cv.ends++
+	} else {
+		cv.types = append(cv.types, fmt.Sprintf("%T", node))
+	}
+	return cv
+}
+
+func TestWalk(t *testing.T) {
+	ast := parseWalkManifest(t, `
+		class A($x,) {
+			file { "/$x": mode => $m[0], }
+			if !$x { include B } else { $y = len([ 1, ]) }
+		}
+	`)
+
+	ends := 0
+	v := &countingVisitor{ends: &ends}
+	Walk(v, ast)
+
+	expected := []string{
+		"*ast.AST",
+		"*ast.Class",
+		"*ast.VariableDef", "ast.VariableName",
+		"*ast.Block",
+		"*ast.Declaration",
+		"ast.InterpolatedString", "ast.Literal", "string", "ast.VariableName",
+		"*ast.Prop", "ast.Index", "ast.VariableName", "ast.Literal", "int",
+		"*ast.If",
+		"ast.UnaryExpression", "ast.VariableName",
+		"*ast.Block", "*ast.Include",
+		"*ast.Block",
+		"*ast.VariableDef", "ast.VariableName",
+		"ast.FunctionCall", "ast.Array", "ast.Literal", "int",
+	}
+	if got := strings.Join(v.types, " "); got != strings.Join(expected, " ") {
+		t.Errorf("Walked\n%s\nexpected\n%s", got, strings.Join(expected, " "))
+	}
+	if ends != len(v.types) {
+		t.Errorf("Got %d ends of %d nodes", ends, len(v.types))
+	}
+}
+
+func TestInspect(t *testing.T) {
+	ast := parseWalkManifest(t, `
+		class A {
+			$a = $b + $c ? { 1 => $d, default => "${e}", }
+			$f = { $g => [ $h, ], }
+			for $i in $j[$k:] {
+				package { $l: }
+			}
+		}
+		func f() {
+			return exec { $m: timeout => $n, }
+		}
+	`)
+
+	// Variables inside of arrays are skipped
+	var names []string
+	Inspect(ast, func(node interface{}) bool {
+		if name, isVariable := node.(VariableName); isVariable {
+			names = append(names, name.Str)
+		}
+		_, isArray := node.(Array)
+		return !isArray
+	})
+
+	expected := "$a $b $c $d $e $f $g $i $j $k $l $m $n"
+	if got := strings.Join(names, " "); got != expected {
+		t.Errorf("Got variables %s, expected %s", got, expected)
+	}
+}
+
+func TestRewrite(t *testing.T) {
+	ast := parseWalkManifest(t, `
+		class A($port = 80,) {
+			$old = [ 1, { 'a' => $old, }, ]
+			case $old {
+				2: { file { "$old": mode => 3 + $old, } }
+			}
+		}
+	`)
+
+	Rewrite(ast, func(val Value) Value {
+		switch val := val.(type) {
+		case VariableName:
+			if val.Str == "$old" {
+				val.Str = "$new"
+				return val
+			}
+		case int:
+			return val * 10
+		}
+		return val
+	})
+
+	block := &ast.Classes[0].Block
+	decl := &block.Cases[0].Branches[0].Block.Declarations[0]
+	rewritten := []struct{ got, expected string }{
+		{valueString(ast.Classes[0].ArgDefs[0].Val), "800"},
+		{block.VariableDefs[0].VariableName.Str, "$old"},
+		{valueString(block.VariableDefs[0].Val), "[ 10, { 'a' => $new, }, ]"},
+		{valueString(block.Cases[0].Value), "$new"},
+		{valueString(block.Cases[0].Branches[0].Matches[0]), "20"},
+		{valueString(decl.Scalar), `"$new"`},
+		{valueString(decl.Props[0].Value), "30 + $new"},
+	}
+	for _, r := range rewritten {
+		if r.got != r.expected {
+			t.Errorf("Got %s, expected %s", r.got, r.expected)
+		}
+	}
+
+	// Values are rewritten as copies
+	array := Array{1, Array{2}}
+	rewrittenArray := Rewrite(array, func(val Value) Value {
+		if i, isInt := val.(int); isInt {
+			return i + 1
+		}
+		return val
+	})
+	if !ValueEquals(rewrittenArray, Array{2, Array{3}}) ||
+		!ValueEquals(array, Array{1, Array{2}}) {
+		t.Errorf("Rewrote %s to %s", array, rewrittenArray)
+	}
+}
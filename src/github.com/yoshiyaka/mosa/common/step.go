@@ -3,6 +3,8 @@ package common
 import (
 	"fmt"
 	"strings"
+
+	"github.com/yoshiyaka/mosa/ast"
 )
 
 // A step, for instance a debian package, or a shell command
@@ -24,6 +26,10 @@ type Step struct {
 	// Each key is a Type, and the values are Item. For instance
 	// {"deb": { "apache2", "php" }, "file": { "/etc/php.ini" } }
 	Depends map[string][]string
+
+	// Where in the manifest the declaration which created this step was
+	// written. Only used for error messages.
+	Pos ast.Pos
 }
 
 func (s *Step) String() string {
@@ -0,0 +1,2 @@
+// A language server for manifests, speaking the Language Server Protocol
+package lsp
@@ -0,0 +1,438 @@
+package lsp
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	. "github.com/yoshiyaka/mosa/ast"
+	"github.com/yoshiyaka/mosa/resolver"
+)
+
+const siteManifest = `define single vhost($name, $port = 80, $docroot,) {}
+
+class Webserver($docroot,) {
+	vhost { 'a': docroot => $docroot, }
+}
+
+node 'localhost' {
+	class { 'Webserver': docroot => '/srv', }
+	include nginx
+}
+`
+
+func writeWorkspace(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "mosa-lsp")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	files := map[string]string{
+		"site.ms":                         siteManifest,
+		"modules/nginx/manifests/init.ms": "class nginx($workers = 4,) {}\n",
+		".hidden/broken.ms":               "class {",
+	}
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return dir
+}
+
+// Sends messages to a new server, and returns everything it sends back. Every
+// message without an id is sent as a notification.
+func session(t *testing.T, root string, msgs ...map[string]interface{}) []map[string]interface{} {
+	in := &bytes.Buffer{}
+	init := map[string]interface{}{
+		"id": 0, "method": "initialize",
+		"params": map[string]interface{}{"rootUri": pathToURI(root)},
+	}
+	for _, msg := range append([]map[string]interface{}{init}, msgs...) {
+		msg["jsonrpc"] = "2.0"
+		if err := writeMessage(in, msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	out := &bytes.Buffer{}
+	if err := Serve(in, out); err != nil {
+		t.Fatal(err)
+	}
+
+	var received []map[string]interface{}
+	r := bufio.NewReader(out)
+	for r.Buffered() > 0 || out.Len() > 0 {
+		data, err := readMessage(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var msg map[string]interface{}
+		if err := json.Unmarshal(data, &msg); err != nil {
+			t.Fatal(err)
+		}
+		received = append(received, msg)
+	}
+
+	if len(received) == 0 || received[0]["result"] == nil {
+		t.Fatalf("Bad response to initialize: %v", received)
+	}
+	return received[1:]
+}
+
+func open(path, text string) map[string]interface{} {
+	return map[string]interface{}{
+		"method": "textDocument/didOpen",
+		"params": map[string]interface{}{
+			"textDocument": map[string]interface{}{
+				"uri": pathToURI(path), "text": text,
+			},
+		},
+	}
+}
+
+func change(path, text string) map[string]interface{} {
+	return map[string]interface{}{
+		"method": "textDocument/didChange",
+		"params": map[string]interface{}{
+			"textDocument":   map[string]interface{}{"uri": pathToURI(path)},
+			"contentChanges": []interface{}{map[string]interface{}{"text": text}},
+		},
+	}
+}
+
+func at(id int, method, path string, line, character int) map[string]interface{} {
+	return map[string]interface{}{
+		"id": id, "method": "textDocument/" + method,
+		"params": map[string]interface{}{
+			"textDocument": map[string]interface{}{"uri": pathToURI(path)},
+			"position":     map[string]interface{}{"line": line, "character": character},
+		},
+	}
+}
+
+// Returns the result of the response with id
+func result(t *testing.T, received []map[string]interface{}, id int) interface{} {
+	for _, msg := range received {
+		if msgID, ok := msg["id"].(float64); ok && int(msgID) == id {
+			if msg["error"] != nil {
+				t.Fatalf("Request %d failed: %v", id, msg["error"])
+			}
+			return msg["result"]
+		}
+	}
+
+	t.Fatalf("No response to request %d", id)
+	return nil
+}
+
+func TestDiagnostics(t *testing.T) {
+	root := writeWorkspace(t)
+	defer os.RemoveAll(root)
+	site := filepath.Join(root, "site.ms")
+
+	badVariable := strings.Replace(siteManifest, "$docroot, }", "$nope, }", 1)
+	received := session(
+		t, root,
+		open(site, siteManifest),
+		change(site, siteManifest+"class {"),
+		change(site, badVariable),
+		change(site, siteManifest),
+		map[string]interface{}{"method": "exit"},
+	)
+
+	type diag struct {
+		line, character int
+		source, msg     string
+	}
+	var got [][]diag
+	for _, msg := range received {
+		if msg["method"] != "textDocument/publishDiagnostics" {
+			t.Errorf("Unexpected message %v", msg)
+			continue
+		}
+
+		params := msg["params"].(map[string]interface{})
+		if params["uri"] != pathToURI(site) {
+			t.Errorf("Got diagnostics for %s", params["uri"])
+		}
+		diags := []diag{}
+		for _, d := range params["diagnostics"].([]interface{}) {
+			d := d.(map[string]interface{})
+			start := d["range"].(map[string]interface{})["start"].(map[string]interface{})
+			diags = append(diags, diag{
+				int(start["line"].(float64)), int(start["character"].(float64)),
+				d["source"].(string), d["message"].(string),
+			})
+		}
+		got = append(got, diags)
+	}
+
+	// Nothing is published for the valid manifest, and the errors are
+	// cleared once it is valid again
+	if len(got) != 3 {
+		t.Fatalf("Got %d diagnostics, expected 3: %v", len(got), got)
+	}
+	if len(got[0]) != 1 || got[0][0].line != 10 || got[0][0].source != "parser" {
+		t.Errorf("Got syntax errors %v", got[0])
+	}
+	if len(got[1]) != 1 || got[1][0].line != 3 || got[1][0].character != 25 ||
+		got[1][0].source != "resolver" || !strings.Contains(got[1][0].msg, "$nope") {
+		t.Errorf("Got resolver errors %v", got[1])
+	}
+	if len(got[2]) != 0 {
+		t.Errorf("Errors weren't cleared: %v", got[2])
+	}
+}
+
+func TestDiagnosticsSkipProbes(t *testing.T) {
+	root := writeWorkspace(t)
+	defer os.RemoveAll(root)
+	site := filepath.Join(root, "site.ms")
+
+	// Probes can't run while editing, not even in loops or functions
+	loop := siteManifest + `
+node 'probes' {
+	for $i in [ 1, ] {
+		$a = exec { 'ls': }
+	}
+}
+`
+	function := siteManifest + `
+node 'probes' {
+	$b = list()
+}
+
+func list() {
+	for $i in [ 1, ] {
+		return exec { 'ls': }
+	}
+}
+`
+	received := session(
+		t, root,
+		open(site, siteManifest+"class {"),
+		change(site, loop),
+		change(site, function),
+		map[string]interface{}{"method": "exit"},
+	)
+
+	// Only the syntax error is published, and then cleared
+	if len(received) != 2 {
+		t.Fatalf("Got %d messages, expected 2: %v", len(received), received)
+	}
+	params := received[1]["params"].(map[string]interface{})
+	if diags := params["diagnostics"].([]interface{}); len(diags) != 0 {
+		t.Errorf("Got diagnostics for probes: %v", diags)
+	}
+}
+
+func TestLocate(t *testing.T) {
+	s := &server{
+		files: map[string]*file{
+			"site.ms":  {text: siteManifest},
+			"other.ms": {text: "class Other {}\n"},
+		},
+		lastChanged: "other.ms",
+	}
+
+	site := func(line int) Pos { return Pos{File: "site.ms", Line: line, Col: 2} }
+	other := Pos{File: "other.ms", Line: 1, Col: 1}
+	cyclic := &resolver.CyclicError{
+		Err: resolver.Err{
+			Type: resolver.ErrorTypeCyclicVariable, Pos: site(4), SymbolName: "$a",
+		},
+		Cycle: []string{"$a", "$a"},
+	}
+	call := func(pos Pos) []resolver.StackFrame {
+		return []resolver.StackFrame{{Name: "f", Pos: pos}}
+	}
+
+	tests := []struct {
+		err  error
+		path string
+		line int
+	}{
+		// Typed errors are located by their positions, even if the message
+		// quotes another one
+		{
+			&resolver.Err{
+				Type:       resolver.ErrorTypeUnresolvableVariable,
+				Pos:        site(3),
+				SymbolName: "'other.ms:1:1'",
+			},
+			"site.ms", 2,
+		},
+		{&resolver.IterationError{Err: cyclic, Iteration: 1, Pos: other}, "site.ms", 3},
+		{&resolver.FuncError{Err: cyclic, CallStack: call(other)}, "site.ms", 3},
+
+		// Positions outside of the workspace are skipped
+		{
+			&resolver.FuncError{
+				Err:       &resolver.ProbesDisabledError{Pos: Pos{File: "modules/m.ms", Line: 2, Col: 2}},
+				CallStack: call(site(8)),
+			},
+			"site.ms", 7,
+		},
+
+		// Other errors are located by their messages
+		{errors.New("Can't include class at site.ms:9:2"), "site.ms", 8},
+		{errors.New("No position"), "other.ms", 0},
+	}
+	for _, test := range tests {
+		path, d := s.locate(test.err)
+		if path != test.path || d.Range.Start.Line != test.line {
+			t.Errorf(
+				"%v was located at %s:%d, expected %s:%d",
+				test.err, path, d.Range.Start.Line, test.path, test.line,
+			)
+		}
+	}
+}
+
+func TestDefinitionAndHover(t *testing.T) {
+	root := writeWorkspace(t)
+	defer os.RemoveAll(root)
+	site := filepath.Join(root, "site.ms")
+	nginx := filepath.Join(root, "modules", "nginx", "manifests", "init.ms")
+
+	received := session(
+		t, root,
+		at(1, "definition", site, 3, 2),
+		at(2, "definition", site, 7, 12),
+		at(3, "definition", site, 8, 11),
+		at(4, "definition", site, 5, 0),
+		at(5, "hover", site, 3, 3),
+		at(6, "hover", site, 7, 2),
+		at(7, "hover", site, 8, 9),
+	)
+
+	locations := []struct {
+		id   int
+		path string
+		line int
+	}{
+		{1, site, 0},
+		{2, site, 2},
+		{3, nginx, 0},
+	}
+	for _, l := range locations {
+		expected := map[string]interface{}{
+			"uri": pathToURI(l.path),
+			"range": map[string]interface{}{
+				"start": map[string]interface{}{"line": float64(l.line), "character": float64(0)},
+			},
+		}
+		loc, _ := result(t, received, l.id).(map[string]interface{})
+		if loc == nil {
+			t.Errorf("No definition for request %d", l.id)
+			continue
+		}
+		delete(loc["range"].(map[string]interface{}), "end")
+		if !reflect.DeepEqual(loc, expected) {
+			t.Errorf("Request %d got definition %v, expected %v", l.id, loc, expected)
+		}
+	}
+
+	if res := result(t, received, 4); res != nil {
+		t.Errorf("Got definition %v for a blank line", res)
+	}
+
+	hovers := map[int]string{
+		5: "define single vhost($name, $port = 80, $docroot)",
+		6: "class Webserver($docroot)",
+		7: "class nginx($workers = 4)",
+	}
+	for id, expected := range hovers {
+		h, _ := result(t, received, id).(map[string]interface{})
+		if h == nil {
+			t.Errorf("No hover for request %d", id)
+			continue
+		}
+		value := h["contents"].(map[string]interface{})["value"].(string)
+		if !strings.Contains(value, expected) {
+			t.Errorf("Request %d got hover %s, expected %s", id, value, expected)
+		}
+	}
+}
+
+func TestCompletion(t *testing.T) {
+	root := writeWorkspace(t)
+	defer os.RemoveAll(root)
+	site := filepath.Join(root, "site.ms")
+
+	edited := siteManifest + `
+class Edited {
+	vhost { 'b':
+		docroot => '/b',
+
+	}
+	class { 'We
+	v
+}
+`
+	received := session(
+		t, root,
+		open(site, edited),
+		at(1, "completion", site, 14, 0),
+		at(2, "completion", site, 16, 12),
+		at(3, "completion", site, 17, 2),
+		at(4, "completion", site, 13, 13),
+	)
+
+	tests := []struct {
+		id       int
+		expected []string
+	}{
+		// Given arguments and $name aren't offered
+		{1, []string{"port"}},
+		// The edited manifest doesn't parse, so Edited isn't known yet
+		{2, []string{"Webserver"}},
+		{3, []string{"class", "exec", "vhost"}},
+		// After the arrow a value is expected
+		{4, []string{}},
+	}
+	for _, test := range tests {
+		labels := []string{}
+		for _, item := range result(t, received, test.id).([]interface{}) {
+			labels = append(labels, item.(map[string]interface{})["label"].(string))
+		}
+		if !reflect.DeepEqual(labels, test.expected) {
+			t.Errorf(
+				"Request %d completed %v, expected %v",
+				test.id, labels, test.expected,
+			)
+		}
+	}
+}
+
+func TestUnknownMethod(t *testing.T) {
+	root := writeWorkspace(t)
+	defer os.RemoveAll(root)
+
+	received := session(
+		t, root,
+		map[string]interface{}{"method": "$/cancelRequest"},
+		map[string]interface{}{"id": 1, "method": "workspace/symbol"},
+	)
+
+	expected := fmt.Sprint(map[string]interface{}{
+		"code": float64(codeMethodNotFound), "message": "Unknown method workspace/symbol",
+	})
+	if len(received) != 1 || fmt.Sprint(received[0]["error"]) != expected {
+		t.Errorf("Got %v", received)
+	}
+}
@@ -0,0 +1,480 @@
+package lsp
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	. "github.com/yoshiyaka/mosa/ast"
+	"github.com/yoshiyaka/mosa/parser"
+	"github.com/yoshiyaka/mosa/resolver"
+)
+
+// A manifest file of the workspace
+type file struct {
+	text string
+
+	// The manifest as of the last time it parsed without errors. Nil if it
+	// never has.
+	ast *AST
+
+	// The syntax errors of text
+	errs parser.ErrorList
+
+	// Whether the client has opened the file, in which case text is the text
+	// in the editor rather than on disk
+	open bool
+}
+
+type server struct {
+	out io.Writer
+
+	// The directory holding the manifests, and the roots of the module path
+	root       string
+	modulePath []string
+
+	// All manifest files by their cleaned paths
+	files map[string]*file
+
+	// The file changed last. Diagnostics which can't be located are shown in
+	// it.
+	lastChanged string
+
+	// The files which diagnostics were last published for
+	diagnosed map[string]bool
+
+	exiting bool
+}
+
+// Serves a single client, reading requests from in and writing responses to
+// out, until the client sends exit or in is closed. The manifests of the
+// workspace are the .ms files below the root directory given by the client.
+// Modules are autoloaded from the modules directory of the root, if there is
+// one.
+func Serve(in io.Reader, out io.Writer) error {
+	s := &server{
+		out:       out,
+		files:     map[string]*file{},
+		diagnosed: map[string]bool{},
+	}
+
+	r := bufio.NewReader(in)
+	for !s.exiting {
+		msg, err := readMessage(r)
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		if err := s.handle(msg); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (s *server) handle(msg []byte) error {
+	var req request
+	if err := json.Unmarshal(msg, &req); err != nil {
+		return s.respondError(nil, codeParseError, err.Error())
+	}
+
+	// Notifications are never answered
+	if req.ID == nil {
+		return s.notified(&req)
+	}
+
+	result, code, err := s.call(&req)
+	if err != nil {
+		return s.respondError(req.ID, code, err.Error())
+	}
+	return writeMessage(s.out, &response{JSONRPC: "2.0", ID: req.ID, Result: result})
+}
+
+func (s *server) respondError(id *json.RawMessage, code int, msg string) error {
+	return writeMessage(s.out, &errorResponse{
+		JSONRPC: "2.0",
+		ID:      id,
+		Error:   responseError{Code: code, Message: msg},
+	})
+}
+
+// Handles a request. If it fails, the code of the error is returned along with
+// it.
+func (s *server) call(req *request) (interface{}, int, error) {
+	switch req.Method {
+	case "initialize":
+		var params initializeParams
+		if err := json.Unmarshal(req.Params, &params); err != nil {
+			return nil, codeInvalidParams, err
+		}
+		if err := s.initialize(&params); err != nil {
+			return nil, codeInvalidParams, err
+		}
+
+		return map[string]interface{}{
+			"capabilities": map[string]interface{}{
+				// The full text is sent on every change
+				"textDocumentSync":   1,
+				"definitionProvider": true,
+				"hoverProvider":      true,
+				"completionProvider": map[string]interface{}{
+					"triggerCharacters": []string{"'", "\""},
+				},
+			},
+		}, 0, nil
+
+	case "shutdown":
+		return nil, 0, nil
+
+	case "textDocument/definition", "textDocument/hover",
+		"textDocument/completion":
+		var params textDocumentPositionParams
+		if err := json.Unmarshal(req.Params, &params); err != nil {
+			return nil, codeInvalidParams, err
+		}
+		path, err := uriToPath(params.TextDocument.URI)
+		if err != nil {
+			return nil, codeInvalidParams, err
+		}
+
+		f := s.files[path]
+		if f == nil {
+			return nil, 0, nil
+		}
+		line, col := fromPosition(f.text, params.Position)
+
+		switch req.Method {
+		case "textDocument/definition":
+			return s.definition(f, line, col), 0, nil
+		case "textDocument/hover":
+			return s.hover(f, line, col), 0, nil
+		default:
+			return s.complete(f, line, col), 0, nil
+		}
+	}
+
+	return nil, codeMethodNotFound, fmt.Errorf("Unknown method %s", req.Method)
+}
+
+// Handles a notification. Unknown notifications are ignored.
+func (s *server) notified(req *request) error {
+	switch req.Method {
+	case "exit":
+		s.exiting = true
+		return nil
+
+	case "textDocument/didOpen":
+		var params didOpenParams
+		if err := json.Unmarshal(req.Params, &params); err != nil {
+			return nil
+		}
+		return s.update(params.TextDocument.URI, params.TextDocument.Text, true)
+
+	case "textDocument/didChange":
+		var params didChangeParams
+		if err := json.Unmarshal(req.Params, &params); err != nil ||
+			len(params.ContentChanges) == 0 {
+			return nil
+		}
+		last := params.ContentChanges[len(params.ContentChanges)-1]
+		return s.update(params.TextDocument.URI, last.Text, true)
+
+	case "textDocument/didClose":
+		var params didCloseParams
+		if err := json.Unmarshal(req.Params, &params); err != nil {
+			return nil
+		}
+		path, err := uriToPath(params.TextDocument.URI)
+		if err != nil {
+			return nil
+		}
+
+		// Unsaved changes are dropped, so the file is read from disk again
+		if text, err := ioutil.ReadFile(path); err == nil {
+			return s.update(params.TextDocument.URI, string(text), false)
+		}
+		delete(s.files, path)
+		return s.check()
+	}
+
+	return nil
+}
+
+// Reads all manifests of the workspace.
+func (s *server) initialize(params *initializeParams) error {
+	s.root = params.RootPath
+	if params.RootURI != "" {
+		root, err := uriToPath(params.RootURI)
+		if err != nil {
+			return err
+		}
+		s.root = root
+	}
+	if s.root == "" {
+		return nil
+	}
+	s.root = filepath.Clean(s.root)
+
+	modules := filepath.Join(s.root, "modules")
+	if info, err := os.Stat(modules); err == nil && info.IsDir() {
+		s.modulePath = []string{modules}
+	}
+
+	return filepath.Walk(s.root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if path != s.root && strings.HasPrefix(info.Name(), ".") ||
+			len(s.modulePath) > 0 && path == s.modulePath[0] {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		if !info.IsDir() && strings.HasSuffix(path, ".ms") {
+			text, err := ioutil.ReadFile(path)
+			if err != nil {
+				return err
+			}
+			s.files[path] = s.parse(path, string(text))
+		}
+		return nil
+	})
+}
+
+func (s *server) parse(path, text string) *file {
+	f := &file{text: text}
+	ast := NewAST()
+	err := parser.Parse(ast, path, strings.NewReader(text))
+	if list, ok := err.(parser.ErrorList); ok {
+		f.errs = list
+	} else if err == nil {
+		f.ast = ast
+	}
+
+	return f
+}
+
+// Replaces the text of a file and publishes the new diagnostics of the
+// workspace.
+func (s *server) update(uri, text string, open bool) error {
+	path, err := uriToPath(uri)
+	if err != nil {
+		return nil
+	}
+
+	f := s.parse(path, text)
+	f.open = open
+	if f.ast == nil {
+		if old := s.files[path]; old != nil {
+			f.ast = old.ast
+		}
+	}
+
+	s.files[path] = f
+	s.lastChanged = path
+	return s.check()
+}
+
+// Returns the paths of all files in the order their manifests are merged.
+func (s *server) paths() []string {
+	paths := make([]string, 0, len(s.files))
+	for path := range s.files {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+// Merges the manifests of all files. Files with syntax errors are included as
+// of the last time they parsed.
+func (s *server) manifest() *AST {
+	merged := NewAST()
+	for _, path := range s.paths() {
+		if ast := s.files[path].ast; ast != nil {
+			merged.Merge(ast)
+		}
+	}
+	return merged
+}
+
+func (s *server) loader() *parser.ModuleLoader {
+	return parser.NewModuleLoader(s.modulePath)
+}
+
+// Parses and resolves the workspace, and publishes the errors found. The
+// workspace is only resolved if all files parse, since resolving outdated
+// manifests would only show outdated errors.
+func (s *server) check() error {
+	diags := map[string][]diagnostic{}
+	for path, f := range s.files {
+		for _, e := range f.errs {
+			diags[path] = append(diags[path], s.diagnostic(e.Pos, e.Msg, "parser"))
+		}
+	}
+
+	if len(diags) == 0 {
+		_, _, err := resolver.ResolveWithAutoloader(s.manifest(), s.loader(), nil)
+
+		// Probes can't be run while editing, which isn't an error
+		if _, isProbe := innermostError(err).(*resolver.ProbesDisabledError); err != nil && !isProbe {
+			path, d := s.locate(err)
+			diags[path] = append(diags[path], d)
+		}
+	}
+
+	// Files which no longer have any errors are published with an empty list
+	// to clear the old ones
+	paths := []string{}
+	for path := range s.diagnosed {
+		if _, ok := diags[path]; !ok {
+			paths = append(paths, path)
+		}
+	}
+	for path := range diags {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+
+	s.diagnosed = map[string]bool{}
+	for _, path := range paths {
+		if len(diags[path]) > 0 {
+			s.diagnosed[path] = true
+		}
+		if err := writeMessage(s.out, &notification{
+			JSONRPC: "2.0",
+			Method:  "textDocument/publishDiagnostics",
+			Params: &publishDiagnosticsParams{
+				URI:         pathToURI(path),
+				Diagnostics: append([]diagnostic{}, diags[path]...),
+			},
+		}); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Returns the error which caused err, without the function calls and for
+// loop iterations wrapping it.
+func innermostError(err error) error {
+	for {
+		switch e := err.(type) {
+		case *resolver.FuncError:
+			err = e.Err
+		case *resolver.IterationError:
+			err = e.Err
+		default:
+			return err
+		}
+	}
+}
+
+// Matches positions written as file:line:col in error messages
+var posRegexp = regexp.MustCompile(`([^\s:'"]+):(\d+):(\d+)`)
+
+// Returns the positions which an error from the resolver refers to, innermost
+// first. They are taken from the typed errors of the resolver, and only read
+// from the message of other errors.
+func errorPositions(err error) []Pos {
+	switch e := err.(type) {
+	case *resolver.Err:
+		return []Pos{e.Pos}
+	case *resolver.CyclicError:
+		return []Pos{e.Pos}
+	case *resolver.ProbesDisabledError:
+		return []Pos{e.Pos}
+	case *resolver.ExpressionError:
+		return append(errorPositions(e.Err), e.Pos)
+	case *resolver.IterationError:
+		return append(errorPositions(e.Err), e.Pos)
+	case *resolver.FuncError:
+		positions := errorPositions(e.Err)
+		for _, frame := range e.CallStack {
+			positions = append(positions, frame.Pos)
+		}
+		return positions
+	}
+
+	var positions []Pos
+	for _, m := range posRegexp.FindAllStringSubmatch(err.Error(), -1) {
+		line, _ := strconv.Atoi(m[2])
+		col, _ := strconv.Atoi(m[3])
+		positions = append(positions, Pos{File: filepath.Clean(m[1]), Line: line, Col: col})
+	}
+	return positions
+}
+
+// Finds the file of the workspace which an error from the resolver refers to.
+// The innermost position in a workspace file is used, so that errors in
+// modules are shown where the workspace calls them. Errors without any, for
+// instance missing classes, are shown at the top of the file changed last.
+func (s *server) locate(err error) (string, diagnostic) {
+	msg := innermostError(err).Error()
+	for _, pos := range errorPositions(err) {
+		if _, ok := s.files[pos.File]; ok {
+			return pos.File, s.diagnostic(pos, msg, "resolver")
+		}
+	}
+
+	return s.lastChanged, s.diagnostic(Pos{File: s.lastChanged, Line: 1, Col: 1}, msg, "resolver")
+}
+
+// Returns a diagnostic spanning the token at pos.
+func (s *server) diagnostic(pos Pos, msg, source string) diagnostic {
+	return diagnostic{
+		Range:    s.span(pos, tokenLen(lineOf(s.text(pos.File), pos.Line-1), pos.Col)),
+		Severity: severityError,
+		Source:   source,
+		Message:  msg,
+	}
+}
+
+// Returns the range of n bytes starting at pos.
+func (s *server) span(pos Pos, n int) lspRange {
+	text := s.text(pos.File)
+	end := pos
+	end.Col += n
+	return lspRange{Start: toPosition(text, pos), End: toPosition(text, end)}
+}
+
+// Returns the text of a file, which may not be a part of the workspace, such
+// as the manifests of modules.
+func (s *server) text(path string) string {
+	if f := s.files[path]; f != nil {
+		return f.text
+	}
+
+	text, _ := ioutil.ReadFile(path)
+	return string(text)
+}
+
+// Returns the length of the token starting at col of line, which is at least
+// one byte unless the line ends before col.
+func tokenLen(line string, col int) int {
+	if col < 1 || col > len(line) {
+		return 0
+	}
+
+	rest := line[col-1:]
+	if i := strings.IndexAny(rest, " \t,;(){}[]"); i > 0 {
+		return i
+	} else if i == 0 {
+		return 1
+	}
+	return len(rest)
+}
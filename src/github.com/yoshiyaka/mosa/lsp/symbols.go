@@ -0,0 +1,358 @@
+package lsp
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+
+	. "github.com/yoshiyaka/mosa/ast"
+	"github.com/yoshiyaka/mosa/resolver"
+)
+
+type symbolKind int
+
+const (
+	symbolClass symbolKind = iota
+	symbolDefine
+	symbolFunc
+)
+
+// A use of a class, define or function in a manifest
+type symbol struct {
+	kind symbolKind
+	name string
+
+	// Where the name of the symbol is written, and its length in bytes
+	pos Pos
+	len int
+}
+
+func (sym *symbol) contains(line, col int) bool {
+	return sym.pos.Line == line && col >= sym.pos.Col && col <= sym.pos.Col+sym.len
+}
+
+// Finds the symbol at a position of a file, such as the type of a declaration,
+// the class of an include or the name of a called function. Returns nil if
+// there is none.
+func symbolAt(f *file, line, col int) *symbol {
+	if f.ast == nil {
+		return nil
+	}
+
+	var found *symbol
+	Inspect(f.ast, func(node interface{}) bool {
+		if found != nil {
+			return false
+		}
+
+		var candidates []symbol
+		switch node := node.(type) {
+		case *Declaration:
+			if node.Type != "class" {
+				candidates = append(candidates, symbol{
+					symbolDefine, node.Type, node.Pos, len(node.Type),
+				})
+			} else if lit, ok := node.Scalar.(Literal); ok {
+				// Both the class keyword and the name in
+				// class { 'Webserver': } lead to the class
+				if name, ok := lit.Val.(QuotedString); ok {
+					candidates = append(candidates,
+						symbol{symbolClass, string(name), node.Pos, len("class")},
+						symbol{symbolClass, string(name), lit.Pos, len(name) + 2},
+					)
+				}
+			}
+
+		case *Include:
+			// The position is that of the include keyword
+			text := lineOf(f.text, node.Pos.Line-1)
+			if node.Pos.Col-1 < len(text) {
+				if i := strings.Index(text[node.Pos.Col-1:], node.Class); i >= 0 {
+					pos := node.Pos
+					pos.Col += i
+					candidates = append(candidates, symbol{
+						symbolClass, node.Class, pos, len(node.Class),
+					})
+				}
+			}
+
+		case Reference:
+			kind := symbolDefine
+			name := node.Type
+			if lit, ok := node.Scalar.(Literal); ok && node.Type == "class" {
+				if class, ok := lit.Val.(QuotedString); ok {
+					kind, name = symbolClass, string(class)
+				}
+			}
+			candidates = append(candidates, symbol{kind, name, node.Pos, len(node.Type)})
+
+		case FunctionCall:
+			candidates = append(candidates, symbol{
+				symbolFunc, node.Name, node.Pos, len(node.Name),
+			})
+		}
+
+		for i := range candidates {
+			if candidates[i].contains(line, col) {
+				found = &candidates[i]
+				return false
+			}
+		}
+		return true
+	})
+
+	return found
+}
+
+// The definition of a symbol
+type definition struct {
+	// The keyword and name, for instance define single file
+	header string
+
+	pos     Pos
+	argDefs []VariableDef
+}
+
+// Returns the signature of the definition, for instance
+// define single vhost($name, $port = 80,)
+func (d *definition) signature() string {
+	args := make([]string, len(d.argDefs))
+	for i, def := range d.argDefs {
+		if def.Val == nil {
+			args[i] = def.VariableName.String()
+		} else {
+			args[i] = def.String()
+		}
+	}
+
+	return d.header + "(" + strings.Join(args, ", ") + ")"
+}
+
+// Returns the definitions of the workspace. Definitions holding errors, such
+// as classes defined twice, are still returned.
+func (s *server) definitions() *resolver.Definitions {
+	defs, _ := resolver.CollectDefinitions(s.manifest())
+	return defs
+}
+
+// Finds the definition of a symbol in the workspace, or in the modules of the
+// module path. Returns nil if there is no such definition.
+func (s *server) lookup(sym *symbol) *definition {
+	defs := s.definitions()
+	if def := findDefinition(defs, sym); def != nil {
+		return def
+	}
+
+	ast, err := s.loader().Autoload(sym.name)
+	if err != nil || ast == nil {
+		return nil
+	}
+	defs, _ = resolver.CollectDefinitions(ast)
+	return findDefinition(defs, sym)
+}
+
+func findDefinition(defs *resolver.Definitions, sym *symbol) *definition {
+	switch sym.kind {
+	case symbolClass:
+		if c := defs.Classes[sym.name]; c != nil {
+			return &definition{"class " + c.Name, c.Pos, c.ArgDefs}
+		}
+	case symbolDefine:
+		if d := defs.Defines[sym.name]; d != nil {
+			return &definition{
+				fmt.Sprintf("define %s %s", d.Type, d.Name), d.Pos, d.ArgDefs,
+			}
+		}
+	case symbolFunc:
+		if f := defs.Funcs[sym.name]; f != nil {
+			return &definition{"func " + f.Name, f.Pos, f.ArgDefs}
+		}
+	}
+
+	return nil
+}
+
+// Returns the location of the definition of the symbol at a position, or nil
+// if it isn't defined in a manifest.
+func (s *server) definition(f *file, line, col int) *location {
+	sym := symbolAt(f, line, col)
+	if sym == nil {
+		return nil
+	}
+	def := s.lookup(sym)
+	if def == nil {
+		return nil
+	}
+
+	// Built in defines, such as exec, aren't defined in any file
+	if _, ok := s.files[def.pos.File]; !ok {
+		if _, err := os.Stat(def.pos.File); err != nil {
+			return nil
+		}
+	}
+
+	return &location{
+		URI:   pathToURI(def.pos.File),
+		Range: s.span(def.pos, len(strings.Fields(def.header)[0])),
+	}
+}
+
+// Returns the signature of the symbol at a position, or nil if there is no
+// known symbol.
+func (s *server) hover(f *file, line, col int) *hover {
+	sym := symbolAt(f, line, col)
+	if sym == nil {
+		return nil
+	}
+	def := s.lookup(sym)
+	if def == nil {
+		return nil
+	}
+
+	r := s.span(sym.pos, sym.len)
+	return &hover{
+		Contents: markupContent{
+			Kind:  "markdown",
+			Value: "```\n" + def.signature() + "\n```",
+		},
+		Range: &r,
+	}
+}
+
+var (
+	// An include or a class declaration, up to the class name being typed
+	classNameRegexp = regexp.MustCompile(
+		`(\binclude\s+|\bclass\s*\{\s*['"])[\w:]*$`,
+	)
+
+	// A statement being typed at the start of a line
+	statementRegexp = regexp.MustCompile(`^\s*[\w:]*$`)
+
+	// The type and name of a declaration, starting at its opening brace
+	declarationRegexp = regexp.MustCompile(`(^|[^\w:$])([\w:]+)\s*$`)
+	classScalarRegexp = regexp.MustCompile(`^\{\s*['"]([\w:]+)['"]\s*:`)
+
+	// An argument name being typed in the body of a declaration
+	argumentRegexp = regexp.MustCompile(`(^|[,:{])\s*\w*$`)
+
+	// Arguments already given in the body of a declaration
+	givenArgRegexp = regexp.MustCompile(`(\w+)\s*=>`)
+)
+
+// Returns the completions at a position. Classes are completed after include
+// and in class declarations, arguments in the bodies of declarations, and
+// defines at the start of statements.
+func (s *server) complete(f *file, line, col int) []completionItem {
+	before := lineOf(f.text, line-1)
+	if col-1 < len(before) {
+		before = before[:col-1]
+	}
+
+	defs := s.definitions()
+	items := []completionItem{}
+
+	if classNameRegexp.MatchString(before) {
+		for name, c := range defs.Classes {
+			items = append(items, completionItem{
+				Label:  name,
+				Kind:   completionClass,
+				Detail: (&definition{"class " + name, c.Pos, c.ArgDefs}).signature(),
+			})
+		}
+	} else if def, body := s.enclosingDeclaration(f, line, col); def != nil {
+		if !argumentRegexp.MatchString(before) {
+			return items
+		}
+
+		given := map[string]bool{}
+		for _, m := range givenArgRegexp.FindAllStringSubmatch(body, -1) {
+			given[m[1]] = true
+		}
+		for _, arg := range def.argDefs {
+			name := strings.TrimPrefix(arg.VariableName.Str, "$")
+			if name == "name" || name == "names" || given[name] {
+				continue
+			}
+
+			item := completionItem{
+				Label:      name,
+				Kind:       completionField,
+				InsertText: name + " => ",
+			}
+			if arg.Val != nil {
+				item.Detail = arg.String()
+			}
+			items = append(items, item)
+		}
+	} else if statementRegexp.MatchString(before) {
+		for name, d := range defs.Defines {
+			items = append(items, completionItem{
+				Label: name,
+				Kind:  completionStruct,
+				Detail: (&definition{
+					fmt.Sprintf("define %s %s", d.Type, name), d.Pos, d.ArgDefs,
+				}).signature(),
+			})
+		}
+		items = append(items, completionItem{Label: "class", Kind: completionKeyword})
+	}
+
+	sort.Slice(items, func(i, j int) bool { return items[i].Label < items[j].Label })
+	return items
+}
+
+// Returns the definition of the declaration whose body holds a position,
+// along with the text of the body up to the position. Returns nil if the
+// position isn't inside the body of a declaration.
+func (s *server) enclosingDeclaration(f *file, line, col int) (*definition, string) {
+	offset := 0
+	for i := 0; i < line-1; i++ {
+		next := strings.IndexByte(f.text[offset:], '\n')
+		if next < 0 {
+			return nil, ""
+		}
+		offset += next + 1
+	}
+	offset += col - 1
+	if offset > len(f.text) {
+		offset = len(f.text)
+	}
+	text := f.text[:offset]
+
+	// Finds the innermost unclosed brace
+	depth := 0
+	brace := -1
+	for i := len(text) - 1; i >= 0 && brace < 0; i-- {
+		switch text[i] {
+		case '}':
+			depth++
+		case '{':
+			if depth == 0 {
+				brace = i
+			}
+			depth--
+		}
+	}
+	if brace < 0 {
+		return nil, ""
+	}
+
+	body := text[brace:]
+	m := declarationRegexp.FindStringSubmatch(text[:brace])
+	if m == nil || m[2] == "else" || !strings.Contains(body, ":") {
+		return nil, ""
+	}
+
+	sym := &symbol{kind: symbolDefine, name: m[2]}
+	if m[2] == "class" {
+		scalar := classScalarRegexp.FindStringSubmatch(body)
+		if scalar == nil {
+			return nil, ""
+		}
+		sym = &symbol{kind: symbolClass, name: scalar[1]}
+	}
+
+	return s.lookup(sym), body
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+
+	"github.com/yoshiyaka/mosa/printer"
+)
+
+// Runs mosa fmt, which formats manifest files in the canonical format of the
+// printer package. Without any files, standard input is formatted to standard
+// output. Returns the exit status.
+func runFmt(args []string) int {
+	flags := flag.NewFlagSet("fmt", flag.ExitOnError)
+	write := flags.Bool(
+		"w", false, "Write the result to the files instead of standard output",
+	)
+	diff := flags.Bool(
+		"d", false, "Print diffs instead of the formatted files",
+	)
+	flags.Usage = func() {
+		fmt.Println("Usage:")
+		fmt.Printf("%s fmt [options] [manifest-directory|manifest-file ...]\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	if flags.NArg() == 0 {
+		if *write {
+			fmt.Fprintln(os.Stderr, "Can't write the result when formatting standard input")
+			return 2
+		}
+
+		src, err := ioutil.ReadAll(os.Stdin)
+		if err == nil {
+			err = formatFile("<standard input>", src, false, *diff)
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err.Error())
+			return 1
+		}
+		return 0
+	}
+
+	status := 0
+	for _, arg := range flags.Args() {
+		paths := []string{arg}
+		if info, err := os.Stat(arg); err != nil {
+			fmt.Fprintln(os.Stderr, err.Error())
+			status = 1
+			continue
+		} else if info.IsDir() {
+			if paths, err = findManifestFiles(arg, nil); err != nil {
+				fmt.Fprintln(os.Stderr, err.Error())
+				status = 1
+				continue
+			}
+		}
+
+		for _, path := range paths {
+			src, err := ioutil.ReadFile(path)
+			if err == nil {
+				err = formatFile(path, src, *write, *diff)
+			}
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err.Error())
+				status = 1
+			}
+		}
+	}
+
+	return status
+}
+
+// Formats the manifest file src read from path. The result is written back to
+// the file if write is set. If diff is set, the changes are printed as a diff,
+// and if neither is set the formatted file is printed.
+func formatFile(path string, src []byte, write, diff bool) error {
+	formatted, err := printer.Format(path, src)
+	if err != nil {
+		return err
+	}
+
+	if !write && !diff {
+		_, err := os.Stdout.Write(formatted)
+		return err
+	}
+
+	if bytes.Equal(src, formatted) {
+		return nil
+	}
+
+	if write {
+		info, err := os.Stat(path)
+		if err != nil {
+			return err
+		}
+		if err := ioutil.WriteFile(path, formatted, info.Mode()); err != nil {
+			return err
+		}
+	}
+
+	if diff {
+		d, err := diffFiles(path, src, formatted)
+		if err != nil {
+			return fmt.Errorf("Can't diff %s: %s", path, err)
+		}
+		os.Stdout.Write(d)
+	}
+
+	return nil
+}
+
+// Returns the unified diff between the original and formatted versions of the
+// file at path, using the diff command.
+func diffFiles(path string, src, formatted []byte) ([]byte, error) {
+	var tmpPaths []string
+	defer func() {
+		for _, tmpPath := range tmpPaths {
+			os.Remove(tmpPath)
+		}
+	}()
+
+	for _, contents := range [][]byte{src, formatted} {
+		f, err := ioutil.TempFile("", "mosa-fmt")
+		if err != nil {
+			return nil, err
+		}
+		tmpPaths = append(tmpPaths, f.Name())
+
+		_, err = f.Write(contents)
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	d, err := exec.Command(
+		"diff", "-u", "-L", path+".orig", "-L", path, tmpPaths[0], tmpPaths[1],
+	).Output()
+	if exitErr, ok := err.(*exec.ExitError); ok && exitErr.ExitCode() == 1 {
+		// diff exits with 1 when the files differ
+		return d, nil
+	}
+
+	return d, err
+}
@@ -5,10 +5,14 @@ import (
 	"fmt"
 	"io/ioutil"
 	"os"
+	"path/filepath"
+	"runtime"
 	"strings"
+	"sync"
 
 	"github.com/yoshiyaka/mosa/ast"
 	"github.com/yoshiyaka/mosa/executor"
+	"github.com/yoshiyaka/mosa/lsp"
 	"github.com/yoshiyaka/mosa/parser"
 	"github.com/yoshiyaka/mosa/planner"
 	"github.com/yoshiyaka/mosa/reducer"
@@ -16,12 +20,16 @@ import (
 	"github.com/yoshiyaka/mosa/stepconverter"
 )
 
-func parseDirAsASTRecursively(ast *ast.AST, dirName string) error {
+// Finds all manifest files in dirName and its subdirectories, skipping hidden
+// files and directories. Directories in skip, such as the roots of the module
+// path, are skipped as well.
+func findManifestFiles(dirName string, skip map[string]bool) ([]string, error) {
 	files, filesErr := ioutil.ReadDir(dirName)
 	if filesErr != nil {
-		return filesErr
+		return nil, filesErr
 	}
 
+	paths := []string{}
 	for _, file := range files {
 		if file.Name()[0] == '.' {
 			continue
@@ -30,42 +38,169 @@ func parseDirAsASTRecursively(ast *ast.AST, dirName string) error {
 		fullPath := dirName + "/" + file.Name()
 
 		if file.IsDir() {
-			if err := parseDirAsASTRecursively(ast, fullPath); err != nil {
-				return err
+			if skip[filepath.Clean(fullPath)] {
+				continue
 			}
-		} else if strings.HasSuffix(file.Name(), ".ms") {
-			f, fErr := os.Open(fullPath)
-			if fErr != nil {
-				return fErr
+			subPaths, err := findManifestFiles(fullPath, skip)
+			if err != nil {
+				return nil, err
 			}
+			paths = append(paths, subPaths...)
+		} else if strings.HasSuffix(file.Name(), ".ms") {
+			paths = append(paths, fullPath)
+		}
+	}
+
+	return paths, nil
+}
+
+func parseFile(ast *ast.AST, path string) error {
+	f, fErr := os.Open(path)
+	if fErr != nil {
+		return fErr
+	}
+	defer f.Close()
+
+	return parser.Parse(ast, path, f)
+}
+
+// Parses all manifest files in dirName concurrently. The files are merged into
+// ast in the same order as they would have been parsed sequentially, followed
+// by any files outside of dirName which they import. If there are syntax
+// errors, the errors of all files are returned together as a single
+// parser.ErrorList. Modules in modulePath are not parsed, since they are
+// autoloaded.
+func parseDirAsASTRecursively(mfst *ast.AST, dirName string, modulePath []string) error {
+	skip := map[string]bool{}
+	for _, root := range modulePath {
+		skip[filepath.Clean(root)] = true
+	}
+
+	paths, pathsErr := findManifestFiles(dirName, skip)
+	if pathsErr != nil {
+		return pathsErr
+	}
+
+	asts := make([]*ast.AST, len(paths))
+	errs := make([]error, len(paths))
 
-			if err := parser.Parse(ast, fullPath, f); err != nil {
-				f.Close()
-				return err
-			} else {
-				f.Close()
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < runtime.NumCPU(); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				asts[i] = ast.NewAST()
+				errs[i] = parseFile(asts[i], paths[i])
 			}
+		}()
+	}
+
+	for i := range paths {
+		jobs <- i
+	}
+	close(jobs)
+	wg.Wait()
+
+	var syntaxErrs parser.ErrorList
+	for i := range paths {
+		if list, ok := errs[i].(parser.ErrorList); ok {
+			syntaxErrs = append(syntaxErrs, list...)
+		} else if errs[i] != nil {
+			return errs[i]
 		}
+		mfst.Merge(asts[i])
+	}
+
+	if err := parser.ParseImports(mfst, paths); err != nil {
+		if list, ok := err.(parser.ErrorList); ok {
+			syntaxErrs = append(syntaxErrs, list...)
+		} else {
+			return err
+		}
+	}
+
+	if len(syntaxErrs) > 0 {
+		return syntaxErrs
 	}
 
 	return nil
 }
 
+// Parses a single manifest file and the files it imports, or all manifest
+// files in a directory except for the modules in modulePath.
+func parseManifest(mfst *ast.AST, path string, modulePath []string) error {
+	if info, err := os.Stat(path); err != nil {
+		return err
+	} else if !info.IsDir() {
+		return parser.ParseFile(mfst, path)
+	}
+
+	return parseDirAsASTRecursively(mfst, path, modulePath)
+}
+
+// Returns the roots of the module path. If none are given, the modules
+// directory next to the manifest is used if it exists.
+func findModulePath(flagValue, manifestPath string) []string {
+	if flagValue != "" {
+		return filepath.SplitList(flagValue)
+	}
+
+	dir := manifestPath
+	if info, err := os.Stat(manifestPath); err == nil && !info.IsDir() {
+		dir = filepath.Dir(manifestPath)
+	}
+
+	modules := filepath.Join(dir, "modules")
+	if info, err := os.Stat(modules); err == nil && info.IsDir() {
+		return []string{modules}
+	}
+	return nil
+}
+
 func showHelp() {
 	fmt.Println("Usage:")
-	fmt.Printf("%s [options] manifest-directory\n", os.Args[0])
+	fmt.Printf("%s [options] manifest-directory|manifest-file\n", os.Args[0])
+	fmt.Printf("%s fmt [-w] [-d] [manifest-directory|manifest-file ...]\n", os.Args[0])
+	fmt.Printf("%s lsp\n", os.Args[0])
 	flag.PrintDefaults()
 }
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "fmt" {
+		os.Exit(runFmt(os.Args[2:]))
+	}
+
+	// The language server speaks the Language Server Protocol over stdio
+	if len(os.Args) > 1 && os.Args[1] == "lsp" {
+		if err := lsp.Serve(os.Stdin, os.Stdout); err != nil {
+			fmt.Fprintln(os.Stderr, err.Error())
+			os.Exit(1)
+		}
+		return
+	}
+
 	help := false
 	run := false
 	verbose := false
+	compileOnly := false
+	modulePathFlag := ""
 	flag.BoolVar(&help, "h", false, "Shows this message")
 	flag.BoolVar(&run, "run", false, "Actually execute the manifest")
 	flag.BoolVar(&verbose, "v", false, "Verbose output")
+	flag.BoolVar(
+		&compileOnly, "compile-only", false,
+		"Only print the resolved declarations, without running any commands",
+	)
+	flag.StringVar(
+		&modulePathFlag, "module-path", "",
+		"Directories to autoload modules from, separated by '"+
+			string(os.PathListSeparator)+"'. Defaults to the modules "+
+			"directory of the manifest",
+	)
 
-	dirName := "../testdata"
+	manifestPath := "../testdata"
 	flag.Parse()
 
 	if help {
@@ -74,22 +209,39 @@ func main() {
 	}
 
 	if args := flag.CommandLine.Args(); len(args) == 1 {
-		dirName = args[0]
+		manifestPath = args[0]
 	}
 
+	modulePath := findModulePath(modulePathFlag, manifestPath)
+
 	mfst := ast.NewAST()
-	if err := parseDirAsASTRecursively(mfst, dirName); err != nil {
+	if err := parseManifest(mfst, manifestPath, modulePath); err != nil {
 		fmt.Fprintln(os.Stderr, err.Error())
 		os.Exit(1)
 	}
 
-	resolved, resolvedErr := resolver.Resolve(mfst)
+	// Probes are refused in compile only mode, since nothing may be run
+	prober := resolver.NewProber()
+	if compileOnly {
+		prober = nil
+	}
+
+	resolved, facters, resolvedErr := resolver.ResolveWithAutoloader(
+		mfst, parser.NewModuleLoader(modulePath), prober,
+	)
 	if resolvedErr != nil {
 		fmt.Fprintln(os.Stderr, resolvedErr.Error())
 		os.Exit(1)
 	}
 
-	reduced, reducedErr := reducer.Reduce(resolved)
+	if compileOnly {
+		for _, decl := range resolved {
+			fmt.Print(decl.String())
+		}
+		return
+	}
+
+	reduced, reducedErr := reducer.Reduce(resolved, facters)
 	if reducedErr != nil {
 		fmt.Fprintln(os.Stderr, reducedErr.Error())
 		os.Exit(1)
@@ -0,0 +1,100 @@
+package parser
+
+import (
+	"fmt"
+	"strings"
+
+	. "github.com/yoshiyaka/mosa/ast"
+)
+
+// A syntax error found while parsing a manifest.
+type Error struct {
+	Pos Pos
+
+	// What went wrong, for instance "unexpected '}'"
+	Msg string
+
+	// The tokens which would have been valid at Pos, for instance
+	// [ "identifier", "'}'" ]. May be empty if they aren't known.
+	Expected []string
+}
+
+func (e *Error) Error() string {
+	msg := fmt.Sprintf("%s: %s", e.Pos, e.Msg)
+
+	switch len(e.Expected) {
+	case 0:
+	case 1:
+		msg += ", expected " + e.Expected[0]
+	default:
+		last := len(e.Expected) - 1
+		msg += fmt.Sprintf(
+			", expected %s or %s",
+			strings.Join(e.Expected[:last], ", "), e.Expected[last],
+		)
+	}
+
+	return msg
+}
+
+// All syntax errors found in a manifest, in the order they appear. Parse()
+// always returns errors of this type for bad manifests.
+type ErrorList []*Error
+
+// Returns all errors, one per line.
+func (el ErrorList) Error() string {
+	msgs := make([]string, len(el))
+	for i, e := range el {
+		msgs[i] = e.Error()
+	}
+	return strings.Join(msgs, "\n")
+}
+
+// Maps the token names used in parser.y to names suitable for error messages.
+// Tokens not in the map, such as '{', are used as is.
+var tokenDescriptions = map[string]string{
+	"STRING":                "identifier",
+	"VARIABLENAME":          "variable",
+	"QUOTED_STRING":         "single-quoted string",
+	"INTPOL_START":          "double-quoted string",
+	"INTPOL_TEXT":           "double-quoted string",
+	"INTPOL_VARIABLE":       "variable",
+	"INTPOL_EXPR_START":     "'${'",
+	"INTPOL_EXPR_END":       "'}'",
+	"HEREDOC_START":         "heredoc",
+	"LITERAL_HEREDOC_START": "heredoc",
+	"HEREDOC_END":           "end of heredoc",
+	"INT":                   "number",
+	"FLOAT":                 "number",
+	"CLASS":                 "'class'",
+	"DEFINE":                "'define'",
+	"NODE":                  "'node'",
+	"FUNC":                  "'func'",
+	"FACTER":                "'facter'",
+	"IMPORT":                "'import'",
+	"INCLUDE":               "'include'",
+	"ARROW":                 "'=>'",
+	"IF":                    "'if'",
+	"ELSIF":                 "'elsif'",
+	"ELSE":                  "'else'",
+	"CASE":                  "'case'",
+	"DEFAULT":               "'default'",
+	"FOR":                   "'for'",
+	"IN":                    "'in'",
+	"REGEX":                 "regex",
+	"RETURN":                "'return'",
+	"BOOLTRUE":              "'true'",
+	"BOOLFALSE":             "'false'",
+	"PLUSMINUS":             "operator",
+	"MULDIV":                "operator",
+	"COMPARISON":            "operator",
+	"BOOLAND":               "operator",
+	"BOOLOR":                "operator",
+}
+
+func describeToken(name string) string {
+	if desc, ok := tokenDescriptions[name]; ok {
+		return desc
+	}
+	return name
+}
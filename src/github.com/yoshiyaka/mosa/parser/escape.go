@@ -0,0 +1,112 @@
+package parser
+
+import (
+	"fmt"
+	"strings"
+
+	. "github.com/yoshiyaka/mosa/ast"
+)
+
+// Decodes the escapes of a single-quoted string. Only \' and \\ are escapes,
+// all other backslashes are kept as is so that shell snippets such as
+// 'grep -E "\s+"' can be written without doubling every backslash.
+func unescapeQuoted(s string) string {
+	if !strings.Contains(s, `\`) {
+		return s
+	}
+
+	var decoded []byte
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+1 < len(s) && (s[i+1] == '\'' || s[i+1] == '\\') {
+			i++
+		}
+		decoded = append(decoded, s[i])
+	}
+
+	return string(decoded)
+}
+
+// The escapes allowed in double-quoted strings and heredocs, and what they
+// decode to.
+var interpolatedEscapes = map[byte]byte{
+	'n':  '\n',
+	't':  '\t',
+	'r':  '\r',
+	'"':  '"',
+	'$':  '$',
+	'\\': '\\',
+}
+
+// Decodes the escapes of text in a double-quoted string or heredoc, which
+// starts at pos. An unknown escape is an error at its position.
+func unescapeInterpolated(s string, pos Pos) (string, *Error) {
+	var decoded []byte
+	for i := 0; i < len(s); i++ {
+		if s[i] != '\\' {
+			decoded = append(decoded, s[i])
+			continue
+		}
+
+		if i+1 < len(s) {
+			if c, ok := interpolatedEscapes[s[i+1]]; ok {
+				decoded = append(decoded, c)
+				i++
+				continue
+			}
+		}
+
+		escape := s[i:]
+		if len(escape) > 2 {
+			escape = escape[:2]
+		}
+		return "", &Error{
+			Pos: offsetPos(pos, s[:i]),
+			Msg: fmt.Sprintf("unknown escape sequence %q", escape),
+		}
+	}
+
+	return string(decoded), nil
+}
+
+// Returns the segments of an interpolated string with the escapes of all text
+// segments decoded. Errors are added to pc.
+func (pc *parseContext) unescapeSegments(segments []interface{}) []interface{} {
+	decoded := make([]interface{}, len(segments))
+	for i, segment := range segments {
+		if text, isText := textSegment(segment); isText {
+			str, err := unescapeInterpolated(text.Val.(string), text.Pos)
+			if err != nil {
+				pc.errors = append(pc.errors, err)
+			}
+			text.Val = str
+			segment = text
+		}
+		decoded[i] = segment
+	}
+
+	return decoded
+}
+
+// Returns the position reached after text starting at pos. Columns are counted
+// in bytes, like the lexer does.
+func offsetPos(pos Pos, text string) Pos {
+	for i := 0; i < len(text); i++ {
+		if text[i] == '\n' {
+			pos.Line++
+			pos.Col = 1
+		} else {
+			pos.Col++
+		}
+	}
+	return pos
+}
+
+// Returns the segment of an interpolated string as a Literal if it is raw text.
+// Interpolated values, such as ${ 5 }, may be literals too but aren't text.
+func textSegment(segment interface{}) (Literal, bool) {
+	text, isLiteral := segment.(Literal)
+	if _, isString := text.Val.(string); !isLiteral || !isString {
+		return Literal{}, false
+	}
+	return text, true
+}
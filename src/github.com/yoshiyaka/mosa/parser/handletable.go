@@ -4,10 +4,16 @@ import "C"
 
 type goHandle int
 
+// Maps the integer handles passed around by bison to the Go values they
+// represent. Handle 0 is reserved to mean "no value".
 type handleTable struct {
 	table []interface{}
 }
 
+func newHandleTable() handleTable {
+	return handleTable{table: []interface{}{nil}}
+}
+
 func (ht *handleTable) Add(i interface{}) goHandle {
 	ht.table = append(ht.table, i)
 	return goHandle(len(ht.table) - 1)
@@ -0,0 +1,121 @@
+package parser
+
+import (
+	"strings"
+
+	. "github.com/yoshiyaka/mosa/ast"
+)
+
+// Joins adjacent text segments of a string or heredoc, since the lexer returns
+// the text in several pieces, for instance around a literal $ or $1. The
+// position of the first piece is kept.
+func mergeText(segments []interface{}) []interface{} {
+	merged := []interface{}{}
+	for _, segment := range segments {
+		text, isText := textSegment(segment)
+		if isText && len(merged) > 0 {
+			if prev, prevIsText := textSegment(merged[len(merged)-1]); prevIsText {
+				prev.Val = prev.Val.(string) + text.Val.(string)
+				merged[len(merged)-1] = prev
+				continue
+			}
+		}
+		merged = append(merged, segment)
+	}
+
+	return merged
+}
+
+// The start of a line in the text segments of a heredoc
+type lineStart struct {
+	segment, offset int
+}
+
+// Removes the leading whitespace that all lines of a heredoc have in common, so
+// that the heredoc can be indented along with the surrounding block. Lines
+// holding only whitespace don't count when finding the common indentation.
+// Adjacent text segments must have been merged.
+func stripIndentation(segments []interface{}) []interface{} {
+	if len(segments) == 0 {
+		return segments
+	}
+	if _, isText := textSegment(segments[0]); !isText {
+		// The first line starts with interpolation, so it isn't indented
+		return segments
+	}
+
+	var starts []lineStart
+	for i, segment := range segments {
+		text, isText := textSegment(segment)
+		if !isText {
+			continue
+		}
+		str := text.Val.(string)
+		if i == 0 {
+			starts = append(starts, lineStart{i, 0})
+		}
+		for offset, c := range str {
+			if c == '\n' {
+				starts = append(starts, lineStart{i, offset + 1})
+			}
+		}
+	}
+
+	indent := ""
+	first := true
+	for _, start := range starts {
+		lineIndent, blank := indentation(segments, start)
+		if blank {
+			continue
+		}
+		if first {
+			indent = lineIndent
+			first = false
+		} else {
+			indent = commonPrefix(indent, lineIndent)
+		}
+	}
+	if indent == "" {
+		return segments
+	}
+
+	stripped := make([]interface{}, len(segments))
+	copy(stripped, segments)
+	// Strip from the end of each segment, so that offsets stay valid
+	for i := len(starts) - 1; i >= 0; i-- {
+		start := starts[i]
+		text := stripped[start.segment].(Literal)
+		str := text.Val.(string)
+		lineIndent, _ := indentation(stripped, start)
+		n := len(lineIndent)
+		if n > len(indent) {
+			n = len(indent)
+		}
+		text.Val = str[:start.offset] + str[start.offset+n:]
+		stripped[start.segment] = text
+	}
+
+	return stripped
+}
+
+// Returns the whitespace at the start of the line, and whether the line holds
+// nothing but whitespace.
+func indentation(segments []interface{}, start lineStart) (string, bool) {
+	rest := segments[start.segment].(Literal).Val.(string)[start.offset:]
+	indent := rest[:len(rest)-len(strings.TrimLeft(rest, " \t"))]
+	rest = rest[len(indent):]
+
+	if rest == "" {
+		// The line continues with interpolation, unless this is the end
+		return indent, start.segment == len(segments)-1
+	}
+	return indent, rest[0] == '\n'
+}
+
+func commonPrefix(a, b string) string {
+	i := 0
+	for i < len(a) && i < len(b) && a[i] == b[i] {
+		i++
+	}
+	return a[:i]
+}
@@ -0,0 +1,134 @@
+package parser
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	. "github.com/yoshiyaka/mosa/ast"
+)
+
+// Follows the imports of manifest files, merging every imported file into a
+// single AST.
+type importer struct {
+	ast *AST
+
+	// The cleaned paths of all files parsed so far. Files are only parsed
+	// once, even if they are imported several times.
+	parsed map[string]bool
+
+	// The files currently being imported, where each file imports the next.
+	// Used to detect import cycles.
+	chain []string
+
+	errors ErrorList
+}
+
+func newImporter(ast *AST, parsed []string) *importer {
+	imp := &importer{ast: ast, parsed: map[string]bool{}}
+	for _, path := range parsed {
+		imp.parsed[filepath.Clean(path)] = true
+	}
+	return imp
+}
+
+// Parses the manifest file at path into ast, along with all files it imports,
+// recursively. Imports are resolved relative to the directory of the file
+// containing them.
+//
+// Like Parse(), syntax errors are returned as an ErrorList, holding the errors
+// of all files. Missing imported files and import cycles are reported the same
+// way.
+func ParseFile(ast *AST, path string) error {
+	imp := newImporter(ast, nil)
+	if err := imp.parseFile(path, nil); err != nil {
+		return err
+	}
+	return imp.err()
+}
+
+// Parses all files imported by ast, recursively. ast must already hold the
+// files in parsed, which won't be parsed again if they are imported. This is
+// used to follow the imports of files which were parsed with Parse().
+func ParseImports(ast *AST, parsed []string) error {
+	imp := newImporter(ast, parsed)
+
+	// Imports of the imported files are appended to ast.Imports while
+	// following, but those are handled recursively.
+	imports := append([]Import{}, ast.Imports...)
+	for i := range imports {
+		imp.chain = []string{filepath.Clean(imports[i].Pos.File)}
+		imp.parseFile(imports[i].Path, &imports[i])
+	}
+
+	return imp.err()
+}
+
+// Parses a file and follows its imports. from is the import which led to the
+// file, or nil if it's the first file. Errors in imported files are stored in
+// imp.errors, and the returned error is only set if the first file couldn't
+// be read.
+func (imp *importer) parseFile(path string, from *Import) error {
+	path = filepath.Clean(path)
+	for i, importing := range imp.chain {
+		if importing == path {
+			cycle := append(append([]string{}, imp.chain[i:]...), path)
+			imp.errors = append(imp.errors, &Error{
+				Pos: from.Pos,
+				Msg: "import cycle: " + strings.Join(cycle, " -> "),
+			})
+			return nil
+		}
+	}
+
+	if imp.parsed[path] {
+		return nil
+	}
+	imp.parsed[path] = true
+
+	fileAST := NewAST()
+	if err := imp.parse(fileAST, path); err != nil {
+		if list, ok := err.(ErrorList); ok {
+			imp.errors = append(imp.errors, list...)
+		} else if from == nil {
+			return err
+		} else {
+			if pathErr, ok := err.(*os.PathError); ok {
+				// The message below already holds the path
+				err = pathErr.Err
+			}
+			imp.errors = append(imp.errors, &Error{
+				Pos: from.Pos,
+				Msg: fmt.Sprintf("can't import %s: %s", from.Path, err),
+			})
+			return nil
+		}
+	}
+	imp.ast.Merge(fileAST)
+
+	imp.chain = append(imp.chain, path)
+	for i := range fileAST.Imports {
+		imp.parseFile(fileAST.Imports[i].Path, &fileAST.Imports[i])
+	}
+	imp.chain = imp.chain[:len(imp.chain)-1]
+
+	return nil
+}
+
+func (imp *importer) parse(ast *AST, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	return Parse(ast, path, f)
+}
+
+func (imp *importer) err() error {
+	if len(imp.errors) > 0 {
+		return imp.errors
+	}
+	return nil
+}
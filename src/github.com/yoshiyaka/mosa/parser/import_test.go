@@ -0,0 +1,153 @@
+package parser
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	. "github.com/yoshiyaka/mosa/ast"
+)
+
+// Writes files to a new temporary directory, and returns its path.
+func writeManifests(t *testing.T, files map[string]string) string {
+	dir, err := ioutil.TempDir("", "mosa-import")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return dir
+}
+
+func classNames(ast *AST) []string {
+	names := make([]string, len(ast.Classes))
+	for i, c := range ast.Classes {
+		names[i] = c.Name
+	}
+	sort.Strings(names)
+	return names
+}
+
+func TestParseFile(t *testing.T) {
+	dir := writeManifests(t, map[string]string{
+		"main.ms": `
+			import 'lib/a.ms'
+			import 'lib/b.ms'
+			class Main {}
+		`,
+		"lib/a.ms": `
+			import 'b.ms'
+			class A {}
+		`,
+		"lib/b.ms": `class B {}`,
+	})
+	defer os.RemoveAll(dir)
+
+	ast := NewAST()
+	if err := ParseFile(ast, filepath.Join(dir, "main.ms")); err != nil {
+		t.Fatal(err)
+	}
+
+	// lib/b.ms is imported twice, but must only be parsed once
+	if names := strings.Join(classNames(ast), " "); names != "A B Main" {
+		t.Error("Got bad classes:", names)
+	}
+}
+
+var badImportTests = []struct {
+	files       map[string]string
+	expectedErr string
+}{
+	{
+		map[string]string{
+			"main.ms": "import 'a.ms'",
+			"a.ms":    "class A {}\nimport 'b.ms'",
+			"b.ms":    "import 'a.ms'",
+		},
+		"DIR/b.ms:1:1: import cycle: DIR/a.ms -> DIR/b.ms -> DIR/a.ms",
+	},
+	{
+		map[string]string{
+			"main.ms": "import 'main.ms'",
+		},
+		"DIR/main.ms:1:1: import cycle: DIR/main.ms -> DIR/main.ms",
+	},
+	{
+		map[string]string{
+			"main.ms": "class A {}\nimport 'lib/missing.ms'",
+		},
+		"DIR/main.ms:2:1: can't import DIR/lib/missing.ms: no such file or directory",
+	},
+	{
+		map[string]string{
+			"main.ms": "import 'a.ms'",
+			"a.ms":    "class {}",
+		},
+		"DIR/a.ms:1:7: unexpected '{', expected identifier",
+	},
+}
+
+func TestBadImports(t *testing.T) {
+	for _, test := range badImportTests {
+		dir := writeManifests(t, test.files)
+		defer os.RemoveAll(dir)
+
+		err := ParseFile(NewAST(), filepath.Join(dir, "main.ms"))
+		expected := strings.Replace(test.expectedErr, "DIR", dir, -1)
+		if _, isList := err.(ErrorList); !isList || err.Error() != expected {
+			t.Log(test.files)
+			t.Errorf("Got bad error: %v, expected %s", err, expected)
+		}
+	}
+}
+
+func TestParseImports(t *testing.T) {
+	dir := writeManifests(t, map[string]string{
+		"manifests/main.ms": `
+			import 'users.ms'
+			import '../lib/lib.ms'
+			class Main {}
+		`,
+		"manifests/users.ms": `class Users {}`,
+		"lib/lib.ms":         `class Lib {}`,
+	})
+	defer os.RemoveAll(dir)
+
+	// Parse the manifests directory like mosa does, and then follow the import
+	// of the file outside of it.
+	ast := NewAST()
+	var parsed []string
+	for _, name := range []string{"main.ms", "users.ms"} {
+		path := filepath.Join(dir, "manifests", name)
+		f, err := os.Open(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = Parse(ast, path, f)
+		f.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		parsed = append(parsed, path)
+	}
+
+	if err := ParseImports(ast, parsed); err != nil {
+		t.Fatal(err)
+	}
+
+	if names := strings.Join(classNames(ast), " "); names != "Lib Main Users" {
+		t.Error("Got bad classes:", names)
+	}
+}
@@ -1,13 +1,7 @@
 package parser
 
-// #cgo LDFLAGS: -lfl
-// typedef struct {
-//   int code;
-//   const char *error;
-//   int line;
-// } t_error;
-// extern t_error doparse(char *);
-// extern int line_num;
+// #include <stdlib.h>
+// extern int doparse(char *, int);
 //
 // #include "types.h"
 import "C"
@@ -15,30 +9,91 @@ import (
 	"fmt"
 	"io"
 	"io/ioutil"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"unsafe"
 
 	. "github.com/yoshiyaka/mosa/ast"
 )
 
+// Holds all state for a single call to Parse(). The bison parser is reentrant,
+// so any number of these may be active at the same time. Each callback from
+// bison gets the id of its context as the first argument.
+type parseContext struct {
+	ht       handleTable
+	ast      *AST
+	filename string
+
+	// All errors reported by bison
+	errors ErrorList
+
+	// The comments which haven't been attached to the statements of a block
+	// yet, in order
+	comments []Comment
+}
+
+// Returns the position in the file currently being parsed.
+func (pc *parseContext) pos(line, col C.int) Pos {
+	return Pos{File: pc.filename, Line: int(line), Col: int(col)}
+}
+
 var (
-	ht         handleTable
-	currentAST *AST
+	contextsMutex sync.Mutex
+	contexts      = map[C.int]*parseContext{}
+	nextContextId C.int
 )
 
+func newParseContext(ast *AST, filename string) (C.int, *parseContext) {
+	pc := &parseContext{
+		ht:       newHandleTable(),
+		ast:      ast,
+		filename: filename,
+	}
+
+	contextsMutex.Lock()
+	defer contextsMutex.Unlock()
+
+	nextContextId++
+	contexts[nextContextId] = pc
+
+	return nextContextId, pc
+}
+
+// Removes the context, which frees its handle table.
+func releaseParseContext(id C.int) {
+	contextsMutex.Lock()
+	defer contextsMutex.Unlock()
+
+	delete(contexts, id)
+}
+
+func getParseContext(id C.int) *parseContext {
+	contextsMutex.Lock()
+	defer contextsMutex.Unlock()
+
+	return contexts[id]
+}
+
 //export nilArray
-func nilArray(typ C.ASTTYPE) goHandle {
+func nilArray(ctx C.int, typ C.ASTTYPE) goHandle {
+	pc := getParseContext(ctx)
 	switch typ {
 	case C.ASTTYPE_STMTS:
-		return ht.Add([]interface{}{})
+		return pc.ht.Add([]interface{}{})
 	case C.ASTTYPE_CLASSES:
-		return ht.Add([]Class{})
+		return pc.ht.Add([]Class{})
 	case C.ASTTYPE_PROPLIST:
-		return ht.Add([]Prop{})
+		return pc.ht.Add([]Prop{})
 	case C.ASTTYPE_ARRAY:
-		return ht.Add(Array{})
+		return pc.ht.Add(Array{})
 	case C.ASTTYPE_ARRAY_INTERFACE:
-		return ht.Add([]interface{}{})
+		return pc.ht.Add([]interface{}{})
 	case C.ASTTYPE_ARGDEFS:
-		return ht.Add([]VariableDef{})
+		return pc.ht.Add([]VariableDef{})
+	case C.ASTTYPE_HASH:
+		return pc.ht.Add(Hash{})
 	}
 
 	fmt.Printf("%#v\n", typ)
@@ -46,19 +101,27 @@ func nilArray(typ C.ASTTYPE) goHandle {
 }
 
 //export appendArray
-func appendArray(arrayHandle, newValue goHandle) goHandle {
-	array := ht.Get(arrayHandle)
+func appendArray(ctx C.int, arrayHandle, newValue goHandle) goHandle {
+	if newValue == 0 {
+		// This is the result of an error production in the grammar
+		return arrayHandle
+	}
+
+	pc := getParseContext(ctx)
+	array := pc.ht.Get(arrayHandle)
 	switch array.(type) {
 	case []VariableDef:
-		return ht.Add(append(array.([]VariableDef), ht.Get(newValue).(VariableDef)))
+		return pc.ht.Add(append(array.([]VariableDef), pc.ht.Get(newValue).(VariableDef)))
 	case []Class:
-		return ht.Add(append(array.([]Class), ht.Get(newValue).(Class)))
+		return pc.ht.Add(append(array.([]Class), pc.ht.Get(newValue).(Class)))
 	case []Prop:
-		return ht.Add(append(array.([]Prop), ht.Get(newValue).(Prop)))
+		return pc.ht.Add(append(array.([]Prop), pc.ht.Get(newValue).(Prop)))
 	case []interface{}:
-		return ht.Add(append(array.([]interface{}), ht.Get(newValue)))
+		return pc.ht.Add(append(array.([]interface{}), pc.ht.Get(newValue)))
 	case Array:
-		return ht.Add(append(array.(Array), ht.Get(newValue)))
+		return pc.ht.Add(append(array.(Array), pc.ht.Get(newValue)))
+	case Hash:
+		return pc.ht.Add(append(array.(Hash), pc.ht.Get(newValue).(HashEntry)))
 	}
 
 	fmt.Printf("%#v\n", array)
@@ -66,244 +129,697 @@ func appendArray(arrayHandle, newValue goHandle) goHandle {
 }
 
 //export sawBody
-func sawBody(classesAndDefines goHandle) {
-	for _, classOrDefine := range ht.Get(classesAndDefines).([]interface{}) {
+func sawBody(ctx C.int, classesAndDefines goHandle) {
+	pc := getParseContext(ctx)
+	for _, classOrDefine := range pc.ht.Get(classesAndDefines).([]interface{}) {
 		switch classOrDefine.(type) {
 		case Class:
-			currentAST.Classes = append(currentAST.Classes, classOrDefine.(Class))
+			pc.ast.Classes = append(pc.ast.Classes, classOrDefine.(Class))
 		case Define:
-			currentAST.Defines = append(currentAST.Defines, classOrDefine.(Define))
+			pc.ast.Defines = append(pc.ast.Defines, classOrDefine.(Define))
 		case Node:
-			currentAST.Nodes = append(currentAST.Nodes, classOrDefine.(Node))
+			pc.ast.Nodes = append(pc.ast.Nodes, classOrDefine.(Node))
+		case Func:
+			pc.ast.Funcs = append(pc.ast.Funcs, classOrDefine.(Func))
+		case Facter:
+			pc.ast.Facters = append(pc.ast.Facters, classOrDefine.(Facter))
+		case Import:
+			pc.ast.Imports = append(pc.ast.Imports, classOrDefine.(Import))
 		default:
-			panic("Found top-level object which is not class or define")
+			panic("Found top-level object which is not class, define, node, func, facter or import")
 		}
 	}
 }
 
 //export newClass
-func newClass(lineNum C.int, identifier *C.char, argDefsH, blockH goHandle) goHandle {
-	argDefs := ht.Get(argDefsH).([]VariableDef)
-	block := ht.Get(blockH).(Block)
-
-	return ht.Add(Class{
-		Filename: curFilename,
-		LineNum:  int(lineNum),
-		Name:     C.GoString(identifier),
-		ArgDefs:  argDefs,
-		Block:    block,
+func newClass(ctx C.int, line, col C.int, identifier *C.char, argDefsH, blockH goHandle) goHandle {
+	pc := getParseContext(ctx)
+	argDefs := pc.ht.Get(argDefsH).([]VariableDef)
+	block := pc.ht.Get(blockH).(Block)
+
+	return pc.ht.Add(Class{
+		Pos:     pc.pos(line, col),
+		Name:    C.GoString(identifier),
+		ArgDefs: argDefs,
+		Block:   block,
+	})
+}
+
+//export sawFunc
+func sawFunc(ctx C.int, line, col C.int, name *C.char, argDefsH, blockH goHandle) goHandle {
+	pc := getParseContext(ctx)
+	return pc.ht.Add(Func{
+		Pos:     pc.pos(line, col),
+		Name:    C.GoString(name),
+		ArgDefs: pc.ht.Get(argDefsH).([]VariableDef),
+		Block:   pc.ht.Get(blockH).(Block),
+	})
+}
+
+//export sawReturn
+func sawReturn(ctx C.int, line, col C.int, value goHandle) goHandle {
+	pc := getParseContext(ctx)
+	return pc.ht.Add(Return{
+		Pos:   pc.pos(line, col),
+		Value: pc.ht.Get(value),
 	})
 }
 
 //export sawNode
-func sawNode(lineNum C.int, name *C.char, blockH goHandle) goHandle {
-	block := ht.Get(blockH).(Block)
-
-	return ht.Add(Node{
-		Filename: curFilename,
-		LineNum:  int(lineNum),
-		Name:     C.GoString(name),
-		Block:    block,
+func sawNode(ctx C.int, line, col C.int, name *C.char, blockH goHandle) goHandle {
+	pc := getParseContext(ctx)
+	block := pc.ht.Get(blockH).(Block)
+
+	return pc.ht.Add(Node{
+		Pos:   pc.pos(line, col),
+		Name:  unescapeQuoted(C.GoString(name)),
+		Block: block,
 	})
 }
 
-//export sawBlock
-func sawBlock(lineNum C.int, statementsH goHandle) goHandle {
-	statements := ht.Get(statementsH).([]interface{})
+//export sawImport
+func sawImport(ctx C.int, line, col C.int, path *C.char) goHandle {
+	pc := getParseContext(ctx)
+	pos := pc.pos(line, col)
 
-	defs := []VariableDef{}
-	decls := []Declaration{}
-	ifs := []If{}
+	// Imports are relative to the directory of the importing file
+	importPath := unescapeQuoted(C.GoString(path))
+	if !filepath.IsAbs(importPath) {
+		importPath = filepath.Join(filepath.Dir(pos.File), importPath)
+	}
 
+	return pc.ht.Add(Import{
+		Pos:     pos,
+		Path:    importPath,
+		Written: unescapeQuoted(C.GoString(path)),
+	})
+}
+
+//export sawInclude
+func sawInclude(ctx C.int, line, col C.int, class *C.char) goHandle {
+	pc := getParseContext(ctx)
+	return pc.ht.Add(Include{
+		Pos:   pc.pos(line, col),
+		Class: C.GoString(class),
+	})
+}
+
+//export sawBlock
+func sawBlock(ctx C.int, line, col, endLine, endCol C.int, statementsH goHandle) goHandle {
+	pc := getParseContext(ctx)
+	statements := pc.ht.Get(statementsH).([]interface{})
+
+	var prevReturn *Return
 	for _, val := range statements {
-		switch val.(type) {
-		case VariableDef:
-			defs = append(defs, val.(VariableDef))
-		case Declaration:
-			decls = append(decls, val.(Declaration))
-		case If:
-			ifs = append(ifs, val.(If))
-		default:
-			panic("Value is neither def nor decl")
+		if r, isReturn := val.(Return); isReturn {
+			if prevReturn != nil {
+				pc.errors = append(pc.errors, &Error{
+					Pos: r.Pos,
+					Msg: fmt.Sprintf(
+						"more than one return in block, previous return at %s",
+						prevReturn.Pos,
+					),
+				})
+			}
+			prevReturn = &r
 		}
 	}
 
-	return ht.Add(Block{
-		Filename:     curFilename,
-		LineNum:      int(lineNum),
-		VariableDefs: defs,
-		Declarations: decls,
-		Ifs:          ifs,
-	})
+	block := NewBlock(pc.pos(line, col), pc.pos(endLine, endCol), statements)
+	pc.attachComments(&block)
+
+	return pc.ht.Add(block)
+}
+
+// Attaches the comments inside of block to their nearest statements. A comment
+// belongs to the statement following it, unless it trails the code of a
+// statement on the same line. Comments after the last statement are put in
+// EndComments. Blocks are reduced from the inside out, so the comments of
+// nested blocks have already been attached to their own statements.
+func (pc *parseContext) attachComments(block *Block) {
+	remaining := pc.comments[:0]
+	for _, comment := range pc.comments {
+		if !block.Pos.Before(comment.Pos) || !comment.Pos.Before(block.End) {
+			remaining = append(remaining, comment)
+			continue
+		}
+
+		// The statement starting after the comment
+		next := 0
+		for next < len(block.Statements) &&
+			block.Statements[next].Pos().Before(comment.Pos) {
+			next++
+		}
+
+		if comment.Trailing && next > 0 {
+			prev := &block.Statements[next-1]
+			prev.Comments = append(prev.Comments, comment)
+		} else if next < len(block.Statements) {
+			stmt := &block.Statements[next]
+			stmt.Comments = append(stmt.Comments, comment)
+		} else {
+			block.EndComments = append(block.EndComments, comment)
+		}
+	}
+	pc.comments = remaining
 }
 
 //export sawIf
-func sawIf(lineNum C.int, expression, block, _else goHandle) goHandle {
+func sawIf(ctx C.int, line, col C.int, expression, block, elseIfs, _else goHandle) goHandle {
+	pc := getParseContext(ctx)
 	var loadedElse *Block
 	if _else != 0 {
-		b := ht.Get(_else).(Block)
+		b := pc.ht.Get(_else).(Block)
 		loadedElse = &b
 	}
 
-	return ht.Add(If{
-		LineNum:    int(lineNum),
-		Expression: ht.Get(expression).(Value),
-		Block:      ht.Get(block).(Block),
+	var loadedElseIfs []ElseIf
+	for _, elseIf := range pc.ht.Get(elseIfs).([]interface{}) {
+		loadedElseIfs = append(loadedElseIfs, elseIf.(ElseIf))
+	}
+
+	return pc.ht.Add(If{
+		Pos:        pc.pos(line, col),
+		Expression: pc.ht.Get(expression).(Value),
+		Block:      pc.ht.Get(block).(Block),
+		ElseIfs:    loadedElseIfs,
 		Else:       loadedElse,
 	})
 }
 
+//export sawElseIf
+func sawElseIf(ctx C.int, line, col C.int, expression, block goHandle) goHandle {
+	pc := getParseContext(ctx)
+	return pc.ht.Add(ElseIf{
+		Pos:        pc.pos(line, col),
+		Expression: pc.ht.Get(expression).(Value),
+		Block:      pc.ht.Get(block).(Block),
+	})
+}
+
+//export sawFor
+func sawFor(ctx C.int, line, col C.int, key, value, collection, block goHandle) goHandle {
+	pc := getParseContext(ctx)
+	var loadedKey *VariableName
+	if key != 0 {
+		k := pc.ht.Get(key).(VariableName)
+		loadedKey = &k
+	}
+
+	return pc.ht.Add(For{
+		Pos:        pc.pos(line, col),
+		Key:        loadedKey,
+		Value:      pc.ht.Get(value).(VariableName),
+		Collection: pc.ht.Get(collection),
+		Block:      pc.ht.Get(block).(Block),
+	})
+}
+
+//export sawCase
+func sawCase(ctx C.int, line, col C.int, value, branches goHandle) goHandle {
+	pc := getParseContext(ctx)
+	c := Case{
+		Pos:   pc.pos(line, col),
+		Value: pc.ht.Get(value),
+	}
+
+	for _, val := range pc.ht.Get(branches).([]interface{}) {
+		branch := val.(CaseBranch)
+		if len(branch.Matches) > 0 {
+			c.Branches = append(c.Branches, branch)
+			continue
+		}
+
+		if c.Default != nil {
+			pc.errors = append(pc.errors, &Error{
+				Pos: branch.Pos,
+				Msg: fmt.Sprintf(
+					"more than one default in case, previous default at %s",
+					c.Default.Pos,
+				),
+			})
+		}
+		block := branch.Block
+		c.Default = &block
+	}
+
+	return pc.ht.Add(c)
+}
+
+//export sawCaseBranch
+func sawCaseBranch(ctx C.int, line, col C.int, matches, block goHandle) goHandle {
+	pc := getParseContext(ctx)
+	var loadedMatches []Value
+	for _, match := range pc.ht.Get(matches).([]interface{}) {
+		loadedMatches = append(loadedMatches, match)
+	}
+
+	return pc.ht.Add(CaseBranch{
+		Pos:     pc.pos(line, col),
+		Matches: loadedMatches,
+		Block:   pc.ht.Get(block).(Block),
+	})
+}
+
 //export sawBoolTrue
-func sawBoolTrue() goHandle {
-	return ht.Add(Bool(true))
+func sawBoolTrue(ctx C.int, line, col C.int) goHandle {
+	pc := getParseContext(ctx)
+	return pc.ht.Add(Literal{pc.pos(line, col), Bool(true)})
 }
 
 //export sawBoolFalse
-func sawBoolFalse() goHandle {
-	return ht.Add(Bool(false))
+func sawBoolFalse(ctx C.int, line, col C.int) goHandle {
+	pc := getParseContext(ctx)
+	return pc.ht.Add(Literal{pc.pos(line, col), Bool(false)})
 }
 
 //export sawVariableDef
-func sawVariableDef(lineNum C.int, varName *C.char, val goHandle) goHandle {
-	return ht.Add(VariableDef{
-		int(lineNum),
-		VariableName{int(lineNum), C.GoString(varName)},
-		ht.Get(val),
+func sawVariableDef(ctx C.int, line, col C.int, varName *C.char, val goHandle) goHandle {
+	pc := getParseContext(ctx)
+	return pc.ht.Add(VariableDef{
+		pc.pos(line, col),
+		VariableName{pc.pos(line, col), C.GoString(varName)},
+		pc.ht.Get(val),
 	})
 }
 
-//export sawQuotedString
-func sawQuotedString(lineNum C.int, val *C.char) goHandle {
-	return ht.Add(QuotedString(C.GoString(val)))
+//export sawRegex
+func sawRegex(ctx C.int, line, col C.int, val *C.char) goHandle {
+	pc := getParseContext(ctx)
+	pos := pc.pos(line, col)
+
+	// Slashes are escaped in the source, but not in the regex itself
+	var pattern []byte
+	src := C.GoString(val)
+	for i := 0; i < len(src); i++ {
+		if src[i] == '\\' && i+1 < len(src) {
+			if src[i+1] != '/' {
+				pattern = append(pattern, src[i])
+			}
+			i++
+		}
+		pattern = append(pattern, src[i])
+	}
+
+	if _, err := regexp.Compile(string(pattern)); err != nil {
+		pc.errors = append(pc.errors, &Error{
+			Pos: pos,
+			Msg: fmt.Sprintf("bad regex: %s", err),
+		})
+	}
+
+	return pc.ht.Add(Literal{pos, Regex(pattern)})
 }
 
-//export emptyInterpolatedString
-func emptyInterpolatedString(lineNum C.int) goHandle {
-	return ht.Add(InterpolatedString{
-		LineNum: int(lineNum),
+//export sawQuotedString
+func sawQuotedString(ctx C.int, line, col C.int, val *C.char) goHandle {
+	pc := getParseContext(ctx)
+	return pc.ht.Add(Literal{
+		pc.pos(line, col), QuotedString(unescapeQuoted(C.GoString(val))),
 	})
 }
 
-//export appendInterpolatedString
-func appendInterpolatedString(ipStrH goHandle, val goHandle) goHandle {
-	ipStr := ht.Get(ipStrH).(InterpolatedString)
-	ipStr.Segments = append(ipStr.Segments, ht.Get(val))
-	return ht.Add(ipStr)
+//export sawInterpolatedString
+func sawInterpolatedString(ctx C.int, line, col C.int, segmentsH goHandle) goHandle {
+	pc := getParseContext(ctx)
+	var segments []interface{}
+	if s := pc.ht.Get(segmentsH).([]interface{}); len(s) > 0 {
+		segments = pc.unescapeSegments(mergeText(s))
+	}
+
+	return pc.ht.Add(InterpolatedString{
+		Pos:      pc.pos(line, col),
+		Segments: segments,
+	})
 }
 
 //export sawString
-func sawString(val *C.char) goHandle {
-	return ht.Add(C.GoString(val))
+func sawString(ctx C.int, line, col C.int, val *C.char) goHandle {
+	pc := getParseContext(ctx)
+	return pc.ht.Add(Literal{pc.pos(line, col), C.GoString(val)})
 }
 
 //export sawInt
-func sawInt(lineNum C.int, val int) goHandle {
-	return ht.Add(val)
+func sawInt(ctx C.int, line, col C.int, val int) goHandle {
+	pc := getParseContext(ctx)
+	return pc.ht.Add(Literal{pc.pos(line, col), val})
+}
+
+//export sawFloat
+func sawFloat(ctx C.int, line, col C.int, val C.double) goHandle {
+	pc := getParseContext(ctx)
+	return pc.ht.Add(Literal{pc.pos(line, col), Float(val)})
 }
 
 //export sawVariableName
-func sawVariableName(lineNum C.int, name *C.char) goHandle {
-	return ht.Add(VariableName{int(lineNum), C.GoString(name)})
+func sawVariableName(ctx C.int, line, col C.int, name *C.char) goHandle {
+	pc := getParseContext(ctx)
+	return pc.ht.Add(VariableName{pc.pos(line, col), C.GoString(name)})
 }
 
 //export sawExpression
-func sawExpression(lineNum C.int, op *C.char, left, right goHandle) goHandle {
-	return ht.Add(Expression{
-		LineNum:   int(lineNum),
+func sawExpression(ctx C.int, line, col C.int, op *C.char, left, right goHandle) goHandle {
+	pc := getParseContext(ctx)
+	return pc.ht.Add(Expression{
+		Pos:       pc.pos(line, col),
 		Operation: ExpOp(C.GoString(op)),
-		Left:      ht.Get(left),
-		Right:     ht.Get(right),
+		Left:      pc.ht.Get(left),
+		Right:     pc.ht.Get(right),
+	})
+}
+
+//export sawUnaryExpression
+func sawUnaryExpression(ctx C.int, line, col C.int, op *C.char, value goHandle) goHandle {
+	pc := getParseContext(ctx)
+
+	operation := ExpOp(C.GoString(op))
+	if operation == "+" {
+		return -1
+	}
+
+	return pc.ht.Add(UnaryExpression{
+		Pos:       pc.pos(line, col),
+		Operation: operation,
+		Value:     pc.ht.Get(value),
+	})
+}
+
+//export sawSelector
+func sawSelector(ctx C.int, line, col C.int, value, cases goHandle) goHandle {
+	pc := getParseContext(ctx)
+	s := Selector{
+		Pos:   pc.pos(line, col),
+		Value: pc.ht.Get(value),
+	}
+
+	var defaultPos Pos
+	for _, val := range pc.ht.Get(cases).([]interface{}) {
+		c := val.(SelectorCase)
+		if c.Match != nil {
+			s.Cases = append(s.Cases, c)
+			continue
+		}
+
+		if s.Default != nil {
+			pc.errors = append(pc.errors, &Error{
+				Pos: c.Pos,
+				Msg: fmt.Sprintf(
+					"more than one default in selector, previous default at %s",
+					defaultPos,
+				),
+			})
+		}
+		s.Default = c.Val
+		defaultPos = c.Pos
+	}
+
+	return pc.ht.Add(s)
+}
+
+//export sawSelectorCase
+func sawSelectorCase(ctx C.int, line, col C.int, match, val goHandle) goHandle {
+	pc := getParseContext(ctx)
+	return pc.ht.Add(SelectorCase{
+		Pos:   pc.pos(line, col),
+		Match: pc.ht.Get(match),
+		Val:   pc.ht.Get(val),
 	})
 }
 
 //export sawDeclaration
-func sawDeclaration(lineNum C.int, typ *C.char, scalar, proplist goHandle) goHandle {
-	return ht.Add(Declaration{
-		Filename: curFilename,
-		LineNum:  int(lineNum),
-		Type:     C.GoString(typ),
-		Scalar:   ht.Get(scalar).(Value),
-		Props:    ht.Get(proplist).([]Prop),
+func sawDeclaration(ctx C.int, line, col C.int, typ *C.char, scalar, proplist goHandle) goHandle {
+	pc := getParseContext(ctx)
+	return pc.ht.Add(Declaration{
+		Pos:    pc.pos(line, col),
+		Type:   C.GoString(typ),
+		Scalar: pc.ht.Get(scalar).(Value),
+		Props:  pc.ht.Get(proplist).([]Prop),
 	})
 }
 
 //export sawProp
-func sawProp(lineNum C.int, propName *C.char, value goHandle) goHandle {
-	return ht.Add(Prop{
-		LineNum: int(lineNum),
-		Name:    C.GoString(propName),
-		Value:   ht.Get(value),
+func sawProp(ctx C.int, line, col C.int, propName *C.char, value goHandle) goHandle {
+	pc := getParseContext(ctx)
+	return pc.ht.Add(Prop{
+		Pos:   pc.pos(line, col),
+		Name:  C.GoString(propName),
+		Value: pc.ht.Get(value),
 	})
 }
 
 //export sawReference
-func sawReference(lineNum C.int, typ *C.char, scalar goHandle) goHandle {
-	return ht.Add(Reference{
-		LineNum: int(lineNum),
-		Type:    C.GoString(typ),
-		Scalar:  ht.Get(scalar),
+func sawReference(ctx C.int, line, col C.int, typ *C.char, scalar goHandle) goHandle {
+	pc := getParseContext(ctx)
+	return pc.ht.Add(Reference{
+		Pos:    pc.pos(line, col),
+		Type:   C.GoString(typ),
+		Scalar: pc.ht.Get(scalar),
+	})
+}
+
+//export sawHashEntry
+func sawHashEntry(ctx C.int, line, col C.int, key, val goHandle) goHandle {
+	pc := getParseContext(ctx)
+	return pc.ht.Add(HashEntry{
+		Pos: pc.pos(line, col),
+		Key: pc.ht.Get(key),
+		Val: pc.ht.Get(val),
+	})
+}
+
+//export sawIndex
+func sawIndex(ctx C.int, line, col C.int, value, key goHandle) goHandle {
+	pc := getParseContext(ctx)
+	return pc.ht.Add(Index{
+		Pos:   pc.pos(line, col),
+		Value: pc.ht.Get(value),
+		Key:   pc.ht.Get(key),
+	})
+}
+
+//export sawSlice
+func sawSlice(ctx C.int, line, col C.int, value, from, to goHandle) goHandle {
+	pc := getParseContext(ctx)
+	return pc.ht.Add(Slice{
+		Pos:   pc.pos(line, col),
+		Value: pc.ht.Get(value),
+		From:  pc.ht.Get(from),
+		To:    pc.ht.Get(to),
+	})
+}
+
+//export sawFunctionCall
+func sawFunctionCall(ctx C.int, line, col C.int, name *C.char, argsH goHandle) goHandle {
+	pc := getParseContext(ctx)
+	return pc.ht.Add(FunctionCall{
+		Pos:  pc.pos(line, col),
+		Name: C.GoString(name),
+		Args: pc.ht.Get(argsH).([]interface{}),
+	})
+}
+
+//export sawProbe
+func sawProbe(ctx C.int, line, col C.int, typ *C.char, command, proplist goHandle) goHandle {
+	pc := getParseContext(ctx)
+	pos := pc.pos(line, col)
+
+	if t := C.GoString(typ); t != "exec" {
+		pc.errors = append(pc.errors, &Error{
+			Pos: pos,
+			Msg: fmt.Sprintf(
+				"only exec can be used as a value, got declaration of type '%s'", t,
+			),
+		})
+	}
+
+	return pc.ht.Add(Probe{
+		Pos:     pos,
+		Command: pc.ht.Get(command),
+		Props:   pc.ht.Get(proplist).([]Prop),
 	})
 }
 
 //export sawDefine
-func sawDefine(lineNum C.int, modifier, name *C.char, argDefsH, blockH goHandle) goHandle {
-	block := ht.Get(blockH).(Block)
+func sawDefine(ctx C.int, line, col C.int, modifier, name *C.char, argDefsH, blockH goHandle) goHandle {
+	pc := getParseContext(ctx)
+	block := pc.ht.Get(blockH).(Block)
 
-	var dt DefineType
-	switch C.GoString(modifier) {
-	case "single":
-		dt = DefineTypeSingle
-	case "multiple":
-		dt = DefineTypeMultiple
-	default:
+	dt, ok := defineType(C.GoString(modifier))
+	if !ok {
 		return -1
 	}
 
-	argDefs := ht.Get(argDefsH).([]VariableDef)
+	argDefs := pc.ht.Get(argDefsH).([]VariableDef)
+
+	return pc.ht.Add(Define{
+		Pos:     pc.pos(line, col),
+		Name:    C.GoString(name),
+		ArgDefs: argDefs,
+		Block:   block,
+		Type:    dt,
+	})
+}
+
+//export sawFacter
+func sawFacter(ctx C.int, line, col C.int, modifier, name *C.char, argDefsH, blockH goHandle) goHandle {
+	pc := getParseContext(ctx)
+
+	dt, ok := defineType(C.GoString(modifier))
+	if !ok {
+		return -1
+	}
 
-	return ht.Add(Define{
-		Filename: curFilename,
-		LineNum:  int(lineNum),
-		Name:     C.GoString(name),
-		ArgDefs:  argDefs,
-		Block:    block,
-		Type:     dt,
+	return pc.ht.Add(Facter{
+		Pos:     pc.pos(line, col),
+		Name:    C.GoString(name),
+		ArgDefs: pc.ht.Get(argDefsH).([]VariableDef),
+		Block:   pc.ht.Get(blockH).(Block),
+		Type:    dt,
 	})
 }
 
+// Returns the define type for the modifier after define or facter, and false
+// if the modifier is neither single nor multiple.
+func defineType(modifier string) (DefineType, bool) {
+	switch modifier {
+	case "single":
+		return DefineTypeSingle, true
+	case "multiple":
+		return DefineTypeMultiple, true
+	default:
+		return DefineTypeSingle, false
+	}
+}
+
 //export sawArgDef
-func sawArgDef(lineNum C.int, varName *C.char, val goHandle) goHandle {
+func sawArgDef(ctx C.int, line, col C.int, varName *C.char, val goHandle) goHandle {
+	pc := getParseContext(ctx)
 	v := Value(nil)
 	if val != 0 {
-		v = ht.Get(val).(Value)
+		v = pc.ht.Get(val).(Value)
 	}
 
-	return ht.Add(VariableDef{
-		LineNum:      int(lineNum),
-		VariableName: VariableName{int(lineNum), C.GoString(varName)},
+	return pc.ht.Add(VariableDef{
+		Pos:          pc.pos(line, col),
+		VariableName: VariableName{pc.pos(line, col), C.GoString(varName)},
 		Val:          v,
 	})
 }
 
-var curFilename string
+//export sawComment
+func sawComment(ctx C.int, line, col C.int, text *C.char, trailing C.int) {
+	pc := getParseContext(ctx)
+	comment := Comment{
+		Pos:      pc.pos(line, col),
+		Text:     strings.TrimRight(C.GoString(text), " \t\r"),
+		Trailing: trailing != 0,
+	}
+	pc.ast.Layout.Comments = append(pc.ast.Layout.Comments, comment)
+	pc.comments = append(pc.comments, comment)
+}
 
-// Please note that as of current, Lex() is /NOT/ reentrant.
-// This function will parse r and store the output into ast.
-func Parse(ast *AST, filename string, r io.Reader) error {
-	curFilename = filename
-	currentAST = ast
+//export sawBlankLine
+func sawBlankLine(ctx C.int, line, col C.int) {
+	pc := getParseContext(ctx)
+	pc.ast.Layout.BlankLines = append(pc.ast.Layout.BlankLines, pc.pos(line, col))
+}
+
+//export sawError
+func sawError(ctx C.int, line, col C.int, msg *C.char) {
+	pc := getParseContext(ctx)
+	pc.errors = append(pc.errors, &Error{
+		Pos: pc.pos(line, col),
+		Msg: C.GoString(msg),
+	})
+}
+
+//export sawSyntaxError
+func sawSyntaxError(ctx C.int, line, col C.int, unexpected *C.char) {
+	pc := getParseContext(ctx)
+	pc.errors = append(pc.errors, &Error{
+		Pos: pc.pos(line, col),
+		Msg: "unexpected " + describeToken(C.GoString(unexpected)),
+	})
+}
 
+// Adds an expected token to the last syntax error.
+//
+//export sawExpectedToken
+func sawExpectedToken(ctx C.int, token *C.char) {
+	pc := getParseContext(ctx)
+	e := pc.errors[len(pc.errors)-1]
+
+	desc := describeToken(C.GoString(token))
+	for _, expected := range e.Expected {
+		if expected == desc {
+			return
+		}
+	}
+
+	e.Expected = append(e.Expected, desc)
+}
+
+// This function will parse r and store the output into ast. Parse is safe to
+// call from multiple goroutines at the same time, as long as each call is
+// given its own ast. The results may then be combined using AST.Merge().
+//
+// Parsing continues after syntax errors where possible, and all of them are
+// returned as an ErrorList. Everything that could be parsed is still stored
+// into ast.
+func Parse(ast *AST, filename string, r io.Reader) error {
 	buf, err := ioutil.ReadAll(r)
 	if err != nil {
 		return err
 	}
 
-	ret := C.doparse(C.CString(string(buf)))
-	if ret.code != 0 {
-		return fmt.Errorf(
-			"%s:%d: %s", filename, C.line_num, C.GoString(ret.error),
-		)
+	ctx, pc := newParseContext(ast, filename)
+	defer releaseParseContext(ctx)
+
+	cBuf := C.CString(string(buf))
+	defer C.free(unsafe.Pointer(cBuf))
+
+	ret := C.doparse(cBuf, ctx)
+	if ret != 0 && len(pc.errors) == 0 {
+		pc.errors = append(pc.errors, &Error{
+			Pos: Pos{File: filename},
+			Msg: "parsing aborted",
+		})
+	}
+
+	if len(pc.errors) > 0 {
+		return pc.errors
 	} else {
 		return nil
 	}
 }
+
+//export sawHeredoc
+func sawHeredoc(ctx C.int, line, col C.int, segmentsH goHandle, literal C.int) goHandle {
+	pc := getParseContext(ctx)
+	pos := pc.pos(line, col)
+	segments := mergeText(pc.ht.Get(segmentsH).([]interface{}))
+	pc.ast.Layout.Heredocs = append(pc.ast.Layout.Heredocs, pos)
+
+	if literal != 0 {
+		str := ""
+		for _, segment := range stripIndentation(segments) {
+			str += segment.(Literal).Val.(string)
+		}
+		return pc.ht.Add(Literal{pos, QuotedString(str)})
+	}
+
+	// Escapes are checked before the indentation is stripped, so that errors
+	// get the right positions, but decoded after so that an escaped tab isn't
+	// taken for indentation.
+	errCount := len(pc.errors)
+	pc.unescapeSegments(segments)
+	segments = stripIndentation(segments)
+	if len(pc.errors) == errCount {
+		segments = pc.unescapeSegments(segments)
+	}
+
+	if len(segments) == 0 {
+		segments = nil
+	}
+	return pc.ht.Add(InterpolatedString{Pos: pos, Segments: segments})
+}
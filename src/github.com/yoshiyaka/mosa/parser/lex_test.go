@@ -2,8 +2,10 @@ package parser
 
 import (
 	"encoding/json"
+	"fmt"
 	"reflect"
 	"strings"
+	"sync"
 	"testing"
 
 	. "github.com/yoshiyaka/mosa/ast"
@@ -19,11 +21,11 @@ var lexTests = []struct {
 		&AST{
 			Classes: []Class{
 				{
-					LineNum: 1,
+					Pos:     Pos{Line: 1},
 					Name:    "Test",
 					ArgDefs: []VariableDef{},
 					Block: Block{
-						LineNum:      1,
+						Pos:          Pos{Line: 1},
 						VariableDefs: []VariableDef{},
 						Declarations: []Declaration{},
 					},
@@ -42,21 +44,21 @@ var lexTests = []struct {
 		&AST{
 			Classes: []Class{
 				{
-					LineNum: 2,
+					Pos:     Pos{Line: 2},
 					Name:    "Test",
 					ArgDefs: []VariableDef{},
 					Block: Block{
-						LineNum:      2,
+						Pos:          Pos{Line: 2},
 						VariableDefs: []VariableDef{},
 						Declarations: []Declaration{},
 					},
 				},
 				{
-					LineNum: 4,
+					Pos:     Pos{Line: 4},
 					Name:    "Bar",
 					ArgDefs: []VariableDef{},
 					Block: Block{
-						LineNum:      4,
+						Pos:          Pos{Line: 4},
 						VariableDefs: []VariableDef{},
 						Declarations: []Declaration{},
 					},
@@ -75,15 +77,15 @@ var lexTests = []struct {
 		&AST{
 			Classes: []Class{
 				{
-					LineNum: 2,
+					Pos:     Pos{Line: 2},
 					Name:    "Test",
 					ArgDefs: []VariableDef{},
 					Block: Block{
-						LineNum: 2,
+						Pos: Pos{Line: 2},
 						VariableDefs: []VariableDef{
 							{
-								LineNum:      3,
-								VariableName: VariableName{3, "$prop"},
+								Pos:          Pos{Line: 3},
+								VariableName: VariableName{Pos{Line: 3}, "$prop"},
 								Val:          Value("x"),
 							},
 						},
@@ -106,21 +108,21 @@ var lexTests = []struct {
 		&AST{
 			Classes: []Class{
 				{
-					LineNum: 2,
+					Pos:     Pos{Line: 2},
 					Name:    "Test",
 					ArgDefs: []VariableDef{},
 					Block: Block{
-						LineNum: 2,
+						Pos: Pos{Line: 2},
 						VariableDefs: []VariableDef{
 							{
-								LineNum:      3,
-								VariableName: VariableName{3, "$prop"},
+								Pos:          Pos{Line: 3},
+								VariableName: VariableName{Pos{Line: 3}, "$prop"},
 								Val: Expression{
-									LineNum:   3,
+									Pos:       Pos{Line: 3},
 									Operation: "*",
 									Left:      4,
 									Right: Expression{
-										LineNum:   3,
+										Pos:       Pos{Line: 3},
 										Operation: "+",
 										Left:      2,
 										Right:     3,
@@ -128,29 +130,29 @@ var lexTests = []struct {
 								},
 							},
 							{
-								LineNum:      4,
-								VariableName: VariableName{4, "$foo"},
+								Pos:          Pos{Line: 4},
+								VariableName: VariableName{Pos{Line: 4}, "$foo"},
 								Val: Expression{
-									LineNum:   4,
+									Pos:       Pos{Line: 4},
 									Operation: "-",
 									Left: Expression{
-										LineNum:   4,
+										Pos:       Pos{Line: 4},
 										Operation: "/",
-										Left:      VariableName{4, "$prop"},
+										Left:      VariableName{Pos{Line: 4}, "$prop"},
 										Right:     QuotedString("foo"),
 									},
 									Right: 8,
 								},
 							},
 							{
-								LineNum:      5,
-								VariableName: VariableName{5, "$bool"},
+								Pos:          Pos{Line: 5},
+								VariableName: VariableName{Pos{Line: 5}, "$bool"},
 								Val: Expression{
-									LineNum:   5,
+									Pos:       Pos{Line: 5},
 									Operation: ">",
 									Left:      4,
 									Right: Expression{
-										LineNum:   5,
+										Pos:       Pos{Line: 5},
 										Operation: "+",
 										Left:      3,
 										Right:     1,
@@ -165,6 +167,46 @@ var lexTests = []struct {
 		},
 	},
 
+	{
+		`
+		class Test {
+			$ratio = 0.75
+			$sum = 1.5 + 2
+		}
+		`,
+
+		&AST{
+			Classes: []Class{
+				{
+					Pos:     Pos{Line: 2},
+					Name:    "Test",
+					ArgDefs: []VariableDef{},
+					Block: Block{
+						Pos: Pos{Line: 2},
+						VariableDefs: []VariableDef{
+							{
+								Pos:          Pos{Line: 3},
+								VariableName: VariableName{Pos{Line: 3}, "$ratio"},
+								Val:          Float(0.75),
+							},
+							{
+								Pos:          Pos{Line: 4},
+								VariableName: VariableName{Pos{Line: 4}, "$sum"},
+								Val: Expression{
+									Pos:       Pos{Line: 4},
+									Operation: "+",
+									Left:      Float(1.5),
+									Right:     2,
+								},
+							},
+						},
+						Declarations: []Declaration{},
+					},
+				},
+			},
+		},
+	},
+
 	{
 		`
 		class Test {
@@ -175,31 +217,31 @@ var lexTests = []struct {
 		&AST{
 			Classes: []Class{
 				{
-					LineNum: 2,
+					Pos:     Pos{Line: 2},
 					Name:    "Test",
 					ArgDefs: []VariableDef{},
 					Block: Block{
-						LineNum: 2,
+						Pos: Pos{Line: 2},
 						VariableDefs: []VariableDef{
 							{
-								LineNum:      3,
-								VariableName: VariableName{3, "$order"},
+								Pos:          Pos{Line: 3},
+								VariableName: VariableName{Pos{Line: 3}, "$order"},
 								Val: Expression{
-									LineNum:   3,
+									Pos:       Pos{Line: 3},
 									Operation: "-",
 									Left: Expression{
-										LineNum:   3,
+										Pos:       Pos{Line: 3},
 										Operation: "+",
 										Left:      1,
 										Right: Expression{
-											LineNum:   3,
+											Pos:       Pos{Line: 3},
 											Operation: "*",
 											Left:      5,
 											Right:     3,
 										},
 									},
 									Right: Expression{
-										LineNum:   3,
+										Pos:       Pos{Line: 3},
 										Operation: "/",
 										Left:      4,
 										Right:     2,
@@ -229,43 +271,43 @@ var lexTests = []struct {
 		&AST{
 			Classes: []Class{
 				{
-					LineNum: 2,
+					Pos:     Pos{Line: 2},
 					Name:    "Test",
 					ArgDefs: []VariableDef{},
 					Block: Block{
-						LineNum:      2,
+						Pos:          Pos{Line: 2},
 						VariableDefs: []VariableDef{},
 						Declarations: []Declaration{
 							{
-								LineNum: 3,
-								Type:    "exec",
+								Pos:  Pos{Line: 3},
+								Type: "exec",
 								Scalar: Expression{
-									LineNum:   3,
+									Pos:       Pos{Line: 3},
 									Operation: "+",
 									Left:      QuotedString("my"),
 									Right:     QuotedString("type"),
 								},
 								Props: []Prop{
 									{
-										LineNum: 4,
-										Name:    "threads",
+										Pos:  Pos{Line: 4},
+										Name: "threads",
 										Value: Expression{
-											LineNum:   4,
+											Pos:       Pos{Line: 4},
 											Operation: "-",
 											Left:      6,
 											Right:     4,
 										},
 									},
 									{
-										LineNum: 5,
-										Name:    "args",
+										Pos:  Pos{Line: 5},
+										Name: "args",
 										Value: Array{
 											Expression{
-												LineNum:   6,
+												Pos:       Pos{Line: 6},
 												Operation: "-",
 												Left: Array{
 													Expression{
-														LineNum:   6,
+														Pos:       Pos{Line: 6},
 														Operation: "+",
 														Left:      5,
 														Right:     2,
@@ -294,15 +336,15 @@ var lexTests = []struct {
 		&AST{
 			Classes: []Class{
 				{
-					LineNum: 2,
+					Pos:     Pos{Line: 2},
 					Name:    "Test",
 					ArgDefs: []VariableDef{},
 					Block: Block{
-						LineNum: 2,
+						Pos: Pos{Line: 2},
 						VariableDefs: []VariableDef{
 							{
-								LineNum:      3,
-								VariableName: VariableName{3, "$prop"},
+								Pos:          Pos{Line: 3},
+								VariableName: VariableName{Pos{Line: 3}, "$prop"},
 								Val: Array{
 									Value("x"),
 									Value(1),
@@ -331,15 +373,15 @@ var lexTests = []struct {
 		&AST{
 			Classes: []Class{
 				{
-					LineNum: 3,
+					Pos:     Pos{Line: 3},
 					Name:    "Test",
 					ArgDefs: []VariableDef{},
 					Block: Block{
-						LineNum: 3,
+						Pos: Pos{Line: 3},
 						VariableDefs: []VariableDef{
 							{
-								LineNum:      4,
-								VariableName: VariableName{4, "$prop"},
+								Pos:          Pos{Line: 4},
+								VariableName: VariableName{Pos{Line: 4}, "$prop"},
 								Val:          Value("x"),
 							},
 						},
@@ -361,18 +403,18 @@ var lexTests = []struct {
 		&AST{
 			Classes: []Class{
 				{
-					LineNum: 2,
+					Pos:     Pos{Line: 2},
 					Name:    "Test",
 					ArgDefs: []VariableDef{},
 					Block: Block{
-						LineNum:      2,
+						Pos:          Pos{Line: 2},
 						VariableDefs: []VariableDef{},
 						Declarations: []Declaration{
 							{
-								LineNum: 3,
-								Type:    "package",
-								Scalar:  "pkg-name",
-								Props:   []Prop{},
+								Pos:    Pos{Line: 3},
+								Type:   "package",
+								Scalar: "pkg-name",
+								Props:  []Prop{},
 							},
 						},
 					},
@@ -393,22 +435,22 @@ var lexTests = []struct {
 		&AST{
 			Classes: []Class{
 				{
-					LineNum: 2,
+					Pos:     Pos{Line: 2},
 					Name:    "Test",
 					ArgDefs: []VariableDef{},
 					Block: Block{
-						LineNum:      2,
+						Pos:          Pos{Line: 2},
 						VariableDefs: []VariableDef{},
 						Declarations: []Declaration{
 							{
-								LineNum: 3,
-								Type:    "package",
-								Scalar:  "pkg",
+								Pos:    Pos{Line: 3},
+								Type:   "package",
+								Scalar: "pkg",
 								Props: []Prop{
 									{
-										LineNum: 4,
-										Name:    "foo",
-										Value:   "bar",
+										Pos:   Pos{Line: 4},
+										Name:  "foo",
+										Value: "bar",
 									},
 								},
 							},
@@ -431,32 +473,32 @@ var lexTests = []struct {
 		&AST{
 			Classes: []Class{
 				{
-					LineNum: 1,
+					Pos:     Pos{Line: 1},
 					Name:    "Test",
 					ArgDefs: []VariableDef{},
 					Block: Block{
-						LineNum:      1,
+						Pos:          Pos{Line: 1},
 						VariableDefs: []VariableDef{},
 						Declarations: []Declaration{
 							{
-								LineNum: 2,
-								Type:    "package",
-								Scalar:  "pkg",
+								Pos:    Pos{Line: 2},
+								Type:   "package",
+								Scalar: "pkg",
 								Props: []Prop{
 									{
-										LineNum: 3,
-										Name:    "class",
-										Value:   "foo",
+										Pos:   Pos{Line: 3},
+										Name:  "class",
+										Value: "foo",
 									},
 									{
-										LineNum: 4,
-										Name:    "define",
-										Value:   "bar",
+										Pos:   Pos{Line: 4},
+										Name:  "define",
+										Value: "bar",
 									},
 									{
-										LineNum: 5,
-										Name:    "node",
-										Value:   "baz",
+										Pos:   Pos{Line: 5},
+										Name:  "node",
+										Value: "baz",
 									},
 								},
 							},
@@ -482,22 +524,22 @@ var lexTests = []struct {
 		&AST{
 			Classes: []Class{
 				{
-					LineNum: 2,
+					Pos:     Pos{Line: 2},
 					Name:    "Test",
 					ArgDefs: []VariableDef{},
 					Block: Block{
-						LineNum: 2,
+						Pos: Pos{Line: 2},
 						VariableDefs: []VariableDef{
 							{
-								LineNum:      3,
-								VariableName: VariableName{3, "$foo"},
+								Pos:          Pos{Line: 3},
+								VariableName: VariableName{Pos{Line: 3}, "$foo"},
 								Val:          "bar",
 							},
 
 							{
-								LineNum:      4,
-								VariableName: VariableName{4, "$baz"},
-								Val:          VariableName{4, "$foo"},
+								Pos:          Pos{Line: 4},
+								VariableName: VariableName{Pos{Line: 4}, "$baz"},
+								Val:          VariableName{Pos{Line: 4}, "$foo"},
 							},
 						},
 						Declarations: []Declaration{},
@@ -505,15 +547,15 @@ var lexTests = []struct {
 				},
 
 				{
-					LineNum: 7,
+					Pos:     Pos{Line: 7},
 					Name:    "Class2",
 					ArgDefs: []VariableDef{},
 					Block: Block{
-						LineNum: 7,
+						Pos: Pos{Line: 7},
 						VariableDefs: []VariableDef{
 							{
-								LineNum:      8,
-								VariableName: VariableName{8, "$good"},
+								Pos:          Pos{Line: 8},
+								VariableName: VariableName{Pos{Line: 8}, "$good"},
 								Val:          "text",
 							},
 						},
@@ -536,22 +578,22 @@ var lexTests = []struct {
 		&AST{
 			Classes: []Class{
 				{
-					LineNum: 2,
+					Pos:     Pos{Line: 2},
 					Name:    "Test",
 					ArgDefs: []VariableDef{},
 					Block: Block{
-						LineNum:      2,
+						Pos:          Pos{Line: 2},
 						VariableDefs: []VariableDef{},
 						Declarations: []Declaration{
 							{
-								LineNum: 3,
-								Type:    "package",
-								Scalar:  "pkg3",
+								Pos:    Pos{Line: 3},
+								Type:   "package",
+								Scalar: "pkg3",
 								Props: []Prop{
 									{
-										LineNum: 4,
-										Name:    "depends",
-										Value:   Array{},
+										Pos:   Pos{Line: 4},
+										Name:  "depends",
+										Value: Array{},
 									},
 								},
 							},
@@ -574,26 +616,26 @@ var lexTests = []struct {
 		&AST{
 			Classes: []Class{
 				{
-					LineNum: 2,
+					Pos:     Pos{Line: 2},
 					Name:    "Test",
 					ArgDefs: []VariableDef{},
 					Block: Block{
-						LineNum:      2,
+						Pos:          Pos{Line: 2},
 						VariableDefs: []VariableDef{},
 						Declarations: []Declaration{
 							{
-								LineNum: 3,
-								Type:    "package",
-								Scalar:  "pkg3",
+								Pos:    Pos{Line: 3},
+								Type:   "package",
+								Scalar: "pkg3",
 								Props: []Prop{
 									{
-										LineNum: 4,
-										Name:    "depends",
+										Pos:  Pos{Line: 4},
+										Name: "depends",
 										Value: Array{
 											Reference{
-												LineNum: 4,
-												Type:    "package",
-												Scalar:  "pkg1",
+												Pos:    Pos{Line: 4},
+												Type:   "package",
+												Scalar: "pkg1",
 											},
 										},
 									},
@@ -621,31 +663,31 @@ var lexTests = []struct {
 		&AST{
 			Classes: []Class{
 				{
-					LineNum: 2,
+					Pos:     Pos{Line: 2},
 					Name:    "Test",
 					ArgDefs: []VariableDef{},
 					Block: Block{
-						LineNum:      2,
+						Pos:          Pos{Line: 2},
 						VariableDefs: []VariableDef{},
 						Declarations: []Declaration{
 							{
-								LineNum: 3,
-								Type:    "package",
-								Scalar:  "pkg3",
+								Pos:    Pos{Line: 3},
+								Type:   "package",
+								Scalar: "pkg3",
 								Props: []Prop{
 									{
-										LineNum: 4,
-										Name:    "depends",
+										Pos:  Pos{Line: 4},
+										Name: "depends",
 										Value: Array{
 											Reference{
-												LineNum: 5,
-												Type:    "package",
-												Scalar:  "pkg1",
+												Pos:    Pos{Line: 5},
+												Type:   "package",
+												Scalar: "pkg1",
 											},
 											Reference{
-												LineNum: 6,
-												Type:    "package",
-												Scalar:  "pkg2",
+												Pos:    Pos{Line: 6},
+												Type:   "package",
+												Scalar: "pkg2",
 											},
 										},
 									},
@@ -673,43 +715,43 @@ var lexTests = []struct {
 		&AST{
 			Classes: []Class{
 				{
-					LineNum: 2,
+					Pos:     Pos{Line: 2},
 					Name:    "Arrays",
 					ArgDefs: []VariableDef{},
 					Block: Block{
-						LineNum: 2,
+						Pos: Pos{Line: 2},
 						VariableDefs: []VariableDef{
 							{
-								LineNum:      3,
-								VariableName: VariableName{3, "$a1"},
+								Pos:          Pos{Line: 3},
+								VariableName: VariableName{Pos{Line: 3}, "$a1"},
 								Val:          Array{},
 							},
 							{
-								LineNum:      4,
-								VariableName: VariableName{4, "$a2"},
+								Pos:          Pos{Line: 4},
+								VariableName: VariableName{Pos{Line: 4}, "$a2"},
 								Val:          Array{"foo"},
 							},
 							{
-								LineNum:      5,
-								VariableName: VariableName{5, "$a3"},
+								Pos:          Pos{Line: 5},
+								VariableName: VariableName{Pos{Line: 5}, "$a3"},
 								Val:          Array{"foo", "bar"},
 							},
 							{
-								LineNum:      6,
-								VariableName: VariableName{6, "$a4"},
-								Val:          Array{VariableName{6, "$a1"}},
+								Pos:          Pos{Line: 6},
+								VariableName: VariableName{Pos{Line: 6}, "$a4"},
+								Val:          Array{VariableName{Pos{Line: 6}, "$a1"}},
 							},
 							{
-								LineNum:      7,
-								VariableName: VariableName{7, "$a5"},
+								Pos:          Pos{Line: 7},
+								VariableName: VariableName{Pos{Line: 7}, "$a5"},
 								Val: Array{
-									VariableName{7, "$a1"}, VariableName{7, "$a2"},
+									VariableName{Pos{Line: 7}, "$a1"}, VariableName{Pos{Line: 7}, "$a2"},
 								},
 							},
 							{
-								LineNum:      8,
-								VariableName: VariableName{8, "$a6"},
-								Val:          Array{VariableName{8, "$a1"}, "foo"},
+								Pos:          Pos{Line: 8},
+								VariableName: VariableName{Pos{Line: 8}, "$a6"},
+								Val:          Array{VariableName{Pos{Line: 8}, "$a1"}, "foo"},
 							},
 						},
 						Declarations: []Declaration{},
@@ -732,32 +774,32 @@ var lexTests = []struct {
 		&AST{
 			Classes: []Class{
 				{
-					LineNum: 2,
+					Pos:     Pos{Line: 2},
 					Name:    "Test",
 					ArgDefs: []VariableDef{},
 					Block: Block{
-						LineNum: 2,
+						Pos: Pos{Line: 2},
 						VariableDefs: []VariableDef{
 							{
-								LineNum:      3,
-								VariableName: VariableName{3, "$webserver"},
+								Pos:          Pos{Line: 3},
+								VariableName: VariableName{Pos{Line: 3}, "$webserver"},
 								Val:          "nginx",
 							},
 						},
 						Declarations: []Declaration{
 							{
-								LineNum: 4,
-								Type:    "package",
-								Scalar:  "pkg3",
+								Pos:    Pos{Line: 4},
+								Type:   "package",
+								Scalar: "pkg3",
 								Props: []Prop{
 									{
-										Name:    "depends",
-										LineNum: 5,
+										Name: "depends",
+										Pos:  Pos{Line: 5},
 										Value: Array{
 											Reference{
-												LineNum: 5,
-												Type:    "package",
-												Scalar:  VariableName{5, "$webserver"},
+												Pos:    Pos{Line: 5},
+												Type:   "package",
+												Scalar: VariableName{Pos{Line: 5}, "$webserver"},
 											},
 										},
 									},
@@ -788,43 +830,43 @@ var lexTests = []struct {
 		&AST{
 			Classes: []Class{
 				{
-					LineNum: 2,
+					Pos:     Pos{Line: 2},
 					Name:    "Test",
 					ArgDefs: []VariableDef{},
 					Block: Block{
-						LineNum: 2,
+						Pos: Pos{Line: 2},
 						VariableDefs: []VariableDef{
 							{
-								LineNum:      3,
-								VariableName: VariableName{3, "$webserver"},
+								Pos:          Pos{Line: 3},
+								VariableName: VariableName{Pos{Line: 3}, "$webserver"},
 								Val:          "nginx",
 							},
 						},
 						Declarations: []Declaration{
 							{
-								LineNum: 5,
-								Type:    "package",
-								Scalar:  VariableName{5, "$webserver"},
+								Pos:    Pos{Line: 5},
+								Type:   "package",
+								Scalar: VariableName{Pos{Line: 5}, "$webserver"},
 								Props: []Prop{
 									{
-										LineNum: 6,
-										Name:    "ensure",
-										Value:   "latest",
+										Pos:   Pos{Line: 6},
+										Name:  "ensure",
+										Value: "latest",
 									},
 								},
 							},
 							{
-								LineNum: 9,
-								Type:    "package",
-								Scalar:  "website",
+								Pos:    Pos{Line: 9},
+								Type:   "package",
+								Scalar: "website",
 								Props: []Prop{
 									{
-										LineNum: 10,
-										Name:    "depends",
+										Pos:  Pos{Line: 10},
+										Name: "depends",
 										Value: Reference{
-											LineNum: 10,
-											Type:    "package",
-											Scalar:  VariableName{10, "$webserver"},
+											Pos:    Pos{Line: 10},
+											Type:   "package",
+											Scalar: VariableName{Pos{Line: 10}, "$webserver"},
 										},
 									},
 								},
@@ -866,84 +908,84 @@ var lexTests = []struct {
 		&AST{
 			Classes: []Class{
 				{
-					LineNum: 2,
+					Pos:     Pos{Line: 2},
 					Name:    "Deps",
 					ArgDefs: []VariableDef{},
 					Block: Block{
-						LineNum:      2,
+						Pos:          Pos{Line: 2},
 						VariableDefs: []VariableDef{},
 						Declarations: []Declaration{
 							{
-								LineNum: 3,
-								Type:    "package",
-								Scalar:  "pkg1",
+								Pos:    Pos{Line: 3},
+								Type:   "package",
+								Scalar: "pkg1",
 								Props: []Prop{
 									{
-										LineNum: 4,
-										Name:    "depends",
+										Pos:  Pos{Line: 4},
+										Name: "depends",
 										Value: Array{
-											Reference{4, "deb", "pkg2"},
-											Reference{4, "file", "file1"},
+											Reference{Pos{Line: 4}, "deb", "pkg2"},
+											Reference{Pos{Line: 4}, "file", "file1"},
 										},
 									},
 								},
 							},
 							{
-								LineNum: 7,
-								Type:    "package",
-								Scalar:  "pkg2",
+								Pos:    Pos{Line: 7},
+								Type:   "package",
+								Scalar: "pkg2",
 								Props: []Prop{
 									{
-										LineNum: 8,
-										Name:    "depends",
+										Pos:  Pos{Line: 8},
+										Name: "depends",
 										Value: Array{
-											Reference{8, "file", "file1"},
-											Reference{8, "file", "file2"},
+											Reference{Pos{Line: 8}, "file", "file1"},
+											Reference{Pos{Line: 8}, "file", "file2"},
 										},
 									},
 								},
 							},
 							{
-								LineNum: 11,
-								Type:    "file",
-								Scalar:  "file1",
+								Pos:    Pos{Line: 11},
+								Type:   "file",
+								Scalar: "file1",
 								Props: []Prop{
 									{
-										LineNum: 12,
-										Name:    "depends",
-										Value:   Reference{12, "shell", "cmd1"},
+										Pos:   Pos{Line: 12},
+										Name:  "depends",
+										Value: Reference{Pos{Line: 12}, "shell", "cmd1"},
 									},
 								},
 							},
 							{
-								LineNum: 15,
-								Type:    "file",
-								Scalar:  "file2",
+								Pos:    Pos{Line: 15},
+								Type:   "file",
+								Scalar: "file2",
 								Props: []Prop{
 									{
-										LineNum: 16,
-										Name:    "depends",
-										Value:   Reference{16, "shell", "cmd2"},
+										Pos:   Pos{Line: 16},
+										Name:  "depends",
+										Value: Reference{Pos{Line: 16}, "shell", "cmd2"},
 									},
 								},
 							},
 							{
-								LineNum: 19,
-								Type:    "shell",
-								Scalar:  "cmd1",
+								Pos:    Pos{Line: 19},
+								Type:   "shell",
+								Scalar: "cmd1",
 								Props: []Prop{
 									{
-										LineNum: 20,
-										Name:    "depends",
-										Value:   Reference{20, "shell", "cmd2"},
+										Pos:   Pos{Line: 20},
+										Name:  "depends",
+										Value: Reference{Pos{Line: 20}, "shell", "cmd2"},
 									},
 								},
 							},
 							{
-								LineNum: 23,
-								Type:    "shell",
-								Scalar:  "cmd2",
-								Props:   []Prop{},
+								Pos:    Pos{Line: 23},
+								Type:   "shell",
+								Scalar: "cmd2",
+								Props:  []Prop{},
 							},
 						},
 					},
@@ -959,22 +1001,22 @@ var lexTests = []struct {
 		&AST{
 			Defines: []Define{
 				{
-					Name:    "package",
-					LineNum: 1,
+					Name: "package",
+					Pos:  Pos{Line: 1},
 					ArgDefs: []VariableDef{
 						{
-							LineNum:      1,
+							Pos:          Pos{Line: 1},
 							Val:          nil,
-							VariableName: VariableName{1, "$names"},
+							VariableName: VariableName{Pos{Line: 1}, "$names"},
 						},
 					},
 					Type: DefineTypeMultiple,
 					Block: Block{
-						LineNum: 1,
+						Pos: Pos{Line: 1},
 						VariableDefs: []VariableDef{
 							{
-								LineNum:      2,
-								VariableName: VariableName{2, "$foo"},
+								Pos:          Pos{Line: 2},
+								VariableName: VariableName{Pos{Line: 2}, "$foo"},
 								Val:          "x",
 							},
 						},
@@ -990,18 +1032,18 @@ var lexTests = []struct {
 		&AST{
 			Defines: []Define{
 				{
-					Name:    "package",
-					LineNum: 1,
+					Name: "package",
+					Pos:  Pos{Line: 1},
 					ArgDefs: []VariableDef{
 						{
-							LineNum:      1,
+							Pos:          Pos{Line: 1},
 							Val:          nil,
-							VariableName: VariableName{1, "$names"},
+							VariableName: VariableName{Pos{Line: 1}, "$names"},
 						},
 					},
 					Type: DefineTypeMultiple,
 					Block: Block{
-						LineNum:      1,
+						Pos:          Pos{Line: 1},
 						VariableDefs: []VariableDef{},
 						Declarations: []Declaration{},
 					},
@@ -1017,14 +1059,14 @@ var lexTests = []struct {
 		&AST{
 			Nodes: []Node{
 				{
-					Name:    "localhost",
-					LineNum: 1,
+					Name: "localhost",
+					Pos:  Pos{Line: 1},
 					Block: Block{
-						LineNum: 1,
+						Pos: Pos{Line: 1},
 						VariableDefs: []VariableDef{
 							{
-								LineNum:      2,
-								VariableName: VariableName{2, "$foo"},
+								Pos:          Pos{Line: 2},
+								VariableName: VariableName{Pos{Line: 2}, "$foo"},
 								Val:          "x",
 							},
 						},
@@ -1040,10 +1082,10 @@ var lexTests = []struct {
 		&AST{
 			Nodes: []Node{
 				{
-					Name:    "localhost",
-					LineNum: 1,
+					Name: "localhost",
+					Pos:  Pos{Line: 1},
 					Block: Block{
-						LineNum:      1,
+						Pos:          Pos{Line: 1},
 						VariableDefs: []VariableDef{},
 						Declarations: []Declaration{},
 					},
@@ -1061,27 +1103,27 @@ var lexTests = []struct {
 		&AST{
 			Nodes: []Node{
 				{
-					Name:    "localhost",
-					LineNum: 1,
+					Name: "localhost",
+					Pos:  Pos{Line: 1},
 					Block: Block{
-						LineNum: 1,
+						Pos: Pos{Line: 1},
 						VariableDefs: []VariableDef{
 							{
-								LineNum:      2,
-								VariableName: VariableName{2, "$foo"},
+								Pos:          Pos{Line: 2},
+								VariableName: VariableName{Pos{Line: 2}, "$foo"},
 								Val:          "x",
 							},
 						},
 						Declarations: []Declaration{
 							{
-								LineNum: 4,
-								Type:    "decl",
-								Scalar:  "x",
+								Pos:    Pos{Line: 4},
+								Type:   "decl",
+								Scalar: "x",
 								Props: []Prop{
 									{
-										LineNum: 4,
-										Name:    "foo",
-										Value:   5,
+										Pos:   Pos{Line: 4},
+										Name:  "foo",
+										Value: 5,
 									},
 								},
 							},
@@ -1098,11 +1140,11 @@ var lexTests = []struct {
 		&AST{
 			Classes: []Class{
 				{
-					LineNum: 1,
+					Pos:     Pos{Line: 1},
 					Name:    "Test",
 					ArgDefs: []VariableDef{},
 					Block: Block{
-						LineNum:      1,
+						Pos:          Pos{Line: 1},
 						VariableDefs: []VariableDef{},
 						Declarations: []Declaration{},
 					},
@@ -1117,17 +1159,17 @@ var lexTests = []struct {
 		&AST{
 			Classes: []Class{
 				{
-					LineNum: 1,
-					Name:    "Test",
+					Pos:  Pos{Line: 1},
+					Name: "Test",
 					ArgDefs: []VariableDef{
 						{
-							LineNum:      1,
+							Pos:          Pos{Line: 1},
 							Val:          nil,
-							VariableName: VariableName{1, "$foo"},
+							VariableName: VariableName{Pos{Line: 1}, "$foo"},
 						},
 					},
 					Block: Block{
-						LineNum:      1,
+						Pos:          Pos{Line: 1},
 						VariableDefs: []VariableDef{},
 						Declarations: []Declaration{},
 					},
@@ -1145,22 +1187,22 @@ var lexTests = []struct {
 		&AST{
 			Classes: []Class{
 				{
-					LineNum: 1,
-					Name:    "Test",
+					Pos:  Pos{Line: 1},
+					Name: "Test",
 					ArgDefs: []VariableDef{
 						{
-							LineNum:      2,
-							VariableName: VariableName{2, "$foo"},
+							Pos:          Pos{Line: 2},
+							VariableName: VariableName{Pos{Line: 2}, "$foo"},
 							Val:          nil,
 						},
 						{
-							LineNum:      3,
-							VariableName: VariableName{3, "$bar"},
+							Pos:          Pos{Line: 3},
+							VariableName: VariableName{Pos{Line: 3}, "$bar"},
 							Val:          nil,
 						},
 					},
 					Block: Block{
-						LineNum:      4,
+						Pos:          Pos{Line: 4},
 						VariableDefs: []VariableDef{},
 						Declarations: []Declaration{},
 					},
@@ -1175,32 +1217,32 @@ var lexTests = []struct {
 		&AST{
 			Classes: []Class{
 				{
-					LineNum: 1,
-					Name:    "Test",
+					Pos:  Pos{Line: 1},
+					Name: "Test",
 					ArgDefs: []VariableDef{
 						{
-							LineNum:      1,
-							VariableName: VariableName{1, "$foo"},
+							Pos:          Pos{Line: 1},
+							VariableName: VariableName{Pos{Line: 1}, "$foo"},
 							Val:          5,
 						},
 						{
-							LineNum:      1,
-							VariableName: VariableName{1, "$bar"},
+							Pos:          Pos{Line: 1},
+							VariableName: VariableName{Pos{Line: 1}, "$bar"},
 							Val:          "x",
 						},
 						{
-							LineNum:      1,
-							VariableName: VariableName{1, "$baz"},
+							Pos:          Pos{Line: 1},
+							VariableName: VariableName{Pos{Line: 1}, "$baz"},
 							Val:          Array{1, 2},
 						},
 						{
-							LineNum:      1,
-							VariableName: VariableName{1, "$a"},
+							Pos:          Pos{Line: 1},
+							VariableName: VariableName{Pos{Line: 1}, "$a"},
 							Val:          nil,
 						},
 					},
 					Block: Block{
-						LineNum:      1,
+						Pos:          Pos{Line: 1},
 						VariableDefs: []VariableDef{},
 						Declarations: []Declaration{},
 					},
@@ -1219,17 +1261,17 @@ var lexTests = []struct {
 		&AST{
 			Classes: []Class{
 				{
-					LineNum: 3,
+					Pos:     Pos{Line: 3},
 					Name:    "Test",
 					ArgDefs: []VariableDef{},
 					Block: Block{
-						LineNum: 3,
+						Pos: Pos{Line: 3},
 						VariableDefs: []VariableDef{
 							{
-								LineNum:      4,
-								VariableName: VariableName{4, "$foo"},
+								Pos:          Pos{Line: 4},
+								VariableName: VariableName{Pos{Line: 4}, "$foo"},
 								Val: InterpolatedString{
-									LineNum:  4,
+									Pos:      Pos{Line: 4},
 									Segments: []interface{}{"string"},
 								},
 							},
@@ -1247,26 +1289,26 @@ var lexTests = []struct {
 		&AST{
 			Classes: []Class{
 				{
-					LineNum: 1,
-					Name:    "Test",
+					Pos:  Pos{Line: 1},
+					Name: "Test",
 					ArgDefs: []VariableDef{
 						{
-							LineNum:      1,
-							VariableName: VariableName{1, "$foo"},
+							Pos:          Pos{Line: 1},
+							VariableName: VariableName{Pos{Line: 1}, "$foo"},
 							Val: InterpolatedString{
-								LineNum: 1,
+								Pos: Pos{Line: 1},
 								Segments: []interface{}{
 									"/home/",
 									VariableName{
-										LineNum: 1,
-										Str:     "$bar",
+										Pos: Pos{Line: 1},
+										Str: "$bar",
 									},
 								},
 							},
 						},
 					},
 					Block: Block{
-						LineNum:      1,
+						Pos:          Pos{Line: 1},
 						VariableDefs: []VariableDef{},
 						Declarations: []Declaration{},
 					},
@@ -1283,19 +1325,19 @@ var lexTests = []struct {
 		&AST{
 			Classes: []Class{
 				{
-					LineNum: 1,
+					Pos:     Pos{Line: 1},
 					Name:    "Test",
 					ArgDefs: []VariableDef{},
 					Block: Block{
-						LineNum: 1,
+						Pos: Pos{Line: 1},
 						VariableDefs: []VariableDef{
 							{
-								LineNum:      2,
-								VariableName: VariableName{2, "$a"},
+								Pos:          Pos{Line: 2},
+								VariableName: VariableName{Pos{Line: 2}, "$a"},
 								Val: InterpolatedString{
-									LineNum: 2,
+									Pos: Pos{Line: 2},
 									Segments: []interface{}{
-										VariableName{LineNum: 2, Str: "$b"},
+										VariableName{Pos: Pos{Line: 2}, Str: "$b"},
 									},
 								},
 							},
@@ -1320,137 +1362,146 @@ var lexTests = []struct {
 			$f = "bar{baz}"
 			$g = "bar{ba$z}"
 			$h = "bar{${foo}}"
-			$i = "bar${{foo}}"
+			$i = "bar$-{foo}"
 			$j = "bar{{$foo}}"
 			$k = "cat /etc/passwd | grep -q '^$name:'"
+			$l = "awk '{print $2}' /etc/passwd"
 		}`,
 
 		&AST{
 			Classes: []Class{
 				{
-					LineNum: 3,
+					Pos:     Pos{Line: 3},
 					Name:    "T",
 					ArgDefs: []VariableDef{},
 					Block: Block{
-						LineNum: 3,
+						Pos: Pos{Line: 3},
 						VariableDefs: []VariableDef{
 							{
-								LineNum:      4,
-								VariableName: VariableName{4, "$a"},
+								Pos:          Pos{Line: 4},
+								VariableName: VariableName{Pos{Line: 4}, "$a"},
 								Val: InterpolatedString{
-									LineNum:  4,
+									Pos:      Pos{Line: 4},
 									Segments: nil,
 								},
 							},
 							{
-								LineNum:      5,
-								VariableName: VariableName{5, "$b"},
+								Pos:          Pos{Line: 5},
+								VariableName: VariableName{Pos{Line: 5}, "$b"},
 								Val: InterpolatedString{
-									LineNum: 5,
+									Pos: Pos{Line: 5},
 									Segments: []interface{}{
-										VariableName{LineNum: 5, Str: "$foo"},
-										VariableName{LineNum: 5, Str: "$bar"},
+										VariableName{Pos: Pos{Line: 5}, Str: "$foo"},
+										VariableName{Pos: Pos{Line: 5}, Str: "$bar"},
 									},
 								},
 							},
 							{
-								LineNum:      6,
-								VariableName: VariableName{6, "$c"},
+								Pos:          Pos{Line: 6},
+								VariableName: VariableName{Pos{Line: 6}, "$c"},
 								Val: InterpolatedString{
-									LineNum: 6,
+									Pos: Pos{Line: 6},
 									Segments: []interface{}{
-										VariableName{LineNum: 6, Str: "$multi"},
+										VariableName{Pos: Pos{Line: 6}, Str: "$multi"},
 										string("\n\t\t\t"),
-										VariableName{LineNum: 7, Str: "$line"},
+										VariableName{Pos: Pos{Line: 7}, Str: "$line"},
 									},
 								},
 							},
 							{
-								LineNum:      8,
-								VariableName: VariableName{8, "$d"},
+								Pos:          Pos{Line: 8},
+								VariableName: VariableName{Pos{Line: 8}, "$d"},
 								Val: InterpolatedString{
-									LineNum: 8,
+									Pos: Pos{Line: 8},
 									Segments: []interface{}{
-										VariableName{LineNum: 8, Str: "$foo"},
+										VariableName{Pos: Pos{Line: 8}, Str: "$foo"},
 										"bar",
 									},
 								},
 							},
 							{
-								LineNum:      9,
-								VariableName: VariableName{9, "$e"},
+								Pos:          Pos{Line: 9},
+								VariableName: VariableName{Pos{Line: 9}, "$e"},
 								Val: InterpolatedString{
-									LineNum: 9,
+									Pos: Pos{Line: 9},
 									Segments: []interface{}{
 										"bar",
-										VariableName{LineNum: 9, Str: "$foo"},
+										VariableName{Pos: Pos{Line: 9}, Str: "$foo"},
 									},
 								},
 							},
 							{
-								LineNum:      10,
-								VariableName: VariableName{10, "$f"},
+								Pos:          Pos{Line: 10},
+								VariableName: VariableName{Pos{Line: 10}, "$f"},
 								Val: InterpolatedString{
-									LineNum:  10,
+									Pos:      Pos{Line: 10},
 									Segments: []interface{}{"bar{baz}"},
 								},
 							},
 							{
-								LineNum:      11,
-								VariableName: VariableName{11, "$g"},
+								Pos:          Pos{Line: 11},
+								VariableName: VariableName{Pos{Line: 11}, "$g"},
 								Val: InterpolatedString{
-									LineNum: 11,
+									Pos: Pos{Line: 11},
 									Segments: []interface{}{
 										"bar{ba",
-										VariableName{LineNum: 11, Str: "$z"},
+										VariableName{Pos: Pos{Line: 11}, Str: "$z"},
 										"}",
 									},
 								},
 							},
 							{
-								LineNum:      12,
-								VariableName: VariableName{12, "$h"},
+								Pos:          Pos{Line: 12},
+								VariableName: VariableName{Pos{Line: 12}, "$h"},
 								Val: InterpolatedString{
-									LineNum: 12,
+									Pos: Pos{Line: 12},
 									Segments: []interface{}{
 										"bar{",
-										VariableName{LineNum: 12, Str: "$foo"},
+										VariableName{Pos: Pos{Line: 12}, Str: "$foo"},
 										"}",
 									},
 								},
 							},
 							{
-								LineNum:      13,
-								VariableName: VariableName{13, "$i"},
+								Pos:          Pos{Line: 13},
+								VariableName: VariableName{Pos{Line: 13}, "$i"},
 								Val: InterpolatedString{
-									LineNum:  13,
-									Segments: []interface{}{"bar", "$", "{{foo}}"},
+									Pos:      Pos{Line: 13},
+									Segments: []interface{}{"bar$-{foo}"},
 								},
 							},
 							{
-								LineNum:      14,
-								VariableName: VariableName{14, "$j"},
+								Pos:          Pos{Line: 14},
+								VariableName: VariableName{Pos{Line: 14}, "$j"},
 								Val: InterpolatedString{
-									LineNum: 14,
+									Pos: Pos{Line: 14},
 									Segments: []interface{}{
 										"bar{{",
-										VariableName{LineNum: 14, Str: "$foo"},
+										VariableName{Pos: Pos{Line: 14}, Str: "$foo"},
 										"}}",
 									},
 								},
 							},
 							{
-								LineNum:      15,
-								VariableName: VariableName{15, "$k"},
+								Pos:          Pos{Line: 15},
+								VariableName: VariableName{Pos{Line: 15}, "$k"},
 								Val: InterpolatedString{
-									LineNum: 15,
+									Pos: Pos{Line: 15},
 									Segments: []interface{}{
 										"cat /etc/passwd | grep -q '^",
-										VariableName{LineNum: 15, Str: "$name"},
+										VariableName{Pos: Pos{Line: 15}, Str: "$name"},
 										":'",
 									},
 								},
 							},
+							{
+								Pos:          Pos{Line: 16},
+								VariableName: VariableName{Pos{Line: 16}, "$l"},
+								Val: InterpolatedString{
+									Pos:      Pos{Line: 16},
+									Segments: []interface{}{"awk '{print $2}' /etc/passwd"},
+								},
+							},
 						},
 						Declarations: []Declaration{},
 					},
@@ -1469,35 +1520,33 @@ var lexTests = []struct {
 		&AST{
 			Defines: []Define{
 				{
-					LineNum: 1,
-					Name:    "t",
-					Type:    DefineTypeSingle,
+					Pos:  Pos{Line: 1},
+					Name: "t",
+					Type: DefineTypeSingle,
 					ArgDefs: []VariableDef{
 						{
-							LineNum:      1,
-							VariableName: VariableName{1, "$name"},
+							Pos:          Pos{Line: 1},
+							VariableName: VariableName{Pos{Line: 1}, "$name"},
 						},
 					},
 					Block: Block{
-						LineNum: 1,
+						Pos: Pos{Line: 1},
 						Declarations: []Declaration{
 							{
-								LineNum: 2,
-								Type:    "exec",
+								Pos:  Pos{Line: 2},
+								Type: "exec",
 								Scalar: InterpolatedString{
-									LineNum: 2,
+									Pos: Pos{Line: 2},
 									Segments: []interface{}{
-										QuotedString("'"),
-										QuotedString("$"),
-										QuotedString("'"),
+										QuotedString("'$'"),
 									},
 								},
 								Props: []Prop{
 									{
-										LineNum: 3,
-										Name:    "unless",
+										Pos:  Pos{Line: 3},
+										Name: "unless",
 										Value: InterpolatedString{
-											LineNum: 3,
+											Pos: Pos{Line: 3},
 											Segments: []interface{}{
 												QuotedString("''"),
 											},
@@ -1524,27 +1573,27 @@ var lexTests = []struct {
 		&AST{
 			Classes: []Class{
 				{
-					LineNum: 3,
+					Pos:     Pos{Line: 3},
 					Name:    "Test",
 					ArgDefs: []VariableDef{},
 					Block: Block{
-						LineNum:      3,
+						Pos:          Pos{Line: 3},
 						VariableDefs: []VariableDef{},
 						Ifs: []If{
 							{
-								LineNum: 4,
+								Pos: Pos{Line: 4},
 								Expression: Expression{
-									LineNum:   4,
+									Pos:       Pos{Line: 4},
 									Operation: "==",
 									Left:      4,
 									Right:     5,
 								},
 								Block: Block{
-									LineNum: 4,
+									Pos: Pos{Line: 4},
 									VariableDefs: []VariableDef{
 										{
-											LineNum:      5,
-											VariableName: VariableName{5, "$foo"},
+											Pos:          Pos{Line: 5},
+											VariableName: VariableName{Pos{Line: 5}, "$foo"},
 											Val:          "bar",
 										},
 									},
@@ -1572,32 +1621,32 @@ var lexTests = []struct {
 		&AST{
 			Classes: []Class{
 				{
-					LineNum: 3,
+					Pos:     Pos{Line: 3},
 					Name:    "Test",
 					ArgDefs: []VariableDef{},
 					Block: Block{
-						LineNum:      3,
+						Pos:          Pos{Line: 3},
 						VariableDefs: []VariableDef{},
 						Ifs: []If{
 							{
-								LineNum:    4,
+								Pos:        Pos{Line: 4},
 								Expression: Bool(true),
 								Block: Block{
-									LineNum: 4,
+									Pos: Pos{Line: 4},
 									VariableDefs: []VariableDef{
 										{
-											LineNum:      5,
-											VariableName: VariableName{5, "$foo"},
+											Pos:          Pos{Line: 5},
+											VariableName: VariableName{Pos{Line: 5}, "$foo"},
 											Val:          QuotedString("bar"),
 										},
 									},
 								},
 								Else: &Block{
-									LineNum: 6,
+									Pos: Pos{Line: 6},
 									VariableDefs: []VariableDef{
 										{
-											LineNum:      7,
-											VariableName: VariableName{7, "$foo"},
+											Pos:          Pos{Line: 7},
+											VariableName: VariableName{Pos{Line: 7}, "$foo"},
 											Val:          QuotedString("baz"),
 										},
 									},
@@ -1627,28 +1676,28 @@ var lexTests = []struct {
 		&AST{
 			Classes: []Class{
 				{
-					LineNum: 3,
+					Pos:     Pos{Line: 3},
 					Name:    "Test",
 					ArgDefs: []VariableDef{},
 					Block: Block{
-						LineNum:      3,
+						Pos:          Pos{Line: 3},
 						VariableDefs: []VariableDef{},
 						Ifs: []If{
 							{
-								LineNum:    4,
+								Pos:        Pos{Line: 4},
 								Expression: Bool(true),
 								Block: Block{
-									LineNum: 4,
+									Pos: Pos{Line: 4},
 									Ifs: []If{
 										{
-											LineNum:    5,
+											Pos:        Pos{Line: 5},
 											Expression: Bool(false),
 											Block: Block{
-												LineNum: 5,
+												Pos: Pos{Line: 5},
 												VariableDefs: []VariableDef{
 													{
-														LineNum:      6,
-														VariableName: VariableName{6, "$foo"},
+														Pos:          Pos{Line: 6},
+														VariableName: VariableName{Pos{Line: 6}, "$foo"},
 														Val:          QuotedString("bar"),
 													},
 												},
@@ -1657,11 +1706,11 @@ var lexTests = []struct {
 									},
 								},
 								Else: &Block{
-									LineNum: 8,
+									Pos: Pos{Line: 8},
 									VariableDefs: []VariableDef{
 										{
-											LineNum:      9,
-											VariableName: VariableName{9, "$foo"},
+											Pos:          Pos{Line: 9},
+											VariableName: VariableName{Pos{Line: 9}, "$foo"},
 											Val:          QuotedString("baz"),
 										},
 									},
@@ -1685,38 +1734,38 @@ var lexTests = []struct {
 		&AST{
 			Nodes: []Node{
 				{
-					LineNum: 1,
-					Name:    "n",
+					Pos:  Pos{Line: 1},
+					Name: "n",
 					Block: Block{
-						LineNum:      1,
+						Pos:          Pos{Line: 1},
 						VariableDefs: []VariableDef{},
 						Ifs: []If{
 							{
-								LineNum: 2,
+								Pos: Pos{Line: 2},
 								Expression: Expression{
-									LineNum:   2,
+									Pos:       Pos{Line: 2},
 									Operation: "||",
 									Left: Expression{
-										LineNum:   2,
+										Pos:       Pos{Line: 2},
 										Operation: "&&",
 										Left: Expression{
-											LineNum:   2,
+											Pos:       Pos{Line: 2},
 											Operation: "!=",
 											Left: VariableName{
-												LineNum: 2,
-												Str:     "$name",
+												Pos: Pos{Line: 2},
+												Str: "$name",
 											},
 											Right: VariableName{
-												LineNum: 2,
-												Str:     "$foo",
+												Pos: Pos{Line: 2},
+												Str: "$foo",
 											},
 										},
 										Right: Expression{
-											LineNum:   2,
+											Pos:       Pos{Line: 2},
 											Operation: "!=",
 											Left: VariableName{
-												LineNum: 2,
-												Str:     "$foo",
+												Pos: Pos{Line: 2},
+												Str: "$foo",
 											},
 											Right: QuotedString("cat"),
 										},
@@ -1724,7 +1773,7 @@ var lexTests = []struct {
 									Right: true,
 								},
 								Block: Block{
-									LineNum: 2,
+									Pos: Pos{Line: 2},
 								},
 							},
 						},
@@ -1734,183 +1783,1229 @@ var lexTests = []struct {
 			},
 		},
 	},
-}
-
-func normalizeBlock(b *Block, filename string) {
-	if b == nil {
-		return
-	}
-
-	b.Filename = filename
-
-	if b.VariableDefs == nil {
-		b.VariableDefs = []VariableDef{}
-	}
-
-	if b.Declarations == nil {
-		b.Declarations = []Declaration{}
-	}
-
-	for i, _ := range b.Declarations {
-		b.Declarations[i].Filename = filename
-	}
-
-	if b.Ifs == nil {
-		b.Ifs = []If{}
-	}
 
-	for i, _ := range b.Ifs {
-		normalizeBlock(&b.Ifs[i].Block, filename)
-		normalizeBlock(b.Ifs[i].Else, filename)
-	}
-}
-
-func TestLex(t *testing.T) {
-	for _, test := range lexTests {
-		for i, _ := range test.ast.Classes {
-			test.ast.Classes[i].Filename = "test.manifest"
-			normalizeBlock(&test.ast.Classes[i].Block, "test.manifest")
-		}
-		for i, _ := range test.ast.Defines {
-			test.ast.Defines[i].Filename = "test.manifest"
-			normalizeBlock(&test.ast.Defines[i].Block, "test.manifest")
-		}
-		for i, _ := range test.ast.Nodes {
-			test.ast.Nodes[i].Filename = "test.manifest"
-			normalizeBlock(&test.ast.Nodes[i].Block, "test.manifest")
-		}
+	{
+		`node 'n' {
+			if !$a || $b && -$c % 2 == 1 {
 
-		ast := NewAST()
-		if err := Parse(ast, "test.manifest", strings.NewReader(test.manifest)); err != nil {
-			t.Log(test.manifest)
-			t.Error(err)
-		} else {
-			if !equalsAsJson(ast, test.ast) {
-				t.Logf("%#v", test.ast)
-				t.Logf("%#v", ast)
-				js2, _ := json.MarshalIndent(test.ast, "", "  ")
-				t.Log(string(js2))
-				js, _ := json.MarshalIndent(ast, "", "  ")
-				t.Log(string(js))
-				t.Error("Expected manifest", test.manifest)
-				if ast != nil {
-					t.Log("Read manifest", ast.String())
-				}
 			}
-		}
-	}
-}
-
-var badLexTests = []struct {
-	manifest string
-}{
-	{`class`},
-	{`class foo`},
-	{`class foo {`},
-	{`class foo }`},
-	{`class bar {}}`},
-	{`foo`},
-	{`define package {}`},
-	{`define foobar package {}`},
-	{`define foobar package { $x = 5 }`},
-	{`define single multiple package {}`},
-	{`define single multiple package { $x = 5 }`},
-	{`define multiple package {}`},
-	{`define multiple package($nonamevar) {}`},
-	{`node {}`},
-	{`node badname {}`},
-}
-
-func TestBadLex(t *testing.T) {
-	for _, test := range badLexTests {
-		ast := NewAST()
-		if err := Parse(ast, "test.manifest", strings.NewReader(test.manifest)); err == nil {
-			t.Error("Bad manifest didn't fail:", test.manifest)
-		}
-	}
-}
-
-// Makes sure that a second call to yyparse() does not return the error of a
-// previous run.
-func TestParseGoodAfterBad(t *testing.T) {
-	goods := []string{
-		"",
-		"define single a(){}",
-		"class x{}",
-		"define multiple a(){}",
-		"node 'x'{}",
-	}
+		}`,
 
-	for _, good := range goods {
-		// Parse a bad grammar file
-		ast := NewAST()
-		if err := Parse(ast, "bad.ms", strings.NewReader("node{}")); err == nil {
-			t.Fatal("Bad grammar parsed")
-		}
+		&AST{
+			Nodes: []Node{
+				{
+					Pos:  Pos{Line: 1},
+					Name: "n",
+					Block: Block{
+						Pos:          Pos{Line: 1},
+						VariableDefs: []VariableDef{},
+						Ifs: []If{
+							{
+								Pos: Pos{Line: 2},
+								Expression: Expression{
+									Pos:       Pos{Line: 2},
+									Operation: "||",
+									Left: UnaryExpression{
+										Pos:       Pos{Line: 2},
+										Operation: "!",
+										Value:     VariableName{Pos{Line: 2}, "$a"},
+									},
+									Right: Expression{
+										Pos:       Pos{Line: 2},
+										Operation: "&&",
+										Left:      VariableName{Pos{Line: 2}, "$b"},
+										Right: Expression{
+											Pos:       Pos{Line: 2},
+											Operation: "==",
+											Left: Expression{
+												Pos:       Pos{Line: 2},
+												Operation: "%",
+												Left: UnaryExpression{
+													Pos:       Pos{Line: 2},
+													Operation: "-",
+													Value:     VariableName{Pos{Line: 2}, "$c"},
+												},
+												Right: 2,
+											},
+											Right: 1,
+										},
+									},
+								},
+								Block: Block{
+									Pos: Pos{Line: 2},
+								},
+							},
+						},
+						Declarations: []Declaration{},
+					},
+				},
+			},
+		},
+	},
 
-		// Now parse valid grammar and make sure we don't get an error
-		ast2 := NewAST()
-		if err := Parse(ast2, "bad.ms", strings.NewReader(good)); err != nil {
-			t.Log(good)
-			t.Error("Got error when parsing good grammar:", err)
-		}
-	}
-}
+	{
+		`
+		// elsif and case
+		node 'n' {
+			if $a {
+			} elsif $b {
+				$x = 1 /2/ 3
+			} elsif $c {
+			} else {
+			}
 
-func TestParseMultipleFiles(t *testing.T) {
-	testMs := `
-		node 'n' { 
-			class { 'A': }
-		}`
-	test2Ms := `
-		class A { 
-			exec { 'ls': }
-		}`
+			case $os {
+				'debian', /^ubuntu|mint\//: {}
+				default: {}
+			}
+		}`,
 
-	ast := NewAST()
-	expectedAst := &AST{
-		Nodes: []Node{
-			{
-				Filename: "test.ms",
-				LineNum:  2,
-				Name:     "n",
-				Block: Block{
-					LineNum:      2,
-					Filename:     "test.ms",
-					VariableDefs: []VariableDef{},
-					Declarations: []Declaration{
-						{
-							Filename: "test.ms",
-							LineNum:  3,
-							Type:     "class",
-							Scalar:   QuotedString("A"),
-							Props:    []Prop{},
+		&AST{
+			Nodes: []Node{
+				{
+					Pos:  Pos{Line: 3},
+					Name: "n",
+					Block: Block{
+						Pos:          Pos{Line: 3},
+						VariableDefs: []VariableDef{},
+						Ifs: []If{
+							{
+								Pos:        Pos{Line: 4},
+								Expression: VariableName{Pos{Line: 4}, "$a"},
+								Block:      Block{Pos: Pos{Line: 4}},
+								ElseIfs: []ElseIf{
+									{
+										Pos:        Pos{Line: 5},
+										Expression: VariableName{Pos{Line: 5}, "$b"},
+										Block: Block{
+											Pos: Pos{Line: 5},
+											VariableDefs: []VariableDef{
+												{
+													Pos:          Pos{Line: 6},
+													VariableName: VariableName{Pos{Line: 6}, "$x"},
+													Val: Expression{
+														Pos:       Pos{Line: 6},
+														Operation: "/",
+														Left: Expression{
+															Pos:       Pos{Line: 6},
+															Operation: "/",
+															Left:      1,
+															Right:     2,
+														},
+														Right: 3,
+													},
+												},
+											},
+										},
+									},
+									{
+										Pos:        Pos{Line: 7},
+										Expression: VariableName{Pos{Line: 7}, "$c"},
+										Block:      Block{Pos: Pos{Line: 7}},
+									},
+								},
+								Else: &Block{Pos: Pos{Line: 8}},
+							},
+						},
+						Cases: []Case{
+							{
+								Pos:   Pos{Line: 11},
+								Value: VariableName{Pos{Line: 11}, "$os"},
+								Branches: []CaseBranch{
+									{
+										Pos: Pos{Line: 12},
+										Matches: []Value{
+											QuotedString("debian"),
+											Regex("^ubuntu|mint/"),
+										},
+										Block: Block{Pos: Pos{Line: 12}},
+									},
+								},
+								Default: &Block{Pos: Pos{Line: 13}},
+							},
 						},
+						Declarations: []Declaration{},
 					},
-					Ifs: []If{},
 				},
 			},
 		},
-		Classes: []Class{
-			{
-				Filename: "test2.ms",
-				LineNum:  2,
-				Name:     "A",
-				ArgDefs:  []VariableDef{},
-				Block: Block{
-					LineNum:      2,
-					Filename:     "test2.ms",
-					VariableDefs: []VariableDef{},
-					Declarations: []Declaration{
-						{
-							Filename: "test2.ms",
-							LineNum:  3,
-							Type:     "exec",
-							Scalar:   QuotedString("ls"),
-							Props:    []Prop{},
+	},
+
+	{
+		`
+		// Selectors
+		class Test {
+			$pkg = $os ? {
+				'debian' => 'apache2',
+				default => 'httpd',
+			}
+			$size = $cores > 4 ? { true => 'big' }
+		}`,
+
+		&AST{
+			Classes: []Class{
+				{
+					Pos:     Pos{Line: 3},
+					Name:    "Test",
+					ArgDefs: []VariableDef{},
+					Block: Block{
+						Pos: Pos{Line: 3},
+						VariableDefs: []VariableDef{
+							{
+								Pos:          Pos{Line: 4},
+								VariableName: VariableName{Pos{Line: 4}, "$pkg"},
+								Val: Selector{
+									Pos:   Pos{Line: 4},
+									Value: VariableName{Pos{Line: 4}, "$os"},
+									Cases: []SelectorCase{
+										{
+											Pos:   Pos{Line: 5},
+											Match: QuotedString("debian"),
+											Val:   QuotedString("apache2"),
+										},
+									},
+									Default: QuotedString("httpd"),
+								},
+							},
+							{
+								Pos:          Pos{Line: 8},
+								VariableName: VariableName{Pos{Line: 8}, "$size"},
+								Val: Selector{
+									Pos: Pos{Line: 8},
+									Value: Expression{
+										Pos:       Pos{Line: 8},
+										Operation: ">",
+										Left:      VariableName{Pos{Line: 8}, "$cores"},
+										Right:     4,
+									},
+									Cases: []SelectorCase{
+										{
+											Pos:   Pos{Line: 8},
+											Match: true,
+											Val:   QuotedString("big"),
+										},
+									},
+								},
+							},
 						},
+						Declarations: []Declaration{},
 					},
-					Ifs: []If{},
+				},
+			},
+		},
+	},
+
+	{
+		`
+		// Hashes
+		class Test($vhost = { 'port' => 80, 'ssl' => true },) {
+			$users = {
+				'joe' => { 'uid' => 1000, },
+				'empty' => {},
+			}
+			$uid = $users['joe']['uid']
+			user { 'joe':
+				opts => { 'shell' => '/bin/sh', 'home' => "/home/$name" },
+			}
+		}`,
+
+		&AST{
+			Classes: []Class{
+				{
+					Pos:  Pos{Line: 3},
+					Name: "Test",
+					ArgDefs: []VariableDef{
+						{
+							Pos:          Pos{Line: 3},
+							VariableName: VariableName{Pos{Line: 3}, "$vhost"},
+							Val: Hash{
+								{Pos{Line: 3}, QuotedString("port"), 80},
+								{Pos{Line: 3}, QuotedString("ssl"), Bool(true)},
+							},
+						},
+					},
+					Block: Block{
+						Pos: Pos{Line: 3},
+						VariableDefs: []VariableDef{
+							{
+								Pos:          Pos{Line: 4},
+								VariableName: VariableName{Pos{Line: 4}, "$users"},
+								Val: Hash{
+									{
+										Pos{Line: 5},
+										QuotedString("joe"),
+										Hash{{Pos{Line: 5}, QuotedString("uid"), 1000}},
+									},
+									{Pos{Line: 6}, QuotedString("empty"), Hash{}},
+								},
+							},
+							{
+								Pos:          Pos{Line: 8},
+								VariableName: VariableName{Pos{Line: 8}, "$uid"},
+								Val: Index{
+									Pos: Pos{Line: 8},
+									Value: Index{
+										Pos:   Pos{Line: 8},
+										Value: VariableName{Pos{Line: 8}, "$users"},
+										Key:   QuotedString("joe"),
+									},
+									Key: QuotedString("uid"),
+								},
+							},
+						},
+						Declarations: []Declaration{
+							{
+								Pos:    Pos{Line: 9},
+								Type:   "user",
+								Scalar: QuotedString("joe"),
+								Props: []Prop{
+									{
+										Pos:  Pos{Line: 10},
+										Name: "opts",
+										Value: Hash{
+											{Pos{Line: 10}, QuotedString("shell"), QuotedString("/bin/sh")},
+											{
+												Pos{Line: 10},
+												QuotedString("home"),
+												InterpolatedString{
+													Pos: Pos{Line: 10},
+													Segments: []interface{}{
+														"/home/",
+														VariableName{Pos{Line: 10}, "$name"},
+													},
+												},
+											},
+										},
+									},
+								},
+							},
+						},
+					},
+				},
+			},
+		},
+	},
+
+	{
+		`
+		// Function calls
+		class Test {
+			$str = implode($names, ' ')
+			$none = now()
+			$nested = md5sum(trim($content),) + len([ 1, ])
+		}`,
+
+		&AST{
+			Classes: []Class{
+				{
+					Pos:     Pos{Line: 3},
+					Name:    "Test",
+					ArgDefs: []VariableDef{},
+					Block: Block{
+						Pos: Pos{Line: 3},
+						VariableDefs: []VariableDef{
+							{
+								Pos:          Pos{Line: 4},
+								VariableName: VariableName{Pos{Line: 4}, "$str"},
+								Val: FunctionCall{
+									Pos:  Pos{Line: 4},
+									Name: "implode",
+									Args: []interface{}{
+										VariableName{Pos{Line: 4}, "$names"},
+										QuotedString(" "),
+									},
+								},
+							},
+							{
+								Pos:          Pos{Line: 5},
+								VariableName: VariableName{Pos{Line: 5}, "$none"},
+								Val: FunctionCall{
+									Pos:  Pos{Line: 5},
+									Name: "now",
+									Args: []interface{}{},
+								},
+							},
+							{
+								Pos:          Pos{Line: 6},
+								VariableName: VariableName{Pos{Line: 6}, "$nested"},
+								Val: Expression{
+									Pos:       Pos{Line: 6},
+									Operation: "+",
+									Left: FunctionCall{
+										Pos:  Pos{Line: 6},
+										Name: "md5sum",
+										Args: []interface{}{
+											FunctionCall{
+												Pos:  Pos{Line: 6},
+												Name: "trim",
+												Args: []interface{}{
+													VariableName{Pos{Line: 6}, "$content"},
+												},
+											},
+										},
+									},
+									Right: FunctionCall{
+										Pos:  Pos{Line: 6},
+										Name: "len",
+										Args: []interface{}{Array{1}},
+									},
+								},
+							},
+						},
+						Declarations: []Declaration{},
+					},
+				},
+			},
+		},
+	},
+	{
+		`
+		// Probes
+		class Test {
+			$installed = exec { "dpkg -l | grep $name": }
+			$md5 = exec { 'md5sum': stdin => $content, timeout => 0.5, }
+		}`,
+
+		&AST{
+			Classes: []Class{
+				{
+					Pos:     Pos{Line: 3},
+					Name:    "Test",
+					ArgDefs: []VariableDef{},
+					Block: Block{
+						Pos: Pos{Line: 3},
+						VariableDefs: []VariableDef{
+							{
+								Pos:          Pos{Line: 4},
+								VariableName: VariableName{Pos{Line: 4}, "$installed"},
+								Val: Probe{
+									Pos: Pos{Line: 4},
+									Command: InterpolatedString{
+										Pos: Pos{Line: 4},
+										Segments: []interface{}{
+											"dpkg -l | grep ",
+											VariableName{Pos{Line: 4}, "$name"},
+										},
+									},
+									Props: []Prop{},
+								},
+							},
+							{
+								Pos:          Pos{Line: 5},
+								VariableName: VariableName{Pos{Line: 5}, "$md5"},
+								Val: Probe{
+									Pos:     Pos{Line: 5},
+									Command: QuotedString("md5sum"),
+									Props: []Prop{
+										{
+											Pos:   Pos{Line: 5},
+											Name:  "stdin",
+											Value: VariableName{Pos{Line: 5}, "$content"},
+										},
+										{
+											Pos:   Pos{Line: 5},
+											Name:  "timeout",
+											Value: Float(0.5),
+										},
+									},
+								},
+							},
+						},
+						Declarations: []Declaration{},
+					},
+				},
+			},
+		},
+	},
+
+	{
+		`
+		// Functions
+		func vhost_path($name, $dir = '/etc/nginx',) {
+			$file = "$name.conf"
+			if $name == '' {
+				return false
+			}
+			return "$dir/$file"
+		}
+
+		func now() {}`,
+
+		&AST{
+			Funcs: []Func{
+				{
+					Pos:  Pos{Line: 3},
+					Name: "vhost_path",
+					ArgDefs: []VariableDef{
+						{
+							Pos:          Pos{Line: 3},
+							VariableName: VariableName{Pos{Line: 3}, "$name"},
+						},
+						{
+							Pos:          Pos{Line: 3},
+							VariableName: VariableName{Pos{Line: 3}, "$dir"},
+							Val:          QuotedString("/etc/nginx"),
+						},
+					},
+					Block: Block{
+						Pos: Pos{Line: 3},
+						VariableDefs: []VariableDef{
+							{
+								Pos:          Pos{Line: 4},
+								VariableName: VariableName{Pos{Line: 4}, "$file"},
+								Val: InterpolatedString{
+									Pos: Pos{Line: 4},
+									Segments: []interface{}{
+										VariableName{Pos{Line: 4}, "$name"},
+										".conf",
+									},
+								},
+							},
+						},
+						Ifs: []If{
+							{
+								Pos: Pos{Line: 5},
+								Expression: Expression{
+									Pos:       Pos{Line: 5},
+									Operation: "==",
+									Left:      VariableName{Pos{Line: 5}, "$name"},
+									Right:     QuotedString(""),
+								},
+								Block: Block{
+									Pos: Pos{Line: 5},
+									Return: &Return{
+										Pos:   Pos{Line: 6},
+										Value: Bool(false),
+									},
+								},
+							},
+						},
+						Return: &Return{
+							Pos: Pos{Line: 8},
+							Value: InterpolatedString{
+								Pos: Pos{Line: 8},
+								Segments: []interface{}{
+									VariableName{Pos{Line: 8}, "$dir"},
+									"/",
+									VariableName{Pos{Line: 8}, "$file"},
+								},
+							},
+						},
+					},
+				},
+				{
+					Pos:     Pos{Line: 11},
+					Name:    "now",
+					ArgDefs: []VariableDef{},
+					Block:   Block{Pos: Pos{Line: 11}},
+				},
+			},
+		},
+	},
+
+	{
+		`
+		// Heredocs
+		class Heredocs {
+			$conf = <<EOT
+				server {
+					server_name $name;
+				}
+
+				EOT$name
+			EOT
+			$raw = <<'RAW'
+			  cost: $5
+			    RAW!
+			  RAW
+			$list = [ <<EOT
+			EOT, ]
+		}`,
+
+		&AST{
+			Classes: []Class{
+				{
+					Pos:     Pos{Line: 3},
+					Name:    "Heredocs",
+					ArgDefs: []VariableDef{},
+					Block: Block{
+						Pos: Pos{Line: 3},
+						VariableDefs: []VariableDef{
+							{
+								Pos:          Pos{Line: 4},
+								VariableName: VariableName{Pos{Line: 4}, "$conf"},
+								Val: InterpolatedString{
+									Pos: Pos{Line: 4},
+									Segments: []interface{}{
+										"server {\n\tserver_name ",
+										VariableName{Pos{Line: 6}, "$name"},
+										";\n}\n\nEOT",
+										VariableName{Pos{Line: 9}, "$name"},
+										"\n",
+									},
+								},
+							},
+							{
+								Pos:          Pos{Line: 11},
+								VariableName: VariableName{Pos{Line: 11}, "$raw"},
+								Val:          QuotedString("cost: $5\n  RAW!\n"),
+							},
+							{
+								Pos:          Pos{Line: 15},
+								VariableName: VariableName{Pos{Line: 15}, "$list"},
+								Val:          Array{InterpolatedString{Pos: Pos{Line: 15}}},
+							},
+						},
+					},
+				},
+			},
+		},
+	},
+
+	{
+		`
+		// Escapes
+		class Escapes {
+			$single = 'it\'s a \\ and a \d'
+			$double = "tab\tquote\" \$HOME ${user}_x \\"
+		}`,
+
+		&AST{
+			Classes: []Class{
+				{
+					Pos:     Pos{Line: 3},
+					Name:    "Escapes",
+					ArgDefs: []VariableDef{},
+					Block: Block{
+						Pos: Pos{Line: 3},
+						VariableDefs: []VariableDef{
+							{
+								Pos:          Pos{Line: 4},
+								VariableName: VariableName{Pos{Line: 4}, "$single"},
+								Val:          QuotedString(`it's a \ and a \d`),
+							},
+							{
+								Pos:          Pos{Line: 5},
+								VariableName: VariableName{Pos{Line: 5}, "$double"},
+								Val: InterpolatedString{
+									Pos: Pos{Line: 5},
+									Segments: []interface{}{
+										"tab\tquote\" $HOME ",
+										VariableName{Pos{Line: 5}, "$user"},
+										"_x \\",
+									},
+								},
+							},
+						},
+					},
+				},
+			},
+		},
+	},
+
+	{
+		`
+		// Interpolated expressions
+		class Exprs {
+			$a = "port ${ $port + 1 }!"
+			$b = "${ upcase($h['x'], "${ { 'y' => 1 } }") }"
+		}`,
+
+		&AST{
+			Classes: []Class{
+				{
+					Pos:     Pos{Line: 3},
+					Name:    "Exprs",
+					ArgDefs: []VariableDef{},
+					Block: Block{
+						Pos: Pos{Line: 3},
+						VariableDefs: []VariableDef{
+							{
+								Pos:          Pos{Line: 4},
+								VariableName: VariableName{Pos{Line: 4}, "$a"},
+								Val: InterpolatedString{
+									Pos: Pos{Line: 4},
+									Segments: []interface{}{
+										"port ",
+										Expression{
+											Pos:       Pos{Line: 4},
+											Operation: "+",
+											Left:      VariableName{Pos{Line: 4}, "$port"},
+											Right:     1,
+										},
+										"!",
+									},
+								},
+							},
+							{
+								Pos:          Pos{Line: 5},
+								VariableName: VariableName{Pos{Line: 5}, "$b"},
+								Val: InterpolatedString{
+									Pos: Pos{Line: 5},
+									Segments: []interface{}{
+										FunctionCall{
+											Pos:  Pos{Line: 5},
+											Name: "upcase",
+											Args: []interface{}{
+												Index{
+													Pos:   Pos{Line: 5},
+													Value: VariableName{Pos{Line: 5}, "$h"},
+													Key:   QuotedString("x"),
+												},
+												InterpolatedString{
+													Pos: Pos{Line: 5},
+													Segments: []interface{}{
+														Hash{
+															{
+																Pos: Pos{Line: 5},
+																Key: QuotedString("y"),
+																Val: 1,
+															},
+														},
+													},
+												},
+											},
+										},
+									},
+								},
+							},
+						},
+					},
+				},
+			},
+		},
+	},
+
+	{
+		`
+		// Array indexes, slices and membership
+		class Arrays {
+			$a = $ports[-1]
+			$b = $ports[1:$n]
+			$c = $h['ports'][:2]
+			$d = 'a' in $names
+		}`,
+
+		&AST{
+			Classes: []Class{
+				{
+					Pos:     Pos{Line: 3},
+					Name:    "Arrays",
+					ArgDefs: []VariableDef{},
+					Block: Block{
+						Pos: Pos{Line: 3},
+						VariableDefs: []VariableDef{
+							{
+								Pos:          Pos{Line: 4},
+								VariableName: VariableName{Pos{Line: 4}, "$a"},
+								Val: Index{
+									Pos:   Pos{Line: 4},
+									Value: VariableName{Pos{Line: 4}, "$ports"},
+									Key: UnaryExpression{
+										Pos:       Pos{Line: 4},
+										Operation: "-",
+										Value:     1,
+									},
+								},
+							},
+							{
+								Pos:          Pos{Line: 5},
+								VariableName: VariableName{Pos{Line: 5}, "$b"},
+								Val: Slice{
+									Pos:   Pos{Line: 5},
+									Value: VariableName{Pos{Line: 5}, "$ports"},
+									From:  1,
+									To:    VariableName{Pos{Line: 5}, "$n"},
+								},
+							},
+							{
+								Pos:          Pos{Line: 6},
+								VariableName: VariableName{Pos{Line: 6}, "$c"},
+								Val: Slice{
+									Pos: Pos{Line: 6},
+									Value: Index{
+										Pos:   Pos{Line: 6},
+										Value: VariableName{Pos{Line: 6}, "$h"},
+										Key:   QuotedString("ports"),
+									},
+									To: 2,
+								},
+							},
+							{
+								Pos:          Pos{Line: 7},
+								VariableName: VariableName{Pos{Line: 7}, "$d"},
+								Val: Expression{
+									Pos:       Pos{Line: 7},
+									Operation: "in",
+									Left:      QuotedString("a"),
+									Right:     VariableName{Pos{Line: 7}, "$names"},
+								},
+							},
+						},
+					},
+				},
+			},
+		},
+	},
+
+	{
+		`
+		// Regex matches
+		class Matches {
+			$a = $host =~ /^web(\d+)$/
+			$b = $host !~ 'db'
+			$c = "node ${1}"
+		}`,
+
+		&AST{
+			Classes: []Class{
+				{
+					Pos:     Pos{Line: 3},
+					Name:    "Matches",
+					ArgDefs: []VariableDef{},
+					Block: Block{
+						Pos: Pos{Line: 3},
+						VariableDefs: []VariableDef{
+							{
+								Pos:          Pos{Line: 4},
+								VariableName: VariableName{Pos{Line: 4}, "$a"},
+								Val: Expression{
+									Pos:       Pos{Line: 4},
+									Operation: "=~",
+									Left:      VariableName{Pos{Line: 4}, "$host"},
+									Right:     Regex(`^web(\d+)$`),
+								},
+							},
+							{
+								Pos:          Pos{Line: 5},
+								VariableName: VariableName{Pos{Line: 5}, "$b"},
+								Val: Expression{
+									Pos:       Pos{Line: 5},
+									Operation: "!~",
+									Left:      VariableName{Pos{Line: 5}, "$host"},
+									Right:     QuotedString("db"),
+								},
+							},
+							{
+								Pos:          Pos{Line: 6},
+								VariableName: VariableName{Pos{Line: 6}, "$c"},
+								Val: InterpolatedString{
+									Pos: Pos{Line: 6},
+									Segments: []interface{}{
+										"node ",
+										VariableName{Pos{Line: 6}, "$1"},
+									},
+								},
+							},
+						},
+					},
+				},
+			},
+		},
+	},
+
+	{
+		`
+		// For loops
+		class Loops {
+			for $u in $users {
+				user { $u['name']: shell => $u['shell'], }
+			}
+			for $i, $port in [ 80, 443, ] {}
+		}`,
+
+		&AST{
+			Classes: []Class{
+				{
+					Pos:     Pos{Line: 3},
+					Name:    "Loops",
+					ArgDefs: []VariableDef{},
+					Block: Block{
+						Pos: Pos{Line: 3},
+						Fors: []For{
+							{
+								Pos:        Pos{Line: 4},
+								Value:      VariableName{Pos{Line: 4}, "$u"},
+								Collection: VariableName{Pos{Line: 4}, "$users"},
+								Block: Block{
+									Pos: Pos{Line: 4},
+									Declarations: []Declaration{
+										{
+											Pos:  Pos{Line: 5},
+											Type: "user",
+											Scalar: Index{
+												Pos:   Pos{Line: 5},
+												Value: VariableName{Pos{Line: 5}, "$u"},
+												Key:   QuotedString("name"),
+											},
+											Props: []Prop{
+												{
+													Pos:  Pos{Line: 5},
+													Name: "shell",
+													Value: Index{
+														Pos:   Pos{Line: 5},
+														Value: VariableName{Pos{Line: 5}, "$u"},
+														Key:   QuotedString("shell"),
+													},
+												},
+											},
+										},
+									},
+								},
+							},
+							{
+								Pos:        Pos{Line: 7},
+								Key:        &VariableName{Pos{Line: 7}, "$i"},
+								Value:      VariableName{Pos{Line: 7}, "$port"},
+								Collection: Array{80, 443},
+								Block:      Block{Pos: Pos{Line: 7}},
+							},
+						},
+					},
+				},
+			},
+		},
+	},
+
+	{
+		`
+		// Imports and includes
+		import 'lib/users.ms'
+		class Web {
+			include Nginx
+		}`,
+
+		&AST{
+			Imports: []Import{
+				{Pos: Pos{Line: 3}, Path: "lib/users.ms", Written: "lib/users.ms"},
+			},
+			Classes: []Class{
+				{
+					Pos:     Pos{Line: 4},
+					Name:    "Web",
+					ArgDefs: []VariableDef{},
+					Block: Block{
+						Pos: Pos{Line: 4},
+						Includes: []Include{
+							{Pos: Pos{Line: 5}, Class: "Nginx"},
+						},
+					},
+				},
+			},
+		},
+	},
+
+	{
+		`
+		// Namespaced names
+		class nginx::site {
+			include nginx
+			nginx::vhost { 'example.com': root => nginx::docroot('example.com'), }
+		}`,
+
+		&AST{
+			Classes: []Class{
+				{
+					Pos:     Pos{Line: 3},
+					Name:    "nginx::site",
+					ArgDefs: []VariableDef{},
+					Block: Block{
+						Pos: Pos{Line: 3},
+						Declarations: []Declaration{
+							{
+								Pos:    Pos{Line: 5},
+								Type:   "nginx::vhost",
+								Scalar: QuotedString("example.com"),
+								Props: []Prop{
+									{
+										Pos:  Pos{Line: 5},
+										Name: "root",
+										Value: FunctionCall{
+											Pos:  Pos{Line: 5},
+											Name: "nginx::docroot",
+											Args: []interface{}{
+												QuotedString("example.com"),
+											},
+										},
+									},
+								},
+							},
+						},
+						Includes: []Include{
+							{Pos: Pos{Line: 4}, Class: "nginx"},
+						},
+					},
+				},
+			},
+		},
+	},
+
+	{
+		`
+		// Facters
+		facter multiple package($names,) {
+			return [ 'a', ]
+		}`,
+
+		&AST{
+			Facters: []Facter{
+				{
+					Pos:  Pos{Line: 3},
+					Name: "package",
+					Type: DefineTypeMultiple,
+					ArgDefs: []VariableDef{
+						{
+							Pos:          Pos{Line: 3},
+							VariableName: VariableName{Pos{Line: 3}, "$names"},
+						},
+					},
+					Block: Block{
+						Pos: Pos{Line: 3},
+						Return: &Return{
+							Pos:   Pos{Line: 4},
+							Value: Array{QuotedString("a")},
+						},
+					},
+				},
+			},
+		},
+	},
+}
+
+func normalizeBlock(b *Block) {
+	if b == nil {
+		return
+	}
+
+	if b.VariableDefs == nil {
+		b.VariableDefs = []VariableDef{}
+	}
+
+	if b.Declarations == nil {
+		b.Declarations = []Declaration{}
+	}
+
+	if b.Ifs == nil {
+		b.Ifs = []If{}
+	}
+
+	for i, _ := range b.Ifs {
+		normalizeBlock(&b.Ifs[i].Block)
+		for j, _ := range b.Ifs[i].ElseIfs {
+			normalizeBlock(&b.Ifs[i].ElseIfs[j].Block)
+		}
+		normalizeBlock(b.Ifs[i].Else)
+	}
+
+	for i, _ := range b.Cases {
+		for j, _ := range b.Cases[i].Branches {
+			normalizeBlock(&b.Cases[i].Branches[j].Block)
+		}
+		normalizeBlock(b.Cases[i].Default)
+	}
+
+	for i := range b.Fors {
+		normalizeBlock(&b.Fors[i].Block)
+	}
+}
+
+func TestLex(t *testing.T) {
+	for _, test := range lexTests {
+		for i, _ := range test.ast.Classes {
+			normalizeBlock(&test.ast.Classes[i].Block)
+		}
+		for i, _ := range test.ast.Defines {
+			normalizeBlock(&test.ast.Defines[i].Block)
+		}
+		for i, _ := range test.ast.Nodes {
+			normalizeBlock(&test.ast.Nodes[i].Block)
+		}
+		for i, _ := range test.ast.Funcs {
+			normalizeBlock(&test.ast.Funcs[i].Block)
+		}
+		for i, _ := range test.ast.Facters {
+			normalizeBlock(&test.ast.Facters[i].Block)
+		}
+
+		ast := NewAST()
+		if err := Parse(ast, "test.manifest", strings.NewReader(test.manifest)); err != nil {
+			t.Log(test.manifest)
+			t.Error(err)
+		} else {
+			if !astEquals(ast, test.ast, "test.manifest") {
+				t.Logf("%#v", test.ast)
+				t.Logf("%#v", ast)
+				js2, _ := json.MarshalIndent(test.ast, "", "  ")
+				t.Log(string(js2))
+				js, _ := json.MarshalIndent(ast, "", "  ")
+				t.Log(string(js))
+				t.Error("Expected manifest", test.manifest)
+				if ast != nil {
+					t.Log("Read manifest", ast.String())
+				}
+			}
+		}
+	}
+}
+
+var badLexTests = []struct {
+	manifest string
+}{
+	{`class`},
+	{`class foo`},
+	{`class foo {`},
+	{`class foo }`},
+	{`class bar {}}`},
+	{`foo`},
+	{`define package {}`},
+	{`define foobar package {}`},
+	{`define foobar package { $x = 5 }`},
+	{`define single multiple package {}`},
+	{`define single multiple package { $x = 5 }`},
+	{`define multiple package {}`},
+	{`define multiple package($nonamevar) {}`},
+	{`node {}`},
+	{`node badname {}`},
+	{`facter package($name,) {}`},
+	{`facter single package {}`},
+	{`class C { $x = package { 'nginx': } }`},
+	{`class C { $x = +5 }`},
+	{`class C { $x = 5 ! 3 }`},
+	{`class C { $x = /(/ }`},
+	{`class C { case $x { default: {} default: {} } }`},
+	{`class C { case $x { } }`},
+	{`class C { elsif true {} }`},
+	{`class C { $x = $a ? {} }`},
+	{`class C { $x = $a ? { default => 1, default => 2 } }`},
+	{"class C { $x = <<EOT\n foo\n }"},
+	{"class C { $x = <<EOT foo\nEOT\n }"},
+	{"class C { $x = <<'EOT'\n foo\n EOT2\n }"},
+	{`class C { $x = 'foo\' }`},
+	{`class C { $x = "foo\" }`},
+	{`class C { $x = "\d" }`},
+	{`class C { $x = "${ }" }`},
+	{`class C { $x = "${ $a " }`},
+	{`class C { $x = "${ $a $b }" }`},
+}
+
+func TestBadLex(t *testing.T) {
+	for _, test := range badLexTests {
+		ast := NewAST()
+		if err := Parse(ast, "test.manifest", strings.NewReader(test.manifest)); err == nil {
+			t.Error("Bad manifest didn't fail:", test.manifest)
+		}
+	}
+}
+
+// Makes sure that printing a string gives source which parses back to the same
+// string.
+func TestStringRoundTrip(t *testing.T) {
+	strs := []string{
+		`'plain'`,
+		`'it\'s \\ \d'`,
+		`"tab\t\"quoted\" \$5 \\"`,
+		`"${name}_suffix $name-$name"`,
+		`"${1}st \$2 $0"`,
+		`"${ $a + 1 }${ 'x' }${ "$y" }"`,
+		"\"multi\nline\"",
+	}
+
+	parse := func(str string) Value {
+		ast := NewAST()
+		manifest := "class C { $x = " + str + " }"
+		if err := Parse(ast, "t.ms", strings.NewReader(manifest)); err != nil {
+			t.Fatal(manifest, err)
+		}
+		return ast.Classes[0].Block.VariableDefs[0].Val
+	}
+
+	for _, str := range strs {
+		val := parse(str)
+		if l, isLiteral := val.(Literal); isLiteral {
+			val = l.Val
+		}
+		printed := val.(fmt.Stringer).String()
+		if reparsed := parse(printed); !ValueEquals(val, reparsed) {
+			t.Errorf("%s printed as %s, which parses as %#v", str, printed, reparsed)
+		}
+	}
+}
+
+// Makes sure that a second call to yyparse() does not return the error of a
+// previous run.
+func TestParseGoodAfterBad(t *testing.T) {
+	goods := []string{
+		"",
+		"define single a(){}",
+		"class x{}",
+		"define multiple a(){}",
+		"node 'x'{}",
+	}
+
+	for _, good := range goods {
+		// Parse a bad grammar file
+		ast := NewAST()
+		if err := Parse(ast, "bad.ms", strings.NewReader("node{}")); err == nil {
+			t.Fatal("Bad grammar parsed")
+		}
+
+		// Now parse valid grammar and make sure we don't get an error
+		ast2 := NewAST()
+		if err := Parse(ast2, "bad.ms", strings.NewReader(good)); err != nil {
+			t.Log(good)
+			t.Error("Got error when parsing good grammar:", err)
+		}
+	}
+}
+
+func TestParseMultipleFiles(t *testing.T) {
+	testMs := `
+		node 'n' { 
+			class { 'A': }
+		}`
+	test2Ms := `
+		class A { 
+			exec { 'ls': }
+		}`
+
+	ast := NewAST()
+	expectedAst := &AST{
+		Nodes: []Node{
+			{
+				Pos:  Pos{File: "test.ms", Line: 2},
+				Name: "n",
+				Block: Block{
+					Pos:          Pos{File: "test.ms", Line: 2},
+					VariableDefs: []VariableDef{},
+					Declarations: []Declaration{
+						{
+							Pos:    Pos{File: "test.ms", Line: 3},
+							Type:   "class",
+							Scalar: QuotedString("A"),
+							Props:  []Prop{},
+						},
+					},
+					Ifs: []If{},
+				},
+			},
+		},
+		Classes: []Class{
+			{
+				Pos:     Pos{File: "test2.ms", Line: 2},
+				Name:    "A",
+				ArgDefs: []VariableDef{},
+				Block: Block{
+					Pos:          Pos{File: "test2.ms", Line: 2},
+					VariableDefs: []VariableDef{},
+					Declarations: []Declaration{
+						{
+							Pos:    Pos{File: "test2.ms", Line: 3},
+							Type:   "exec",
+							Scalar: QuotedString("ls"),
+							Props:  []Prop{},
+						},
+					},
+					Ifs: []If{},
 				},
 			},
 		},
@@ -1925,7 +3020,7 @@ func TestParseMultipleFiles(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	if !equalsAsJson(ast, expectedAst) {
+	if !astEquals(ast, expectedAst, "") {
 		t.Logf("%#v", expectedAst)
 		t.Logf("%#v", ast)
 		js2, _ := json.MarshalIndent(expectedAst, "", "  ")
@@ -1936,6 +3031,418 @@ func TestParseMultipleFiles(t *testing.T) {
 	}
 }
 
+func TestParsePositions(t *testing.T) {
+	manifest := `class A($x = 5,) {
+	$y = "a$x b"
+	if $x > 2 {
+		exec { 'foo':
+			unless => true,
+			depends => file['bar'],
+		}
+	}
+}`
+
+	ast := NewAST()
+	if err := Parse(ast, "pos.ms", strings.NewReader(manifest)); err != nil {
+		t.Fatal(err)
+	}
+
+	pos := func(line, col int) Pos { return Pos{"pos.ms", line, col} }
+
+	class := ast.Classes[0]
+	varDef := class.Block.VariableDefs[0]
+	ipStr := varDef.Val.(InterpolatedString)
+	_if := class.Block.Ifs[0]
+	exp := _if.Expression.(Expression)
+	decl := _if.Block.Declarations[0]
+	ref := decl.Props[1].Value.(Reference)
+
+	positions := []struct {
+		name          string
+		pos, expected Pos
+	}{
+		{"class", class.Pos, pos(1, 1)},
+		{"arg def", class.ArgDefs[0].Pos, pos(1, 9)},
+		{"arg def value", class.ArgDefs[0].Val.(Literal).Pos, pos(1, 14)},
+		{"block", class.Block.Pos, pos(1, 18)},
+		{"variable def", varDef.Pos, pos(2, 2)},
+		{"interpolated string", ipStr.Pos, pos(2, 7)},
+		{"string segment", ipStr.Segments[0].(Literal).Pos, pos(2, 8)},
+		{"variable segment", ipStr.Segments[1].(VariableName).Pos, pos(2, 9)},
+		{"second string segment", ipStr.Segments[2].(Literal).Pos, pos(2, 11)},
+		{"if", _if.Pos, pos(3, 2)},
+		{"expression", exp.Pos, pos(3, 5)},
+		{"variable name", exp.Left.(VariableName).Pos, pos(3, 5)},
+		{"int", exp.Right.(Literal).Pos, pos(3, 10)},
+		{"declaration", decl.Pos, pos(4, 3)},
+		{"quoted string", decl.Scalar.(Literal).Pos, pos(4, 10)},
+		{"prop", decl.Props[0].Pos, pos(5, 4)},
+		{"bool", decl.Props[0].Value.(Literal).Pos, pos(5, 14)},
+		{"reference", ref.Pos, pos(6, 15)},
+		{"reference scalar", ref.Scalar.(Literal).Pos, pos(6, 20)},
+	}
+
+	for _, p := range positions {
+		if p.pos != p.expected {
+			t.Errorf("Bad position for %s: got %s, expected %s", p.name, p.pos, p.expected)
+		}
+	}
+}
+
+func TestParseStatementOrder(t *testing.T) {
+	manifest := `class A {
+	// About b
+	file { 'b': }
+	$x = 1 // one
+	/* About the if */
+	if $x == 1 {
+		// Nested
+		$y = 2
+	} // After the if
+	package { 'a': }
+	include B
+
+	// At the end
+}`
+
+	ast := NewAST()
+	if err := Parse(ast, "order.ms", strings.NewReader(manifest)); err != nil {
+		t.Fatal(err)
+	}
+
+	describe := func(block *Block) string {
+		var stmts []string
+		for _, stmt := range block.Statements {
+			str := fmt.Sprintf("%T", stmt.Stmt)
+			for _, comment := range stmt.Comments {
+				str += " " + comment.Text
+			}
+			stmts = append(stmts, str)
+		}
+		for _, comment := range block.EndComments {
+			stmts = append(stmts, comment.Text)
+		}
+		return strings.Join(stmts, "\n")
+	}
+
+	block := &ast.Classes[0].Block
+	expected := strings.Join([]string{
+		"*ast.Declaration // About b",
+		"*ast.VariableDef // one",
+		"*ast.If /* About the if */ // After the if",
+		"*ast.Declaration",
+		"*ast.Include",
+		"// At the end",
+	}, "\n")
+	if got := describe(block); got != expected {
+		t.Errorf("Got statements\n%s\nexpected\n%s", got, expected)
+	}
+
+	nested := &block.Ifs[0].Block
+	if got := describe(nested); got != "*ast.VariableDef // Nested" {
+		t.Errorf("Got nested statements\n%s", got)
+	}
+
+	// The statements in order are the same ones as in the slices by type
+	if block.Statements[0].Stmt != &block.Declarations[0] ||
+		block.Statements[3].Stmt != &block.Declarations[1] ||
+		block.Statements[1].Stmt != &block.VariableDefs[0] {
+		t.Error("Statements don't point into the slices of the block")
+	}
+}
+
+func TestParseErrorPosition(t *testing.T) {
+	manifest := "class A {\n\t$x = 5\n\tfoo bar\n}"
+
+	ast := NewAST()
+	err := Parse(ast, "err.ms", strings.NewReader(manifest))
+	if err == nil {
+		t.Fatal("Bad manifest didn't fail")
+	}
+
+	if !strings.HasPrefix(err.Error(), "err.ms:3:6: ") {
+		t.Error("Got error at bad position:", err)
+	}
+}
+
+var multipleErrorsTests = []struct {
+	manifest       string
+	expectedErrors []Error
+}{
+	{
+		"class",
+		[]Error{
+			{Pos{"err.ms", 1, 6}, "unexpected end of file", []string{"identifier"}},
+		},
+	},
+
+	{
+		// Statement level recovery
+		"class A {\n\t$x = 5\n\tfoo bar\n\t$y = 3 3\n}",
+		[]Error{
+			{Pos{"err.ms", 3, 6}, "unexpected identifier", []string{"'{'"}},
+			{
+				Pos{"err.ms", 4, 9}, "unexpected number",
+				[]string{"identifier", "variable", "'include'", "'if'", "'case'", "'for'", "'return'", "'}'"},
+			},
+		},
+	},
+
+	{
+		// Prop level recovery
+		"class B {\n\tpackage { 'x':\n\t\tensure => ,\n\t\ty => 5 6,\n\t}\n}",
+		[]Error{
+			{
+				Pos{"err.ms", 3, 13}, "unexpected ','",
+				[]string{
+					"number", "identifier", "variable", "'true'", "'false'",
+					"operator", "single-quoted string", "regex", "double-quoted string",
+					"heredoc", "'!'", "'{'", "'('", "'['",
+				},
+			},
+			{
+				Pos{"err.ms", 4, 10}, "unexpected number",
+				[]string{"operator", "'in'", "'?'", "','"},
+			},
+		},
+	},
+
+	{
+		// Recovery at the next class, define or node
+		"class C( {}\ndefine foo bar() {}\nnode 'n' { $z = }",
+		[]Error{
+			{Pos{"err.ms", 1, 10}, "unexpected '{'", []string{"variable", "')'"}},
+			{Pos{"err.ms", 2, 8}, "Expected 'single' or 'multiple' after define", nil},
+			{
+				Pos{"err.ms", 3, 17}, "unexpected '}'",
+				[]string{
+					"number", "identifier", "variable", "'true'", "'false'",
+					"operator", "single-quoted string", "regex", "double-quoted string",
+					"heredoc", "'!'", "'{'", "'('", "'['",
+				},
+			},
+		},
+	},
+
+	{
+		// Single and double quoted strings aren't interchangeable everywhere
+		"node \"x\" { }",
+		[]Error{
+			{
+				Pos{"err.ms", 1, 6}, "unexpected double-quoted string",
+				[]string{"single-quoted string"},
+			},
+		},
+	},
+
+	{
+		"class E {\n\t$x = \"a\\tb\\q\"\n\t$y = <<EOT\n\t\tok\n\t\tbad \\w\n\tEOT\n}",
+		[]Error{
+			{Pos{"err.ms", 2, 12}, `unknown escape sequence "\\q"`, nil},
+			{Pos{"err.ms", 5, 7}, `unknown escape sequence "\\w"`, nil},
+		},
+	},
+
+	{
+		"func f() {\n\treturn 1\n\treturn 2\n}",
+		[]Error{
+			{
+				Pos{"err.ms", 3, 2},
+				"more than one return in block, previous return at err.ms:2:2",
+				nil,
+			},
+		},
+	},
+}
+
+func TestParseMultipleErrors(t *testing.T) {
+	for _, test := range multipleErrorsTests {
+		ast := NewAST()
+		err := Parse(ast, "err.ms", strings.NewReader(test.manifest))
+
+		errList, ok := err.(ErrorList)
+		if !ok {
+			t.Log(test.manifest)
+			t.Errorf("Expected ErrorList, got %#v", err)
+			continue
+		}
+
+		if len(errList) != len(test.expectedErrors) {
+			t.Log(test.manifest)
+			t.Errorf(
+				"Expected %d errors, got %d:\n%s",
+				len(test.expectedErrors), len(errList), errList,
+			)
+			continue
+		}
+
+		for i, e := range errList {
+			if exp := test.expectedErrors[i]; !reflect.DeepEqual(*e, exp) {
+				t.Log(test.manifest)
+				t.Errorf("Expected error %#v, got %#v", exp, *e)
+			}
+		}
+	}
+}
+
+// Makes sure that everything that could be parsed is returned even if there
+// are syntax errors.
+func TestParsePartialAST(t *testing.T) {
+	manifest := `
+		class A {
+			$x = 5
+			$y = = 3
+			$z = 7
+		}
+		class B( {}
+		node 'n' {}
+	`
+
+	ast := NewAST()
+	if err := Parse(ast, "err.ms", strings.NewReader(manifest)); err == nil {
+		t.Fatal("Bad manifest didn't fail")
+	} else if len(err.(ErrorList)) != 2 {
+		t.Error("Expected two errors, got", err)
+	}
+
+	if len(ast.Classes) != 1 || ast.Classes[0].Name != "A" {
+		t.Fatalf("Expected class A, got %#v", ast.Classes)
+	} else if defs := ast.Classes[0].Block.VariableDefs; len(defs) != 2 ||
+		defs[0].VariableName.Str != "$x" || defs[1].VariableName.Str != "$z" {
+		t.Errorf("Expected $x and $z to be defined, got %#v", defs)
+	}
+
+	if len(ast.Nodes) != 1 || ast.Nodes[0].Name != "n" {
+		t.Errorf("Expected node n, got %#v", ast.Nodes)
+	}
+}
+
+// Parses all lexTests manifests, together with a few bad ones, from many
+// goroutines at once and makes sure that every result matches the result of
+// parsing the same manifest sequentially.
+func TestParseConcurrently(t *testing.T) {
+	manifests := []string{}
+	for _, test := range lexTests {
+		manifests = append(manifests, test.manifest)
+	}
+	for _, test := range badLexTests {
+		manifests = append(manifests, test.manifest)
+	}
+
+	type result struct {
+		ast *AST
+		err error
+	}
+
+	expected := make([]result, len(manifests))
+	for i, manifest := range manifests {
+		ast := NewAST()
+		err := Parse(ast, "test.manifest", strings.NewReader(manifest))
+		expected[i] = result{ast, err}
+	}
+
+	const goroutines = 8
+	results := make([][]result, goroutines)
+	var wg sync.WaitGroup
+	for g := 0; g < goroutines; g++ {
+		results[g] = make([]result, len(manifests))
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i, manifest := range manifests {
+				ast := NewAST()
+				err := Parse(ast, "test.manifest", strings.NewReader(manifest))
+				results[g][i] = result{ast, err}
+			}
+		}(g)
+	}
+	wg.Wait()
+
+	for g := range results {
+		for i, res := range results[g] {
+			exp := expected[i]
+			if (res.err == nil) != (exp.err == nil) ||
+				(res.err != nil && res.err.Error() != exp.err.Error()) {
+				t.Errorf(
+					"Bad error for %s: expected %v, got %v",
+					manifests[i], exp.err, res.err,
+				)
+			} else if !equalsAsJson(res.ast, exp.ast) {
+				t.Error("Got different AST when parsing concurrently:", manifests[i])
+			}
+		}
+	}
+
+	contextsMutex.Lock()
+	defer contextsMutex.Unlock()
+	if len(contexts) != 0 {
+		t.Errorf("%d parse contexts were never released", len(contexts))
+	}
+}
+
+// Returns whether the parsed AST equals the expected one. Columns and the
+// positions of literals are not compared, that is covered by
+// TestParsePositions. Positions in expected which lack a filename are assumed
+// to be in filename. The layout and the ends of blocks are only used for
+// printing, and are covered by the tests of the printer. The statements of
+// blocks in order are the same as the ones in the slices by type, and are
+// covered by TestParseStatementOrder.
+func astEquals(parsed, expected *AST, filename string) bool {
+	j1, err1 := json.Marshal(parsed)
+	j2, err2 := json.Marshal(expected)
+
+	if err1 != nil || err2 != nil {
+		return false
+	}
+
+	var unserialized1, unserialized2 interface{}
+	json.Unmarshal(j1, &unserialized1)
+	json.Unmarshal(j2, &unserialized2)
+
+	return reflect.DeepEqual(
+		normalizePositions(unserialized1, ""),
+		normalizePositions(unserialized2, filename),
+	)
+}
+
+// Walks a value unserialized from JSON, and strips all literals and columns
+// from it.
+func normalizePositions(i interface{}, filename string) interface{} {
+	switch i.(type) {
+	case map[string]interface{}:
+		m := i.(map[string]interface{})
+		if _, hasVal := m["Val"]; hasVal && len(m) == 2 && m["Pos"] != nil {
+			// This is a Literal
+			return normalizePositions(m["Val"], filename)
+		}
+
+		delete(m, "End")
+		delete(m, "Layout")
+		delete(m, "Statements")
+		delete(m, "EndComments")
+		for key, val := range m {
+			m[key] = normalizePositions(val, filename)
+		}
+
+		if pos, isPos := m["Pos"].(map[string]interface{}); isPos {
+			delete(pos, "Col")
+			if pos["File"] == "" && filename != "" {
+				pos["File"] = filename
+			}
+		}
+
+		return m
+	case []interface{}:
+		a := i.([]interface{})
+		for idx, val := range a {
+			a[idx] = normalizePositions(val, filename)
+		}
+		return a
+	default:
+		return i
+	}
+}
+
 func equalsAsJson(i1, i2 interface{}) bool {
 	j1, err1 := json.Marshal(i1)
 	j2, err2 := json.Marshal(i2)
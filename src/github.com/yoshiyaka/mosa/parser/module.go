@@ -0,0 +1,115 @@
+package parser
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	. "github.com/yoshiyaka/mosa/ast"
+)
+
+// Loads the manifests of modules on demand. A module is a directory named
+// after the module in one of the roots of a module path, with its manifests in
+// a manifests subdirectory:
+//
+//	nginx             -> <root>/nginx/manifests/init.ms
+//	nginx::vhost      -> <root>/nginx/manifests/vhost.ms
+//	nginx::vhost::ssl -> <root>/nginx/manifests/vhost/ssl.ms
+//
+// The roots are searched in order, and the first root holding a directory for
+// the module is used for all of its manifests. A vendored module can thereby
+// be replaced by putting another version of it in an earlier root.
+//
+// Everything defined in the manifests of a module must be named after the
+// module, so that modules can't collide with each other.
+type ModuleLoader struct {
+	path []string
+
+	// The cleaned paths of all files loaded so far, including imported ones
+	parsed map[string]bool
+}
+
+func NewModuleLoader(path []string) *ModuleLoader {
+	return &ModuleLoader{path: path, parsed: map[string]bool{}}
+}
+
+// Parses the manifest which should define name, along with the files it
+// imports. Returns nil if the module has no such manifest, or if the manifest
+// is already loaded.
+func (ml *ModuleLoader) Autoload(name string) (*AST, error) {
+	parts := strings.Split(name, "::")
+	module := parts[0]
+
+	file := "init.ms"
+	if len(parts) > 1 {
+		file = filepath.Join(parts[1:]...) + ".ms"
+	}
+
+	for _, root := range ml.path {
+		if info, err := os.Stat(filepath.Join(root, module)); err != nil || !info.IsDir() {
+			continue
+		}
+
+		path := filepath.Join(root, module, "manifests", file)
+		if _, err := os.Stat(path); os.IsNotExist(err) {
+			return nil, nil
+		}
+
+		ast := NewAST()
+		imp := &importer{ast: ast, parsed: ml.parsed}
+		if err := imp.parseFile(path, nil); err != nil {
+			return nil, err
+		} else if err := imp.err(); err != nil {
+			return nil, err
+		}
+
+		if err := checkNamespace(ast, module); err != nil {
+			return nil, err
+		}
+		return ast, nil
+	}
+
+	return nil, nil
+}
+
+// Makes sure that everything defined in the manifests of a module is named
+// after the module, for instance nginx or nginx::vhost for the module nginx.
+func checkNamespace(ast *AST, module string) error {
+	var errs ErrorList
+	check := func(what, name string, pos Pos) {
+		if name != module && !strings.HasPrefix(name, module+"::") {
+			errs = append(errs, &Error{
+				Pos: pos,
+				Msg: fmt.Sprintf(
+					"%s %s must be named %s or %s::<name> in module %s",
+					what, name, module, module, module,
+				),
+			})
+		}
+	}
+
+	for _, c := range ast.Classes {
+		check("class", c.Name, c.Pos)
+	}
+	for _, d := range ast.Defines {
+		check("define", d.Name, d.Pos)
+	}
+	for _, f := range ast.Funcs {
+		check("function", f.Name, f.Pos)
+	}
+	for _, f := range ast.Facters {
+		check("facter", f.Name, f.Pos)
+	}
+	for _, n := range ast.Nodes {
+		errs = append(errs, &Error{
+			Pos: n.Pos,
+			Msg: fmt.Sprintf("nodes can't be defined in module %s", module),
+		})
+	}
+
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
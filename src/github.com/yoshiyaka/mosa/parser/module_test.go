@@ -0,0 +1,89 @@
+package parser
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestModuleLoader(t *testing.T) {
+	dir := writeManifests(t, map[string]string{
+		"site/nginx/manifests/vhost.ms": `
+			import 'params.ms'
+			define single nginx::vhost($name,) {}
+		`,
+		"site/nginx/manifests/params.ms": `class nginx::params {}`,
+		"vendor/nginx/manifests/init.ms": `class nginx {}`,
+		"vendor/nginx/manifests/vhost.ms": `
+			define single nginx::vhost($name,) {}
+		`,
+		"vendor/mysql/manifests/init.ms":          `class mysql {}`,
+		"vendor/mysql/manifests/server/config.ms": `class mysql::server::config {}`,
+	})
+	defer os.RemoveAll(dir)
+
+	ml := NewModuleLoader([]string{
+		filepath.Join(dir, "site"), filepath.Join(dir, "vendor"),
+	})
+
+	tests := []struct {
+		name            string
+		expectedClasses string
+		expectedDefines int
+	}{
+		// The first root holding nginx is used, even though the vendored
+		// module has an init.ms
+		{"nginx::vhost", "nginx::params", 1},
+		{"nginx", "", 0},
+		// Already loaded through the import of vhost.ms
+		{"nginx::params", "", 0},
+		{"mysql", "mysql", 0},
+		{"mysql::server::config", "mysql::server::config", 0},
+		{"nosuchmodule::x", "", 0},
+	}
+
+	for _, test := range tests {
+		ast, err := ml.Autoload(test.name)
+		if err != nil {
+			t.Error(test.name, err)
+			continue
+		}
+
+		var classes string
+		var defines int
+		if ast != nil {
+			classes = strings.Join(classNames(ast), " ")
+			defines = len(ast.Defines)
+		}
+		if classes != test.expectedClasses || defines != test.expectedDefines {
+			t.Errorf(
+				"Autoloading %s got classes '%s' and %d defines",
+				test.name, classes, defines,
+			)
+		}
+	}
+}
+
+func TestModuleLoaderNamespace(t *testing.T) {
+	dir := writeManifests(t, map[string]string{
+		"modules/nginx/manifests/init.ms": `
+			class nginx {}
+			class nginxfoo {}
+			func mysql::f() { return 1 }
+			node 'n' {}
+		`,
+	})
+	defer os.RemoveAll(dir)
+
+	_, err := NewModuleLoader([]string{filepath.Join(dir, "modules")}).Autoload("nginx")
+	expected := strings.Replace(
+		"DIR/init.ms:3:4: class nginxfoo must be named nginx or nginx::<name> in module nginx\n"+
+			"DIR/init.ms:4:4: function mysql::f must be named nginx or nginx::<name> in module nginx\n"+
+			"DIR/init.ms:5:4: nodes can't be defined in module nginx",
+		"DIR", filepath.Join(dir, "modules", "nginx", "manifests"), -1,
+	)
+	if err == nil || err.Error() != expected {
+		t.Errorf("Got bad error: %v, expected %s", err, expected)
+	}
+}
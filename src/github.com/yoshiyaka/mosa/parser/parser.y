@@ -11,24 +11,39 @@ extern int yydebug;
 #include "_cgo_export.h"
 #include "types.h"
 
-extern int line_num;
-extern int level;
-extern FILE *yyin;
-extern int yylineno;
+// Expands a bison location to the line and column arguments expected by the
+// Go callbacks.
+#define POS(loc) (loc).first_line, (loc).first_column
 
-typedef struct yy_buffer_state * YY_BUFFER_STATE;
-extern int yyparse();
-extern YY_BUFFER_STATE yy_scan_string(char * str);
-extern void yy_delete_buffer(YY_BUFFER_STATE buffer);
+%}
 
-int yylex();
-void yylex_destroy();
-void yyerror(const char *s);
+%code requires {
+#ifndef YY_TYPEDEF_YY_SCANNER_T
+#define YY_TYPEDEF_YY_SCANNER_T
+typedef void *yyscan_t;
+#endif
+}
 
-%}
+%code provides {
+typedef struct yy_buffer_state * YY_BUFFER_STATE;
+extern int yylex_init_extra(t_lexstate *state, yyscan_t *scanner);
+extern YY_BUFFER_STATE yy_scan_string(const char *str, yyscan_t scanner);
+extern void yy_delete_buffer(YY_BUFFER_STATE buffer, yyscan_t scanner);
+extern int yylex_destroy(yyscan_t scanner);
 
-%define parse.error verbose
+int yylex(YYSTYPE *lvalp, YYLTYPE *llocp, yyscan_t scanner);
+void yyerror(YYLTYPE *loc, yyscan_t scanner, int ctx, const char *s);
+}
+
+// The parser is reentrant. Each call to doparse() gets its own scanner, and
+// ctx identifies the Go side parse context that all callbacks should use.
+%define api.pure full
+// Syntax errors are reported through yyreport_syntax_error() below, so that
+// the expected tokens can be passed on to Go.
+%define parse.error custom
 %locations
+%parse-param {yyscan_t scanner} {int ctx}
+%lex-param {yyscan_t scanner}
 
 // Bison fundamentally works by asking flex to get the next token, which it
 // returns as an object of type "yystype".  But tokens could be of any
@@ -37,7 +52,7 @@ void yyerror(const char *s);
 // use that union instead of "int" for the definition of "yystype":
 %union {
   int ival;
-  float fval;
+  double fval;
   char *sval;
   int gohandle;
 }
@@ -52,34 +67,58 @@ void yyerror(const char *s);
 %token DEFINE
 %token NODE
 %token FUNC
+%token FACTER
+%token IMPORT INCLUDE
 %token ARROW
-%token IF ELSE
+%token IF ELSIF ELSE
+%token CASE DEFAULT
+%token FOR
+%token RETURN
 %token <ival> BOOLTRUE BOOLFALSE
 %token <sval> PLUSMINUS // + -
-%token <sval> MULDIV // * /
-%token <sval> COMPARISON // == > < >= <=
-%token <sval> BOOLOP // && ||
+%token <sval> MULDIV // * / %
+%token <sval> COMPARISON // == > < >= <= =~ !~
+%token <sval> BOOLAND // &&
+%token <sval> BOOLOR // ||
 %token <sval> QUOTED_STRING
+%token <sval> REGEX
+%token IN
 %token INTPOL_START
 %token <sval> INTPOL_TEXT
 %token <sval> INTPOL_VARIABLE
-
-%left BOOLOP
-%left COMPARISON
+%token INTPOL_EXPR_START INTPOL_EXPR_END
+%token HEREDOC_START LITERAL_HEREDOC_START HEREDOC_END
+
+// Operators are listed from lowest to highest precedence. The selector operator
+// ? has the lowest precedence, so that $a > 1 ? { ... } selects on $a > 1.
+// UNARY is only used to give the unary - and ! precedence over all binary
+// operators, so that -$a * $b is (-$a) * $b and !$a == $b is (!$a) == $b.
+%left '?'
+%left BOOLOR
+%left BOOLAND
+%left COMPARISON IN
 %left PLUSMINUS
 %left MULDIV
+%right '!' UNARY
 
 %type <gohandle> define
 %type <gohandle> class
 %type <gohandle> node
+%type <gohandle> func
+%type <gohandle> facter
+%type <gohandle> import include
 %type <gohandle> block
 %type <gohandle> statement statements
-%type <gohandle> ifstmt
+%type <gohandle> ifstmt elsifs
+%type <gohandle> casestmt casebranches casebranch casematches
+%type <gohandle> forstmt
+%type <gohandle> returnstmt
 %type <gohandle> optional_arg_defs
 %type <gohandle> define_arg_defs
 %type <gohandle> arg_defs
 %type <gohandle> arg_def
 %type <gohandle> file_body
+%type <gohandle> definition
 %type <gohandle> file
 %type <gohandle> declaration
 %type <gohandle> variable_def
@@ -90,162 +129,342 @@ void yyerror(const char *s);
 %type <gohandle> interpolated_string
 %type <gohandle> interpolated_string_list
 %type <gohandle> interpolated_string_value
+%type <gohandle> heredoc
 %type <gohandle> arrayentries
 %type <gohandle> array
 %type <gohandle> scalar
 %type <gohandle> reference
+%type <gohandle> hash
+%type <gohandle> hashentries
+%type <gohandle> hashentry
+%type <gohandle> index optional_expression
+%type <gohandle> function_call
+%type <gohandle> call_args
+%type <gohandle> probe
+%type <gohandle> selector_cases selector_case
 
 %%
 
 file:
-	file_body				{ sawBody($1); }
+	file_body				{ sawBody(ctx, $1); }
 	| /* Empty manifest */	{}
 
 file_body:
-	  file_body class   	{ $$ = appendArray($1, $2); }
-	| file_body define		{ $$ = appendArray($1, $2); }
-	| file_body node		{ $$ = appendArray($1, $2); }
-	| class					{ $$ = appendArray(nilArray(ASTTYPE_ARRAY_INTERFACE), $1); }
-	| define				{ $$ = appendArray(nilArray(ASTTYPE_ARRAY_INTERFACE), $1); }
-	| node					{ $$ = appendArray(nilArray(ASTTYPE_ARRAY_INTERFACE), $1); }
+	  file_body definition	{ $$ = appendArray(ctx, $1, $2); }
+	| definition			{ $$ = appendArray(ctx, nilArray(ctx, ASTTYPE_ARRAY_INTERFACE), $1); }
+
+// The error productions below allow us to recover from syntax errors, so that
+// all errors in a file can be reported at once. They all result in the nil
+// handle 0, which appendArray() ignores.
+//
+// An error which can't be recovered from inside of a class, define or node
+// skips the rest of it, and parsing continues at the next one.
+definition:
+	  class
+	| define
+	| node
+	| func
+	| facter
+	| import
+	| error					{ $$ = 0; }
+
+import:
+	  IMPORT QUOTED_STRING		{ $$ = sawImport(ctx, POS(@1), $2); }
 
 node:
-	  NODE QUOTED_STRING block	{ $$ = sawNode(@1.first_line, $2, $3); }
+	  NODE QUOTED_STRING block	{ $$ = sawNode(ctx, POS(@1), $2, $3); }
 
 class:
-	  CLASS STRING optional_arg_defs block { $$ = newClass(@1.first_line, $2, $3, $4); }
+	  CLASS STRING optional_arg_defs block { $$ = newClass(ctx, POS(@1), $2, $3, $4); }
 
 block:
-	  '{' statements '}' 	{ $$ = sawBlock(@1.first_line, $2); }
-	| '{' '}'				{ $$ = sawBlock(@1.first_line, nilArray(ASTTYPE_STMTS)); }
+	  '{' statements '}' 	{ $$ = sawBlock(ctx, POS(@1), POS(@3), $2); }
+	| '{' '}'				{ $$ = sawBlock(ctx, POS(@1), POS(@2), nilArray(ctx, ASTTYPE_STMTS)); }
 
 statements:
-	  statements statement	{ $$ = appendArray($1, $2); }
-	| statement				{ $$ = appendArray(nilArray(ASTTYPE_STMTS), $1); }
+	  statements statement	{ $$ = appendArray(ctx, $1, $2); }
+	| statement				{ $$ = appendArray(ctx, nilArray(ctx, ASTTYPE_STMTS), $1); }
 
+// Skips tokens until the next statement
 statement:
-	  variable_def | declaration | ifstmt;
+	  variable_def | declaration | ifstmt | casestmt | forstmt | include
+	| returnstmt
+	| error					{ $$ = 0; }
+
+func:
+	  FUNC STRING define_arg_defs block { $$ = sawFunc(ctx, POS(@1), $2, $3, $4); }
 
 define:
 	DEFINE STRING STRING define_arg_defs block {
-		$$ = sawDefine(@1.first_line, $2, $3, $4, $5);
+		$$ = sawDefine(ctx, POS(@1), $2, $3, $4, $5);
 		if($$ == -1) {
-			yyerror("Expected 'single' or 'multiple' after define");
-			YYABORT;
+			yyerror(&@2, scanner, ctx, "Expected 'single' or 'multiple' after define");
+			$$ = 0;
+		}
+	}
+
+facter:
+	FACTER STRING STRING define_arg_defs block {
+		$$ = sawFacter(ctx, POS(@1), $2, $3, $4, $5);
+		if($$ == -1) {
+			yyerror(&@2, scanner, ctx, "Expected 'single' or 'multiple' after facter");
+			$$ = 0;
 		}
 	}
 
 define_arg_defs:
-	  '(' ')'			{ $$ = nilArray(ASTTYPE_ARGDEFS); }
+	  '(' ')'			{ $$ = nilArray(ctx, ASTTYPE_ARGDEFS); }
 	| '(' arg_defs ')'	{ $$ = $2; }
 
 optional_arg_defs:
-	/* empty */					{ $$ = nilArray(ASTTYPE_ARGDEFS); }
-	| '(' ')'					{ $$ = nilArray(ASTTYPE_ARGDEFS); }
+	/* empty */					{ $$ = nilArray(ctx, ASTTYPE_ARGDEFS); }
+	| '(' ')'					{ $$ = nilArray(ctx, ASTTYPE_ARGDEFS); }
 	| '(' arg_defs ')'			{ $$ = $2; }
 
 arg_defs:
-	  arg_defs arg_def			{ $$ = appendArray($1, $2); }
-	| arg_def					{ $$ = appendArray(nilArray(ASTTYPE_ARGDEFS), $1); }
+	  arg_defs arg_def			{ $$ = appendArray(ctx, $1, $2); }
+	| arg_def					{ $$ = appendArray(ctx, nilArray(ctx, ASTTYPE_ARGDEFS), $1); }
 
 arg_def:
-	  VARIABLENAME ','				{ $$ = sawArgDef(@1.first_line, $1, 0);  }
-	| VARIABLENAME '=' scalar ','	{ $$ = sawArgDef(@1.first_line, $1, $3); }
-	| VARIABLENAME '=' array  ','	{ $$ = sawArgDef(@1.first_line, $1, $3); }
+	  VARIABLENAME ','				{ $$ = sawArgDef(ctx, POS(@1), $1, 0);  }
+	| VARIABLENAME '=' scalar ','	{ $$ = sawArgDef(ctx, POS(@1), $1, $3); }
+	| VARIABLENAME '=' array  ','	{ $$ = sawArgDef(ctx, POS(@1), $1, $3); }
+	| VARIABLENAME '=' hash   ','	{ $$ = sawArgDef(ctx, POS(@1), $1, $3); }
 	
 variable_def:
-	VARIABLENAME '=' expression { $$ = sawVariableDef(@1.first_line, $1, $3);	}
+	VARIABLENAME '=' expression { $$ = sawVariableDef(ctx, POS(@1), $1, $3);	}
 
 declaration:
-	  STRING '{' expression ':' proplist '}'	{ $$ = sawDeclaration(@1.first_line, $1, $3, $5); }
-	| STRING '{' expression ':' '}'			{ $$ = sawDeclaration(@1.first_line, $1, $3, nilArray(ASTTYPE_PROPLIST)); }
+	  STRING '{' expression ':' proplist '}'	{ $$ = sawDeclaration(ctx, POS(@1), $1, $3, $5); }
+	| STRING '{' expression ':' '}'			{ $$ = sawDeclaration(ctx, POS(@1), $1, $3, nilArray(ctx, ASTTYPE_PROPLIST)); }
 
 ifstmt:
-	  IF expression block				{ $$ = sawIf(@1.first_line, $2, $3, 0);  }
-	| IF expression block ELSE block	{ $$ = sawIf(@1.first_line, $2, $3, $5); }
+	  IF expression block elsifs			{ $$ = sawIf(ctx, POS(@1), $2, $3, $4, 0);  }
+	| IF expression block elsifs ELSE block	{ $$ = sawIf(ctx, POS(@1), $2, $3, $4, $6); }
+
+elsifs:
+	  /* empty */						{ $$ = nilArray(ctx, ASTTYPE_ARRAY_INTERFACE); }
+	| elsifs ELSIF expression block		{ $$ = appendArray(ctx, $1, sawElseIf(ctx, POS(@2), $3, $4)); }
+
+include:
+	  INCLUDE STRING			{ $$ = sawInclude(ctx, POS(@1), $2); }
+
+forstmt:
+	  FOR VARIABLENAME IN expression block	{
+		$$ = sawFor(ctx, POS(@1), 0, sawVariableName(ctx, POS(@2), $2), $4, $5);
+	}
+	| FOR VARIABLENAME ',' VARIABLENAME IN expression block	{
+		$$ = sawFor(
+			ctx, POS(@1),
+			sawVariableName(ctx, POS(@2), $2), sawVariableName(ctx, POS(@4), $4),
+			$6, $7
+		);
+	}
+
+casestmt:
+	  CASE expression '{' casebranches '}'	{ $$ = sawCase(ctx, POS(@1), $2, $4); }
+
+casebranches:
+	  casebranches casebranch	{ $$ = appendArray(ctx, $1, $2); }
+	| casebranch				{ $$ = appendArray(ctx, nilArray(ctx, ASTTYPE_ARRAY_INTERFACE), $1); }
+
+// A branch without any matches is the default branch
+casebranch:
+	  casematches ':' block		{ $$ = sawCaseBranch(ctx, POS(@1), $1, $3); }
+	| DEFAULT ':' block			{ $$ = sawCaseBranch(ctx, POS(@1), nilArray(ctx, ASTTYPE_ARRAY_INTERFACE), $3); }
+
+casematches:
+	  casematches ',' expression	{ $$ = appendArray(ctx, $1, $3); }
+	| expression					{ $$ = appendArray(ctx, nilArray(ctx, ASTTYPE_ARRAY_INTERFACE), $1); }
+
+returnstmt:
+	  RETURN expression					{ $$ = sawReturn(ctx, POS(@1), $2); }
 
 proplist:
-	  proplist prop	{ $$ = appendArray($1, $2); }
-	| prop			{ $$ = appendArray(nilArray(ASTTYPE_PROPLIST), $1); }
+	  proplist prop	{ $$ = appendArray(ctx, $1, $2); }
+	| prop			{ $$ = appendArray(ctx, nilArray(ctx, ASTTYPE_PROPLIST), $1); }
 	;
 
+// Skips tokens until the next comma
 prop:
-	STRING ARROW expression ','	{ $$ = sawProp(@1.first_line, $1, $3); }
+	  STRING ARROW expression ','	{ $$ = sawProp(ctx, POS(@1), $1, $3); }
+	| error ','						{ $$ = 0; }
 
 expression:
 	  value								{ $$ = $1; }
 	| '(' expression ')'				{ $$ = $2; }
-	| expression PLUSMINUS	expression	{ $$ = sawExpression(@1.first_line, $2, $1, $3); }
-	| expression MULDIV		expression	{ $$ = sawExpression(@1.first_line, $2, $1, $3); }
-	| expression COMPARISON	expression	{ $$ = sawExpression(@1.first_line, $2, $1, $3); }
-	| expression BOOLOP		expression	{ $$ = sawExpression(@1.first_line, $2, $1, $3); }
+	| expression PLUSMINUS	expression	{ $$ = sawExpression(ctx, POS(@1), $2, $1, $3); }
+	| expression MULDIV		expression	{ $$ = sawExpression(ctx, POS(@1), $2, $1, $3); }
+	| expression COMPARISON	expression	{ $$ = sawExpression(ctx, POS(@1), $2, $1, $3); }
+	| expression IN			expression	{ $$ = sawExpression(ctx, POS(@1), "in", $1, $3); }
+	| expression BOOLAND	expression	{ $$ = sawExpression(ctx, POS(@1), $2, $1, $3); }
+	| expression BOOLOR		expression	{ $$ = sawExpression(ctx, POS(@1), $2, $1, $3); }
+	| '!' expression					{ $$ = sawUnaryExpression(ctx, POS(@1), "!", $2); }
+	| expression '?' '{' selector_cases '}'		{ $$ = sawSelector(ctx, POS(@1), $1, $4); }
+	| expression '?' '{' selector_cases ',' '}'	{ $$ = sawSelector(ctx, POS(@1), $1, $4); }
+	| PLUSMINUS expression %prec UNARY	{
+		$$ = sawUnaryExpression(ctx, POS(@1), $1, $2);
+		if($$ == -1) {
+			yyerror(&@1, scanner, ctx, "Unary + is not supported");
+			$$ = 0;
+		}
+	}
 
 value:
 	  scalar		{ $$ = $1; }
 	| array			{ $$ = $1; }
 	| reference		{ $$ = $1; }
+	| hash			{ $$ = $1; }
+	| index			{ $$ = $1; }
+	| function_call	{ $$ = $1; }
+	| probe			{ $$ = $1; }
 
 scalar:
-	  QUOTED_STRING			{ $$ = sawQuotedString(@1.first_line, $1);	}
+	  QUOTED_STRING			{ $$ = sawQuotedString(ctx, POS(@1), $1);	}
 	| interpolated_string	{ $$ = $1;									}
-	| VARIABLENAME			{ $$ = sawVariableName(@1.first_line, $1);	}
-	| INT					{ $$ = sawInt(@1.first_line, $1);			}
-	| BOOLTRUE				{ $$ = sawBoolTrue(); 						}
-	| BOOLFALSE				{ $$ = sawBoolFalse();						}
+	| heredoc				{ $$ = $1;									}
+	| VARIABLENAME			{ $$ = sawVariableName(ctx, POS(@1), $1);	}
+	| INT					{ $$ = sawInt(ctx, POS(@1), $1);			}
+	| FLOAT					{ $$ = sawFloat(ctx, POS(@1), $1);			}
+	| BOOLTRUE				{ $$ = sawBoolTrue(ctx, POS(@1));				}
+	| BOOLFALSE				{ $$ = sawBoolFalse(ctx, POS(@1));				}
+	| REGEX					{ $$ = sawRegex(ctx, POS(@1), $1);			}
 
 reference:
-	STRING '[' scalar ']' { $$ = sawReference(@1.first_line, $1, $3); }
+	STRING '[' scalar ']' { $$ = sawReference(ctx, POS(@1), $1, $3); }
 
 array:
 	  '[' arrayentries ']'	{ $$ = $2; }
-	| '[' ']' 				{ $$ = nilArray(ASTTYPE_ARRAY); }
+	| '[' ']' 				{ $$ = nilArray(ctx, ASTTYPE_ARRAY); }
 
 arrayentries:
-	  arrayentries expression ','	{ $$ = appendArray($1, $2); }
-	| expression ','				{ $$ = appendArray(nilArray(ASTTYPE_ARRAY), $1); }
+	  arrayentries expression ','	{ $$ = appendArray(ctx, $1, $2); }
+	| expression ','				{ $$ = appendArray(ctx, nilArray(ctx, ASTTYPE_ARRAY), $1); }
+
+// The trailing comma is optional for hashes, so both { 'a' => 1 } and
+// { 'a' => 1, } are allowed.
+hash:
+	  '{' hashentries '}'		{ $$ = $2; }
+	| '{' hashentries ',' '}'	{ $$ = $2; }
+	| '{' '}'					{ $$ = nilArray(ctx, ASTTYPE_HASH); }
+
+hashentries:
+	  hashentries ',' hashentry	{ $$ = appendArray(ctx, $1, $3); }
+	| hashentry					{ $$ = appendArray(ctx, nilArray(ctx, ASTTYPE_HASH), $1); }
+
+hashentry:
+	expression ARROW expression	{ $$ = sawHashEntry(ctx, POS(@1), $1, $3); }
+
+// A lookup in a hash or an array, for instance $vhost['port'], $users['joe']['uid']
+// or $ports[-1], or a slice of an array, for instance $ports[1:3] or $ports[:2]
+index:
+	  VARIABLENAME '[' expression ']'	{ $$ = sawIndex(ctx, POS(@1), sawVariableName(ctx, POS(@1), $1), $3); }
+	| index '[' expression ']'			{ $$ = sawIndex(ctx, POS(@1), $1, $3); }
+	| VARIABLENAME '[' optional_expression ':' optional_expression ']'	{ $$ = sawSlice(ctx, POS(@1), sawVariableName(ctx, POS(@1), $1), $3, $5); }
+	| index '[' optional_expression ':' optional_expression ']'			{ $$ = sawSlice(ctx, POS(@1), $1, $3, $5); }
+
+optional_expression:
+	  expression	{ $$ = $1; }
+	| 				{ $$ = 0; }
+
+// A call to a function, for instance implode($names, ' '). A trailing comma
+// after the last argument is allowed, but not required.
+function_call:
+	  STRING '(' ')'					{ $$ = sawFunctionCall(ctx, POS(@1), $1, nilArray(ctx, ASTTYPE_ARRAY_INTERFACE)); }
+	| STRING '(' call_args ')'			{ $$ = sawFunctionCall(ctx, POS(@1), $1, $3); }
+	| STRING '(' call_args ',' ')'		{ $$ = sawFunctionCall(ctx, POS(@1), $1, $3); }
+
+call_args:
+	  call_args ',' expression	{ $$ = appendArray(ctx, $1, $3); }
+	| expression				{ $$ = appendArray(ctx, nilArray(ctx, ASTTYPE_ARRAY_INTERFACE), $1); }
+
+selector_cases:
+	  selector_cases ',' selector_case	{ $$ = appendArray(ctx, $1, $3); }
+	| selector_case						{ $$ = appendArray(ctx, nilArray(ctx, ASTTYPE_ARRAY_INTERFACE), $1); }
+
+// A case without a match is the default case
+selector_case:
+	  expression ARROW expression	{ $$ = sawSelectorCase(ctx, POS(@1), $1, $3); }
+	| DEFAULT ARROW expression		{ $$ = sawSelectorCase(ctx, POS(@1), 0, $3); }
+
+// A command run while resolving, for instance exec { "dpkg -l": timeout => 5, }.
+// Only exec is allowed as the type, which is checked in sawProbe().
+probe:
+	  STRING '{' expression ':' proplist '}'	{ $$ = sawProbe(ctx, POS(@1), $1, $3, $5); }
+	| STRING '{' expression ':' '}'			{ $$ = sawProbe(ctx, POS(@1), $1, $3, nilArray(ctx, ASTTYPE_PROPLIST)); }
 
 interpolated_string:
-	  INTPOL_START interpolated_string_list	{ $$ = $2; }
-	| INTPOL_START							{ $$ = emptyInterpolatedString(@1.first_line); }
+	  INTPOL_START interpolated_string_list	{ $$ = sawInterpolatedString(ctx, POS(@1), $2); }
+	| INTPOL_START							{ $$ = sawInterpolatedString(ctx, POS(@1), nilArray(ctx, ASTTYPE_ARRAY_INTERFACE)); }
 	  
 interpolated_string_list:
-	  interpolated_string_list interpolated_string_value	{ $$ = appendInterpolatedString($1, $2);		}
-	| interpolated_string_value								{ $$ = appendInterpolatedString(emptyInterpolatedString(@1.first_line), $1);	}
+	  interpolated_string_list interpolated_string_value	{ $$ = appendArray(ctx, $1, $2); }
+	| interpolated_string_value								{ $$ = appendArray(ctx, nilArray(ctx, ASTTYPE_ARRAY_INTERFACE), $1); }
 
 interpolated_string_value:
-	  INTPOL_VARIABLE	{ $$ = sawVariableName(@1.first_line, $1); }
-	| INTPOL_TEXT 		{ $$ = sawString($1); }
+	  INTPOL_VARIABLE	{ $$ = sawVariableName(ctx, POS(@1), $1); }
+	| INTPOL_TEXT 		{ $$ = sawString(ctx, POS(@1), $1); }
+	| INTPOL_EXPR_START expression INTPOL_EXPR_END	{ $$ = $2; }
+
+// A multi-line string ending at a line holding only the end marker, for instance
+//
+//	content => <<EOT
+//		server_name $name;
+//	EOT
+//
+// The body of <<'EOT' heredocs is lexed as text only, without interpolation.
+heredoc:
+	  HEREDOC_START interpolated_string_list HEREDOC_END			{ $$ = sawHeredoc(ctx, POS(@1), $2, 0); }
+	| HEREDOC_START HEREDOC_END										{ $$ = sawHeredoc(ctx, POS(@1), nilArray(ctx, ASTTYPE_ARRAY_INTERFACE), 0); }
+	| LITERAL_HEREDOC_START interpolated_string_list HEREDOC_END	{ $$ = sawHeredoc(ctx, POS(@1), $2, 1); }
+	| LITERAL_HEREDOC_START HEREDOC_END								{ $$ = sawHeredoc(ctx, POS(@1), nilArray(ctx, ASTTYPE_ARRAY_INTERFACE), 1); }
 	
 %%
 
-char *last_error = NULL;
-
-t_error doparse(char *file) {
+int doparse(char *file, int ctx) {
 /* 	yydebug = 1; */
 
 	int ret;
-	line_num = 1;
-	level = 0;
-	
-	memset(&yylloc, 0, sizeof(YYLTYPE));
-	yylineno = 1;
-	
-	YY_BUFFER_STATE buffer = yy_scan_string(file);
-    ret = yyparse();
-    yy_delete_buffer(buffer);
-	yylex_destroy();
-	
-	t_error err;
-	err.code = ret;
-	err.error = last_error;
-	err.line = line_num;
-	
-	return err;
+	t_lexstate state;
+	yyscan_t scanner;
+
+	memset(&state, 0, sizeof(t_lexstate));
+	state.ctx = ctx;
+	state.line = 1;
+	state.col = 1;
+	yylex_init_extra(&state, &scanner);
+
+	YY_BUFFER_STATE buffer = yy_scan_string(file, scanner);
+	ret = yyparse(scanner, ctx);
+	yy_delete_buffer(buffer, scanner);
+	yylex_destroy(scanner);
+
+	return ret;
+}
+
+void yyerror(YYLTYPE *loc, yyscan_t scanner, int ctx, const char *s) {
+	sawError(ctx, POS(*loc), (char *)s);
 }
 
-void yyerror(const char *s) {
-	if(!last_error) {
-		free(last_error);
+// There are never more expected tokens than this in any state of the grammar
+#define MAX_EXPECTED_TOKENS 32
+
+static int yyreport_syntax_error(const yypcontext_t *yyctx, yyscan_t scanner, int ctx) {
+	yysymbol_kind_t expected[MAX_EXPECTED_TOKENS];
+	int i, n;
+
+	n = yypcontext_expected_tokens(yyctx, expected, MAX_EXPECTED_TOKENS);
+	if(n < 0) {
+		return n;
 	}
-	last_error = strdup(s);
+
+	sawSyntaxError(
+		ctx, POS(*yypcontext_location(yyctx)),
+		(char *)yysymbol_name(yypcontext_token(yyctx))
+	);
+	for(i = 0; i < n; i++) {
+		sawExpectedToken(ctx, (char *)yysymbol_name(expected[i]));
+	}
+
+	return 0;
 }
@@ -7,7 +7,40 @@ typedef enum {
 	ASTTYPE_PROPLIST,
 	ASTTYPE_ARRAY,
 	ASTTYPE_ARRAY_INTERFACE,
-	ASTTYPE_ARGDEFS
+	ASTTYPE_ARGDEFS,
+	ASTTYPE_HASH
 } ASTTYPE;
 
+// State kept by the lexer for a single parse
+typedef struct {
+	// The Go side parse context, which callbacks from the lexer must use
+	int ctx;
+
+	// How many braces deep we currently are
+	int level;
+
+	// Where the next token starts
+	int line;
+	int col;
+
+	// Whether the last token returned ended an operand, such as a number or a
+	// variable. Used to tell a regex apart from a division.
+	int operand_ended;
+
+	// The line of the last token returned, where a comment following it would
+	// be a trailing comment, and the number of newlines seen since.
+	int last_token_line;
+	int newlines;
+
+	// The end marker of the heredoc being lexed, and whether the heredoc is
+	// literal rather than interpolated.
+	char heredoc_marker[64];
+	int heredoc_literal;
+
+	// The brace levels at which the ${ ... } interpolations being lexed started,
+	// innermost last.
+	int interpolation_levels[32];
+	int interpolation_depth;
+} t_lexstate;
+
 #endif
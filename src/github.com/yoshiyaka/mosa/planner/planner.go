@@ -30,7 +30,17 @@ func newError(ge error, s *common.Step, details string) *Error {
 }
 
 func (e *Error) Error() string {
-	err := fmt.Sprintf("Error processsing %s: %s", e.Step, e.GeneralError.Error())
+	err := ""
+	if e.Step.Pos.IsValid() {
+		err = fmt.Sprintf(
+			"Error at %s processsing %s: %s",
+			e.Step.Pos, e.Step, e.GeneralError.Error(),
+		)
+	} else {
+		err = fmt.Sprintf(
+			"Error processsing %s: %s", e.Step, e.GeneralError.Error(),
+		)
+	}
 	if e.Details != "" {
 		err += " (" + e.Details + ")"
 	}
@@ -86,10 +96,15 @@ func (p *Planner) extractSteps(steps []common.Step) (map[string]map[string]*comm
 			stepsByType[step.Type] = map[string]*common.Step{}
 		}
 
-		if _, stepExists := stepsByType[step.Type][step.Item]; stepExists {
+		if previous, stepExists := stepsByType[step.Type][step.Item]; stepExists {
+			details := ""
+			if previous.Pos.IsValid() {
+				details = fmt.Sprintf("previously defined at %s", previous.Pos)
+			}
 			return nil, &Error{
 				GeneralError: ErrDuplicateDefinition,
 				Step:         &step,
+				Details:      details,
 			}
 		}
 
@@ -2,8 +2,10 @@ package planner
 
 import (
 	"encoding/json"
+	"strings"
 	"testing"
 
+	"github.com/yoshiyaka/mosa/ast"
 	"github.com/yoshiyaka/mosa/common"
 )
 
@@ -139,6 +141,34 @@ func TestBadPlan(t *testing.T) {
 	}
 }
 
+func TestBadPlanPosition(t *testing.T) {
+	steps := []common.Step{
+		common.Step{
+			Type: "deb",
+			Item: "pkg1",
+			Pos:  ast.Pos{File: "a.ms", Line: 3, Col: 4},
+		},
+		common.Step{
+			Type: "deb",
+			Item: "pkg1",
+			Pos:  ast.Pos{File: "b.ms", Line: 7, Col: 2},
+		},
+	}
+
+	_, err := New().Plan(steps)
+	if err == nil {
+		t.Fatal("Plan with duplicate steps worked")
+	}
+
+	msg := err.Error()
+	if !strings.HasPrefix(msg, "Error at b.ms:7:2 ") {
+		t.Error("Error doesn't start with position of the failing step:", msg)
+	}
+	if !strings.HasSuffix(msg, "(previously defined at a.ms:3:4)") {
+		t.Error("Error doesn't contain position of the first step:", msg)
+	}
+}
+
 type goodPlanTest struct {
 	comment      string
 	steps        []common.Step
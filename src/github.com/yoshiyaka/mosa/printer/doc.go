@@ -0,0 +1,2 @@
+// Prints parsed manifests back to source in a canonical format
+package printer
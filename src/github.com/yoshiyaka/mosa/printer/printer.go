@@ -0,0 +1,852 @@
+package printer
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+
+	. "github.com/yoshiyaka/mosa/ast"
+	"github.com/yoshiyaka/mosa/parser"
+)
+
+// Parses a manifest file and returns it formatted. filename is only used for
+// positions in errors. If the file has syntax errors, they are returned as a
+// parser.ErrorList and nothing is formatted.
+func Format(filename string, src []byte) ([]byte, error) {
+	ast := NewAST()
+	if err := parser.Parse(ast, filename, bytes.NewReader(src)); err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	if err := Fprint(&buf, ast); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Writes a parsed manifest file to w as source in the canonical format.
+// Definitions and statements are written in the order they were parsed, along
+// with the comments and the blank lines between them. ast must hold a single
+// file, since comments are placed by their positions.
+//
+// Blocks are indented by tabs, and definitions are separated by blank lines.
+// The properties of declarations are written one per line with their arrows
+// aligned. Arrays, hashes, selectors and argument lists are written on a single
+// line, unless their elements were written on different lines. Parentheses are
+// only kept where they are needed.
+func Fprint(w io.Writer, ast *AST) error {
+	p := newPrinter(ast)
+	p.file(ast)
+
+	_, err := w.Write(p.buf.Bytes())
+	return err
+}
+
+type printer struct {
+	buf bytes.Buffer
+
+	// The number of tabs to indent lines with, and whether nothing has been
+	// written on the current line yet. The indentation is written along with
+	// the first text of each line, so that empty lines stay empty.
+	indent      int
+	atLineStart bool
+
+	// The comments not printed yet, in order
+	comments []Comment
+
+	blankLines map[Pos]bool
+	heredocs   map[Pos]bool
+
+	// Whether the next line must be preceded by a blank line, as after a
+	// definition, and whether it is the first line of a block or list, where
+	// blank lines are left out.
+	needBlank  bool
+	blockStart bool
+
+	// Whether all values are printed on a single line, as inside of an
+	// interpolated string.
+	inline bool
+}
+
+func newPrinter(ast *AST) *printer {
+	p := &printer{
+		atLineStart: true,
+		blockStart:  true,
+		comments:    ast.Layout.Comments,
+		blankLines:  map[Pos]bool{},
+		heredocs:    map[Pos]bool{},
+	}
+	for _, pos := range ast.Layout.BlankLines {
+		p.blankLines[pos] = true
+	}
+	for _, pos := range ast.Layout.Heredocs {
+		p.heredocs[pos] = true
+	}
+
+	return p
+}
+
+func (p *printer) write(s string) {
+	if s == "" {
+		return
+	}
+	if p.atLineStart {
+		p.buf.WriteString(strings.Repeat("\t", p.indent))
+		p.atLineStart = false
+	}
+	p.buf.WriteString(s)
+}
+
+func (p *printer) newline() {
+	p.buf.WriteByte('\n')
+	p.atLineStart = true
+}
+
+// Prepares for printing something starting at pos on a line of its own, by
+// printing the comments before it, and the blank line before it if there was
+// one in the source.
+func (p *printer) startLine(pos Pos) {
+	p.flushComments(pos)
+	p.blankLine(pos)
+}
+
+func (p *printer) blankLine(pos Pos) {
+	if (p.needBlank || p.blankLines[pos]) && !p.blockStart {
+		p.newline()
+	}
+	p.needBlank = false
+	p.blockStart = false
+}
+
+// Prints all comments written before pos. Nothing is printed if pos is
+// invalid, as in manifests which weren't parsed.
+func (p *printer) flushComments(pos Pos) {
+	for p.hasCommentsBefore(pos) {
+		p.comment(p.comments[0])
+		p.comments = p.comments[1:]
+	}
+}
+
+func (p *printer) hasCommentsBefore(pos Pos) bool {
+	return pos.IsValid() && len(p.comments) > 0 && p.comments[0].Pos.Before(pos)
+}
+
+func (p *printer) comment(c Comment) {
+	if c.Trailing && p.atLineStart && p.buf.Len() > 0 {
+		// Put the comment back at the end of the line before
+		p.buf.Truncate(p.buf.Len() - 1)
+		p.buf.WriteString(" " + c.Text)
+		p.newline()
+		return
+	}
+
+	if !p.atLineStart {
+		p.newline()
+	}
+	p.blankLine(c.Pos)
+	p.write(c.Text)
+	p.newline()
+}
+
+func (p *printer) file(ast *AST) {
+	var defs []interface{}
+	for i := range ast.Imports {
+		defs = append(defs, &ast.Imports[i])
+	}
+	for i := range ast.Classes {
+		defs = append(defs, &ast.Classes[i])
+	}
+	for i := range ast.Defines {
+		defs = append(defs, &ast.Defines[i])
+	}
+	for i := range ast.Nodes {
+		defs = append(defs, &ast.Nodes[i])
+	}
+	for i := range ast.Funcs {
+		defs = append(defs, &ast.Funcs[i])
+	}
+	for i := range ast.Facters {
+		defs = append(defs, &ast.Facters[i])
+	}
+	sort.SliceStable(defs, func(i, j int) bool {
+		return definitionPos(defs[i]).Before(definitionPos(defs[j]))
+	})
+
+	for i, def := range defs {
+		// Definitions are separated by blank lines, except for imports
+		// following each other.
+		_, isImport := def.(*Import)
+		if i > 0 {
+			_, prevIsImport := defs[i-1].(*Import)
+			p.needBlank = !isImport || !prevIsImport
+		}
+
+		p.startLine(definitionPos(def))
+		p.definition(def)
+		p.newline()
+	}
+
+	for len(p.comments) > 0 {
+		p.comment(p.comments[0])
+		p.comments = p.comments[1:]
+	}
+}
+
+func definitionPos(def interface{}) Pos {
+	switch def := def.(type) {
+	case *Import:
+		return def.Pos
+	case *Class:
+		return def.Pos
+	case *Define:
+		return def.Pos
+	case *Node:
+		return def.Pos
+	case *Func:
+		return def.Pos
+	case *Facter:
+		return def.Pos
+	}
+
+	panic(fmt.Sprintf("Not a definition: %#v", def))
+}
+
+func (p *printer) definition(def interface{}) {
+	switch def := def.(type) {
+	case *Import:
+		path := def.Written
+		if path == "" {
+			path = def.Path
+		}
+		p.write("import " + QuotedString(path).String())
+	case *Class:
+		p.write("class " + def.Name)
+		if len(def.ArgDefs) > 0 {
+			p.argDefs(def.Pos, def.ArgDefs)
+		}
+		p.write(" ")
+		p.block(&def.Block)
+	case *Define:
+		p.write(fmt.Sprintf("define %s %s", def.Type, def.Name))
+		p.argDefs(def.Pos, def.ArgDefs)
+		p.write(" ")
+		p.block(&def.Block)
+	case *Node:
+		p.write("node " + QuotedString(def.Name).String() + " ")
+		p.block(&def.Block)
+	case *Func:
+		p.write("func " + def.Name)
+		p.argDefs(def.Pos, def.ArgDefs)
+		p.write(" ")
+		p.block(&def.Block)
+	case *Facter:
+		p.write(fmt.Sprintf("facter %s %s", def.Type, def.Name))
+		p.argDefs(def.Pos, def.ArgDefs)
+		p.write(" ")
+		p.block(&def.Block)
+	}
+}
+
+// Prints the argument definitions of a class, define, function or facter
+// defined at pos, on the form ($name, $port = 80,). The arguments are written
+// one per line if any of them wasn't on the same line as the definition.
+func (p *printer) argDefs(pos Pos, argDefs []VariableDef) {
+	multiLine := false
+	for _, def := range argDefs {
+		if def.Pos.IsValid() && def.Pos.Line != pos.Line {
+			multiLine = !p.inline
+		}
+	}
+
+	p.write("(")
+	if multiLine {
+		p.newline()
+		p.indent++
+		p.blockStart = true
+	}
+
+	for i, def := range argDefs {
+		if multiLine {
+			p.startLine(def.Pos)
+		} else if i > 0 {
+			p.write(" ")
+		}
+
+		p.write(def.VariableName.Str)
+		if def.Val != nil {
+			p.write(" = ")
+			p.value(def.Val, 0, true)
+		}
+		p.write(",")
+
+		if multiLine {
+			p.newline()
+		}
+	}
+
+	if multiLine {
+		p.indent--
+	}
+	p.write(")")
+}
+
+func (p *printer) block(b *Block) {
+	stmts := b.OrderedStatements()
+	if len(stmts) == 0 && !p.hasCommentsBefore(b.End) {
+		p.write("{}")
+		return
+	}
+
+	p.write("{")
+	p.newline()
+	p.indent++
+	p.blockStart = true
+
+	for i := range stmts {
+		p.statement(&stmts[i])
+	}
+	p.flushComments(b.End)
+
+	p.indent--
+	p.blockStart = false
+	p.write("}")
+}
+
+func (p *printer) statement(s *Statement) {
+	p.startLine(s.Pos())
+
+	switch stmt := s.Stmt.(type) {
+	case *VariableDef:
+		p.write(stmt.VariableName.Str + " = ")
+		p.value(stmt.Val, 0, true)
+	case *Declaration:
+		p.write(stmt.Type + " { ")
+		p.value(stmt.Scalar, 0, false)
+		p.write(":")
+		if len(stmt.Props) == 0 {
+			p.write(" }")
+		} else {
+			p.props(stmt.Props)
+			p.write("}")
+		}
+	case *If:
+		p.write("if ")
+		p.value(stmt.Expression, 0, false)
+		p.write(" ")
+		p.block(&stmt.Block)
+		for i := range stmt.ElseIfs {
+			elseIf := &stmt.ElseIfs[i]
+			p.write(" elsif ")
+			p.value(elseIf.Expression, 0, false)
+			p.write(" ")
+			p.block(&elseIf.Block)
+		}
+		if stmt.Else != nil {
+			p.write(" else ")
+			p.block(stmt.Else)
+		}
+	case *Case:
+		p.caseStatement(stmt)
+	case *For:
+		p.write("for ")
+		if stmt.Key != nil {
+			p.write(stmt.Key.Str + ", ")
+		}
+		p.write(stmt.Value.Str + " in ")
+		p.value(stmt.Collection, 0, false)
+		p.write(" ")
+		p.block(&stmt.Block)
+	case *Include:
+		p.write("include " + stmt.Class)
+	case *Return:
+		p.write("return ")
+		p.value(stmt.Value, 0, true)
+	}
+
+	p.newline()
+}
+
+// Prints the properties of a declaration or a probe, one per line with the
+// arrows aligned. The line holding the opening brace must not be ended yet.
+func (p *printer) props(props []Prop) {
+	width := 0
+	for _, prop := range props {
+		if len(prop.Name) > width {
+			width = len(prop.Name)
+		}
+	}
+
+	p.newline()
+	p.indent++
+	p.blockStart = true
+
+	for _, prop := range props {
+		p.startLine(prop.Pos)
+		p.write(prop.Name + strings.Repeat(" ", width-len(prop.Name)) + " => ")
+		p.value(prop.Value, 0, true)
+		p.write(",")
+		p.newline()
+	}
+
+	p.indent--
+}
+
+func (p *printer) caseStatement(c *Case) {
+	p.write("case ")
+	p.value(c.Value, 0, false)
+	p.write(" {")
+	p.newline()
+	p.indent++
+	p.blockStart = true
+
+	// The default branch is printed where it was written
+	defaultAt := len(c.Branches)
+	if c.Default != nil && c.Default.Pos.IsValid() {
+		for i, branch := range c.Branches {
+			if c.Default.Pos.Before(branch.Pos) {
+				defaultAt = i
+				break
+			}
+		}
+	}
+
+	for i := 0; i <= len(c.Branches); i++ {
+		if i == defaultAt && c.Default != nil {
+			p.startLine(c.Default.Pos)
+			p.write("default: ")
+			p.block(c.Default)
+			p.newline()
+		}
+		if i == len(c.Branches) {
+			break
+		}
+
+		branch := &c.Branches[i]
+		p.startLine(branch.Pos)
+		for j, match := range branch.Matches {
+			if j > 0 {
+				p.write(", ")
+			}
+			p.value(match, 0, false)
+		}
+		p.write(": ")
+		p.block(&branch.Block)
+		p.newline()
+	}
+
+	p.indent--
+	p.write("}")
+}
+
+// The precedences of the operators, which are the same as in the grammar.
+// Operators with higher precedence bind tighter.
+const (
+	selectorPrec = 1
+	unaryPrec    = 7
+	atomPrec     = 8
+)
+
+var binaryPrecs = map[ExpOp]int{
+	"||": 2,
+	"&&": 3,
+	"==": 4, "!=": 4, "<": 4, "<=": 4, ">": 4, ">=": 4, "=~": 4, "!~": 4,
+	"in": 4,
+	"+":  5, "-": 5,
+	"*": 6, "/": 6, "%": 6,
+}
+
+func precedence(v Value) int {
+	switch v := v.(type) {
+	case Expression:
+		return binaryPrecs[v.Operation]
+	case UnaryExpression:
+		return unaryPrec
+	case Selector:
+		return selectorPrec
+	}
+
+	return atomPrec
+}
+
+// Returns the position where a value starts, or an invalid position if it's
+// unknown.
+func valuePos(v Value) Pos {
+	switch v := v.(type) {
+	case Literal:
+		return v.Pos
+	case VariableName:
+		return v.Pos
+	case InterpolatedString:
+		return v.Pos
+	case Expression:
+		return v.Pos
+	case UnaryExpression:
+		return v.Pos
+	case Selector:
+		return v.Pos
+	case Reference:
+		return v.Pos
+	case Index:
+		return v.Pos
+	case Slice:
+		return v.Pos
+	case FunctionCall:
+		return v.Pos
+	case Probe:
+		return v.Pos
+	case Array:
+		if len(v) > 0 {
+			return valuePos(v[0])
+		}
+	case Hash:
+		if len(v) > 0 {
+			return v[0].Pos
+		}
+	}
+
+	return Pos{}
+}
+
+// Prints a value. Parentheses are added if it binds less tightly than prec.
+// heredoc tells whether a string written as a heredoc may be printed as one,
+// which requires that nothing but a closing character such as , or ) follows
+// the value on the line of the end marker.
+func (p *printer) value(v Value, prec int, heredoc bool) {
+	pos := valuePos(v)
+	if l, isLiteral := v.(Literal); isLiteral {
+		v = l.Val
+	}
+
+	if precedence(v) < prec {
+		p.write("(")
+		p.value(v, 0, false)
+		p.write(")")
+		return
+	}
+
+	switch v := v.(type) {
+	case int:
+		p.write(strconv.Itoa(v))
+	case int64:
+		p.write(strconv.FormatInt(v, 10))
+	case Float:
+		p.write(v.String())
+	case Bool:
+		p.write(strconv.FormatBool(bool(v)))
+	case QuotedString:
+		segments := []interface{}{string(v)}
+		if !heredoc || !p.heredocs[pos] || !p.heredoc(segments, true) {
+			p.write(v.String())
+		}
+	case string:
+		p.write(QuotedString(v).String())
+	case Regex:
+		p.write(v.String())
+	case VariableName:
+		p.write(v.Str)
+	case InterpolatedString:
+		if !heredoc || !p.heredocs[pos] || !p.heredoc(v.Segments, false) {
+			p.write(`"` + p.segments(v.Segments) + `"`)
+		}
+	case Expression:
+		opPrec := binaryPrecs[v.Operation]
+		p.value(v.Left, opPrec, false)
+		p.write(" " + string(v.Operation) + " ")
+		// All binary operators are left associative
+		p.value(v.Right, opPrec+1, false)
+	case UnaryExpression:
+		p.write(string(v.Operation))
+		p.value(v.Value, unaryPrec, false)
+	case Selector:
+		p.value(v.Value, selectorPrec, false)
+		p.write(" ? ")
+		p.selectorCases(v)
+	case Array:
+		positions := make([]Pos, len(v))
+		for i, val := range v {
+			positions[i] = valuePos(val)
+		}
+		p.list("[", "]", positions, func(i int) {
+			p.value(v[i], 0, true)
+		})
+	case Hash:
+		positions := make([]Pos, len(v))
+		for i, entry := range v {
+			positions[i] = entry.Pos
+		}
+		p.list("{", "}", positions, func(i int) {
+			p.value(v[i].Key, 0, false)
+			p.write(" => ")
+			p.value(v[i].Val, 0, true)
+		})
+	case Reference:
+		p.write(v.Type + "[")
+		p.value(v.Scalar, 0, true)
+		p.write("]")
+	case Index:
+		p.value(v.Value, atomPrec, false)
+		p.write("[")
+		p.value(v.Key, 0, true)
+		p.write("]")
+	case Slice:
+		p.value(v.Value, atomPrec, false)
+		p.write("[")
+		if v.From != nil {
+			p.value(v.From, 0, false)
+		}
+		p.write(":")
+		if v.To != nil {
+			p.value(v.To, 0, true)
+		}
+		p.write("]")
+	case FunctionCall:
+		p.write(v.Name + "(")
+		for i, arg := range v.Args {
+			if i > 0 {
+				p.write(", ")
+			}
+			p.value(arg, 0, true)
+		}
+		p.write(")")
+	case Probe:
+		p.write("exec { ")
+		p.value(v.Command, 0, false)
+		p.write(":")
+		positions := []Pos{v.Pos}
+		for _, prop := range v.Props {
+			positions = append(positions, prop.Pos)
+		}
+		if len(v.Props) > 0 && p.spansLines(positions) {
+			p.props(v.Props)
+			p.write("}")
+		} else {
+			for _, prop := range v.Props {
+				p.write(" " + prop.Name + " => ")
+				p.value(prop.Value, 0, true)
+				p.write(",")
+			}
+			p.write(" }")
+		}
+	default:
+		panic(fmt.Sprintf("Can't print value %#v", v))
+	}
+}
+
+func (p *printer) selectorCases(s Selector) {
+	positions := make([]Pos, len(s.Cases))
+	for i, c := range s.Cases {
+		positions[i] = c.Pos
+	}
+	if s.Default != nil {
+		positions = append(positions, valuePos(s.Default))
+	}
+
+	p.list("{", "}", positions, func(i int) {
+		if i == len(s.Cases) {
+			p.write("default => ")
+			p.value(s.Default, 0, true)
+			return
+		}
+
+		p.value(s.Cases[i].Match, 0, false)
+		p.write(" => ")
+		p.value(s.Cases[i].Val, 0, true)
+	})
+}
+
+// Returns whether the positions are on more than one line. Positions which
+// aren't known are ignored.
+func (p *printer) spansLines(positions []Pos) bool {
+	if p.inline {
+		return false
+	}
+
+	line := 0
+	for _, pos := range positions {
+		if !pos.IsValid() {
+			continue
+		}
+		if line == 0 {
+			line = pos.Line
+		} else if pos.Line != line {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Prints the items of an array, hash or selector between open and close, each
+// followed by a comma. The items are printed one per line if their positions
+// are on different lines, and on a single line otherwise.
+func (p *printer) list(open, close string, positions []Pos, item func(i int)) {
+	if len(positions) == 0 {
+		p.write(open + close)
+		return
+	}
+
+	p.write(open)
+	if !p.spansLines(positions) {
+		for i := range positions {
+			p.write(" ")
+			item(i)
+			p.write(",")
+		}
+		p.write(" " + close)
+		return
+	}
+
+	p.newline()
+	p.indent++
+	p.blockStart = true
+
+	for i, pos := range positions {
+		p.startLine(pos)
+		item(i)
+		p.write(",")
+		p.newline()
+	}
+
+	p.indent--
+	p.write(close)
+}
+
+// Heredocs hold their line breaks and tabs as is
+var heredocEscaper = strings.NewReplacer(`\`, `\\`, `$`, `\$`)
+
+// Returns the raw text of a segment of an interpolated string, and whether the
+// segment is text rather than interpolated.
+func segmentText(segment interface{}) (string, bool) {
+	if l, isLiteral := segment.(Literal); isLiteral {
+		segment = l.Val
+	}
+	text, isText := segment.(string)
+	return text, isText
+}
+
+// Returns the segments of a double-quoted string as source.
+func (p *printer) segments(segments []interface{}) string {
+	str := ""
+	for i, segment := range segments {
+		if text, isText := segmentText(segment); isText {
+			str += EscapeInterpolated(text)
+		} else {
+			str += p.interpolation(segments, i)
+		}
+	}
+
+	return str
+}
+
+func isText(segment interface{}) bool {
+	_, isText := segmentText(segment)
+	return isText
+}
+
+// Returns an interpolated segment of a string as source, for instance $name or
+// ${ $port + 1 }.
+func (p *printer) interpolation(segments []interface{}, i int) string {
+	if _, isVariable := segments[i].(VariableName); isVariable {
+		return InterpolatedVariable(segments, i)
+	}
+
+	inline := &printer{inline: true}
+	inline.value(segments[i], 0, false)
+	return "${ " + inline.buf.String() + " }"
+}
+
+// Prints a string as a heredoc, with its lines indented one level deeper than
+// the current line. literal tells whether the heredoc is written without
+// interpolation. Returns false without printing anything if the string can't
+// be written as a heredoc.
+func (p *printer) heredoc(segments []interface{}, literal bool) bool {
+	// The parser strips the indentation that all lines have in common, unless
+	// the first line starts with interpolation or all lines are blank.
+	skeleton := ""
+	for i, segment := range segments {
+		if text, isText := segmentText(segment); isText {
+			skeleton += text
+		} else if interpolation := p.interpolation(segments, i); strings.Contains(interpolation, "\n") {
+			return false
+		} else {
+			skeleton += "x"
+		}
+	}
+	if skeleton != "" && !strings.HasSuffix(skeleton, "\n") {
+		return false
+	}
+	lines := strings.Split(strings.TrimSuffix(skeleton, "\n"), "\n")
+
+	indent := ""
+	if len(segments) > 0 && isText(segments[0]) {
+		for _, line := range lines {
+			if strings.TrimLeft(line, " \t") != "" {
+				indent = strings.Repeat("\t", p.indent+1)
+				break
+			}
+		}
+	}
+
+	marker := "EOT"
+	for n := 2; ; n++ {
+		taken := false
+		for _, line := range lines {
+			if strings.HasPrefix(strings.TrimLeft(line, " \t"), marker) {
+				taken = true
+				break
+			}
+		}
+		if !taken {
+			break
+		}
+		marker = fmt.Sprintf("EOT%d", n)
+	}
+
+	body := ""
+	lineStart := true
+	for i, segment := range segments {
+		text, isText := segmentText(segment)
+		if !isText {
+			if lineStart {
+				body += indent
+				lineStart = false
+			}
+			body += p.interpolation(segments, i)
+			continue
+		}
+
+		for j, line := range strings.Split(text, "\n") {
+			if j > 0 {
+				body += "\n"
+				lineStart = true
+			}
+			if line == "" {
+				continue
+			}
+			if lineStart {
+				body += indent
+				lineStart = false
+			}
+			if literal {
+				body += line
+			} else {
+				body += heredocEscaper.Replace(line)
+			}
+		}
+	}
+
+	if literal {
+		p.write("<<'" + marker + "'")
+	} else {
+		p.write("<<" + marker)
+	}
+	p.newline()
+	p.buf.WriteString(body)
+	p.write(marker)
+
+	return true
+}
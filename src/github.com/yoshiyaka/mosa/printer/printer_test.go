@@ -0,0 +1,301 @@
+package printer
+
+import (
+	"bytes"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	. "github.com/yoshiyaka/mosa/ast"
+	"github.com/yoshiyaka/mosa/parser"
+)
+
+var formatTests = []struct {
+	manifest, expected string
+}{
+	{
+		``,
+		``,
+	},
+
+	{
+		`
+		import 'b.ms'
+		import 'c.ms'
+		class A {}
+		class B($x, $y = 2,) { }
+		`,
+		`import 'b.ms'
+import 'c.ms'
+
+class A {}
+
+class B($x, $y = 2,) {}
+`,
+	},
+
+	{
+		// Statements are kept in order, and blank lines are kept within
+		// blocks but not at their starts
+		`
+		class A {
+
+		  file { 'a': }
+		  $x = 1
+		  if $x == 1 { $y = 2 } elsif !$x { $y = 3 } else { $y = 4 }
+
+
+		  package { 'b': ensure => 'present', depends => file['a'], }
+		}
+		`,
+		`class A {
+	file { 'a': }
+	$x = 1
+	if $x == 1 {
+		$y = 2
+	} elsif !$x {
+		$y = 3
+	} else {
+		$y = 4
+	}
+
+	package { 'b':
+		ensure  => 'present',
+		depends => file['a'],
+	}
+}
+`,
+	},
+
+	{
+		`
+		// The class
+		class A { // the block
+		  // leading
+		  $a = 1 /* trailing */
+		  $b = [
+		    1, // one
+		    2,
+		  ]
+
+		  /* last
+		     one */
+		}
+		// The end
+		`,
+		`// The class
+class A { // the block
+	// leading
+	$a = 1 /* trailing */
+	$b = [
+		1, // one
+		2,
+	]
+
+	/* last
+		     one */
+}
+// The end
+`,
+	},
+
+	{
+		`
+		define single foo($name,
+		  $port = 80,) {
+		  case $port {
+		    default: {}
+		    80, 443: { include web }
+		  }
+		  for $k, $v in { 'a' => 1, 'b' => 2, } { $x = $k }
+		}
+		node 'n.example.com' { include web }
+		func f() { return exec { 'ls': stdout => true, } }
+		`,
+		`define single foo(
+	$name,
+	$port = 80,
+) {
+	case $port {
+		default: {}
+		80, 443: {
+			include web
+		}
+	}
+	for $k, $v in { 'a' => 1, 'b' => 2, } {
+		$x = $k
+	}
+}
+
+node 'n.example.com' {
+	include web
+}
+
+func f() {
+	return exec { 'ls': stdout => true, }
+}
+`,
+	},
+
+	{
+		// Only the parentheses that are needed are kept
+		`
+		class A {
+		  $a = (1 + 2) * 3
+		  $b = 1 + (2 * 3)
+		  $c = 1 - (2 - 3)
+		  $d = (1 - 2) - 3
+		  $e = -(1 + $x[0])
+		  $f = !($x && $y) || $z =~ /a+/
+		  $g = ($x ? { 1 => 2, default => 3, }) + 1
+		  $h = $x[1:][:2]
+		}
+		`,
+		`class A {
+	$a = (1 + 2) * 3
+	$b = 1 + 2 * 3
+	$c = 1 - (2 - 3)
+	$d = 1 - 2 - 3
+	$e = -(1 + $x[0])
+	$f = !($x && $y) || $z =~ /a+/
+	$g = ($x ? { 1 => 2, default => 3, }) + 1
+	$h = $x[1:][:2]
+}
+`,
+	},
+
+	{
+		"class A {\n" +
+			`$a = "$x ${x}_y \$ \" ${ $x + 1 } \\ 'q'"` + "\n" +
+			`$b = 'it\'s'` + "\n" +
+			"}",
+		`class A {
+	$a = "$x ${x}_y \$ \" ${ $x + 1 } \\ 'q'"
+	$b = 'it\'s'
+}
+`,
+	},
+
+	{
+		// Control characters in double-quoted strings are escaped back
+		"class A {\n" +
+			`file { 'a': stdin => "a\tb\r\n$x\n", }` + "\n" +
+			"}",
+		`class A {
+	file { 'a':
+		stdin => "a\tb\r\n$x\n",
+	}
+}
+`,
+	},
+
+	{
+		// Captures are kept as ${1}, since $1 is text in strings
+		"class A {\n" +
+			`$a = "${1}-$name awk '{ print $2 }'"` + "\n" +
+			"}",
+		`class A {
+	$a = "${1}-$name awk '{ print \$2 }'"
+}
+`,
+	},
+
+	{
+		// Heredocs are indented one level deeper than their line
+		`
+		class A {
+		  file { 'a':
+		    content => <<EOT
+		      line $x
+		        "more" \$
+		      EOT,
+		    mode => <<'EOT'
+		  EOT is taken
+		  EOT,
+		  }
+		  $x = <<EOT
+		EOT
+		}
+		`,
+		`class A {
+	file { 'a':
+		content => <<EOT
+			line $x
+			  "more" \$
+		EOT,
+		mode    => <<'EOT2'
+			EOT is taken
+		EOT2,
+	}
+	$x = <<EOT
+	EOT
+}
+`,
+	},
+}
+
+func TestFormat(t *testing.T) {
+	for _, test := range formatTests {
+		formatted, err := Format("test.ms", []byte(test.manifest))
+		if err != nil {
+			t.Error(test.manifest, err)
+			continue
+		}
+		if string(formatted) != test.expected {
+			t.Errorf("Formatted\n%s\nas\n%s\nexpected\n%s", test.manifest, formatted, test.expected)
+			continue
+		}
+
+		// Formatting must be idempotent
+		if again, err := Format("test.ms", formatted); err != nil {
+			t.Error(string(formatted), err)
+		} else if !bytes.Equal(again, formatted) {
+			t.Errorf("Formatting\n%s\nagain gave\n%s", formatted, again)
+		}
+	}
+}
+
+func parse(t *testing.T, src []byte) *AST {
+	ast := NewAST()
+	if err := parser.Parse(ast, "test.ms", bytes.NewReader(src)); err != nil {
+		t.Fatal(string(src), err)
+	}
+	return ast
+}
+
+// Makes sure that formatting doesn't change the meaning of manifests, by
+// comparing the printed ASTs of the original and the formatted files.
+func TestFormatKeepsMeaning(t *testing.T) {
+	manifests := [][]byte{}
+	for _, test := range formatTests {
+		manifests = append(manifests, []byte(test.manifest))
+	}
+	paths, _ := filepath.Glob("../testdata/*.ms")
+	for _, path := range paths {
+		src, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		manifests = append(manifests, src)
+	}
+
+	for _, src := range manifests {
+		formatted, err := Format("test.ms", src)
+		if err != nil {
+			t.Error(string(src), err)
+			continue
+		}
+
+		original, reparsed := parse(t, src).String(), parse(t, formatted).String()
+		if original != reparsed {
+			t.Errorf("Formatted\n%s\nas\n%s\nwhich means\n%s\ninstead of\n%s", src, formatted, reparsed, original)
+		}
+	}
+}
+
+func TestFormatSyntaxError(t *testing.T) {
+	_, err := Format("bad.ms", []byte("class A { $a = }"))
+	if _, isList := err.(parser.ErrorList); !isList {
+		t.Errorf("Got %#v, expected a parser.ErrorList", err)
+	}
+}
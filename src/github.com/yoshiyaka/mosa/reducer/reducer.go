@@ -4,9 +4,22 @@ import (
 	"os/exec"
 
 	. "github.com/yoshiyaka/mosa/ast"
+	"github.com/yoshiyaka/mosa/resolver"
 )
 
-func Reduce(d []Declaration) ([]Declaration, error) {
+// Returns the exec declarations in d which are needed to reach the state
+// described by the manifest. Realizations of defines which their facters
+// report as satisfied are removed together with everything declared inside of
+// them. facters may be nil, in which case only the 'unless' parameter of exec
+// is used.
+func Reduce(d []Declaration, facters *resolver.Facters) ([]Declaration, error) {
+	if facters != nil {
+		var err error
+		if d, err = facters.Reduce(d); err != nil {
+			return nil, err
+		}
+	}
+
 	ret := make([]Declaration, 0)
 
 	for _, decl := range d {
@@ -73,11 +73,62 @@ var reducerTests = []struct {
 		`,
 		`exec { 'b-a-foo': }`,
 	},
+
+	{
+		`node 'n' {
+			file { '/a': content => 'x', }
+			file { '/b': content => 'y', }
+		}
+		define single file($name, $content,) {
+			exec { "write $name": stdin => $content, }
+		}
+		facter single file($name, $content,) {
+			return $content == 'x'
+		}
+		`,
+		`exec { 'write /b': stdin => 'y', }`,
+	},
+
+	{
+		`node 'n' {
+			package { [ 'a', 'b', 'c', ]: }
+			package { 'd': ensure => 'latest', }
+		}
+		define multiple package($names, $ensure = 'present',) {
+			exec { "install $names": }
+		}
+		facter multiple package($names, $ensure = 'present',) {
+			if $ensure == 'latest' {
+				return true
+			}
+			return [ 'b', ]
+		}
+		`,
+		`exec { 'install b': }`,
+	},
+
+	{
+		`node 'n' {
+			a { 'foo': }
+			a { 'bar': }
+		}
+		define single a($name,) {
+			b { "a-$name": }
+		}
+		define single b($name,) {
+			exec { "b-$name": }
+		}
+		facter single a($name,) {
+			return $name == 'foo'
+		}
+		`,
+		`exec { 'b-a-bar': }`,
+	},
 }
 
 func TestReducer(t *testing.T) {
 	for _, test := range reducerTests {
-		inputDecls, inputErr := parseDecls(test.inputManifest)
+		inputDecls, facters, inputErr := parseDecls(test.inputManifest)
 		if inputErr != nil {
 			t.Log(test.inputManifest)
 			t.Error(inputErr)
@@ -87,14 +138,14 @@ func TestReducer(t *testing.T) {
 		realExpectedManifest := fmt.Sprintf(
 			`node 'n' { %s }`, test.expectedManifest,
 		)
-		expectedDecls, expectedErr := parseDecls(realExpectedManifest)
+		expectedDecls, _, expectedErr := parseDecls(realExpectedManifest)
 		if expectedErr != nil {
 			t.Log(test.expectedManifest)
 			t.Error(expectedErr)
 			continue
 		}
 
-		reduced, reducedErr := Reduce(inputDecls)
+		reduced, reducedErr := Reduce(inputDecls, facters)
 		if reducedErr != nil {
 			t.Log(test.inputManifest)
 			t.Error(reducedErr)
@@ -111,15 +162,73 @@ func TestReducer(t *testing.T) {
 	}
 }
 
-func parseDecls(manifest string) ([]Declaration, error) {
+var badReducerTests = []struct {
+	manifest    string
+	expectedErr string
+}{
+	{
+		`node 'n' {
+			file { '/a': }
+		}
+		define single file($name,) {}
+		facter single file($name,) {
+			return 'yes'
+		}
+		`,
+		`Facter for type 'file' at t.ms:5:3 must return a bool (got ast.QuotedString)`,
+	},
+
+	{
+		`node 'n' {
+			package { 'a': }
+		}
+		define multiple package($names,) {}
+		facter multiple package($names,) {
+			return 5
+		}
+		`,
+		`Facter for type 'package' at t.ms:5:3 must return a bool or an array of names (got int)`,
+	},
+
+	{
+		`node 'n' {
+			file { '/a': }
+		}
+		define single file($name,) {}
+		facter single file($name,) {
+			if false {
+				return true
+			}
+		}
+		`,
+		`Facter for type 'file' defined at t.ms:5:3 didn't return a value`,
+	},
+}
+
+func TestBadReducer(t *testing.T) {
+	for _, test := range badReducerTests {
+		decls, facters, err := parseDecls(test.manifest)
+		if err != nil {
+			t.Log(test.manifest)
+			t.Error(err)
+			continue
+		}
+
+		if _, err := Reduce(decls, facters); err == nil {
+			t.Log(test.manifest)
+			t.Error("Got no error for bad manifest")
+		} else if err.Error() != test.expectedErr {
+			t.Log(test.manifest)
+			t.Error("Got bad error:", err)
+		}
+	}
+}
+
+func parseDecls(manifest string) ([]Declaration, *resolver.Facters, error) {
 	var ast AST
 	if err := parser.Parse(&ast, "t.ms", strings.NewReader(manifest)); err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
-	if decls, err := resolver.Resolve(&ast); err != nil {
-		return nil, err
-	} else {
-		return decls, nil
-	}
+	return resolver.ResolveWithFacters(&ast, resolver.NewProber())
 }
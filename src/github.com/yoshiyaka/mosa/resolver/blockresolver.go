@@ -20,9 +20,9 @@ type blockResolver struct {
 
 func newBlockResolver(b *Block, ls *localState, gs *globalState, allowClassRealizations bool) *blockResolver {
 	return &blockResolver{
-		block: b,
-		ls:    ls,
-		gs:    gs,
+		block:                  b,
+		ls:                     ls,
+		gs:                     gs,
 		allowClassRealizations: allowClassRealizations,
 	}
 }
@@ -30,10 +30,17 @@ func newBlockResolver(b *Block, ls *localState, gs *globalState, allowClassReali
 func (br *blockResolver) resolve() (Block, error) {
 	retBlock := *br.block
 
+	if br.block.Return != nil {
+		return retBlock, fmt.Errorf(
+			"Return statements are only allowed in functions at %s",
+			br.block.Return.Pos,
+		)
+	}
+
 	for _, def := range br.block.VariableDefs {
-		if _, exists := br.ls.varDefsByName[def.VariableName.Str]; exists {
+		if br.ls.isDefined(def.VariableName.Str) {
 			return retBlock, &Err{
-				Line:       def.LineNum,
+				Pos:        def.Pos,
 				Type:       ErrorTypeMultipleDefinition,
 				SymbolName: string(def.VariableName.Str),
 			}
@@ -43,14 +50,9 @@ func (br *blockResolver) resolve() (Block, error) {
 	}
 
 	// Resolve top-level variables defined
-	newDefs := make([]VariableDef, len(br.block.VariableDefs))
-	for i, def := range br.block.VariableDefs {
-		var err error
-		def.Val, err = br.ls.resolveValue(def.Val, def.LineNum)
-		if err != nil {
-			return retBlock, err
-		}
-		newDefs[i] = def
+	newDefs, err := br.ls.bindVariables(br.block.VariableDefs)
+	if err != nil {
+		return retBlock, err
 	}
 	retBlock.VariableDefs = newDefs
 
@@ -63,6 +65,24 @@ func (br *blockResolver) resolve() (Block, error) {
 		}
 	}
 
+	retBlock.Cases = make([]Case, len(br.block.Cases))
+	for i, c := range br.block.Cases {
+		var err error
+		retBlock.Cases[i], err = br.resolveCase(&c)
+		if err != nil {
+			return retBlock, err
+		}
+	}
+
+	retBlock.Fors = make([]For, len(br.block.Fors))
+	for i := range br.block.Fors {
+		var err error
+		retBlock.Fors[i], err = br.resolveFor(&br.block.Fors[i])
+		if err != nil {
+			return retBlock, err
+		}
+	}
+
 	retBlock.Declarations = make([]Declaration, 0, len(br.block.Declarations))
 	for _, decl := range br.block.Declarations {
 		if decls, err := br.resolveDeclaration(&decl); err != nil {
@@ -74,14 +94,47 @@ func (br *blockResolver) resolve() (Block, error) {
 		}
 	}
 
+	// Includes come after the declarations, so that a class may be both
+	// declared and included in the same block regardless of the order.
+	for i := range br.block.Includes {
+		if err := br.resolveInclude(&br.block.Includes[i]); err != nil {
+			return retBlock, err
+		}
+	}
+
 	return retBlock, nil
 }
 
+// Realizes the class of an include statement, unless it's already realized.
+func (br *blockResolver) resolveInclude(inc *Include) error {
+	if !br.allowClassRealizations {
+		return fmt.Errorf(
+			"Can't realize classes inside of a define at %s", inc.Pos,
+		)
+	}
+
+	if _, realized := br.gs.realizedClasses[inc.Class]; realized {
+		return nil
+	}
+
+	// Lock the class like a declaration would, so that a later
+	// class { 'Name': } is reported as a realization made twice.
+	decl := &Declaration{
+		Pos:    inc.Pos,
+		Type:   "class",
+		Scalar: QuotedString(inc.Class),
+		Props:  []Prop{},
+	}
+	br.gs.lockRealization(decl, inc.Class, inc.Pos)
+
+	return br.realizeClass(inc.Class, decl)
+}
+
 func (cr *blockResolver) resolveDeclaration(decl *Declaration) ([]Declaration, error) {
 	var ret []Declaration
 
 	var resolvedNames Value
-	if v, err := cr.ls.resolveValue(decl.Scalar, decl.LineNum); err != nil {
+	if v, err := cr.ls.resolveValue(decl.Scalar); err != nil {
 		return ret, err
 	} else {
 		resolvedNames = v
@@ -102,8 +155,8 @@ func (cr *blockResolver) resolveDeclaration(decl *Declaration) ([]Declaration, e
 		for i, name := range namesArray {
 			if n, ok := name.(QuotedString); !ok {
 				return ret, fmt.Errorf(
-					"Can't realize declaration of type %s with non-string name at %s:%d",
-					decl.Type, cr.block.Filename, decl.LineNum,
+					"Can't realize declaration of type %s with non-string name at %s",
+					decl.Type, decl.Pos,
 				)
 			} else {
 				names[i] = n
@@ -111,18 +164,17 @@ func (cr *blockResolver) resolveDeclaration(decl *Declaration) ([]Declaration, e
 		}
 	} else {
 		return ret, fmt.Errorf(
-			"Can't realize declaration of type %s with non-string name at %s:%d",
-			decl.Type, cr.block.Filename, decl.LineNum,
+			"Can't realize declaration of type %s with non-string name at %s",
+			decl.Type, decl.Pos,
 		)
 	}
 
 	ret = make([]Declaration, 0, len(names))
 	for _, name := range names {
-		if previous := cr.gs.lockRealization(decl, string(name), cr.block.Filename, decl.LineNum); previous != nil {
+		if previous := cr.gs.lockRealization(decl, string(name), decl.Pos); previous != nil {
 			return ret, fmt.Errorf(
-				"%s[%s] realized twice at %s:%d. Previously realized at %s:%d",
-				decl.Type, name, cr.block.Filename, decl.LineNum,
-				previous.file, previous.line,
+				"%s[%s] realized twice at %s. Previously realized at %s",
+				decl.Type, name, decl.Pos, previous.pos,
 			)
 		}
 
@@ -146,19 +198,27 @@ func (cr *blockResolver) resolveDeclaration(decl *Declaration) ([]Declaration, e
 }
 
 func (cr *blockResolver) realizeDeclaration(name string, decl *Declaration) error {
-	def, defOk := cr.gs.definesByName[decl.Type]
-	if !defOk {
+	def, defOk, err := cr.gs.lookupDefine(decl.Type)
+	if err != nil {
+		return err
+	} else if !defOk {
 		return fmt.Errorf(
-			"Reference to undefined type '%s' at %s:%d",
-			decl.Type, cr.block.Filename, decl.LineNum,
+			"Reference to undefined type '%s' at %s", decl.Type, decl.Pos,
 		)
 	}
 
+	key := declKey{decl.Type, name}
+	if n := len(cr.gs.defineStack); n > 0 {
+		cr.gs.parents[key] = cr.gs.defineStack[n-1]
+	}
+
 	dr := newDeclarationResolver(
-		def, decl.Scalar, decl.Props, cr.gs, cr.block.Filename,
-		decl.LineNum,
+		def, decl.Scalar, decl.Props, cr.gs, decl.Pos,
 	)
-	if _, err := dr.resolve(); err != nil {
+	cr.gs.defineStack = append(cr.gs.defineStack, key)
+	_, err = dr.resolve()
+	cr.gs.defineStack = cr.gs.defineStack[:len(cr.gs.defineStack)-1]
+	if err != nil {
 		return err
 	}
 
@@ -167,9 +227,8 @@ func (cr *blockResolver) realizeDeclaration(name string, decl *Declaration) erro
 	}
 
 	cr.gs.realizedDeclarations[decl.Type][name] = realizedDeclaration{
-		d:    decl,
-		file: cr.block.Filename,
-		line: decl.LineNum,
+		d:   decl,
+		pos: decl.Pos,
 	}
 	cr.gs.realizedDeclarationsInOrder = append(
 		cr.gs.realizedDeclarationsInOrder, *decl,
@@ -181,31 +240,27 @@ func (cr *blockResolver) realizeDeclaration(name string, decl *Declaration) erro
 func (br *blockResolver) realizeClass(name string, decl *Declaration) error {
 	if !br.allowClassRealizations {
 		return fmt.Errorf(
-			"Can't realize classes inside of a define at %s:%d",
-			br.block.Filename, decl.LineNum,
+			"Can't realize classes inside of a define at %s", decl.Pos,
 		)
 	}
 
-	if class, ok := br.gs.classesByName[name]; !ok {
+	if class, ok, err := br.gs.lookupClass(name); err != nil {
+		return err
+	} else if !ok {
 		return fmt.Errorf(
-			"Reference to undefined class '%s' at %s:%d",
-			string(name), br.block.Filename, decl.LineNum,
+			"Reference to undefined class '%s' at %s", string(name), decl.Pos,
 		)
 	} else if oldDef, defined := br.gs.realizedClasses[name]; defined {
 		return fmt.Errorf(
-			"Class %s realized twice at %s:%d. Previously realized at %s:%d",
-			string(name), br.block.Filename, decl.LineNum,
-			oldDef.file, oldDef.line,
+			"Class %s realized twice at %s. Previously realized at %s",
+			string(name), decl.Pos, oldDef.pos,
 		)
 	} else {
 		br.gs.realizedClasses[string(name)] = realizedClass{
-			c:    class,
-			file: br.block.Filename,
-			line: decl.LineNum,
+			c:   class,
+			pos: decl.Pos,
 		}
-		nestedResolver := newClassResolver(
-			br.gs, class, decl.Props, br.block.Filename, decl.LineNum,
-		)
+		nestedResolver := newClassResolver(br.gs, class, decl.Props, decl.Pos)
 		_, err := nestedResolver.resolve()
 		return err
 	}
@@ -214,39 +269,88 @@ func (br *blockResolver) realizeClass(name string, decl *Declaration) error {
 func (br *blockResolver) resolveIf(_if *If) (If, error) {
 	retIf := *_if
 
-	var boolean bool
-	if boolVal, err := br.ls.resolveValue(_if.Expression, _if.LineNum); err != nil {
+	branch, captures, err := br.ls.resolveIfBranch(_if)
+	if err != nil || branch == nil {
 		return retIf, err
-	} else if realBool, ok := boolVal.(Bool); !ok {
-		return retIf, fmt.Errorf(
-			"Expressions in if-statements must be boolean at %s:%d",
-			br.block.Filename, _if.LineNum,
-		)
+	}
+
+	restore := br.ls.setCaptures(captures)
+	block, err := br.resolveBranch(branch)
+	restore()
+	if err != nil {
+		return retIf, err
+	}
+
+	if branch == &_if.Block {
+		retIf.Block = block
+	} else if branch == _if.Else {
+		retIf.Else = &block
 	} else {
-		boolean = bool(realBool)
+		retIf.ElseIfs = make([]ElseIf, len(_if.ElseIfs))
+		for i, _ := range _if.ElseIfs {
+			retIf.ElseIfs[i] = _if.ElseIfs[i]
+			if branch == &_if.ElseIfs[i].Block {
+				retIf.ElseIfs[i].Block = block
+			}
+		}
 	}
 
-	if boolean {
-		br := newBlockResolver(
-			&_if.Block, br.ls, br.gs, br.allowClassRealizations,
-		)
+	return retIf, nil
+}
 
-		var err error
-		retIf.Block, err = br.resolve()
-		if err != nil {
-			return retIf, err
+func (br *blockResolver) resolveCase(c *Case) (Case, error) {
+	retCase := *c
+
+	branch, err := br.ls.resolveCaseBranch(c)
+	if err != nil || branch == nil {
+		return retCase, err
+	}
+
+	block, err := br.resolveBranch(branch)
+	if err != nil {
+		return retCase, err
+	}
+
+	if branch == c.Default {
+		retCase.Default = &block
+	} else {
+		retCase.Branches = make([]CaseBranch, len(c.Branches))
+		for i, _ := range c.Branches {
+			retCase.Branches[i] = c.Branches[i]
+			if branch == &c.Branches[i].Block {
+				retCase.Branches[i].Block = block
+			}
 		}
-	} else if _if.Else != nil {
-		br := newBlockResolver(
-			_if.Else, br.ls, br.gs, br.allowClassRealizations,
-		)
+	}
 
-		if block, err := br.resolve(); err != nil {
-			return retIf, err
-		} else {
-			retIf.Else = &block
+	return retCase, nil
+}
+
+// Resolves the block of a for loop once for each element of its collection,
+// each time in a new scope. Realizing the same declaration in more than one
+// iteration is an error, just like anywhere else.
+func (br *blockResolver) resolveFor(f *For) (For, error) {
+	retFor := *f
+
+	scopes, err := br.ls.resolveForScopes(f)
+	if err != nil {
+		return retFor, err
+	}
+
+	retFor.Iterations = make([]Block, len(scopes))
+	for i, scope := range scopes {
+		retFor.Iterations[i], err = newBlockResolver(
+			&f.Block, scope, br.gs, br.allowClassRealizations,
+		).resolve()
+		if err != nil {
+			return retFor, &IterationError{Err: err, Iteration: i + 1, Pos: f.Pos}
 		}
 	}
 
-	return retIf, nil
+	return retFor, nil
+}
+
+// Resolves the block of a branch taken in an if or case statement.
+func (br *blockResolver) resolveBranch(b *Block) (Block, error) {
+	return newBlockResolver(b, br.ls, br.gs, br.allowClassRealizations).resolve()
 }
@@ -0,0 +1,470 @@
+package resolver
+
+import (
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	. "github.com/yoshiyaka/mosa/ast"
+)
+
+// The standard library of functions available to all manifests.
+func init() {
+	strFunc := func(f func(string) string) *Function {
+		return &Function{1, 1, func(args []Value) (Value, error) {
+			str, err := stringArg(args, 0)
+			if err != nil {
+				return nil, err
+			}
+			return QuotedString(f(str)), nil
+		}}
+	}
+
+	hashFunc := func(sum func([]byte) []byte) *Function {
+		return strFunc(func(str string) string {
+			return hex.EncodeToString(sum([]byte(str)))
+		})
+	}
+
+	roundFunc := func(round func(float64) float64) *Function {
+		return &Function{1, 1, func(args []Value) (Value, error) {
+			f, err := numberArg(args, 0)
+			if err != nil {
+				return nil, err
+			}
+			return int(round(f)), nil
+		}}
+	}
+
+	// Strings
+	RegisterFunction("len", &Function{1, 1, builtinLen})
+	RegisterFunction("upcase", strFunc(strings.ToUpper))
+	RegisterFunction("downcase", strFunc(strings.ToLower))
+	RegisterFunction("trim", strFunc(strings.TrimSpace))
+	RegisterFunction("str", &Function{1, 1, builtinStr})
+	RegisterFunction("split", &Function{2, 2, builtinSplit})
+	RegisterFunction("join", &Function{2, 2, builtinJoin})
+	RegisterFunction("implode", &Function{2, 2, builtinJoin})
+	RegisterFunction("replace", &Function{3, 3, builtinReplace})
+	RegisterFunction("has_prefix", &Function{2, 2, builtinHasPrefix})
+	RegisterFunction("has_suffix", &Function{2, 2, builtinHasSuffix})
+
+	// Arrays
+	RegisterFunction("sort", &Function{1, 1, builtinSort})
+	RegisterFunction("uniq", &Function{1, 1, builtinUniq})
+	RegisterFunction("reverse", &Function{1, 1, builtinReverse})
+	RegisterFunction("flatten", &Function{1, 1, builtinFlatten})
+
+	// Hashes
+	RegisterFunction("keys", &Function{1, 1, builtinKeys})
+	RegisterFunction("values", &Function{1, 1, builtinValues})
+	RegisterFunction("has_key", &Function{2, 2, builtinHasKey})
+	RegisterFunction("merge", &Function{1, -1, builtinMerge})
+
+	// Numbers
+	RegisterFunction("abs", &Function{1, 1, builtinAbs})
+	RegisterFunction("min", &Function{1, -1, builtinMin})
+	RegisterFunction("max", &Function{1, -1, builtinMax})
+	RegisterFunction("floor", roundFunc(math.Floor))
+	RegisterFunction("ceil", roundFunc(math.Ceil))
+	RegisterFunction("round", roundFunc(math.Round))
+	RegisterFunction("int", &Function{1, 1, builtinInt})
+	RegisterFunction("float", &Function{1, 1, builtinFloat})
+
+	// Hashing
+	RegisterFunction("md5sum", hashFunc(func(b []byte) []byte {
+		sum := md5.Sum(b)
+		return sum[:]
+	}))
+	RegisterFunction("sha1sum", hashFunc(func(b []byte) []byte {
+		sum := sha1.Sum(b)
+		return sum[:]
+	}))
+	RegisterFunction("sha256sum", hashFunc(func(b []byte) []byte {
+		sum := sha256.Sum256(b)
+		return sum[:]
+	}))
+}
+
+// Returns the number of characters in a string, or the number of entries in an
+// array or a hash.
+func builtinLen(args []Value) (Value, error) {
+	switch args[0].(type) {
+	case Array:
+		return len(args[0].(Array)), nil
+	case Hash:
+		return len(args[0].(Hash)), nil
+	}
+
+	str, err := stringArg(args, 0)
+	if err != nil {
+		return nil, argError(args, 0, "a string, an array or a hash")
+	}
+	return utf8.RuneCountInString(str), nil
+}
+
+// Returns the string representation of a scalar, for instance '5' for 5.
+func scalarToString(v Value) (string, bool) {
+	switch v.(type) {
+	case QuotedString:
+		return string(v.(QuotedString)), true
+	case string:
+		return v.(string), true
+	case int:
+		return strconv.Itoa(v.(int)), true
+	case Float:
+		return v.(Float).String(), true
+	case Bool:
+		return strconv.FormatBool(bool(v.(Bool))), true
+	}
+
+	return "", false
+}
+
+func builtinStr(args []Value) (Value, error) {
+	if str, ok := scalarToString(args[0]); ok {
+		return QuotedString(str), nil
+	}
+
+	return nil, argError(args, 0, "a string, a number or a bool")
+}
+
+func builtinSplit(args []Value) (Value, error) {
+	str, err := stringArg(args, 0)
+	if err != nil {
+		return nil, err
+	}
+	sep, err := stringArg(args, 1)
+	if err != nil {
+		return nil, err
+	}
+
+	parts := strings.Split(str, sep)
+	a := make(Array, len(parts))
+	for i, part := range parts {
+		a[i] = QuotedString(part)
+	}
+
+	return a, nil
+}
+
+// Joins all entries in an array into a string, for instance
+// join([ 'a', 'b', ], ', ') results in 'a, b'.
+func builtinJoin(args []Value) (Value, error) {
+	a, err := arrayArg(args, 0)
+	if err != nil {
+		return nil, err
+	}
+	sep, err := stringArg(args, 1)
+	if err != nil {
+		return nil, err
+	}
+
+	strs := make([]string, len(a))
+	for i, val := range a {
+		var ok bool
+		if strs[i], ok = scalarToString(val); !ok {
+			return nil, argError(args, 0, "an array of scalars")
+		}
+	}
+
+	return QuotedString(strings.Join(strs, sep)), nil
+}
+
+func builtinReplace(args []Value) (Value, error) {
+	strs := make([]string, 3)
+	for i, _ := range strs {
+		var err error
+		if strs[i], err = stringArg(args, i); err != nil {
+			return nil, err
+		}
+	}
+
+	return QuotedString(strings.Replace(strs[0], strs[1], strs[2], -1)), nil
+}
+
+func builtinHasPrefix(args []Value) (Value, error) {
+	str, err := stringArg(args, 0)
+	if err != nil {
+		return nil, err
+	}
+	prefix, err := stringArg(args, 1)
+	if err != nil {
+		return nil, err
+	}
+
+	return Bool(strings.HasPrefix(str, prefix)), nil
+}
+
+func builtinHasSuffix(args []Value) (Value, error) {
+	str, err := stringArg(args, 0)
+	if err != nil {
+		return nil, err
+	}
+	suffix, err := stringArg(args, 1)
+	if err != nil {
+		return nil, err
+	}
+
+	return Bool(strings.HasSuffix(str, suffix)), nil
+}
+
+// Sorts an array of strings, or an array of numbers.
+func builtinSort(args []Value) (Value, error) {
+	a, err := arrayArg(args, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	sorted := make(Array, len(a))
+	copy(sorted, a)
+
+	allNumbers, allStrings := true, true
+	for _, val := range sorted {
+		_, isNumber := toFloat(val)
+		_, isString := val.(QuotedString)
+		allNumbers = allNumbers && isNumber
+		allStrings = allStrings && isString
+	}
+
+	switch {
+	case allNumbers:
+		sort.SliceStable(sorted, func(i, j int) bool {
+			fi, _ := toFloat(sorted[i])
+			fj, _ := toFloat(sorted[j])
+			return fi < fj
+		})
+	case allStrings:
+		sort.SliceStable(sorted, func(i, j int) bool {
+			return sorted[i].(QuotedString) < sorted[j].(QuotedString)
+		})
+	default:
+		return nil, argError(args, 0, "an array of only strings or only numbers")
+	}
+
+	return sorted, nil
+}
+
+// Removes all duplicate entries from an array, keeping the first occurrence.
+func builtinUniq(args []Value) (Value, error) {
+	a, err := arrayArg(args, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	uniq := Array{}
+	for _, val := range a {
+		seen := false
+		for _, existing := range uniq {
+			if ValueEquals(val, existing) {
+				seen = true
+				break
+			}
+		}
+
+		if !seen {
+			uniq = append(uniq, val)
+		}
+	}
+
+	return uniq, nil
+}
+
+func builtinReverse(args []Value) (Value, error) {
+	a, err := arrayArg(args, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	reversed := make(Array, len(a))
+	for i, val := range a {
+		reversed[len(a)-1-i] = val
+	}
+
+	return reversed, nil
+}
+
+// Recursively flattens nested arrays, so that [ 1, [ 2, [ 3, ], ], ] becomes
+// [ 1, 2, 3, ].
+func builtinFlatten(args []Value) (Value, error) {
+	a, err := arrayArg(args, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	var flatten func(a Array) Array
+	flatten = func(a Array) Array {
+		flat := Array{}
+		for _, val := range a {
+			if nested, isArray := val.(Array); isArray {
+				flat = append(flat, flatten(nested)...)
+			} else {
+				flat = append(flat, val)
+			}
+		}
+		return flat
+	}
+
+	return flatten(a), nil
+}
+
+func builtinKeys(args []Value) (Value, error) {
+	h, err := hashArg(args, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	keys := make(Array, len(h))
+	for i, entry := range h {
+		keys[i] = entry.Key
+	}
+
+	return keys, nil
+}
+
+func builtinValues(args []Value) (Value, error) {
+	h, err := hashArg(args, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	values := make(Array, len(h))
+	for i, entry := range h {
+		values[i] = entry.Val
+	}
+
+	return values, nil
+}
+
+func builtinHasKey(args []Value) (Value, error) {
+	h, err := hashArg(args, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	_, found := h.Get(args[1])
+	return Bool(found), nil
+}
+
+// Merges any number of hashes into a new one. Keys in later hashes replace the
+// ones in earlier hashes.
+func builtinMerge(args []Value) (Value, error) {
+	merged := Hash{}
+
+	for i, _ := range args {
+		h, err := hashArg(args, i)
+		if err != nil {
+			return nil, err
+		}
+
+	entries:
+		for _, entry := range h {
+			for j, existing := range merged {
+				if ValueEquals(existing.Key, entry.Key) {
+					merged[j].Val = entry.Val
+					continue entries
+				}
+			}
+			merged = append(merged, entry)
+		}
+	}
+
+	return merged, nil
+}
+
+func builtinAbs(args []Value) (Value, error) {
+	switch args[0].(type) {
+	case int:
+		if i := args[0].(int); i < 0 {
+			return -i, nil
+		} else {
+			return i, nil
+		}
+	case Float:
+		return Float(math.Abs(float64(args[0].(Float)))), nil
+	}
+
+	return nil, argError(args, 0, "a number")
+}
+
+func builtinMin(args []Value) (Value, error) {
+	return extreme(args, func(a, b float64) bool { return a < b })
+}
+
+func builtinMax(args []Value) (Value, error) {
+	return extreme(args, func(a, b float64) bool { return a > b })
+}
+
+// Returns the argument for which better() returns true when compared to all
+// other arguments. If any argument is a Float, the result will be a Float.
+func extreme(args []Value, better func(a, b float64) bool) (Value, error) {
+	var best Value
+	var bestF float64
+	anyFloat := false
+
+	for i, arg := range args {
+		f, err := numberArg(args, i)
+		if err != nil {
+			return nil, err
+		}
+
+		if _, isFloat := arg.(Float); isFloat {
+			anyFloat = true
+		}
+
+		if best == nil || better(f, bestF) {
+			best, bestF = arg, f
+		}
+	}
+
+	if anyFloat {
+		return Float(bestF), nil
+	}
+	return best, nil
+}
+
+// Converts a number or a string to an int. Floats are truncated.
+func builtinInt(args []Value) (Value, error) {
+	switch args[0].(type) {
+	case int:
+		return args[0], nil
+	case Float:
+		return int(args[0].(Float)), nil
+	}
+
+	str, err := stringArg(args, 0)
+	if err != nil {
+		return nil, argError(args, 0, "a number or a string")
+	}
+
+	i, err := strconv.Atoi(strings.TrimSpace(str))
+	if err != nil {
+		return nil, fmt.Errorf("Can't convert '%s' to an int", str)
+	}
+	return i, nil
+}
+
+// Converts a number or a string to a Float.
+func builtinFloat(args []Value) (Value, error) {
+	if f, isNumber := toFloat(args[0]); isNumber {
+		return Float(f), nil
+	}
+
+	str, err := stringArg(args, 0)
+	if err != nil {
+		return nil, argError(args, 0, "a number or a string")
+	}
+
+	f, err := strconv.ParseFloat(strings.TrimSpace(str), 64)
+	if err != nil {
+		return nil, fmt.Errorf("Can't convert '%s' to a float", str)
+	}
+	return Float(f), nil
+}
@@ -15,39 +15,37 @@ type classResolver struct {
 	ls *localState
 	gs *globalState
 
-	realizedInFile string
-	realizedAtLine int
+	realizedAt Pos
 }
 
-func newClassResolver(gs *globalState, class *Class, withArgs []Prop, realizedIn string, at int) *classResolver {
+func newClassResolver(gs *globalState, class *Class, withArgs []Prop, at Pos) *classResolver {
 	return &classResolver{
-		original:       class,
-		args:           withArgs,
-		realizedInFile: realizedIn,
-		realizedAtLine: at,
-		ls:             newLocalState(class.Filename, realizedIn, at),
-		gs:             gs,
+		original:   class,
+		args:       withArgs,
+		realizedAt: at,
+		ls:         newLocalState(gs, at),
+		gs:         gs,
 	}
 }
 
 // Resolves all variables in the class and converts them to values. For
 // instance, consider the following manifest:
 //
-//  class C {
-//  	$foo = 'bar'
-// 		$baz = $foo
+//	 class C {
+//	 	$foo = 'bar'
+//			$baz = $foo
 //
-//		package { $baz: }
-//	}
+//			package { $baz: }
+//		}
 //
 // After this function is run, the class would be returned as:
 //
-//  class C {
-//  	$foo = 'bar'
-// 		$baz = 'bar'
+//	 class C {
+//	 	$foo = 'bar'
+//			$baz = 'bar'
 //
-//		package { 'bar': }
-//	}
+//			package { 'bar': }
+//		}
 func (cr *classResolver) resolve() (Class, error) {
 	c := cr.original
 	retClass := *cr.original
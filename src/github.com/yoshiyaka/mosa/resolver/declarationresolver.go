@@ -20,19 +20,17 @@ type declarationResolver struct {
 	ls *localState
 	gs *globalState
 
-	realizedInFile string
-	realizedAtLine int
+	realizedAt Pos
 }
 
-func newDeclarationResolver(d *Define, name Value, withArgs []Prop, gs *globalState, realizedIn string, at int) *declarationResolver {
+func newDeclarationResolver(d *Define, name Value, withArgs []Prop, gs *globalState, at Pos) *declarationResolver {
 	return &declarationResolver{
-		define:         d,
-		name:           name,
-		args:           withArgs,
-		realizedInFile: realizedIn,
-		realizedAtLine: at,
-		ls:             newLocalState(d.Filename, realizedIn, at),
-		gs:             gs,
+		define:     d,
+		name:       name,
+		args:       withArgs,
+		realizedAt: at,
+		ls:         newLocalState(gs, at),
+		gs:         gs,
 	}
 }
 
@@ -46,16 +44,16 @@ func (cr *declarationResolver) resolve() (Define, error) {
 	for _, arg := range cr.args {
 		if arg.Name == nameKey {
 			return retClass, fmt.Errorf(
-				"'%s' may not be passed as an argument in %s:%d",
-				nameKey, cr.realizedInFile, arg.LineNum,
+				"'%s' may not be passed as an argument in %s",
+				nameKey, arg.Pos,
 			)
 		}
 	}
 
 	cr.args = append(cr.args, Prop{
-		LineNum: 0,
-		Name:    nameKey,
-		Value:   cr.name,
+		Pos:   cr.realizedAt,
+		Name:  nameKey,
+		Value: cr.name,
 	})
 
 	// Start by loading all top-level variables defined
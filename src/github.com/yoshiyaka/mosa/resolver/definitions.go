@@ -0,0 +1,35 @@
+package resolver
+
+import (
+	. "github.com/yoshiyaka/mosa/ast"
+)
+
+// The classes, defines, functions and facters of a manifest, mapped by name.
+// The built in exec define is included among the defines.
+type Definitions struct {
+	Classes map[string]*Class
+	Defines map[string]*Define
+	Funcs   map[string]*Func
+	Facters map[string]*Facter
+}
+
+// Collects the definitions of a manifest without resolving it. The definitions
+// are checked like when resolving, so classes defined twice or defines lacking
+// a $name argument are errors. The definitions collected up to the first error
+// are returned along with it.
+func CollectDefinitions(ast *AST) (*Definitions, error) {
+	gs := newGlobalState()
+	err := gs.populate(ast)
+
+	defs := &Definitions{
+		Classes: gs.classesByName,
+		Defines: gs.definesByName,
+		Funcs:   gs.funcsByName,
+		Facters: gs.factersByName,
+	}
+	if defs.Defines == nil {
+		defs.Defines = map[string]*Define{"exec": &defineExec}
+	}
+
+	return defs, err
+}
@@ -1,60 +1,259 @@
 package resolver
 
 import (
+	"errors"
+	"fmt"
+	"math"
+	"regexp"
 	"strings"
 
 	. "github.com/yoshiyaka/mosa/ast"
 )
 
-func ExpPlus(a, b Value) (Value, error) {
-	switch a.(type) {
+var (
+	ErrDivisionByZero = errors.New("Division by zero")
+
+	// Returned by the Exp functions when an operation isn't supported for the
+	// types of its operands, for instance 5 > "banana" or true * 4.
+	ErrBadTypes = errors.New("Bad types")
+)
+
+// An error which occurred when evaluating an expression. Err is either
+// ErrBadTypes, ErrDivisionByZero or an error returned by an operand.
+type ExpressionError struct {
+	Pos       Pos
+	Operation ExpOp
+
+	// The resolved operands. Unary expressions have a single operand.
+	Operands []Value
+
+	Err error
+}
+
+func (e *ExpressionError) Error() string {
+	if e.Err != ErrBadTypes {
+		return fmt.Sprintf("%s at %s", e.Err, e.Pos)
+	}
+
+	if len(e.Operands) == 1 {
+		return fmt.Sprintf(
+			"Bad type (%T) supplied for operation '%s' at %s",
+			e.Operands[0], e.Operation, e.Pos,
+		)
+	}
+
+	return fmt.Sprintf(
+		"Bad types (%T, %T) supplied for operation '%s' at %s",
+		e.Operands[0], e.Operands[1], e.Operation, e.Pos,
+	)
+}
+
+// Returns the numeric value of v as a float64, and whether v was a number at
+// all.
+func toFloat(v Value) (float64, bool) {
+	switch v.(type) {
 	case int:
-		return a.(int) + b.(int), nil
-	case QuotedString:
-		return a.(QuotedString) + b.(QuotedString), nil
+		return float64(v.(int)), true
+	case Float:
+		return float64(v.(Float)), true
+	}
+
+	return 0, false
+}
+
+// If both a and b are numbers and at least one of them is a Float, they are
+// both returned as float64 and ok will be true. In other words, an int used
+// together with a Float is always promoted to a Float. An int used together
+// with an int is never promoted.
+func floatOperands(a, b Value) (af, bf float64, ok bool) {
+	_, aIsFloat := a.(Float)
+	_, bIsFloat := b.(Float)
+	if !aIsFloat && !bIsFloat {
+		return 0, 0, false
+	}
+
+	af, aIsNum := toFloat(a)
+	bf, bIsNum := toFloat(b)
+	return af, bf, aIsNum && bIsNum
+}
+
+// Returns a and b as ints if both of them are ints.
+func intOperands(a, b Value) (ai, bi int, ok bool) {
+	ai, aIsInt := a.(int)
+	bi, bIsInt := b.(int)
+	return ai, bi, aIsInt && bIsInt
+}
+
+// Returns a and b as strings if both of them are strings, quoted or not.
+func stringOperands(a, b Value) (as, bs string, ok bool) {
+	toString := func(v Value) (string, bool) {
+		switch v.(type) {
+		case QuotedString:
+			return string(v.(QuotedString)), true
+		case string:
+			return v.(string), true
+		}
+		return "", false
+	}
+
+	as, aIsString := toString(a)
+	bs, bIsString := toString(b)
+	return as, bs, aIsString && bIsString
+}
+
+// Returns a and b as bools if both of them are bools.
+func boolOperands(a, b Value) (ab, bb bool, ok bool) {
+	toBool := func(v Value) (bool, bool) {
+		switch v.(type) {
+		case Bool:
+			return bool(v.(Bool)), true
+		case bool:
+			return v.(bool), true
+		}
+		return false, false
 	}
 
-	panic("Bad types")
+	ab, aIsBool := toBool(a)
+	bb, bIsBool := toBool(b)
+	return ab, bb, aIsBool && bIsBool
+}
+
+// Returns a and b as arrays if both of them are arrays.
+func arrayOperands(a, b Value) (aa, ba Array, ok bool) {
+	aa, aIsArray := a.(Array)
+	ba, bIsArray := b.(Array)
+	return aa, ba, aIsArray && bIsArray
+}
+
+// Returns whether a and b are equal. Values of types which can't be compared,
+// such as 5 and 'five', are never equal.
+func valuesEqual(a, b Value) bool {
+	eq, err := ExpEquals(a, b)
+	return err == nil && bool(eq)
 }
 
+// Adds numbers, concatenates strings or concatenates arrays.
+func ExpPlus(a, b Value) (Value, error) {
+	if af, bf, ok := floatOperands(a, b); ok {
+		return Float(af + bf), nil
+	}
+	if ai, bi, ok := intOperands(a, b); ok {
+		return ai + bi, nil
+	}
+	if as, bs, ok := stringOperands(a, b); ok {
+		return QuotedString(as + bs), nil
+	}
+	if aa, ba, ok := arrayOperands(a, b); ok {
+		sum := make(Array, 0, len(aa)+len(ba))
+		return append(append(sum, aa...), ba...), nil
+	}
+
+	return nil, ErrBadTypes
+}
+
+// Subtracts numbers. For arrays, returns the elements of a which are not in b,
+// in the order they appear in a.
 func ExpMinus(a, b Value) (Value, error) {
-	switch a.(type) {
-	case int:
-		return a.(int) - b.(int), nil
+	if af, bf, ok := floatOperands(a, b); ok {
+		return Float(af - bf), nil
+	}
+	if ai, bi, ok := intOperands(a, b); ok {
+		return ai - bi, nil
+	}
+	if aa, ba, ok := arrayOperands(a, b); ok {
+		diff := Array{}
+		for _, elem := range aa {
+			if in, _ := ExpIn(elem, ba); !in {
+				diff = append(diff, elem)
+			}
+		}
+		return diff, nil
 	}
 
-	panic("Bad types")
+	return nil, ErrBadTypes
 }
 
 func ExpMultiply(a, b Value) (Value, error) {
-	switch a.(type) {
-	case int:
-		return a.(int) * b.(int), nil
+	if af, bf, ok := floatOperands(a, b); ok {
+		return Float(af * bf), nil
+	}
+	if ai, bi, ok := intOperands(a, b); ok {
+		return ai * bi, nil
 	}
 
-	panic("Bad types")
+	return nil, ErrBadTypes
 }
 
+// Divides a by b. Dividing two ints results in an int, with the decimals
+// truncated. Dividing by zero is an error for both ints and floats.
 func ExpDivide(a, b Value) (Value, error) {
-	switch a.(type) {
-	case int:
-		return a.(int) / b.(int), nil
+	if af, bf, ok := floatOperands(a, b); ok {
+		if bf == 0 {
+			return nil, ErrDivisionByZero
+		}
+		return Float(af / bf), nil
+	}
+	if ai, bi, ok := intOperands(a, b); ok {
+		if bi == 0 {
+			return nil, ErrDivisionByZero
+		}
+		return ai / bi, nil
 	}
 
-	panic("Bad types")
+	return nil, ErrBadTypes
+}
+
+// Returns the remainder of dividing a by b. The result has the same sign as a,
+// so -7 % 2 is -1. Like for division, b may not be zero.
+func ExpModulo(a, b Value) (Value, error) {
+	if af, bf, ok := floatOperands(a, b); ok {
+		if bf == 0 {
+			return nil, ErrDivisionByZero
+		}
+		return Float(math.Mod(af, bf)), nil
+	}
+	if ai, bi, ok := intOperands(a, b); ok {
+		if bi == 0 {
+			return nil, ErrDivisionByZero
+		}
+		return ai % bi, nil
+	}
+
+	return nil, ErrBadTypes
 }
 
 func ExpEquals(a, b Value) (Bool, error) {
-	switch a.(type) {
-	case int:
-		return a.(int) == b.(int), nil
-	case QuotedString:
-		return a.(QuotedString) == b.(QuotedString), nil
-	case string:
-		return a.(string) == b.(string), nil
+	if af, bf, ok := floatOperands(a, b); ok {
+		return af == bf, nil
+	}
+	if ai, bi, ok := intOperands(a, b); ok {
+		return ai == bi, nil
+	}
+	if as, bs, ok := stringOperands(a, b); ok {
+		return as == bs, nil
+	}
+	if ab, bb, ok := boolOperands(a, b); ok {
+		return ab == bb, nil
 	}
 
-	panic("Bad types")
+	if ah, ok := a.(Hash); ok {
+		if bh, ok := b.(Hash); ok {
+			return Bool(HashEquals(ah, bh)), nil
+		}
+	}
+	if aa, ba, ok := arrayOperands(a, b); ok {
+		if len(aa) != len(ba) {
+			return false, nil
+		}
+		for i := range aa {
+			if !valuesEqual(aa[i], ba[i]) {
+				return false, nil
+			}
+		}
+		return true, nil
+	}
+
+	return false, ErrBadTypes
 }
 
 func ExpNotEquals(a, b Value) (Bool, error) {
@@ -62,68 +261,154 @@ func ExpNotEquals(a, b Value) (Bool, error) {
 	return Bool(!bl), err
 }
 
-func ExpLT(a, b Value) (Bool, error) {
-	switch a.(type) {
-	case int:
-		return a.(int) < b.(int), nil
-	case string:
-		return strings.Compare(a.(string), b.(string)) < 0, nil
+// Compares a and b, which must both be numbers or both be strings. Returns -1,
+// 0 or 1 if a is less than, equal to or greater than b.
+func compare(a, b Value) (int, error) {
+	if af, bf, ok := floatOperands(a, b); ok {
+		switch {
+		case af < bf:
+			return -1, nil
+		case af > bf:
+			return 1, nil
+		}
+		return 0, nil
+	}
+	if ai, bi, ok := intOperands(a, b); ok {
+		switch {
+		case ai < bi:
+			return -1, nil
+		case ai > bi:
+			return 1, nil
+		}
+		return 0, nil
+	}
+	if as, bs, ok := stringOperands(a, b); ok {
+		return strings.Compare(as, bs), nil
 	}
 
-	panic("Bad types")
+	return 0, ErrBadTypes
+}
+
+func ExpLT(a, b Value) (Bool, error) {
+	c, err := compare(a, b)
+	return c < 0, err
 }
 
 func ExpLTEq(a, b Value) (Bool, error) {
-	switch a.(type) {
-	case int:
-		return a.(int) <= b.(int), nil
-	case string:
-		return strings.Compare(a.(string), b.(string)) <= 0, nil
+	c, err := compare(a, b)
+	return c <= 0, err
+}
+
+func ExpGT(a, b Value) (Bool, error) {
+	c, err := compare(a, b)
+	return c > 0, err
+}
+
+func ExpGTEq(a, b Value) (Bool, error) {
+	c, err := compare(a, b)
+	return c >= 0, err
+}
+
+func ExpBoolAnd(a, b Value) (Bool, error) {
+	if ab, bb, ok := boolOperands(a, b); ok {
+		return Bool(ab && bb), nil
 	}
 
-	panic("Bad types")
+	return false, ErrBadTypes
 }
 
-func ExpGT(a, b Value) (Bool, error) {
-	switch a.(type) {
-	case int:
-		return a.(int) > b.(int), nil
-	case string:
-		return strings.Compare(a.(string), b.(string)) > 0, nil
+func ExpBoolOr(a, b Value) (Bool, error) {
+	if ab, bb, ok := boolOperands(a, b); ok {
+		return Bool(ab || bb), nil
 	}
 
-	panic("Bad types")
+	return false, ErrBadTypes
 }
 
-func ExpGTEq(a, b Value) (Bool, error) {
-	switch a.(type) {
-	case int:
-		return a.(int) > b.(int), nil
+// Returns whether a is an element of the array b, a key of the hash b or a
+// substring of the string b.
+func ExpIn(a, b Value) (Bool, error) {
+	switch b.(type) {
+	case Array:
+		for _, elem := range b.(Array) {
+			if valuesEqual(a, elem) {
+				return true, nil
+			}
+		}
+		return false, nil
+	case Hash:
+		if _, isString := a.(QuotedString); isString {
+			_, exists := b.(Hash).Get(a)
+			return Bool(exists), nil
+		}
+	}
+
+	if as, bs, ok := stringOperands(a, b); ok {
+		return Bool(strings.Contains(bs, as)), nil
+	}
+
+	return false, ErrBadTypes
+}
+
+// Matches the string a against b, which is either a regex or a string holding
+// one. Returns the capture groups of the match, where the first element is the
+// whole match, or nil if a doesn't match b.
+func regexCaptures(a, b Value) ([]string, error) {
+	var pattern string
+	switch b.(type) {
+	case Regex:
+		pattern = string(b.(Regex))
+	case QuotedString:
+		pattern = string(b.(QuotedString))
 	case string:
-		return strings.Compare(a.(string), b.(string)) >= 0, nil
+		pattern = b.(string)
+	default:
+		return nil, ErrBadTypes
+	}
+
+	str, _, ok := stringOperands(a, a)
+	if !ok {
+		return nil, ErrBadTypes
 	}
 
-	panic("Bad types")
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, fmt.Errorf("Bad regex %s: %s", Regex(pattern), err)
+	}
+
+	return re.FindStringSubmatch(str), nil
 }
 
-func ExpBoolAnd(a, b Value) (Bool, error) {
-	switch a.(type) {
-	case bool:
-		return Bool(a.(bool) && b.(bool)), nil
-	case Bool:
-		return a.(Bool) && b.(Bool), nil
+// Returns whether the string a matches the regex b, so that "web01" =~ /^web/
+// is true.
+func ExpMatch(a, b Value) (Bool, error) {
+	captures, err := regexCaptures(a, b)
+	return captures != nil, err
+}
+
+// Returns whether the string a doesn't match the regex b.
+func ExpNotMatch(a, b Value) (Bool, error) {
+	matches, err := ExpMatch(a, b)
+	return !matches, err
+}
+
+// Negates a bool, so that !true is false.
+func ExpNot(a Value) (Bool, error) {
+	if ab, _, ok := boolOperands(a, a); ok {
+		return Bool(!ab), nil
 	}
 
-	panic("Bad types")
+	return false, ErrBadTypes
 }
 
-func ExpBoolOr(a, b Value) (Bool, error) {
+// Negates a number, so that -(5) is -5.
+func ExpNegate(a Value) (Value, error) {
 	switch a.(type) {
-	case bool:
-		return Bool(a.(bool) || b.(bool)), nil
-	case Bool:
-		return a.(Bool) || b.(Bool), nil
+	case int:
+		return -a.(int), nil
+	case Float:
+		return -a.(Float), nil
 	}
 
-	panic("Bad types")
+	return nil, ErrBadTypes
 }
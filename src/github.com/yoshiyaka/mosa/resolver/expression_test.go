@@ -11,52 +11,129 @@ var expressionTests = []struct {
 	expression    Value
 	expectedValue Value
 }{
-	{Expression{0, "+", 4, 5}, 9},
-	{Expression{0, "-", 4, 5}, -1},
-	{Expression{0, "*", 4, 5}, 20},
-	{Expression{0, "/", 6, 2}, 3},
-
-	{Expression{0, "<", 4, 5}, Bool(true)},
-	{Expression{0, "<=", 4, 5}, Bool(true)},
-	{Expression{0, ">", 4, 5}, Bool(false)},
-	{Expression{0, ">=", 4, 5}, Bool(false)},
-
-	{Expression{0, "<", "aa", "ab"}, Bool(true)},
-	{Expression{0, "<=", "ba", "ab"}, Bool(false)},
-	{Expression{0, ">", "ba", "ab"}, Bool(true)},
-	{Expression{0, ">=", "aa", "ab"}, Bool(false)},
-
-	{Expression{0, "&&", Bool(false), Bool(false)}, Bool(false)},
-	{Expression{0, "&&", Bool(false), Bool(true)}, Bool(false)},
-	{Expression{0, "&&", Bool(true), Bool(false)}, Bool(false)},
-	{Expression{0, "&&", Bool(true), Bool(true)}, Bool(true)},
-	{Expression{0, "||", Bool(false), Bool(false)}, Bool(false)},
-	{Expression{0, "||", Bool(false), Bool(true)}, Bool(true)},
-	{Expression{0, "||", Bool(true), Bool(false)}, Bool(true)},
-	{Expression{0, "||", Bool(true), Bool(true)}, Bool(true)},
-
-	{Expression{0, "*", Expression{0, "-", 4, 5}, 5}, -5},
+	{Expression{Pos{}, "+", 4, 5}, 9},
+	{Expression{Pos{}, "-", 4, 5}, -1},
+	{Expression{Pos{}, "*", 4, 5}, 20},
+	{Expression{Pos{}, "/", 6, 2}, 3},
+
+	{Expression{Pos{}, "<", 4, 5}, Bool(true)},
+	{Expression{Pos{}, "<=", 4, 5}, Bool(true)},
+	{Expression{Pos{}, ">", 4, 5}, Bool(false)},
+	{Expression{Pos{}, ">=", 4, 5}, Bool(false)},
+
+	{Expression{Pos{}, "<", "aa", "ab"}, Bool(true)},
+	{Expression{Pos{}, "<=", "ba", "ab"}, Bool(false)},
+	{Expression{Pos{}, ">", "ba", "ab"}, Bool(true)},
+	{Expression{Pos{}, ">=", "aa", "ab"}, Bool(false)},
+
+	{Expression{Pos{}, "&&", Bool(false), Bool(false)}, Bool(false)},
+	{Expression{Pos{}, "&&", Bool(false), Bool(true)}, Bool(false)},
+	{Expression{Pos{}, "&&", Bool(true), Bool(false)}, Bool(false)},
+	{Expression{Pos{}, "&&", Bool(true), Bool(true)}, Bool(true)},
+	{Expression{Pos{}, "||", Bool(false), Bool(false)}, Bool(false)},
+	{Expression{Pos{}, "||", Bool(false), Bool(true)}, Bool(true)},
+	{Expression{Pos{}, "||", Bool(true), Bool(false)}, Bool(true)},
+	{Expression{Pos{}, "||", Bool(true), Bool(true)}, Bool(true)},
+
+	{Expression{Pos{}, "*", Expression{Pos{}, "-", 4, 5}, 5}, -5},
+
+	{Expression{Pos{}, "%", 7, 3}, 1},
+	{Expression{Pos{}, "%", -7, 3}, -1},
+	{Expression{Pos{}, "%", Float(7.5), 2}, Float(1.5)},
+	{UnaryExpression{Pos{}, "-", 5}, -5},
+	{UnaryExpression{Pos{}, "-", Float(0.5)}, Float(-0.5)},
+	{UnaryExpression{Pos{}, "-", Expression{Pos{}, "-", 4, 5}}, 1},
+	{UnaryExpression{Pos{}, "!", Bool(true)}, Bool(false)},
+	{
+		UnaryExpression{Pos{}, "!", Expression{Pos{}, "==", Bool(true), Bool(false)}},
+		Bool(true),
+	},
+	{Expression{Pos{}, "==", QuotedString("a"), "a"}, Bool(true)},
+	{Expression{Pos{}, "<", QuotedString("a"), QuotedString("b")}, Bool(true)},
+
+	{Expression{Pos{}, ">=", 5, 5}, Bool(true)},
+
+	{Expression{Pos{}, "/", 7, 2}, 3},
+	{Expression{Pos{}, "/", Float(7), 2}, Float(3.5)},
+	{Expression{Pos{}, "+", 4, Float(0.5)}, Float(4.5)},
+	{Expression{Pos{}, "-", Float(0.5), Float(0.25)}, Float(0.25)},
+	{Expression{Pos{}, "*", Float(1.5), 2}, Float(3)},
+	{Expression{Pos{}, "==", 2, Float(2)}, Bool(true)},
+	{Expression{Pos{}, "!=", Float(2.5), 2}, Bool(true)},
+	{Expression{Pos{}, "<", Float(1.5), 2}, Bool(true)},
+	{Expression{Pos{}, "<=", 2, Float(1.5)}, Bool(false)},
+	{Expression{Pos{}, ">", Float(2.5), Float(2)}, Bool(true)},
+	{Expression{Pos{}, ">=", Float(2), 2}, Bool(true)},
 
 	{
-		Expression{0, "+", QuotedString("a"), QuotedString("b")},
+		Expression{Pos{}, "+", QuotedString("a"), QuotedString("b")},
 		QuotedString("ab"),
 	},
 
 	{
 		Expression{
-			0, "+",
-			InterpolatedString{0, []interface{}{"a"}},
-			InterpolatedString{0, []interface{}{"b"}},
+			Pos{}, "+",
+			InterpolatedString{Pos{}, []interface{}{Literal{Pos{}, "a"}}},
+			InterpolatedString{Pos{}, []interface{}{Literal{Pos{}, "b"}}},
 		},
 		QuotedString("ab"),
 	},
+
+	{
+		Expression{
+			Pos{}, "==",
+			Hash{{Pos{}, QuotedString("a"), 1}, {Pos{}, QuotedString("b"), 2}},
+			Hash{{Pos{}, QuotedString("b"), 2}, {Pos{}, QuotedString("a"), 1}},
+		},
+		Bool(true),
+	},
+	{
+		Expression{
+			Pos{}, "!=",
+			Hash{{Pos{}, QuotedString("a"), 1}},
+			Hash{{Pos{}, QuotedString("a"), 2}},
+		},
+		Bool(true),
+	},
+
+	{
+		Expression{Pos{}, "+", Array{1, QuotedString("a")}, Array{2}},
+		Array{1, QuotedString("a"), 2},
+	},
+	{
+		Expression{
+			Pos{}, "-",
+			Array{QuotedString("a"), QuotedString("b"), QuotedString("c"), 1},
+			Array{QuotedString("b"), 1, Float(2)},
+		},
+		Array{QuotedString("a"), QuotedString("c")},
+	},
+	{Expression{Pos{}, "-", Array{1, 2}, Array{1, 2}}, Array{}},
+	{Expression{Pos{}, "==", Array{1, Array{2}}, Array{1, Array{2}}}, Bool(true)},
+	{Expression{Pos{}, "!=", Array{1, 2}, Array{2, 1}}, Bool(true)},
+	{Expression{Pos{}, "in", 2, Array{1, Float(2)}}, Bool(true)},
+	{Expression{Pos{}, "in", QuotedString("2"), Array{1, 2}}, Bool(false)},
+	{
+		Expression{
+			Pos{}, "in",
+			QuotedString("a"), Hash{{Pos{}, QuotedString("a"), 1}},
+		},
+		Bool(true),
+	},
+	{Expression{Pos{}, "in", QuotedString("ell"), QuotedString("hello")}, Bool(true)},
+
+	{Expression{Pos{}, "=~", QuotedString("web01"), Regex(`^web\d+$`)}, Bool(true)},
+	{Expression{Pos{}, "=~", QuotedString("db01"), Regex(`^web`)}, Bool(false)},
+	{Expression{Pos{}, "=~", QuotedString("db01"), QuotedString("b0")}, Bool(true)},
+	{Expression{Pos{}, "!~", QuotedString("web01"), Regex(`^db`)}, Bool(true)},
+	{Expression{Pos{}, "!~", QuotedString("web01"), QuotedString("eb")}, Bool(false)},
 }
 
 func TestExpressions(t *testing.T) {
 	for _, test := range expressionTests {
-		ls := newLocalState("test.ms", "test.ms", 0)
+		ls := newLocalState(nil, Pos{File: "test.ms"})
 
-		val, err := ls.resolveValue(test.expression, 0)
+		val, err := ls.resolveValue(test.expression)
 		if err != nil {
 			t.Error("Resolving", test.expression, ", got error:", err.Error())
 			continue
@@ -72,20 +149,62 @@ var badExpressionTests = []struct {
 	expression    Expression
 	expectedError string
 }{
-	{Expression{0, "+", 4, "string"}, "Bad types (int, string) supplied for operation '+' at t.ms:0"},
-	{Expression{0, "-", 4, "string"}, "Bad types (int, string) supplied for operation '-' at t.ms:0"},
-	{Expression{0, "*", 4, "string"}, "Bad types (int, string) supplied for operation '*' at t.ms:0"},
-	{Expression{0, "/", 4, "string"}, "Bad types (int, string) supplied for operation '/' at t.ms:0"},
+	{Expression{Pos{"t.ms", 1, 5}, "+", 4, "string"}, "Bad types (int, string) supplied for operation '+' at t.ms:1:5"},
+	{Expression{Pos{"t.ms", 1, 5}, "-", 4, "string"}, "Bad types (int, string) supplied for operation '-' at t.ms:1:5"},
+	{Expression{Pos{"t.ms", 1, 5}, "*", 4, "string"}, "Bad types (int, string) supplied for operation '*' at t.ms:1:5"},
+	{Expression{Pos{"t.ms", 1, 5}, "/", 4, "string"}, "Bad types (int, string) supplied for operation '/' at t.ms:1:5"},
+
+	{Expression{Pos{"t.ms", 1, 5}, "*", "s1", "s2"}, "Bad types (string, string) supplied for operation '*' at t.ms:1:5"},
+	{Expression{Pos{"t.ms", 1, 5}, "/", "s1", "s2"}, "Bad types (string, string) supplied for operation '/' at t.ms:1:5"},
+	{Expression{Pos{"t.ms", 1, 5}, "+", Float(1), "s"}, "Bad types (ast.Float, string) supplied for operation '+' at t.ms:1:5"},
+
+	{Expression{Pos{"t.ms", 1, 5}, "/", 4, 0}, "Division by zero at t.ms:1:5"},
+	{Expression{Pos{"t.ms", 1, 5}, "/", Float(4), 0}, "Division by zero at t.ms:1:5"},
+	{Expression{Pos{"t.ms", 1, 5}, "/", 4, Float(0)}, "Division by zero at t.ms:1:5"},
+	{Expression{Pos{"t.ms", 1, 5}, "%", 4, 0}, "Division by zero at t.ms:1:5"},
+	{Expression{Pos{"t.ms", 1, 5}, "%", QuotedString("a"), 2}, "Bad types (ast.QuotedString, int) supplied for operation '%' at t.ms:1:5"},
+
+	{Expression{Pos{"t.ms", 1, 5}, "==", 4, QuotedString("4")}, "Bad types (int, ast.QuotedString) supplied for operation '==' at t.ms:1:5"},
+	{Expression{Pos{"t.ms", 1, 5}, "<", Bool(true), Bool(false)}, "Bad types (ast.Bool, ast.Bool) supplied for operation '<' at t.ms:1:5"},
+	{Expression{Pos{"t.ms", 1, 5}, "&&", Bool(true), 1}, "Bad types (ast.Bool, int) supplied for operation '&&' at t.ms:1:5"},
+	{Expression{Pos{"t.ms", 1, 5}, "-", Array{1}, 1}, "Bad types (ast.Array, int) supplied for operation '-' at t.ms:1:5"},
+	{Expression{Pos{"t.ms", 1, 5}, "in", 1, 2}, "Bad types (int, int) supplied for operation 'in' at t.ms:1:5"},
+	{Expression{Pos{"t.ms", 1, 5}, "=~", 1, Regex("1")}, "Bad types (int, ast.Regex) supplied for operation '=~' at t.ms:1:5"},
+	{Expression{Pos{"t.ms", 1, 5}, "!~", QuotedString("a"), 1}, "Bad types (ast.QuotedString, int) supplied for operation '!~' at t.ms:1:5"},
+	{
+		Expression{Pos{"t.ms", 1, 5}, "=~", QuotedString("a"), QuotedString("(")},
+		"Bad regex /(/: error parsing regexp: missing closing ): `(` at t.ms:1:5",
+	},
+}
+
+var badUnaryExpressionTests = []struct {
+	expression    UnaryExpression
+	expectedError string
+}{
+	{UnaryExpression{Pos{"t.ms", 1, 5}, "!", 1}, "Bad type (int) supplied for operation '!' at t.ms:1:5"},
+	{UnaryExpression{Pos{"t.ms", 1, 5}, "-", QuotedString("a")}, "Bad type (ast.QuotedString) supplied for operation '-' at t.ms:1:5"},
+	{
+		UnaryExpression{Pos{"t.ms", 1, 5}, "-", Expression{Pos{"t.ms", 1, 6}, "/", 1, 0}},
+		"Division by zero at t.ms:1:6",
+	},
+}
+
+func TestBadUnaryExpressions(t *testing.T) {
+	for _, test := range badUnaryExpressionTests {
+		ls := newLocalState(nil, Pos{File: "t.ms"})
 
-	{Expression{0, "*", "s1", "s2"}, "Bad types (string, string) supplied for operation '*' at t.ms:0"},
-	{Expression{0, "/", "s1", "s2"}, "Bad types (string, string) supplied for operation '/' at t.ms:0"},
+		_, err := ls.resolveValue(test.expression)
+		if err == nil || err.Error() != test.expectedError {
+			t.Error("Resolving", test.expression, ", got bad error:", err)
+		}
+	}
 }
 
 func TestBadExpressions(t *testing.T) {
 	for _, test := range badExpressionTests {
-		ls := newLocalState("t.ms", "t.ms", 0)
+		ls := newLocalState(nil, Pos{File: "t.ms"})
 
-		_, err := ls.resolveValue(test.expression, 0)
+		_, err := ls.resolveValue(test.expression)
 		if err == nil || err.Error() != test.expectedError {
 			t.Error("Resolving", test.expression, ", got bad error:", err)
 			continue
@@ -0,0 +1,198 @@
+package resolver
+
+import (
+	"fmt"
+
+	. "github.com/yoshiyaka/mosa/ast"
+)
+
+// The facters of a resolved manifest. Use ResolveWithFacters() to get hold of
+// them.
+type Facters struct {
+	gs *globalState
+}
+
+// The realizations of a multiple define which were made with the same
+// arguments, and thus are checked by a single call to the facter.
+type facterGroup struct {
+	facter *Facter
+	first  *Declaration
+	names  Array
+	keys   []declKey
+}
+
+// Evaluates the facters for all declarations in decls, and removes the
+// declarations which are already satisfied. All declarations realized inside
+// of a satisfied define are removed as well, no matter how deeply nested they
+// are.
+//
+// Declarations of types without a facter are always kept.
+func (f *Facters) Reduce(decls []Declaration) ([]Declaration, error) {
+	satisfied := map[declKey]bool{}
+	var groups []*facterGroup
+
+	for i, _ := range decls {
+		decl := &decls[i]
+		facter, hasFacter := f.gs.factersByName[decl.Type]
+		if !hasFacter {
+			continue
+		}
+
+		key := declKey{decl.Type, string(decl.Scalar.(QuotedString))}
+		if facter.Type == DefineTypeSingle {
+			ok, err := f.evalSingle(facter, decl)
+			if err != nil {
+				return nil, err
+			}
+			satisfied[key] = ok
+			continue
+		}
+
+		var group *facterGroup
+		for _, g := range groups {
+			if g.facter == facter && sameArgs(g.first.Props, decl.Props) {
+				group = g
+				break
+			}
+		}
+		if group == nil {
+			group = &facterGroup{facter: facter, first: decl}
+			groups = append(groups, group)
+		}
+		group.names = append(group.names, decl.Scalar)
+		group.keys = append(group.keys, key)
+	}
+
+	for _, group := range groups {
+		if err := f.evalMultiple(group, satisfied); err != nil {
+			return nil, err
+		}
+	}
+
+	ret := make([]Declaration, 0, len(decls))
+	for _, decl := range decls {
+		if !f.isSatisfied(declKey{decl.Type, string(decl.Scalar.(QuotedString))}, satisfied) {
+			ret = append(ret, decl)
+		}
+	}
+
+	return ret, nil
+}
+
+// Returns whether the declaration, or the define it was realized in, is
+// satisfied.
+func (f *Facters) isSatisfied(key declKey, satisfied map[declKey]bool) bool {
+	for {
+		if satisfied[key] {
+			return true
+		}
+
+		parent, hasParent := f.gs.parents[key]
+		if !hasParent {
+			return false
+		}
+		key = parent
+	}
+}
+
+func (f *Facters) evalSingle(facter *Facter, decl *Declaration) (bool, error) {
+	ret, err := f.gs.evalFacter(facter, decl.Props, "name", decl.Scalar, decl.Pos)
+	if err != nil {
+		return false, err
+	}
+
+	if b, ok := ret.(Bool); ok {
+		return bool(b), nil
+	}
+
+	return false, fmt.Errorf(
+		"Facter for type '%s' at %s must return a bool (got %T)",
+		facter.Name, facter.Pos, ret,
+	)
+}
+
+// Calls the facter once for all names in the group. The facter either returns
+// a bool for all names, or the names which are not satisfied.
+func (f *Facters) evalMultiple(group *facterGroup, satisfied map[declKey]bool) error {
+	ret, err := f.gs.evalFacter(
+		group.facter, group.first.Props, "names", group.names, group.first.Pos,
+	)
+	if err != nil {
+		return err
+	}
+
+	switch ret.(type) {
+	case Bool:
+		for _, key := range group.keys {
+			satisfied[key] = bool(ret.(Bool))
+		}
+		return nil
+	case Array:
+		for _, key := range group.keys {
+			satisfied[key] = true
+		}
+		for _, name := range ret.(Array) {
+			if str, ok := name.(QuotedString); ok {
+				delete(satisfied, declKey{group.facter.Name, string(str)})
+			} else {
+				return fmt.Errorf(
+					"Facter for type '%s' at %s returned a non-string name (got %T)",
+					group.facter.Name, group.facter.Pos, name,
+				)
+			}
+		}
+		return nil
+	}
+
+	return fmt.Errorf(
+		"Facter for type '%s' at %s must return a bool or an array of names (got %T)",
+		group.facter.Name, group.facter.Pos, ret,
+	)
+}
+
+// Evaluates a facter with the resolved arguments of a realization. The name or
+// names of the realization is passed as nameKey.
+func (gs *globalState) evalFacter(facter *Facter, props []Prop, nameKey string, name Value, at Pos) (Value, error) {
+	fr := newFuncResolver(gs, &Func{
+		Pos:     facter.Pos,
+		Name:    facter.Name,
+		ArgDefs: facter.ArgDefs,
+		Block:   facter.Block,
+	}, at)
+	fr.what = fmt.Sprintf("Facter for type '%s'", facter.Name)
+
+	args := append([]Prop{}, props...)
+	args = append(args, Prop{Pos: at, Name: nameKey, Value: name})
+	if err := fr.ls.setVarsFromArgs(args, facter.ArgDefs); err != nil {
+		return nil, err
+	}
+
+	return fr.resolveReturn()
+}
+
+// Returns whether the props holds the same arguments, not taking the order or
+// dependencies into consideration.
+func sameArgs(p1, p2 []Prop) bool {
+	byName := func(props []Prop) map[string]Value {
+		m := map[string]Value{}
+		for _, p := range props {
+			if p.Name != "depends" {
+				m[p.Name] = p.Value
+			}
+		}
+		return m
+	}
+
+	m1, m2 := byName(p1), byName(p2)
+	if len(m1) != len(m2) {
+		return false
+	}
+
+	for name, val := range m1 {
+		if val2, exists := m2[name]; !exists || !ValueEquals(val, val2) {
+			return false
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,225 @@
+package resolver
+
+import (
+	"fmt"
+
+	. "github.com/yoshiyaka/mosa/ast"
+)
+
+// A call to a function defined in a manifest.
+type StackFrame struct {
+	// The name of the called function
+	Name string
+
+	// Where the function was called
+	Pos Pos
+}
+
+// An error which occurred inside of a function defined in a manifest. It holds
+// the chain of calls which led to the error, so that it can be traced back to
+// the class or define which made the first call.
+type FuncError struct {
+	Err error
+
+	// The innermost call comes first
+	CallStack []StackFrame
+}
+
+func (fe *FuncError) Error() string {
+	msg := fe.Err.Error()
+	for _, frame := range fe.CallStack {
+		msg += fmt.Sprintf("\n\tin %s() called at %s", frame.Name, frame.Pos)
+	}
+	return msg
+}
+
+// Calls a function defined in the manifest with a list of resolved arguments.
+// Recursive calls, direct or indirect, are not allowed.
+func (gs *globalState) callFunc(f *Func, args []Value, at Pos) (Value, error) {
+	for _, frame := range gs.callStack {
+		if frame.Name == f.Name {
+			return nil, fmt.Errorf(
+				"Recursive call to function %s() at %s", f.Name, at,
+			)
+		}
+	}
+
+	frame := StackFrame{Name: f.Name, Pos: at}
+	gs.callStack = append(gs.callStack, frame)
+	defer func() { gs.callStack = gs.callStack[:len(gs.callStack)-1] }()
+
+	ret, err := newFuncResolver(gs, f, at).resolve(args)
+	if err != nil {
+		if fe, ok := err.(*FuncError); ok {
+			fe.CallStack = append(fe.CallStack, frame)
+			return nil, fe
+		}
+
+		return nil, &FuncError{Err: err, CallStack: []StackFrame{frame}}
+	}
+
+	return ret, nil
+}
+
+// Evaluates a single call to a function defined in the manifest. Each call gets
+// its own local state, so functions can't see the variables of the caller.
+// Facters are evaluated the same way.
+type funcResolver struct {
+	f *Func
+
+	// Describes what is being evaluated in error messages, for instance
+	// "Function f()"
+	what string
+
+	ls *localState
+	gs *globalState
+
+	calledAt Pos
+}
+
+func newFuncResolver(gs *globalState, f *Func, at Pos) *funcResolver {
+	return &funcResolver{
+		f:        f,
+		what:     fmt.Sprintf("Function %s()", f.Name),
+		ls:       newLocalState(gs, at),
+		gs:       gs,
+		calledAt: at,
+	}
+}
+
+func (fr *funcResolver) resolve(args []Value) (Value, error) {
+	if len(args) > len(fr.f.ArgDefs) {
+		return nil, fmt.Errorf(
+			"Function %s() takes at most %d arguments, got %d at %s",
+			fr.f.Name, len(fr.f.ArgDefs), len(args), fr.calledAt,
+		)
+	}
+
+	for i, def := range fr.f.ArgDefs {
+		if i < len(args) {
+			def.Val = args[i]
+		} else if def.Val == nil {
+			return nil, fmt.Errorf(
+				"Required argument '%s' not supplied at %s",
+				def.VariableName.Str[1:], fr.calledAt,
+			)
+		}
+
+		fr.ls.varDefsByName[def.VariableName.Str] = def
+	}
+
+	return fr.resolveReturn()
+}
+
+// Resolves the block of the function and returns the value it returns. All
+// arguments must already be defined in the local state.
+func (fr *funcResolver) resolveReturn() (Value, error) {
+	ret, returned, err := fr.resolveBlock(&fr.f.Block)
+	if err != nil {
+		return nil, err
+	} else if !returned {
+		return nil, fmt.Errorf(
+			"%s defined at %s didn't return a value", fr.what, fr.f.Pos,
+		)
+	}
+
+	return ret, nil
+}
+
+// Resolves a block in the function. A return inside of an if statement which
+// is taken has precedence over a return directly in the block, which makes it
+// possible to return early.
+func (fr *funcResolver) resolveBlock(b *Block) (ret Value, returned bool, err error) {
+	if len(b.Declarations) > 0 {
+		return nil, false, fmt.Errorf(
+			"Declarations are not allowed in functions at %s",
+			b.Declarations[0].Pos,
+		)
+	} else if len(b.Includes) > 0 {
+		return nil, false, fmt.Errorf(
+			"Includes are not allowed in functions at %s", b.Includes[0].Pos,
+		)
+	}
+
+	for _, def := range b.VariableDefs {
+		if fr.ls.isDefined(def.VariableName.Str) {
+			return nil, false, &Err{
+				Pos:        def.Pos,
+				Type:       ErrorTypeMultipleDefinition,
+				SymbolName: string(def.VariableName.Str),
+			}
+		}
+
+		fr.ls.varDefsByName[def.VariableName.Str] = def
+	}
+
+	if _, err := fr.ls.bindVariables(b.VariableDefs); err != nil {
+		return nil, false, err
+	}
+
+	for i, _ := range b.Ifs {
+		branch, captures, err := fr.ls.resolveIfBranch(&b.Ifs[i])
+		if err != nil {
+			return nil, false, err
+		}
+
+		if branch != nil {
+			restore := fr.ls.setCaptures(captures)
+			ret, returned, err := fr.resolveBlock(branch)
+			restore()
+			if err != nil || returned {
+				return ret, returned, err
+			}
+		}
+	}
+
+	for i, _ := range b.Cases {
+		branch, err := fr.ls.resolveCaseBranch(&b.Cases[i])
+		if err != nil {
+			return nil, false, err
+		}
+
+		if branch != nil {
+			if ret, returned, err := fr.resolveBlock(branch); err != nil || returned {
+				return ret, returned, err
+			}
+		}
+	}
+
+	for i := range b.Fors {
+		if ret, returned, err := fr.resolveFor(&b.Fors[i]); err != nil || returned {
+			return ret, returned, err
+		}
+	}
+
+	if b.Return != nil {
+		ret, err := fr.ls.resolveValue(b.Return.Value)
+		return ret, err == nil, err
+	}
+
+	return nil, false, nil
+}
+
+// Resolves the block of a for loop once for each element of its collection,
+// each time in a new scope. A return in any iteration returns from the
+// function.
+func (fr *funcResolver) resolveFor(f *For) (ret Value, returned bool, err error) {
+	scopes, err := fr.ls.resolveForScopes(f)
+	if err != nil {
+		return nil, false, err
+	}
+
+	parent := fr.ls
+	defer func() { fr.ls = parent }()
+
+	for i, scope := range scopes {
+		fr.ls = scope
+		if ret, returned, err := fr.resolveBlock(&f.Block); err != nil {
+			return nil, false, &IterationError{Err: err, Iteration: i + 1, Pos: f.Pos}
+		} else if returned {
+			return ret, true, nil
+		}
+	}
+
+	return nil, false, nil
+}
@@ -0,0 +1,149 @@
+package resolver
+
+import (
+	"fmt"
+
+	. "github.com/yoshiyaka/mosa/ast"
+)
+
+// A function which may be called from manifests, for instance len($content).
+// Functions must be pure. They are given resolved values and must return a
+// resolved value, such as an int, a Float, a Bool, a QuotedString, an Array or
+// a Hash.
+type Function struct {
+	// How many arguments the function accepts. A MaxArgs of -1 means that any
+	// number of arguments from MinArgs and up is accepted.
+	MinArgs, MaxArgs int
+
+	// Performs the actual call. The number of arguments has already been
+	// checked. Errors returned will have the name of the function and the
+	// position of the call appended to them.
+	Call func(args []Value) (Value, error)
+}
+
+// All functions callable from manifests, by name. The standard library in
+// builtins.go is registered at init.
+var functionsByName = map[string]*Function{}
+
+// Makes a function callable from manifests. Registering a function with the
+// same name as an existing one replaces it. This is not safe to call at the
+// same time as Resolve().
+func RegisterFunction(name string, f *Function) {
+	functionsByName[name] = f
+}
+
+// Returns a description of how many arguments f takes, for instance
+// "2 arguments" or "at least 1 argument".
+func (f *Function) describeArgs() string {
+	plural := func(n int) string {
+		if n == 1 {
+			return "1 argument"
+		}
+		return fmt.Sprintf("%d arguments", n)
+	}
+
+	switch {
+	case f.MaxArgs == -1:
+		return "at least " + plural(f.MinArgs)
+	case f.MinArgs == f.MaxArgs:
+		return plural(f.MinArgs)
+	default:
+		return fmt.Sprintf("%d to %s", f.MinArgs, plural(f.MaxArgs))
+	}
+}
+
+// Calls a function defined in the manifest, or a builtin function.
+func (ls *localState) resolveFunctionCallRecursive(fc FunctionCall, chain []*VariableDef, seenNames map[string]bool) (Value, error) {
+	f, exists := functionsByName[fc.Name]
+
+	var userFunc *Func
+	if ls.gs != nil && !exists {
+		var err error
+		if userFunc, _, err = ls.gs.lookupFunc(fc.Name); err != nil {
+			return nil, err
+		}
+	}
+
+	if !exists && userFunc == nil {
+		return nil, fmt.Errorf(
+			"Call to undefined function %s() at %s", fc.Name, fc.Pos,
+		)
+	}
+
+	if userFunc == nil && (len(fc.Args) < f.MinArgs ||
+		(f.MaxArgs != -1 && len(fc.Args) > f.MaxArgs)) {
+		return nil, fmt.Errorf(
+			"Function %s() takes %s, got %d at %s",
+			fc.Name, f.describeArgs(), len(fc.Args), fc.Pos,
+		)
+	}
+
+	args := make([]Value, len(fc.Args))
+	for i, arg := range fc.Args {
+		seenNamesCopy := map[string]bool{}
+		for key, val := range seenNames {
+			seenNamesCopy[key] = val
+		}
+
+		var err error
+		args[i], err = ls.resolveValueRecursive(arg, chain, seenNamesCopy)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if userFunc != nil {
+		return ls.gs.callFunc(userFunc, args, fc.Pos)
+	}
+
+	ret, err := f.Call(args)
+	if err != nil {
+		return nil, fmt.Errorf("%s in call to %s() at %s", err, fc.Name, fc.Pos)
+	}
+
+	return ret, nil
+}
+
+// The helpers below fetch argument i, and return an error suitable for
+// returning from Function.Call if it has the wrong type.
+
+func stringArg(args []Value, i int) (string, error) {
+	switch args[i].(type) {
+	case QuotedString:
+		return string(args[i].(QuotedString)), nil
+	case string:
+		return args[i].(string), nil
+	}
+
+	return "", argError(args, i, "a string")
+}
+
+func arrayArg(args []Value, i int) (Array, error) {
+	if a, ok := args[i].(Array); ok {
+		return a, nil
+	}
+
+	return nil, argError(args, i, "an array")
+}
+
+func hashArg(args []Value, i int) (Hash, error) {
+	if h, ok := args[i].(Hash); ok {
+		return h, nil
+	}
+
+	return nil, argError(args, i, "a hash")
+}
+
+func numberArg(args []Value, i int) (float64, error) {
+	if f, ok := toFloat(args[i]); ok {
+		return f, nil
+	}
+
+	return 0, argError(args, i, "a number")
+}
+
+func argError(args []Value, i int, expected string) error {
+	return fmt.Errorf(
+		"Argument %d must be %s (got %T)", i+1, expected, args[i],
+	)
+}
@@ -0,0 +1,169 @@
+package resolver
+
+import (
+	"reflect"
+	"testing"
+
+	. "github.com/yoshiyaka/mosa/ast"
+)
+
+func call(name string, args ...interface{}) FunctionCall {
+	return FunctionCall{Pos{"t.ms", 1, 5}, name, args}
+}
+
+var functionTests = []struct {
+	call          FunctionCall
+	expectedValue Value
+}{
+	{call("len", QuotedString("åäö")), 3},
+	{call("len", Array{1, 2}), 2},
+	{call("len", Hash{{Pos{}, QuotedString("a"), 1}}), 1},
+	{call("upcase", QuotedString("aBc")), QuotedString("ABC")},
+	{call("downcase", QuotedString("aBc")), QuotedString("abc")},
+	{call("trim", QuotedString(" a \n")), QuotedString("a")},
+	{call("str", Float(1)), QuotedString("1.0")},
+	{call("str", Bool(true)), QuotedString("true")},
+	{
+		call("split", QuotedString("a,b"), QuotedString(",")),
+		Array{QuotedString("a"), QuotedString("b")},
+	},
+	{
+		call("implode", Array{QuotedString("a"), 1}, QuotedString(" ")),
+		QuotedString("a 1"),
+	},
+	{
+		call("join", Array{}, QuotedString(" ")),
+		QuotedString(""),
+	},
+	{
+		call("replace", QuotedString("a-b-c"), QuotedString("-"), QuotedString("+")),
+		QuotedString("a+b+c"),
+	},
+	{call("has_prefix", QuotedString("abc"), QuotedString("ab")), Bool(true)},
+	{call("has_suffix", QuotedString("abc"), QuotedString("ab")), Bool(false)},
+
+	{call("sort", Array{3, Float(1.5), 2}), Array{Float(1.5), 2, 3}},
+	{
+		call("sort", Array{QuotedString("b"), QuotedString("a")}),
+		Array{QuotedString("a"), QuotedString("b")},
+	},
+	{call("uniq", Array{1, 2, 1, 3, 2}), Array{1, 2, 3}},
+	{call("reverse", Array{1, 2, 3}), Array{3, 2, 1}},
+	{call("flatten", Array{1, Array{2, Array{3}}}), Array{1, 2, 3}},
+
+	{
+		call("keys", Hash{{Pos{}, QuotedString("a"), 1}, {Pos{}, QuotedString("b"), 2}}),
+		Array{QuotedString("a"), QuotedString("b")},
+	},
+	{
+		call("values", Hash{{Pos{}, QuotedString("a"), 1}, {Pos{}, QuotedString("b"), 2}}),
+		Array{1, 2},
+	},
+	{
+		call("has_key", Hash{{Pos{}, QuotedString("a"), 1}}, QuotedString("a")),
+		Bool(true),
+	},
+	{
+		call(
+			"merge",
+			Hash{{Pos{}, QuotedString("a"), 1}, {Pos{}, QuotedString("b"), 2}},
+			Hash{{Pos{}, QuotedString("b"), 3}, {Pos{}, QuotedString("c"), 4}},
+		),
+		Hash{
+			{Pos{}, QuotedString("a"), 1},
+			{Pos{}, QuotedString("b"), 3},
+			{Pos{}, QuotedString("c"), 4},
+		},
+	},
+
+	{call("abs", -5), 5},
+	{call("abs", Float(-0.5)), Float(0.5)},
+	{call("min", 3, 1, 2), 1},
+	{call("max", 3, Float(4.5), 2), Float(4.5)},
+	{call("floor", Float(1.5)), 1},
+	{call("ceil", Float(1.5)), 2},
+	{call("round", Float(2.5)), 3},
+	{call("int", QuotedString(" 42 ")), 42},
+	{call("int", Float(-1.9)), -1},
+	{call("float", 2), Float(2)},
+	{call("float", QuotedString("0.25")), Float(0.25)},
+
+	{
+		call("md5sum", QuotedString("mosa")),
+		QuotedString("be0789a9c934537d54dfb6e6529ed9ec"),
+	},
+	{
+		call("sha1sum", QuotedString("")),
+		QuotedString("da39a3ee5e6b4b0d3255bfef95601890afd80709"),
+	},
+	{
+		call("sha256sum", QuotedString("")),
+		QuotedString("e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"),
+	},
+
+	{
+		call("len", Expression{Pos{}, "+", QuotedString("a"), QuotedString("b")}),
+		2,
+	},
+}
+
+func TestFunctions(t *testing.T) {
+	for _, test := range functionTests {
+		ls := newLocalState(nil, Pos{File: "t.ms"})
+
+		val, err := ls.resolveValue(test.call)
+		if err != nil {
+			t.Error("Resolving", test.call, ", got error:", err.Error())
+			continue
+		}
+
+		if !ValueEquals(test.expectedValue, val) ||
+			reflect.TypeOf(test.expectedValue) != reflect.TypeOf(val) {
+			t.Errorf("Got bad value for %s: %#v", test.call, val)
+		}
+	}
+}
+
+var badFunctionTests = []struct {
+	call          FunctionCall
+	expectedError string
+}{
+	{call("nosuchfunc"), "Call to undefined function nosuchfunc() at t.ms:1:5"},
+	{call("len"), "Function len() takes 1 argument, got 0 at t.ms:1:5"},
+	{call("merge"), "Function merge() takes at least 1 argument, got 0 at t.ms:1:5"},
+	{
+		call("split", QuotedString("a")),
+		"Function split() takes 2 arguments, got 1 at t.ms:1:5",
+	},
+	{
+		call("len", 5),
+		"Argument 1 must be a string, an array or a hash (got int) in call to len() at t.ms:1:5",
+	},
+	{
+		call("join", Array{}, 5),
+		"Argument 2 must be a string (got int) in call to join() at t.ms:1:5",
+	},
+	{
+		call("sort", Array{1, QuotedString("a")}),
+		"Argument 1 must be an array of only strings or only numbers (got ast.Array) in call to sort() at t.ms:1:5",
+	},
+	{
+		call("int", QuotedString("five")),
+		"Can't convert 'five' to an int in call to int() at t.ms:1:5",
+	},
+	{
+		call("upcase", VariableName{Pos{"t.ms", 1, 12}, "$undefined"}),
+		"Error at t.ms:1:12: Reference to non-defined variable $undefined",
+	},
+}
+
+func TestBadFunctions(t *testing.T) {
+	for _, test := range badFunctionTests {
+		ls := newLocalState(nil, Pos{File: "t.ms"})
+
+		_, err := ls.resolveValue(test.call)
+		if err == nil || err.Error() != test.expectedError {
+			t.Error("Resolving", test.call, ", got bad error:", err)
+		}
+	}
+}
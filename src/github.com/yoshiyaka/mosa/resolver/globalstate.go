@@ -8,9 +8,8 @@ import (
 
 var (
 	defineExec = Define{
-		Filename: "<builtin>",
-		LineNum:  0,
-		Name:     "exec",
+		Pos:  Pos{File: "<builtin>"},
+		Name: "exec",
 		ArgDefs: []VariableDef{
 			VariableDef{VariableName: VariableName{Str: "$name"}},
 			VariableDef{VariableName: VariableName{Str: "$stdin"}, Val: Bool(false)},
@@ -21,15 +20,13 @@ var (
 )
 
 type realizedDeclaration struct {
-	d    *Declaration
-	file string
-	line int
+	d   *Declaration
+	pos Pos
 }
 
 type realizedClass struct {
-	c    *Class
-	file string
-	line int
+	c   *Class
+	pos Pos
 }
 
 // Holds the global state for the complete manifest. This includes stuff such
@@ -38,6 +35,12 @@ type realizedClass struct {
 type globalState struct {
 	classesByName map[string]*Class
 	definesByName map[string]*Define
+	funcsByName   map[string]*Func
+	factersByName map[string]*Facter
+
+	// The functions currently being called, outermost first. Used to detect
+	// recursion.
+	callStack []StackFrame
 
 	// All realized declarations, mapped by type and name
 	realizedDeclarations map[string]map[string]realizedDeclaration
@@ -51,6 +54,29 @@ type globalState struct {
 	realizedClasses map[string]realizedClass
 
 	locks map[string]map[string]realizedDeclaration
+
+	// Maps each realized declaration to the realization of the define it was
+	// declared in. Declarations made directly in classes and nodes have no
+	// parent.
+	parents map[declKey]declKey
+
+	// The realizations of defines currently being resolved, outermost first
+	defineStack []declKey
+
+	// Runs the commands of probes. Probes are refused if nil.
+	prober *Prober
+
+	// Loads classes, defines and functions which aren't defined in the
+	// manifest. Nothing is autoloaded if nil.
+	autoloader Autoloader
+
+	// The names already passed to the autoloader
+	autoloaded map[string]bool
+}
+
+// Identifies a realized declaration, for instance package['nginx']
+type declKey struct {
+	Type, Name string
 }
 
 func newGlobalState() *globalState {
@@ -58,19 +84,23 @@ func newGlobalState() *globalState {
 		realizedDeclarations: map[string]map[string]realizedDeclaration{},
 		realizedClasses:      map[string]realizedClass{},
 		locks:                map[string]map[string]realizedDeclaration{},
+		parents:              map[declKey]declKey{},
+		autoloaded:           map[string]bool{},
 	}
 }
 
+// Adds classes to the manifest. This may be done more than once, since
+// autoloaded classes are added as they are loaded.
 func (r *globalState) populateClassesByName(classes []Class) error {
-	r.classesByName = map[string]*Class{}
+	if r.classesByName == nil {
+		r.classesByName = map[string]*Class{}
+	}
 
 	for i, class := range classes {
 		if existingClass, exists := r.classesByName[class.Name]; exists {
 			return fmt.Errorf(
-				"Can't redefine class '%s' at %s:%d which is already defined at %s:%d",
-				class.Name,
-				class.Filename, class.LineNum,
-				existingClass.Filename, existingClass.LineNum,
+				"Can't redefine class '%s' at %s which is already defined at %s",
+				class.Name, class.Pos, existingClass.Pos,
 			)
 		} else {
 			r.classesByName[class.Name] = &classes[i]
@@ -81,17 +111,16 @@ func (r *globalState) populateClassesByName(classes []Class) error {
 }
 
 func (r *globalState) populateDefinesByName(defines []Define) error {
-	r.definesByName = map[string]*Define{}
-
-	// The built in exec type is always available
-	r.definesByName["exec"] = &defineExec
+	if r.definesByName == nil {
+		// The built in exec type is always available
+		r.definesByName = map[string]*Define{"exec": &defineExec}
+	}
 
 	for i, def := range defines {
 		if existingDef, exists := r.definesByName[def.Name]; exists {
 			return fmt.Errorf(
-				"Can't redefine type '%s' at %s:%d which is already defined at %s:%d",
-				def.Name, def.Filename, def.LineNum,
-				existingDef.Filename, existingDef.LineNum,
+				"Can't redefine type '%s' at %s which is already defined at %s",
+				def.Name, def.Pos, existingDef.Pos,
 			)
 		} else {
 			nameKey := "$name"
@@ -108,8 +137,8 @@ func (r *globalState) populateDefinesByName(defines []Define) error {
 			}
 			if !foundNameKey {
 				return fmt.Errorf(
-					"Missing required argument %s when defining type '%s' at %s:%d",
-					nameKey, def.Name, def.Filename, def.LineNum,
+					"Missing required argument %s when defining type '%s' at %s",
+					nameKey, def.Name, def.Pos,
 				)
 			}
 
@@ -120,12 +149,161 @@ func (r *globalState) populateDefinesByName(defines []Define) error {
 	return nil
 }
 
+func (r *globalState) populateFuncsByName(funcs []Func) error {
+	if r.funcsByName == nil {
+		r.funcsByName = map[string]*Func{}
+	}
+
+	for i, f := range funcs {
+		if _, isBuiltin := functionsByName[f.Name]; isBuiltin {
+			return fmt.Errorf(
+				"Can't redefine builtin function '%s' at %s", f.Name, f.Pos,
+			)
+		} else if existingFunc, exists := r.funcsByName[f.Name]; exists {
+			return fmt.Errorf(
+				"Can't redefine function '%s' at %s which is already defined at %s",
+				f.Name, f.Pos, existingFunc.Pos,
+			)
+		} else {
+			r.funcsByName[f.Name] = &funcs[i]
+		}
+	}
+
+	return nil
+}
+
+// Pairs each facter with the define of the same name, which may be autoloaded.
+// The facter must be of the same type as the define, and take the same
+// arguments.
+func (r *globalState) populateFactersByName(facters []Facter) error {
+	if r.factersByName == nil {
+		r.factersByName = map[string]*Facter{}
+	}
+
+	for i, f := range facters {
+		if existing, exists := r.factersByName[f.Name]; exists {
+			return fmt.Errorf(
+				"Can't redefine facter '%s' at %s which is already defined at %s",
+				f.Name, f.Pos, existing.Pos,
+			)
+		}
+
+		def, defExists, err := r.lookupDefine(f.Name)
+		if err != nil {
+			return err
+		} else if !defExists {
+			return fmt.Errorf(
+				"Facter for undefined type '%s' at %s", f.Name, f.Pos,
+			)
+		} else if def.Type != f.Type {
+			return fmt.Errorf(
+				"Facter for type '%s' at %s must be single or multiple like the define at %s",
+				f.Name, f.Pos, def.Pos,
+			)
+		} else if !sameArgNames(f.ArgDefs, def.ArgDefs) {
+			return fmt.Errorf(
+				"Facter for type '%s' at %s must take the same %d arguments as the define at %s",
+				f.Name, f.Pos, len(def.ArgDefs), def.Pos,
+			)
+		}
+
+		r.factersByName[f.Name] = &facters[i]
+	}
+
+	return nil
+}
+
+// Adds all classes, defines, functions and facters of a manifest.
+func (r *globalState) populate(ast *AST) error {
+	if err := r.populateClassesByName(ast.Classes); err != nil {
+		return err
+	}
+	if err := r.populateDefinesByName(ast.Defines); err != nil {
+		return err
+	}
+	if err := r.populateFuncsByName(ast.Funcs); err != nil {
+		return err
+	}
+	return r.populateFactersByName(ast.Facters)
+}
+
+// Passes name to the autoloader, unless it has already been passed, and adds
+// everything it loads.
+func (r *globalState) autoload(name string) error {
+	if r.autoloader == nil || r.autoloaded[name] {
+		return nil
+	}
+	r.autoloaded[name] = true
+
+	ast, err := r.autoloader.Autoload(name)
+	if err != nil || ast == nil {
+		return err
+	}
+
+	return r.populate(ast)
+}
+
+// Returns the class called name, autoloading it if it isn't defined in the
+// manifest.
+func (r *globalState) lookupClass(name string) (*Class, bool, error) {
+	if class, ok := r.classesByName[name]; ok {
+		return class, true, nil
+	}
+
+	if err := r.autoload(name); err != nil {
+		return nil, false, err
+	}
+	class, ok := r.classesByName[name]
+	return class, ok, nil
+}
+
+// Returns the define called name, autoloading it if it isn't defined in the
+// manifest.
+func (r *globalState) lookupDefine(name string) (*Define, bool, error) {
+	if def, ok := r.definesByName[name]; ok {
+		return def, true, nil
+	}
+
+	if err := r.autoload(name); err != nil {
+		return nil, false, err
+	}
+	def, ok := r.definesByName[name]
+	return def, ok, nil
+}
+
+// Returns the function called name, autoloading it if it isn't defined in the
+// manifest. Builtin functions are not returned.
+func (r *globalState) lookupFunc(name string) (*Func, bool, error) {
+	if f, ok := r.funcsByName[name]; ok {
+		return f, true, nil
+	}
+
+	if err := r.autoload(name); err != nil {
+		return nil, false, err
+	}
+	f, ok := r.funcsByName[name]
+	return f, ok, nil
+}
+
+func sameArgNames(a1, a2 []VariableDef) bool {
+	if len(a1) != len(a2) {
+		return false
+	}
+
+	for i, _ := range a1 {
+		if a1[i].VariableName.Str != a2[i].VariableName.Str {
+			return false
+		}
+	}
+
+	return true
+}
+
 // Locks a specific instance of a type while realizing it, for instance
 // package { 'apache2': }. This is done to prevent cyclic realizations.
-func (gs *globalState) lockRealization(d *Declaration, name, realizedIn string, at int) *realizedDeclaration {
+func (gs *globalState) lockRealization(d *Declaration, name string, at Pos) *realizedDeclaration {
 	rd := realizedDeclaration{
-		file: realizedIn,
-		line: at,
+		pos: at,
 	}
 
 	if typeMap, exists := gs.locks[d.Type]; !exists {
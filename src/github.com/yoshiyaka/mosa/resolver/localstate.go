@@ -2,6 +2,8 @@ package resolver
 
 import (
 	"fmt"
+	"regexp"
+	"strconv"
 
 	. "github.com/yoshiyaka/mosa/ast"
 )
@@ -16,56 +18,112 @@ type localState struct {
 	// stored here with its final value.
 	resolvedVars map[string]Value
 
-	// These helps us return nice error messages. They hold information of where
-	// this class/node/define was realized.
-	definedInFile  string
-	realizedInFile string
-	realizedAtLine int
+	// Helps us return nice error messages. Holds information of where this
+	// class/node/define was realized.
+	realizedAt Pos
+
+	// Used to look up functions defined in the manifest. May be nil, in which
+	// case only the builtin functions are available.
+	gs *globalState
+
+	// The capture groups of the regex match of the if-statement currently
+	// being resolved, available as $0, $1 and so on.
+	captures []string
+
+	// Set for the scope of an iteration of a for loop. Variables which aren't
+	// defined in the scope are looked up in its parent.
+	parent *localState
 }
 
-func newLocalState(definedInFile, realizedInFile string, realizedAtLine int) *localState {
+func newLocalState(gs *globalState, realizedAt Pos) *localState {
 	return &localState{
-		varDefsByName:  map[string]VariableDef{},
-		resolvedVars:   map[string]Value{},
-		definedInFile:  definedInFile,
-		realizedInFile: realizedInFile,
-		realizedAtLine: realizedAtLine,
+		varDefsByName: map[string]VariableDef{},
+		resolvedVars:  map[string]Value{},
+		realizedAt:    realizedAt,
+		gs:            gs,
 	}
 }
 
-func (ls *localState) resolveVariable(v VariableName, lineNum int) (Value, error) {
-	return ls.resolveVariableRecursive(
-		v, lineNum, nil, map[VariableName]bool{},
-	)
+// Returns a new scope for the block of a for loop, in which variables of ls
+// are visible but new ones may be defined without affecting ls.
+func (ls *localState) newChild() *localState {
+	child := newLocalState(ls.gs, ls.realizedAt)
+	child.parent = ls
+	return child
+}
+
+// Returns whether a variable is defined in the scope, resolved or not.
+func (ls *localState) isDefined(name string) bool {
+	_, defined := ls.varDefsByName[name]
+	if !defined {
+		_, defined = ls.resolvedVars[name]
+	}
+	return defined
+}
+
+// Resolves the variable definitions of a block right away and binds the
+// variables to their values. Variables defined in the branch of an if
+// statement with a regex match must be bound while the branch is resolved,
+// since the captures of the match are only available until then.
+func (ls *localState) bindVariables(defs []VariableDef) ([]VariableDef, error) {
+	bound := make([]VariableDef, len(defs))
+	for i, def := range defs {
+		val, err := ls.resolveValue(def.Val)
+		if err != nil {
+			return nil, err
+		}
+
+		def.Val = val
+		ls.resolvedVars[def.VariableName.Str] = val
+		delete(ls.varDefsByName, def.VariableName.Str)
+		bound[i] = def
+	}
+
+	return bound, nil
+}
+
+func (ls *localState) resolveVariable(v VariableName) (Value, error) {
+	return ls.resolveVariableRecursive(v, nil, map[string]bool{})
 }
 
 // Recursively resolves a variable's actual value.
 //
 // chain will keep the chain used to define the variable, for instance if
 // a manifest looks like
-//  $foo = $bar
-//  $bar = 3
+//
+//	$foo = $bar
+//	$bar = 3
+//
 // chain will contain [ $foo, $bar ]. This is used when printing errors about
 // cyclic dependencies.
 //
 // seenNames is keeps track of all variables already seen during the current
 // recursion. Used to detect cyclic dependencies.
-func (ls *localState) resolveVariableRecursive(lookingFor VariableName, lineNum int, chain []*VariableDef, seenNames map[VariableName]bool) (Value, error) {
+//
+// Errors are reported at the position of lookingFor, which is where the
+// variable is referenced.
+func (ls *localState) resolveVariableRecursive(lookingFor VariableName, chain []*VariableDef, seenNames map[string]bool) (Value, error) {
+	if n, err := strconv.Atoi(lookingFor.Str[1:]); err == nil && n < len(ls.captures) {
+		return QuotedString(ls.captures[n]), nil
+	}
+
 	if val, found := ls.resolvedVars[lookingFor.Str]; found {
 		return val, nil
 	}
 
 	foundVar, found := ls.varDefsByName[lookingFor.Str]
-	if !found {
+	if !found && ls.parent != nil {
+		return ls.parent.resolveVariableRecursive(lookingFor, chain, seenNames)
+	} else if !found {
 		return nil, &Err{
-			Line:       lineNum,
+			Pos:        lookingFor.Pos,
 			Type:       ErrorTypeUnresolvableVariable,
 			SymbolName: string(lookingFor.String()),
 		}
 	}
 
 	chain = append(chain, &foundVar)
-	if _, seen := seenNames[lookingFor]; seen {
+	if _, seen := seenNames[lookingFor.Str]; seen {
 		cycle := make([]string, len(chain)+1)
 		for i, def := range chain {
 			cycle[i] = string(def.VariableName.Str)
@@ -73,22 +131,20 @@ func (ls *localState) resolveVariableRecursive(lookingFor VariableName, lineNum
 		cycle[len(cycle)-1] = string(lookingFor.Str)
 		return nil, &CyclicError{
 			Err: Err{
-				Line:       chain[0].LineNum,
+				Pos:        chain[0].Pos,
 				Type:       ErrorTypeCyclicVariable,
 				SymbolName: string(chain[0].VariableName.Str),
 			},
 			Cycle: cycle,
 		}
 	}
-	seenNames[lookingFor] = true
+	seenNames[lookingFor.Str] = true
 
 	if _, isVar := foundVar.Val.(VariableName); !isVar {
 		// This is an actual value, not a variable name. Recurse and continue
 		// resolve in case the value is some thing that needs to be resovled,
 		// such as an array or an interpolated string.
-		resolved, err := ls.resolveValueRecursive(
-			foundVar.Val, foundVar.LineNum, chain, seenNames,
-		)
+		resolved, err := ls.resolveValueRecursive(foundVar.Val, chain, seenNames)
 
 		if err == nil {
 			ls.resolvedVars[lookingFor.Str] = resolved
@@ -99,32 +155,31 @@ func (ls *localState) resolveVariableRecursive(lookingFor VariableName, lineNum
 	}
 
 	return ls.resolveVariableRecursive(
-		foundVar.Val.(VariableName), foundVar.LineNum, append(chain, &foundVar),
-		seenNames,
+		foundVar.Val.(VariableName), append(chain, &foundVar), seenNames,
 	)
 }
 
-func (ls *localState) resolveArrayRecursive(a Array, lineNum int, chain []*VariableDef, seenNames map[VariableName]bool) (Array, error) {
+func (ls *localState) resolveArrayRecursive(a Array, chain []*VariableDef, seenNames map[string]bool) (Array, error) {
 	newArray := make(Array, len(a))
 
 	for i, val := range a {
 		if varName, isVar := val.(VariableName); isVar {
 			// This array entry is a variable name, resolve it.
 			var err error
-			seenNamesCopy := map[VariableName]bool{}
+			seenNamesCopy := map[string]bool{}
 			for key, val := range seenNames {
 				seenNamesCopy[key] = val
 			}
 
 			newArray[i], err = ls.resolveVariableRecursive(
-				varName, lineNum, chain, seenNamesCopy,
+				varName, chain, seenNamesCopy,
 			)
 			if err != nil {
 				return nil, err
 			}
 		} else {
 			var err error
-			newArray[i], err = ls.resolveValue(val, lineNum)
+			newArray[i], err = ls.resolveValue(val)
 			if err != nil {
 				return nil, err
 			}
@@ -134,119 +189,582 @@ func (ls *localState) resolveArrayRecursive(a Array, lineNum int, chain []*Varia
 	return newArray, nil
 }
 
-func (ls *localState) resolveInterpolatedStringRecursive(is InterpolatedString, chain []*VariableDef, seenNames map[VariableName]bool) (QuotedString, error) {
+// Resolves all keys and values in the hash. Keys must resolve to strings, and
+// may only be used once in each hash.
+func (ls *localState) resolveHashRecursive(h Hash, chain []*VariableDef, seenNames map[string]bool) (Hash, error) {
+	newHash := make(Hash, len(h))
+	seenKeys := map[QuotedString]bool{}
+
+	for i, entry := range h {
+		seenNamesCopy := map[string]bool{}
+		for key, val := range seenNames {
+			seenNamesCopy[key] = val
+		}
+
+		key, err := ls.resolveValueRecursive(entry.Key, chain, seenNamesCopy)
+		if err != nil {
+			return nil, err
+		}
+
+		str, ok := key.(QuotedString)
+		if !ok {
+			return nil, fmt.Errorf(
+				"Hash keys must be strings (got %T) at %s", key, entry.Pos,
+			)
+		}
+		if seenKeys[str] {
+			return nil, fmt.Errorf(
+				"Key %s defined more than once in hash at %s", str, entry.Pos,
+			)
+		}
+		seenKeys[str] = true
+
+		seenNamesCopy = map[string]bool{}
+		for key, val := range seenNames {
+			seenNamesCopy[key] = val
+		}
+
+		val, err := ls.resolveValueRecursive(entry.Val, chain, seenNamesCopy)
+		if err != nil {
+			return nil, err
+		}
+
+		newHash[i] = HashEntry{Pos: entry.Pos, Key: str, Val: val}
+	}
+
+	return newHash, nil
+}
+
+// Looks up a key in a hash, for instance $vhost['port'], or an element in an
+// array, for instance $ports[-1].
+func (ls *localState) resolveIndexRecursive(i Index, chain []*VariableDef, seenNames map[string]bool) (Value, error) {
+	val, err := ls.resolveValueRecursive(i.Value, chain, seenNames)
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := ls.resolveValue(i.Key)
+	if err != nil {
+		return nil, err
+	}
+
+	if a, isArray := val.(Array); isArray {
+		idx, isInt := key.(int)
+		if !isInt {
+			return nil, fmt.Errorf(
+				"Array indexes must be ints (got %T) at %s", key, i.Pos,
+			)
+		}
+
+		pos, inRange := arrayPos(idx, len(a))
+		if !inRange || pos == len(a) {
+			return nil, fmt.Errorf(
+				"Index %d out of range for array of length %d at %s",
+				idx, len(a), i.Pos,
+			)
+		}
+		return a[pos], nil
+	}
+
+	h, ok := val.(Hash)
+	if !ok {
+		return nil, fmt.Errorf(
+			"Can't look up a key in value of type %T at %s", val, i.Pos,
+		)
+	}
+
+	if _, ok := key.(QuotedString); !ok {
+		return nil, fmt.Errorf(
+			"Hash keys must be strings (got %T) at %s", key, i.Pos,
+		)
+	}
+
+	if found, exists := h.Get(key); exists {
+		return found, nil
+	} else {
+		return nil, fmt.Errorf("Key %s not found in hash at %s", key, i.Pos)
+	}
+}
+
+// Returns the part of an array between two indexes, for instance $ports[1:3].
+func (ls *localState) resolveSliceRecursive(s Slice, chain []*VariableDef, seenNames map[string]bool) (Value, error) {
+	val, err := ls.resolveValueRecursive(s.Value, chain, seenNames)
+	if err != nil {
+		return nil, err
+	}
+
+	a, isArray := val.(Array)
+	if !isArray {
+		return nil, fmt.Errorf(
+			"Can't slice value of type %T at %s", val, s.Pos,
+		)
+	}
+
+	// Resolves a bound of the slice to a position in the array
+	bound := func(v Value, def int) (int, error) {
+		if v == nil {
+			return def, nil
+		}
+
+		boundVal, err := ls.resolveValue(v)
+		if err != nil {
+			return 0, err
+		}
+		idx, isInt := boundVal.(int)
+		if !isInt {
+			return 0, fmt.Errorf(
+				"Slice bounds must be ints (got %T) at %s", boundVal, s.Pos,
+			)
+		}
+
+		pos, inRange := arrayPos(idx, len(a))
+		if !inRange {
+			return 0, fmt.Errorf(
+				"Slice bound %d out of range for array of length %d at %s",
+				idx, len(a), s.Pos,
+			)
+		}
+		return pos, nil
+	}
+
+	from, err := bound(s.From, 0)
+	if err != nil {
+		return nil, err
+	}
+	to, err := bound(s.To, len(a))
+	if err != nil {
+		return nil, err
+	}
+	if from > to {
+		return nil, fmt.Errorf("Slice starts after its end at %s", s.Pos)
+	}
+
+	slice := make(Array, to-from)
+	copy(slice, a[from:to])
+	return slice, nil
+}
+
+// Converts an index of an array of the given length to a position in it, where
+// negative indexes count from the end. Positions from 0 up to and including
+// the length are in range, since the length is a valid bound for slices.
+func arrayPos(idx, length int) (int, bool) {
+	if idx < 0 {
+		idx += length
+	}
+	return idx, idx >= 0 && idx <= length
+}
+
+func (ls *localState) resolveInterpolatedStringRecursive(is InterpolatedString, chain []*VariableDef, seenNames map[string]bool) (QuotedString, error) {
 	ret := ""
 
 	for _, part := range is.Segments {
-		if v, isVar := part.(VariableName); isVar {
-			// This segment is a variable name, resolve it.
-			seenNamesCopy := map[VariableName]bool{}
-			for key, val := range seenNames {
-				seenNamesCopy[key] = val
+		if text, isText := part.(Literal); isText {
+			if str, isString := text.Val.(string); isString {
+				ret += str
+				continue
 			}
+		}
 
-			if val, err := ls.resolveVariableRecursive(
-				v, is.LineNum, chain, seenNamesCopy,
-			); err != nil {
-				return "", err
-			} else {
-				switch val.(type) {
-				case string:
-					ret += val.(string)
-				case QuotedString:
-					ret += string(val.(QuotedString))
-				default:
-					fmt.Println(val)
-					panic("value can't be interpolated")
-				}
-			}
-		} else {
-			ret += part.(string)
+		// This segment is a variable name or an expression, resolve it.
+		seenNamesCopy := map[string]bool{}
+		for key, val := range seenNames {
+			seenNamesCopy[key] = val
+		}
+
+		val, err := ls.resolveValueRecursive(part, chain, seenNamesCopy)
+		if err != nil {
+			return "", err
+		}
+
+		switch val.(type) {
+		case string:
+			ret += val.(string)
+		case QuotedString:
+			ret += string(val.(QuotedString))
+		case int:
+			ret += strconv.Itoa(val.(int))
+		case Float:
+			ret += val.(Float).String()
+		case Bool:
+			ret += strconv.FormatBool(bool(val.(Bool)))
+		default:
+			return "", fmt.Errorf(
+				"Value of type %T can't be interpolated at %s",
+				val, valuePos(part, is.Pos),
+			)
 		}
 	}
 
 	return QuotedString(ret), nil
 }
 
-func (ls *localState) resolveValue(v Value, lineNum int) (Value, error) {
-	return ls.resolveValueRecursive(v, lineNum, nil, map[VariableName]bool{})
+func (ls *localState) resolveValue(v Value) (Value, error) {
+	return ls.resolveValueRecursive(v, nil, map[string]bool{})
 }
 
-func (ls *localState) resolveValueRecursive(v Value, lineNum int, chain []*VariableDef, seenNames map[VariableName]bool) (Value, error) {
+func (ls *localState) resolveValueRecursive(v Value, chain []*VariableDef, seenNames map[string]bool) (Value, error) {
 	switch v.(type) {
+	case Literal:
+		return v.(Literal).Val, nil
 	case VariableName:
-		return ls.resolveVariableRecursive(
-			v.(VariableName), lineNum, chain, seenNames,
-		)
+		return ls.resolveVariableRecursive(v.(VariableName), chain, seenNames)
 	case Array:
-		return ls.resolveArrayRecursive(v.(Array), lineNum, chain, seenNames)
+		return ls.resolveArrayRecursive(v.(Array), chain, seenNames)
 	case Reference:
 		return ls.resolveReferenceRecursive(v.(Reference), chain, seenNames)
+	case Hash:
+		return ls.resolveHashRecursive(v.(Hash), chain, seenNames)
+	case Index:
+		return ls.resolveIndexRecursive(v.(Index), chain, seenNames)
+	case Slice:
+		return ls.resolveSliceRecursive(v.(Slice), chain, seenNames)
+	case FunctionCall:
+		return ls.resolveFunctionCallRecursive(v.(FunctionCall), chain, seenNames)
+	case Probe:
+		return ls.resolveProbeRecursive(v.(Probe), chain, seenNames)
+	case Selector:
+		return ls.resolveSelectorRecursive(v.(Selector), chain, seenNames)
 	case InterpolatedString:
 		return ls.resolveInterpolatedStringRecursive(
 			v.(InterpolatedString), chain, seenNames,
 		)
 	case Expression:
 		return ls.resolveExpression(v.(Expression))
+	case UnaryExpression:
+		return ls.resolveUnaryExpression(v.(UnaryExpression))
 	default:
 		return v, nil
 	}
 }
 
-func (ls *localState) resolveExpression(e Expression) (v Value, retErr error) {
-	left, leftErr := ls.resolveValue(e.Left, e.LineNum)
+func (ls *localState) resolveExpression(e Expression) (Value, error) {
+	left, leftErr := ls.resolveValue(e.Left)
 	if leftErr != nil {
 		return nil, leftErr
 	}
-	right, rightErr := ls.resolveValue(e.Right, e.LineNum)
+	right, rightErr := ls.resolveValue(e.Right)
 	if rightErr != nil {
 		return nil, rightErr
 	}
 
-	defer func() {
-		if r := recover(); r != nil {
-			retErr = fmt.Errorf(
-				"Bad types (%T, %T) supplied for operation '%s' at %s:%d",
-				left, right, e.Operation, ls.definedInFile, e.LineNum,
-			)
-		}
-	}()
-
-	// The functions below will panic if one of the types are bad (for instance
-	// 5 > "banana" or true * 4.
+	var v Value
+	var err error
 	switch e.Operation {
 	case "+":
-		return ExpPlus(left, right)
+		v, err = ExpPlus(left, right)
 	case "-":
-		return ExpMinus(left, right)
+		v, err = ExpMinus(left, right)
 	case "*":
-		return ExpMultiply(left, right)
+		v, err = ExpMultiply(left, right)
 	case "/":
-		return ExpDivide(left, right)
+		v, err = ExpDivide(left, right)
+	case "%":
+		v, err = ExpModulo(left, right)
 	case "==":
-		return ExpEquals(left, right)
+		v, err = ExpEquals(left, right)
 	case "!=":
-		return ExpNotEquals(left, right)
+		v, err = ExpNotEquals(left, right)
 	case "<":
-		return ExpLT(left, right)
+		v, err = ExpLT(left, right)
 	case "<=":
-		return ExpLTEq(left, right)
+		v, err = ExpLTEq(left, right)
 	case ">":
-		return ExpGT(left, right)
+		v, err = ExpGT(left, right)
 	case ">=":
-		return ExpGTEq(left, right)
+		v, err = ExpGTEq(left, right)
 	case "&&":
-		return ExpBoolAnd(left, right)
+		v, err = ExpBoolAnd(left, right)
 	case "||":
-		return ExpBoolOr(left, right)
+		v, err = ExpBoolOr(left, right)
+	case "in":
+		v, err = ExpIn(left, right)
+	case "=~":
+		v, err = ExpMatch(left, right)
+	case "!~":
+		v, err = ExpNotMatch(left, right)
+	default:
+		return nil, fmt.Errorf(
+			"Encountered unknown operation '%s' in expression at %s",
+			e.Operation, e.Pos,
+		)
+	}
+
+	if err != nil {
+		return nil, &ExpressionError{
+			Pos:       e.Pos,
+			Operation: e.Operation,
+			Operands:  []Value{left, right},
+			Err:       err,
+		}
+	}
+
+	return v, nil
+}
+
+func (ls *localState) resolveUnaryExpression(e UnaryExpression) (Value, error) {
+	operand, err := ls.resolveValue(e.Value)
+	if err != nil {
+		return nil, err
 	}
 
-	return nil, fmt.Errorf(
-		"Encountered unknown operation '%s' in expression at %s:%d",
-		e.Operation, ls.definedInFile, e.LineNum,
+	var v Value
+	switch e.Operation {
+	case "!":
+		v, err = ExpNot(operand)
+	case "-":
+		v, err = ExpNegate(operand)
+	default:
+		return nil, fmt.Errorf(
+			"Encountered unknown operation '%s' in expression at %s",
+			e.Operation, e.Pos,
+		)
+	}
+
+	if err != nil {
+		return nil, &ExpressionError{
+			Pos:       e.Pos,
+			Operation: e.Operation,
+			Operands:  []Value{operand},
+			Err:       err,
+		}
+	}
+
+	return v, nil
+}
+
+// Returns whether the expression of an if or elsif statement at pos is true.
+// The expression must be boolean. If the expression is a regex match such as
+// $host =~ /^web(\d+)/, the capture groups of the match are returned as well.
+func (ls *localState) resolveCondition(expression Value, pos Pos) (bool, []string, error) {
+	if e, isExp := expression.(Expression); isExp && e.Operation == "=~" {
+		return ls.resolveMatchCondition(e)
+	}
+
+	if boolVal, err := ls.resolveValue(expression); err != nil {
+		return false, nil, err
+	} else if realBool, ok := boolVal.(Bool); !ok {
+		return false, nil, fmt.Errorf(
+			"Expressions in if-statements must be boolean at %s", pos,
+		)
+	} else {
+		return bool(realBool), nil, nil
+	}
+}
+
+// Resolves a regex match used as the expression of an if or elsif statement,
+// returning whether it matched and its capture groups.
+func (ls *localState) resolveMatchCondition(e Expression) (bool, []string, error) {
+	left, err := ls.resolveValue(e.Left)
+	if err != nil {
+		return false, nil, err
+	}
+	right, err := ls.resolveValue(e.Right)
+	if err != nil {
+		return false, nil, err
+	}
+
+	captures, err := regexCaptures(left, right)
+	if err != nil {
+		return false, nil, &ExpressionError{
+			Pos:       e.Pos,
+			Operation: e.Operation,
+			Operands:  []Value{left, right},
+			Err:       err,
+		}
+	}
+
+	return captures != nil, captures, nil
+}
+
+// Returns the block of the if statement which should be resolved, which is the
+// block of the first true expression or the else block, along with the capture
+// groups of the expression if it was a regex match. Returns nil if no block
+// should be resolved.
+func (ls *localState) resolveIfBranch(_if *If) (*Block, []string, error) {
+	if taken, captures, err := ls.resolveCondition(_if.Expression, _if.Pos); err != nil {
+		return nil, nil, err
+	} else if taken {
+		return &_if.Block, captures, nil
+	}
+
+	for i := range _if.ElseIfs {
+		elseIf := &_if.ElseIfs[i]
+		if taken, captures, err := ls.resolveCondition(elseIf.Expression, elseIf.Pos); err != nil {
+			return nil, nil, err
+		} else if taken {
+			return &elseIf.Block, captures, nil
+		}
+	}
+
+	return _if.Else, nil, nil
+}
+
+// Returns one scope per iteration of a for loop, in which the loop variables
+// hold the element of the collection for that iteration.
+func (ls *localState) resolveForScopes(f *For) ([]*localState, error) {
+	if f.Key != nil && f.Key.Str == f.Value.Str {
+		return nil, &Err{
+			Pos:        f.Value.Pos,
+			Type:       ErrorTypeMultipleDefinition,
+			SymbolName: f.Value.Str,
+		}
+	}
+
+	collection, err := ls.resolveValue(f.Collection)
+	if err != nil {
+		return nil, err
+	}
+
+	var keys, vals []Value
+	switch collection.(type) {
+	case Array:
+		for i, elem := range collection.(Array) {
+			keys = append(keys, i)
+			vals = append(vals, elem)
+		}
+	case Hash:
+		for _, entry := range collection.(Hash) {
+			keys = append(keys, entry.Key)
+			vals = append(vals, entry.Val)
+		}
+		if f.Key == nil {
+			// A single variable iterates over the keys of a hash
+			vals = keys
+		}
+	default:
+		return nil, fmt.Errorf(
+			"Can't iterate over value of type %T at %s", collection, f.Pos,
+		)
+	}
+
+	scopes := make([]*localState, len(vals))
+	for i := range vals {
+		scopes[i] = ls.newChild()
+		scopes[i].varDefsByName[f.Value.Str] = VariableDef{
+			Pos: f.Value.Pos, VariableName: f.Value, Val: vals[i],
+		}
+		if f.Key != nil {
+			scopes[i].varDefsByName[f.Key.Str] = VariableDef{
+				Pos: f.Key.Pos, VariableName: *f.Key, Val: keys[i],
+			}
+		}
+	}
+
+	return scopes, nil
+}
+
+// An error which occurred in an iteration of a for loop. It tells which
+// element of the collection caused the error.
+type IterationError struct {
+	Err error
+
+	// The iteration in which the error occurred, counted from 1
+	Iteration int
+
+	// The position of the for loop
+	Pos Pos
+}
+
+func (ie *IterationError) Error() string {
+	return fmt.Sprintf(
+		"%s\n\tin iteration %d of for loop at %s", ie.Err, ie.Iteration, ie.Pos,
 	)
 }
 
+// Makes the capture groups of a regex match available as $0, $1 and so on
+// until the returned function is called, which restores the captures which
+// were available before. Passing nil keeps the current captures.
+func (ls *localState) setCaptures(captures []string) (restore func()) {
+	previous := ls.captures
+	if captures != nil {
+		ls.captures = captures
+	}
+	return func() { ls.captures = previous }
+}
+
+// Returns the block of the first branch of the case statement matching its
+// value, or the default block if no branch matches. Returns nil if no block
+// should be resolved.
+func (ls *localState) resolveCaseBranch(c *Case) (*Block, error) {
+	val, err := ls.resolveValue(c.Value)
+	if err != nil {
+		return nil, err
+	}
+
+	for i, _ := range c.Branches {
+		branch := &c.Branches[i]
+		for _, match := range branch.Matches {
+			resolvedMatch, err := ls.resolveValue(match)
+			if err != nil {
+				return nil, err
+			}
+
+			if matches, err := caseMatches(val, resolvedMatch); err != nil {
+				return nil, fmt.Errorf("%s at %s", err, branch.Pos)
+			} else if matches {
+				return &branch.Block, nil
+			}
+		}
+	}
+
+	return c.Default, nil
+}
+
+// Resolves the value of the first case of the selector matching its value.
+// Only the value picked is resolved.
+func (ls *localState) resolveSelectorRecursive(s Selector, chain []*VariableDef, seenNames map[string]bool) (Value, error) {
+	resolve := func(v Value) (Value, error) {
+		seenNamesCopy := map[string]bool{}
+		for key, val := range seenNames {
+			seenNamesCopy[key] = val
+		}
+		return ls.resolveValueRecursive(v, chain, seenNamesCopy)
+	}
+
+	val, err := resolve(s.Value)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, c := range s.Cases {
+		match, err := resolve(c.Match)
+		if err != nil {
+			return nil, err
+		}
+
+		if matches, err := caseMatches(val, match); err != nil {
+			return nil, fmt.Errorf("%s at %s", err, c.Pos)
+		} else if matches {
+			return resolve(c.Val)
+		}
+	}
+
+	if s.Default == nil {
+		return nil, fmt.Errorf(
+			"No case matches %v in selector without default at %s", val, s.Pos,
+		)
+	}
+
+	return resolve(s.Default)
+}
+
+// Returns whether val matches a match of a case branch. A regex matches all
+// strings it matches, while all other values must be equal to val.
+func caseMatches(val, match Value) (bool, error) {
+	re, isRegex := match.(Regex)
+	if !isRegex {
+		return ValueEquals(val, match), nil
+	}
+
+	compiled, err := regexp.Compile(string(re))
+	if err != nil {
+		return false, fmt.Errorf("Bad regex %s: %s", re, err)
+	}
+
+	str, isString := val.(QuotedString)
+	return isString && compiled.MatchString(string(str)), nil
+}
+
 // Defines local variables from an array of arguments. This is used when a class
 // or define is being realized with a set of custom arguments passed to it.
 func (ls *localState) setVarsFromArgs(passedArgs []Prop, availableParams []VariableDef) error {
@@ -261,7 +779,7 @@ func (ls *localState) setVarsFromArgs(passedArgs []Prop, availableParams []Varia
 	for _, def := range availableParams {
 		if _, exists := ls.varDefsByName[def.VariableName.Str]; exists {
 			return &Err{
-				Line:       def.LineNum,
+				Pos:        def.Pos,
 				Type:       ErrorTypeMultipleDefinition,
 				SymbolName: string(def.VariableName.Str),
 			}
@@ -275,8 +793,8 @@ func (ls *localState) setVarsFromArgs(passedArgs []Prop, availableParams []Varia
 
 		if def.Val == nil {
 			return fmt.Errorf(
-				"Required argument '%s' not supplied at %s:%d",
-				def.VariableName.Str[1:], ls.realizedInFile, ls.realizedAtLine,
+				"Required argument '%s' not supplied at %s",
+				def.VariableName.Str[1:], ls.realizedAt,
 			)
 		}
 
@@ -287,8 +805,8 @@ func (ls *localState) setVarsFromArgs(passedArgs []Prop, availableParams []Varia
 	if len(argsByName) > 0 {
 		for _, arg := range argsByName {
 			return fmt.Errorf(
-				"Unsupported argument '%s' sent to type at %s:%d",
-				arg.Name, ls.realizedInFile, arg.LineNum,
+				"Unsupported argument '%s' sent to type at %s",
+				arg.Name, arg.Pos,
 			)
 		}
 	}
@@ -296,30 +814,24 @@ func (ls *localState) setVarsFromArgs(passedArgs []Prop, availableParams []Varia
 	return nil
 }
 
-func (ls *localState) resolveArray(a Array, lineNum int) (Array, error) {
-	return ls.resolveArrayRecursive(
-		a, lineNum, nil, map[VariableName]bool{},
-	)
+func (ls *localState) resolveArray(a Array) (Array, error) {
+	return ls.resolveArrayRecursive(a, nil, map[string]bool{})
 }
 
 func (ls *localState) resolveInterpolatedString(is InterpolatedString) (QuotedString, error) {
-	return ls.resolveInterpolatedStringRecursive(
-		is, nil, map[VariableName]bool{},
-	)
+	return ls.resolveInterpolatedStringRecursive(is, nil, map[string]bool{})
 }
 
-func (ls *localState) resolveReferenceRecursive(r Reference, chain []*VariableDef, seenNames map[VariableName]bool) (Reference, error) {
-	resolved, err := ls.resolveValueRecursive(
-		r.Scalar, r.LineNum, chain, seenNames,
-	)
+func (ls *localState) resolveReferenceRecursive(r Reference, chain []*VariableDef, seenNames map[string]bool) (Reference, error) {
+	resolved, err := ls.resolveValueRecursive(r.Scalar, chain, seenNames)
 	if err != nil {
 		return r, nil
 	}
 
 	if str, ok := resolved.(QuotedString); !ok {
 		return r, fmt.Errorf(
-			"Reference keys must be strings (got %T) at %s:%d",
-			resolved, ls.definedInFile, r.LineNum,
+			"Reference keys must be strings (got %T) at %s",
+			resolved, r.Pos,
 		)
 	} else {
 		r.Scalar = str
@@ -334,14 +846,14 @@ func (ls *localState) resolveProps(props []Prop) ([]Prop, error) {
 	for i, prop := range props {
 		if varName, pointsToVar := prop.Value.(VariableName); pointsToVar {
 			var err error
-			prop.Value, err = ls.resolveVariable(varName, prop.LineNum)
+			prop.Value, err = ls.resolveVariable(varName)
 			if err != nil {
 				return nil, err
 			}
 			ret[i] = prop
 		} else {
 			var err error
-			prop.Value, err = ls.resolveValue(prop.Value, prop.LineNum)
+			prop.Value, err = ls.resolveValue(prop.Value)
 			if err != nil {
 				return nil, err
 			}
@@ -351,3 +863,34 @@ func (ls *localState) resolveProps(props []Prop) ([]Prop, error) {
 
 	return ret, nil
 }
+
+// Returns the position of a value in the manifest, or fallback for values
+// without a position such as arrays.
+func valuePos(v Value, fallback Pos) Pos {
+	switch v.(type) {
+	case Literal:
+		return v.(Literal).Pos
+	case VariableName:
+		return v.(VariableName).Pos
+	case Expression:
+		return v.(Expression).Pos
+	case UnaryExpression:
+		return v.(UnaryExpression).Pos
+	case Index:
+		return v.(Index).Pos
+	case Slice:
+		return v.(Slice).Pos
+	case FunctionCall:
+		return v.(FunctionCall).Pos
+	case Selector:
+		return v.(Selector).Pos
+	case Probe:
+		return v.(Probe).Pos
+	case Reference:
+		return v.(Reference).Pos
+	case InterpolatedString:
+		return v.(InterpolatedString).Pos
+	default:
+		return fallback
+	}
+}
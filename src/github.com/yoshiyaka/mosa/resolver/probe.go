@@ -0,0 +1,210 @@
+package resolver
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os/exec"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	. "github.com/yoshiyaka/mosa/ast"
+)
+
+// How long probes may run before being killed, unless the manifest or the
+// Prober says otherwise.
+const DefaultProbeTimeout = 10 * time.Second
+
+// Runs the commands of probes, such as exec { 'dpkg -l': }, while resolving.
+// The result of each command is cached, so a command is only run once per
+// Prober no matter how many times it is probed. A Prober is safe for use by
+// several resolutions at the same time.
+type Prober struct {
+	// Probes which don't set a timeout of their own are killed after this
+	// long. Zero means DefaultProbeTimeout.
+	Timeout time.Duration
+
+	// Guards cache only, so that unrelated commands run concurrently
+	mutex sync.Mutex
+	cache map[probeKey]*probeEntry
+}
+
+type probeKey struct {
+	command, stdin string
+}
+
+type probeResult struct {
+	stdout string
+	status int
+}
+
+// A command which has been run, or is being run. Done is closed once res or
+// err is set, so that concurrent probes of the same command wait for the first
+// one instead of running it again.
+type probeEntry struct {
+	done chan struct{}
+	res  *probeResult
+	err  error
+}
+
+// Returns a Prober which runs commands with the default timeout.
+func NewProber() *Prober {
+	return &Prober{}
+}
+
+// Runs command using bash, with stdin passed as its standard input. Returns the
+// trimmed standard output and the exit status of the command. A command which
+// exits with a non-zero status is not an error, but failing to start it or
+// having to kill it is.
+func (p *Prober) probe(command, stdin string, timeout time.Duration) (*probeResult, error) {
+	key := probeKey{command, stdin}
+
+	p.mutex.Lock()
+	if entry, cached := p.cache[key]; cached {
+		p.mutex.Unlock()
+		<-entry.done
+		return entry.res, entry.err
+	}
+	if p.cache == nil {
+		p.cache = map[probeKey]*probeEntry{}
+	}
+	entry := &probeEntry{done: make(chan struct{})}
+	p.cache[key] = entry
+	p.mutex.Unlock()
+
+	if timeout == 0 {
+		timeout = p.Timeout
+	}
+	if timeout == 0 {
+		timeout = DefaultProbeTimeout
+	}
+	entry.res, entry.err = runProbe(command, stdin, timeout)
+
+	// Failures aren't cached, so that a command which timed out is run again
+	// the next time it's probed
+	if entry.err != nil {
+		p.mutex.Lock()
+		delete(p.cache, key)
+		p.mutex.Unlock()
+	}
+	close(entry.done)
+
+	return entry.res, entry.err
+}
+
+// Runs command using bash in a process group of its own. If the command times
+// out, the whole group is killed, so that commands which fork, such as
+// sleep 5; echo hi, don't keep running with the standard output open.
+func runProbe(command, stdin string, timeout time.Duration) (*probeResult, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, "/bin/bash", "-c", command)
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	cmd.Cancel = func() error {
+		return syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+	}
+	// Processes which left the group may still hold the standard output
+	cmd.WaitDelay = time.Second
+	cmd.Stdin = strings.NewReader(stdin)
+	var stdout bytes.Buffer
+	cmd.Stdout = &stdout
+
+	err := cmd.Run()
+	if ctx.Err() == context.DeadlineExceeded {
+		return nil, fmt.Errorf("timed out after %s", timeout)
+	}
+
+	res := &probeResult{stdout: strings.TrimSpace(stdout.String())}
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		res.status = exitErr.ExitCode()
+	} else if err != nil {
+		return nil, err
+	}
+
+	return res, nil
+}
+
+// Returned when a probe is resolved without a Prober, as when only compiling a
+// manifest.
+type ProbesDisabledError struct {
+	Pos Pos
+}
+
+func (e *ProbesDisabledError) Error() string {
+	return fmt.Sprintf("Probes are not allowed in compile only mode at %s", e.Pos)
+}
+
+// Resolves the command and settings of the probe, and runs it.
+func (ls *localState) resolveProbeRecursive(probe Probe, chain []*VariableDef, seenNames map[string]bool) (Value, error) {
+	if ls.gs == nil || ls.gs.prober == nil {
+		return nil, &ProbesDisabledError{Pos: probe.Pos}
+	}
+
+	resolve := func(v Value) (Value, error) {
+		seenNamesCopy := map[string]bool{}
+		for key, val := range seenNames {
+			seenNamesCopy[key] = val
+		}
+		return ls.resolveValueRecursive(v, chain, seenNamesCopy)
+	}
+
+	cmdVal, err := resolve(probe.Command)
+	if err != nil {
+		return nil, err
+	}
+	command, isString := cmdVal.(QuotedString)
+	if !isString {
+		return nil, fmt.Errorf(
+			"Command of probe must be a string (got %T) at %s", cmdVal, probe.Pos,
+		)
+	}
+
+	var stdin string
+	var timeout time.Duration
+	for _, prop := range probe.Props {
+		val, err := resolve(prop.Value)
+		if err != nil {
+			return nil, err
+		}
+
+		switch prop.Name {
+		case "timeout":
+			seconds, isNumber := toFloat(val)
+			if !isNumber || seconds <= 0 {
+				return nil, fmt.Errorf(
+					"Value for parameter 'timeout' must be a positive number of seconds at %s",
+					prop.Pos,
+				)
+			}
+			timeout = time.Duration(seconds * float64(time.Second))
+		case "stdin":
+			str, isString := val.(QuotedString)
+			if !isString {
+				return nil, fmt.Errorf(
+					"Value for parameter 'stdin' must be of type string at %s",
+					prop.Pos,
+				)
+			}
+			stdin = string(str)
+		default:
+			return nil, fmt.Errorf(
+				"Unsupported argument '%s' sent to probe at %s", prop.Name, prop.Pos,
+			)
+		}
+	}
+
+	res, err := ls.gs.prober.probe(string(command), stdin, timeout)
+	if err != nil {
+		return nil, fmt.Errorf(
+			"Probe '%s' %s at %s", string(command), err, probe.Pos,
+		)
+	}
+
+	return Hash{
+		{Pos: probe.Pos, Key: QuotedString("stdout"), Val: QuotedString(res.stdout)},
+		{Pos: probe.Pos, Key: QuotedString("status"), Val: res.status},
+	}, nil
+}
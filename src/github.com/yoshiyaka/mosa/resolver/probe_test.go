@@ -0,0 +1,177 @@
+package resolver
+
+import (
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	. "github.com/yoshiyaka/mosa/ast"
+	"github.com/yoshiyaka/mosa/parser"
+)
+
+var probeTests = []struct {
+	manifest       string
+	expectedStdout string
+	expectedStatus int
+}{
+	{`exec { 'echo " foo "': }`, "foo", 0},
+	{`exec { 'echo foo; exit 3': }`, "foo", 3},
+	{`exec { 'echo $0 >&2': }`, "", 0},
+	{`exec { 'tr a-z A-Z': stdin => 'abc', }`, "ABC", 0},
+	{`exec { "echo x$x": timeout => 2, }`, "x5", 0},
+}
+
+// Parses the probe as the value of $probe in a class, and resolves it
+func resolveProbe(t *testing.T, gs *globalState, probe string) (Value, error) {
+	manifest := "class C { $x = 5\n $probe = " + probe + " }"
+
+	var ast AST
+	if err := parser.Parse(&ast, "t.ms", strings.NewReader(manifest)); err != nil {
+		t.Fatal(manifest, err)
+	}
+
+	ls := newLocalState(gs, Pos{File: "t.ms"})
+	for _, def := range ast.Classes[0].Block.VariableDefs {
+		ls.varDefsByName[def.VariableName.Str] = def
+	}
+
+	return ls.resolveVariable(VariableName{Str: "$probe"})
+}
+
+func TestProbe(t *testing.T) {
+	for _, test := range probeTests {
+		gs := newGlobalState()
+		gs.prober = NewProber()
+
+		val, err := resolveProbe(t, gs, test.manifest)
+		if err != nil {
+			t.Error(test.manifest, err)
+			continue
+		}
+
+		h := val.(Hash)
+		if stdout, _ := h.Get(QuotedString("stdout")); stdout != QuotedString(test.expectedStdout) {
+			t.Errorf("%s: got stdout %#v", test.manifest, stdout)
+		}
+		if status, _ := h.Get(QuotedString("status")); status != test.expectedStatus {
+			t.Errorf("%s: got status %#v", test.manifest, status)
+		}
+	}
+}
+
+func TestProbeCache(t *testing.T) {
+	gs := newGlobalState()
+	gs.prober = NewProber()
+
+	// The command prints a different number each time it's run
+	const probe = `exec { 'echo $RANDOM$RANDOM': }`
+	first, err := resolveProbe(t, gs, probe)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := resolveProbe(t, gs, probe)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !ValueEquals(first, second) {
+		t.Error("Probe wasn't cached:", first, second)
+	}
+}
+
+var badProbeTests = []struct {
+	manifest      string
+	prober        *Prober
+	expectedError string
+}{
+	{
+		`exec { 'true': }`,
+		nil,
+		"Probes are not allowed in compile only mode at t.ms:2:11",
+	},
+	{
+		`exec { 'sleep 5': timeout => 0.1, }`,
+		NewProber(),
+		"Probe 'sleep 5' timed out after 100ms at t.ms:2:11",
+	},
+	{
+		`exec { 'sleep 5': }`,
+		&Prober{Timeout: 100 * time.Millisecond},
+		"Probe 'sleep 5' timed out after 100ms at t.ms:2:11",
+	},
+	{
+		`exec { 5: }`,
+		NewProber(),
+		"Command of probe must be a string (got int) at t.ms:2:11",
+	},
+	{
+		`exec { 'true': timeout => 'soon', }`,
+		NewProber(),
+		"Value for parameter 'timeout' must be a positive number of seconds at t.ms:2:26",
+	},
+	{
+		`exec { 'true': stdin => 5, }`,
+		NewProber(),
+		"Value for parameter 'stdin' must be of type string at t.ms:2:26",
+	},
+	{
+		`exec { 'true': unless => 'false', }`,
+		NewProber(),
+		"Unsupported argument 'unless' sent to probe at t.ms:2:26",
+	},
+}
+
+func TestBadProbe(t *testing.T) {
+	for _, test := range badProbeTests {
+		gs := newGlobalState()
+		gs.prober = test.prober
+
+		_, err := resolveProbe(t, gs, test.manifest)
+		if err == nil || err.Error() != test.expectedError {
+			t.Error(test.manifest, "got bad error:", err)
+		}
+	}
+}
+
+func TestProbeTimeoutKillsChildren(t *testing.T) {
+	// The sleep is forked by bash and holds on to the standard output
+	start := time.Now()
+	_, err := NewProber().probe("sleep 5; echo hi", "", 200*time.Millisecond)
+	if err == nil || err.Error() != "timed out after 200ms" {
+		t.Error("Got bad error:", err)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Error("Timing out took", elapsed)
+	}
+}
+
+func TestProbeConcurrently(t *testing.T) {
+	p := NewProber()
+	commands := []string{"sleep 0.5; echo a", "sleep 0.5; echo b", "sleep 0.5; echo a"}
+
+	start := time.Now()
+	results := make([]*probeResult, len(commands))
+	var wg sync.WaitGroup
+	for i, command := range commands {
+		wg.Add(1)
+		go func(i int, command string) {
+			defer wg.Done()
+			res, err := p.probe(command, "", time.Second)
+			if err != nil {
+				t.Error(command, err)
+			}
+			results[i] = res
+		}(i, command)
+	}
+	wg.Wait()
+
+	// Unrelated commands don't wait for each other, and the same command is
+	// only run once
+	if elapsed := time.Since(start); elapsed > 900*time.Millisecond {
+		t.Error("Probing took", elapsed)
+	}
+	if results[0] != results[2] || results[0] == results[1] {
+		t.Error("Got results", results)
+	}
+}
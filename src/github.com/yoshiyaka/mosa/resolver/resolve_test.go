@@ -201,6 +201,54 @@ var resolveClassTest = []struct {
 			$ref = [ [ ref['foo'], ], ]
 		}`,
 	},
+
+	{
+		`class C {
+			$port = 80
+			$vhost = { 'port' => $port, 'ssl' => true, 'names' => [ 'a', ], }
+			$ssl = $vhost['ssl']
+			$name = $vhost['names']
+			$nested = { 'inner' => $vhost, }
+			$nestedPort = $nested['inner']['port'] + 1
+		}`,
+		`class C {
+			$port = 80
+			$vhost = { 'port' => 80, 'ssl' => true, 'names' => [ 'a', ], }
+			$ssl = true
+			$name = [ 'a', ]
+			$nested = { 'inner' => { 'port' => 80, 'ssl' => true, 'names' => [ 'a', ], }, }
+			$nestedPort = 81
+		}`,
+	},
+
+	{
+		`class C {
+			$ports = [ 80, 443, 8080, 8443, ]
+			$first = $ports[0]
+			$last = $ports[-1]
+			$middle = $ports[1:3]
+			$tail = $ports[-2:]
+			$head = $ports[:1]
+			$nested = { 'ports' => $ports, }
+			$nestedSlice = $nested['ports'][1:-1]
+			$all = $ports + [ 22, ]
+			$secure = $ports - [ 80, 8080, ]
+			$hasSsh = 22 in $all
+		}`,
+		`class C {
+			$ports = [ 80, 443, 8080, 8443, ]
+			$first = 80
+			$last = 8443
+			$middle = [ 443, 8080, ]
+			$tail = [ 8080, 8443, ]
+			$head = [ 80, ]
+			$nested = { 'ports' => [ 80, 443, 8080, 8443, ], }
+			$nestedSlice = [ 443, 8080, ]
+			$all = [ 80, 443, 8080, 8443, 22, ]
+			$secure = [ 443, 8443, ]
+			$hasSsh = true
+		}`,
+	},
 }
 
 func TestResolveClass(t *testing.T) {
@@ -227,14 +275,13 @@ func TestResolveClass(t *testing.T) {
 		gs.populateClassesByName(realAST.Classes)
 		gs.populateDefinesByName(realAST.Defines)
 		resolver := newClassResolver(
-			gs, &realAST.Classes[0], nil, "real.ms", realAST.Classes[0].LineNum,
+			gs, &realAST.Classes[0], nil, realAST.Classes[0].Pos,
 		)
 		if resolvedClass, err := resolver.resolve(); err != nil {
 			t.Log(test.inputManifest)
 			t.Fatal(err)
 		} else {
 			c := expectedAST.Classes[0]
-			c.Filename = "real.ms"
 			if !c.Equals(&resolvedClass) {
 				t.Logf("%#v", c)
 				t.Logf("%#v", resolvedClass)
@@ -839,6 +886,389 @@ var resolveFileTest = []struct {
 		exec { 'b': require => exec['a'], }
 		`,
 	},
+
+	{
+		`
+		node 'x' {
+			class { 'A': }
+		}
+
+		class A {
+			$ratio = 3 / 4.0
+			$count = 7 / 2
+			file { "ratio-$ratio-$count":
+				value => $ratio * 2,
+			}
+		}
+
+		define single file($name, $value,) {}
+		`,
+		`file { 'ratio-0.75-3': value => 1.5, }`,
+	},
+
+	{
+		`
+		// Hashes as class arguments and prop values
+		node 'x' {
+			class { 'A':
+				vhost => { 'port' => 8080, 'name' => 'www', },
+			}
+		}
+
+		class A($vhost = { 'port' => 80, },) {
+			$port = $vhost['port']
+			site { $vhost['name']:
+				listen => { 'port' => $port, 'ssl' => false },
+			}
+		}
+
+		define single site($name, $listen,) {}
+		`,
+		`site { 'www': listen => { 'ssl' => false, 'port' => 8080, }, }`,
+	},
+
+	{
+		`
+		// Function calls
+		node 'x' {
+			$names = [ 'nginx', 'php5', ]
+			$namesStr = implode($names, ' ')
+			packages { "apt-get -y install $namesStr":
+				count => len($names) * 2,
+			}
+		}
+
+		define single packages($name, $count,) {}
+		`,
+		`packages { 'apt-get -y install nginx php5': count => 4, }`,
+	},
+
+	{
+		`
+		// User defined functions
+		node 'x' {
+			conf { vhost_path('www'): }
+			conf { vhost_path('api', '/srv'): }
+			conf { vhost_path(''): }
+		}
+
+		func vhost_path($name, $dir = '/etc/nginx',) {
+			if $name == '' {
+				return "$dir/default.conf"
+			}
+			return filename($dir, $name) + '.conf'
+		}
+
+		func filename($dir, $name,) {
+			$path = "$dir/sites-available/$name"
+			return $path
+		}
+
+		define single conf($name,) {}
+		`,
+		`
+		conf { '/etc/nginx/sites-available/www.conf': }
+		conf { '/srv/sites-available/api.conf': }
+		conf { '/etc/nginx/default.conf': }
+		`,
+	},
+
+	{
+		`
+		// elsif chains
+		node 'x' {
+			class { 'A': os => 'redhat', }
+			class { 'B': os => 'arch', }
+		}
+
+		class A($os,) {
+			if $os == 'debian' {
+				pkg { 'apache2': }
+			} elsif $os == 'redhat' {
+				pkg { 'httpd': }
+			} elsif $os == 'redhat' {
+				pkg { 'second': }
+			} else {
+				pkg { 'other': }
+			}
+		}
+
+		class B($os,) {
+			if $os == 'debian' {
+				pkg { 'apache2-b': }
+			} elsif $os == 'redhat' {
+				pkg { 'httpd-b': }
+			} else {
+				pkg { 'other-b': }
+			}
+		}
+
+		define single pkg($name,) {}
+		`,
+		`
+		pkg { 'httpd': }
+		pkg { 'other-b': }
+		`,
+	},
+
+	{
+		`
+		// Case statements
+		node 'x' {
+			$os = 'ubuntu'
+			$cores = 4
+			$host = 'www12.example.com'
+
+			case $os {
+				'debian', 'ubuntu': {
+					pkg { 'apache2': }
+				}
+				'ubuntu': {
+					pkg { 'second': }
+				}
+				default: {
+					pkg { 'httpd': }
+				}
+			}
+
+			case $cores {
+				default: {
+					pkg { 'default': }
+				}
+				1, 2: {
+					pkg { 'small': }
+				}
+			}
+
+			case $host {
+				/^www\d+\./: {
+					pkg { 'web': }
+				}
+			}
+
+			case $host {
+				/^db/, 'localhost': {
+					pkg { 'db': }
+				}
+			}
+		}
+
+		define single pkg($name,) {}
+		`,
+		`
+		pkg { 'apache2': }
+		pkg { 'default': }
+		pkg { 'web': }
+		`,
+	},
+
+	{
+		`
+		// Selectors
+		node 'x' {
+			$os = 'centos'
+			$cores = 8
+			$pkg = $os ? {
+				'debian' => 'apache2',
+				/^(redhat|centos)$/ => 'httpd',
+				default => 'other',
+			}
+			$size = $cores > 4 ? { true => 'big', default => 'small' }
+			$user = 'www' ? { 'www' => $pkg, 'www' => $undefined, }
+
+			pkg { $pkg: size => $size, user => $user, }
+		}
+
+		define single pkg($name, $size, $user,) {}
+		`,
+		`pkg { 'httpd': size => 'big', user => 'httpd', }`,
+	},
+
+	{
+		`
+		// Heredocs
+		node 'x' {
+			$port = 80
+			file { '/etc/nginx/sites-available/default':
+				content => <<EOT
+					server {
+						listen $port;
+					}
+					EOT,
+			}
+			file { '/etc/motd':
+				content => <<'EOT'
+				  costs $5
+				EOT,
+			}
+		}
+
+		define single file($name, $content,) {}
+		`,
+		`
+		file { '/etc/nginx/sites-available/default':
+			content => 'server {
+	listen 80;
+}
+',
+		}
+		file { '/etc/motd': content => 'costs $5
+', }
+		`,
+	},
+	{
+		`
+		// Interpolated expressions
+		node 'x' {
+			$port = 80
+			$vhost = { 'name' => 'example.com', 'ssl' => true, }
+			$ratio = 0.5
+
+			file { "${ $vhost['name'] }:${ $port + 1 }":
+				content => "ssl=${ $vhost['ssl'] } ratio=${ $ratio } ${ upcase('ok') }",
+			}
+		}
+
+		define single file($name, $content,) {}
+		`,
+		`file { 'example.com:81': content => 'ssl=true ratio=0.5 OK', }`,
+	},
+
+	{
+		`
+		// Regex matches
+		node 'x' {
+			$host = 'web01.example.com'
+			if $host =~ /^(web|db)(\d+)\./ {
+				if $2 == '01' {
+					pkg { "${1}-primary": id => $0, }
+				}
+			}
+			if $host =~ /^db/ {
+				pkg { 'db': id => $0, }
+			} elsif $host =~ /^(\w+)\.example/ {
+				pkg { "ex-${1}": id => '', }
+			}
+			if $host !~ /^db/ {
+				pkg { 'notdb': id => short($host), }
+			}
+		}
+
+		func short($h,) {
+			if $h =~ /^([^.]+)/ {
+				return $1
+			}
+			return $h
+		}
+
+		define single pkg($name, $id,) {}
+		`,
+		`
+		pkg { 'web-primary': id => 'web01.', }
+		pkg { 'ex-web01': id => '', }
+		pkg { 'notdb': id => 'web01', }
+		`,
+	},
+
+	{
+		`
+		// Variables defined in the branches of matches hold their own captures
+		node 'x' {
+			if 'web01' =~ /web(\d+)/ {
+				$num = $1
+			}
+			if 'db07' =~ /db(\d+)/ {
+				pkg { "n$num": id => $1, }
+			}
+			pkg { "outside-$num": id => '', }
+		}
+
+		define single pkg($name, $id,) {}
+		`,
+		`
+		pkg { 'n01': id => '07', }
+		pkg { 'outside-01': id => '', }
+		`,
+	},
+
+	{
+		`
+		// For loops
+		node 'x' {
+			$users = [
+				{ 'name' => 'alice', 'shell' => '/bin/bash', },
+				{ 'name' => 'bob', 'shell' => '/bin/zsh', },
+			]
+			for $u in $users {
+				$home = "/home/${ $u['name'] }"
+				user { $u['name']: shell => $u['shell'], home => $home, }
+			}
+			for $name, $port in { 'http' => 80, 'https' => 443, } {
+				if $port > 100 {
+					service { $name: port => $port, }
+				}
+			}
+			for $i, $pkg in [ 'a', 'b', ] {
+				pkg { $pkg: index => $i, }
+			}
+			pkg { first_long([ 'x', 'yy', 'zz', ]): index => 9, }
+		}
+
+		func first_long($names,) {
+			for $n in $names {
+				if $n != 'x' {
+					return $n
+				}
+			}
+			return ''
+		}
+
+		define single user($name, $shell, $home,) {}
+		define single service($name, $port,) {}
+		define single pkg($name, $index,) {}
+		`,
+		`
+		user { 'alice': shell => '/bin/bash', home => '/home/alice', }
+		user { 'bob': shell => '/bin/zsh', home => '/home/bob', }
+		service { 'https': port => 443, }
+		pkg { 'a': index => 0, }
+		pkg { 'b': index => 1, }
+		pkg { 'yy': index => 9, }
+		`,
+	},
+
+	{
+		`
+		// Includes
+		node 'x' {
+			include A
+			include B
+			class { 'C': }
+			include C
+		}
+
+		class A {
+			include B
+			pkg { 'a': }
+		}
+
+		class B {
+			include A
+			pkg { 'b': }
+		}
+
+		class C {
+			pkg { 'c': }
+		}
+
+		define single pkg($name,) {}
+		`,
+		`
+		pkg { 'c': }
+		pkg { 'a': }
+		pkg { 'b': }
+		`,
+	},
 }
 
 func TestResolveFile(t *testing.T) {
@@ -892,6 +1322,134 @@ func TestResolveFile(t *testing.T) {
 	}
 }
 
+// Autoloads manifests from a map of names to manifest source.
+type mapAutoloader struct {
+	manifests map[string]string
+	loaded    []string
+}
+
+func (ma *mapAutoloader) Autoload(name string) (*ast.AST, error) {
+	ma.loaded = append(ma.loaded, name)
+
+	manifest, ok := ma.manifests[name]
+	if !ok {
+		return nil, nil
+	}
+
+	a := ast.NewAST()
+	err := parser.Parse(a, name+".ms", strings.NewReader(manifest))
+	return a, err
+}
+
+func TestResolveAutoload(t *testing.T) {
+	autoloader := &mapAutoloader{manifests: map[string]string{
+		"nginx": `
+			class nginx {
+				pkg { 'nginx': }
+			}
+		`,
+		"nginx::vhost": `
+			define single nginx::vhost($name,) {
+				file { nginx::docroot($name): }
+			}
+		`,
+		"nginx::docroot": `
+			func nginx::docroot($site,) {
+				return "/var/www/$site"
+			}
+		`,
+	}}
+
+	manifest := `
+		node 'x' {
+			nginx::vhost { 'a': }
+			nginx::vhost { 'b': }
+			include nginx
+		}
+
+		define single pkg($name,) {}
+		define single file($name,) {}
+
+		// Facters may be written for autoloaded defines
+		facter single nginx::vhost($name,) { return $name == 'b' }
+	`
+	expectedManifest := `
+		file { '/var/www/a': }
+		nginx::vhost { 'a': }
+		file { '/var/www/b': }
+		nginx::vhost { 'b': }
+		pkg { 'nginx': }
+	`
+
+	realAST := ast.NewAST()
+	if err := parser.Parse(realAST, "real.ms", strings.NewReader(manifest)); err != nil {
+		t.Fatal(err)
+	}
+	expectedAST := ast.NewAST()
+	expectedWrapper := fmt.Sprintf("class __X { %s }", expectedManifest)
+	if err := parser.Parse(expectedAST, "expected.ms", strings.NewReader(expectedWrapper)); err != nil {
+		t.Fatal(err)
+	}
+
+	resolvedDecls, facters, err := ResolveWithAutoloader(realAST, autoloader, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	decls := expectedAST.Classes[0].Block.Declarations
+	if !ast.DeclarationsEquals(decls, resolvedDecls) {
+		declsClass := &ast.Class{Block: ast.Block{Declarations: decls}}
+		resolvedDeclsClass := &ast.Class{Block: ast.Block{
+			Declarations: resolvedDecls,
+		}}
+		t.Fatalf(
+			"Got bad manifest, expected\n>>%s<< but got\n>>%s<<",
+			declsClass.String(), resolvedDeclsClass.String(),
+		)
+	}
+
+	// Names are only passed once, and never when already defined
+	if loaded := strings.Join(autoloader.loaded, " "); loaded != "nginx::vhost nginx::docroot nginx" {
+		t.Error("Got bad autoloaded names:", loaded)
+	}
+
+	reduced, err := facters.Reduce(resolvedDecls)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The facter says that vhost b, along with its file, is already applied
+	for _, decl := range reduced {
+		if scalar := decl.Scalar.(ast.QuotedString); scalar == "b" || scalar == "/var/www/b" {
+			t.Errorf("%s %s wasn't reduced by the autoloaded facter", decl.Type, scalar)
+		}
+	}
+	if len(reduced) != 3 {
+		t.Errorf("Got %d declarations after reducing, expected 3", len(reduced))
+	}
+}
+
+func TestResolveAutoloadErrors(t *testing.T) {
+	autoloader := &mapAutoloader{manifests: map[string]string{
+		"nginx": `class nginx {}`,
+	}}
+
+	realAST := ast.NewAST()
+	err := parser.Parse(realAST, "real.ms", strings.NewReader(`
+		node 'x' {
+			include nginx
+			nginx::vhost { 'a': }
+		}
+	`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, _, err = ResolveWithAutoloader(realAST, autoloader, nil)
+	if expected := "Reference to undefined type 'nginx::vhost' at real.ms:4:4"; err == nil || err.Error() != expected {
+		t.Errorf("Got bad error: %v, expected %s", err, expected)
+	}
+}
+
 var badVariableTest = []struct {
 	comment       string
 	inputManifest string
@@ -903,7 +1461,7 @@ var badVariableTest = []struct {
 		`class C {
 			$foo = "$foo"
 		}`,
-		&Err{Line: 2, Type: ErrorTypeCyclicVariable},
+		&Err{Pos: ast.Pos{Line: 2}, Type: ErrorTypeCyclicVariable},
 	},
 
 	{
@@ -911,13 +1469,13 @@ var badVariableTest = []struct {
 		`class C {
 			$a = [ $a, ]
 		}`,
-		&Err{Line: 2, Type: ErrorTypeCyclicVariable},
+		&Err{Pos: ast.Pos{Line: 2}, Type: ErrorTypeCyclicVariable},
 	},
 
 	{
 		"Non-existing variable",
 		`class C { $foo = $bar }`,
-		&Err{Line: 1, Type: ErrorTypeUnresolvableVariable},
+		&Err{Pos: ast.Pos{Line: 1}, Type: ErrorTypeUnresolvableVariable},
 	},
 
 	{
@@ -925,7 +1483,7 @@ var badVariableTest = []struct {
 		`class C {
 			file { $undefined: }
 		}`,
-		&Err{Line: 2, Type: ErrorTypeUnresolvableVariable},
+		&Err{Pos: ast.Pos{Line: 2}, Type: ErrorTypeUnresolvableVariable},
 	},
 
 	{
@@ -933,7 +1491,7 @@ var badVariableTest = []struct {
 		`class C {
 			file { '/etc/issue': content => $text, }
 		}`,
-		&Err{Line: 2, Type: ErrorTypeUnresolvableVariable},
+		&Err{Pos: ast.Pos{Line: 2}, Type: ErrorTypeUnresolvableVariable},
 	},
 
 	{
@@ -942,7 +1500,7 @@ var badVariableTest = []struct {
 			$foo = $bar
 			$bar = $baz
 		}`,
-		&Err{Line: 3, Type: ErrorTypeUnresolvableVariable},
+		&Err{Pos: ast.Pos{Line: 3}, Type: ErrorTypeUnresolvableVariable},
 	},
 
 	{
@@ -952,7 +1510,9 @@ var badVariableTest = []struct {
 		}`,
 		&CyclicError{
 			Err: Err{
-				Line: 2, Type: ErrorTypeCyclicVariable, SymbolName: "$foo",
+				Pos:        ast.Pos{Line: 2},
+				Type:       ErrorTypeCyclicVariable,
+				SymbolName: "$foo",
 			},
 			Cycle: []string{"$foo", "$foo"},
 		},
@@ -964,7 +1524,7 @@ var badVariableTest = []struct {
 			$foo = $bar
 			$bar = $foo
 		}`,
-		&Err{Line: 3, Type: ErrorTypeCyclicVariable},
+		&Err{Pos: ast.Pos{Line: 3}, Type: ErrorTypeCyclicVariable},
 	},
 
 	{
@@ -974,7 +1534,7 @@ var badVariableTest = []struct {
 			$bar = $baz
 			$baz = $foo
 		}`,
-		&Err{Line: 3, Type: ErrorTypeCyclicVariable},
+		&Err{Pos: ast.Pos{Line: 3}, Type: ErrorTypeCyclicVariable},
 	},
 
 	{
@@ -984,7 +1544,7 @@ var badVariableTest = []struct {
 			$bar = "$baz"
 			$baz = $foo
 		}`,
-		&Err{Line: 3, Type: ErrorTypeCyclicVariable},
+		&Err{Pos: ast.Pos{Line: 3}, Type: ErrorTypeCyclicVariable},
 	},
 
 	{
@@ -993,7 +1553,7 @@ var badVariableTest = []struct {
 			$foo = $bar
 			$bar = [ 1, 'foo', $foo, ]
 		}`,
-		&Err{Line: 2, Type: ErrorTypeCyclicVariable},
+		&Err{Pos: ast.Pos{Line: 2}, Type: ErrorTypeCyclicVariable},
 	},
 
 	{
@@ -1002,7 +1562,7 @@ var badVariableTest = []struct {
 			$foo = 1
 			$foo = 1
 		}`,
-		&Err{Line: 3, Type: ErrorTypeMultipleDefinition},
+		&Err{Pos: ast.Pos{Line: 3}, Type: ErrorTypeMultipleDefinition},
 	},
 
 	{
@@ -1011,20 +1571,20 @@ var badVariableTest = []struct {
 			$foo = 1
 			$foo = 'bar'
 		}`,
-		&Err{Line: 3, Type: ErrorTypeMultipleDefinition},
+		&Err{Pos: ast.Pos{Line: 3}, Type: ErrorTypeMultipleDefinition},
 	},
 
 	{
 		"Multiple definitions of the same name in header",
 		`class C($foo = 4, $foo = 5,) {}`,
-		&Err{Line: 1, Type: ErrorTypeMultipleDefinition},
+		&Err{Pos: ast.Pos{Line: 1}, Type: ErrorTypeMultipleDefinition},
 	},
 	{
 		"Variable definition of same name in header and body",
 		`class C($foo = 5,) {
 			$foo = 4
 		}`,
-		&Err{Line: 2, Type: ErrorTypeMultipleDefinition},
+		&Err{Pos: ast.Pos{Line: 2}, Type: ErrorTypeMultipleDefinition},
 	},
 }
 
@@ -1041,7 +1601,7 @@ func TestResolveBadVariable(t *testing.T) {
 
 		gs := newGlobalState()
 		resolver := newClassResolver(
-			gs, &ast.Classes[0], nil, "err.ms", ast.Classes[0].LineNum,
+			gs, &ast.Classes[0], nil, ast.Classes[0].Pos,
 		)
 		resolved, resolveErr := resolver.resolve()
 		if resolveErr == nil {
@@ -1076,11 +1636,14 @@ func TestResolveBadVariable(t *testing.T) {
 				}
 			}
 
-			if e.Line != expE.Line || e.Type != expE.Type {
+			if e.Pos.Line != expE.Pos.Line || e.Type != expE.Type {
 				t.Log(test.inputManifest)
 				t.Errorf(
 					"%s: Got bad error: %s. Expected %s", test.comment, e, expE,
 				)
+			} else if e.Pos.File != "err.ms" || e.Pos.Col == 0 {
+				t.Log(test.inputManifest)
+				t.Errorf("%s: Got error without position: %s", test.comment, e)
 			}
 		}
 	}
@@ -1096,7 +1659,7 @@ var badDefsTest = []struct {
 		class A {}
 		class A {}
 		`,
-		`Can't redefine class 'A' at real.ms:4 which is already defined at real.ms:3`,
+		`Can't redefine class 'A' at real.ms:4:3 which is already defined at real.ms:3:3`,
 	},
 
 	{
@@ -1106,7 +1669,7 @@ var badDefsTest = []struct {
 			class { 'Undefined': }
 		}
 		`,
-		`Reference to undefined class 'Undefined' at real.ms:4`,
+		`Reference to undefined class 'Undefined' at real.ms:4:4`,
 	},
 
 	{
@@ -1119,7 +1682,7 @@ var badDefsTest = []struct {
 			class { 'Undefined': }
 		}
 		`,
-		`Reference to undefined class 'Undefined' at real.ms:7`,
+		`Reference to undefined class 'Undefined' at real.ms:7:4`,
 	},
 
 	{
@@ -1133,7 +1696,7 @@ var badDefsTest = []struct {
 			class { $var: }
 		}
 		`,
-		`Reference to undefined class 'VarValue' at real.ms:8`,
+		`Reference to undefined class 'VarValue' at real.ms:8:4`,
 	},
 
 	{
@@ -1145,7 +1708,7 @@ var badDefsTest = []struct {
 		}
 		class A {}
 		`,
-		`class['A'] realized twice at real.ms:5. Previously realized at real.ms:4`,
+		`class['A'] realized twice at real.ms:5:4. Previously realized at real.ms:4:4`,
 	},
 
 	{
@@ -1165,7 +1728,7 @@ var badDefsTest = []struct {
 		define single package($name, $from,){}
 		`,
 
-		`package['foo'] realized twice at real.ms:11. Previously realized at real.ms:8`,
+		`package['foo'] realized twice at real.ms:11:4. Previously realized at real.ms:8:4`,
 	},
 
 	{
@@ -1178,7 +1741,7 @@ var badDefsTest = []struct {
 			class { 'A': }
 		}
 		`,
-		`class['A'] realized twice at real.ms:7. Previously realized at real.ms:4`,
+		`class['A'] realized twice at real.ms:7:4. Previously realized at real.ms:4:4`,
 	},
 
 	{
@@ -1194,7 +1757,7 @@ var badDefsTest = []struct {
 			class { 'A': }
 		}
 		`,
-		`class['A'] realized twice at real.ms:10. Previously realized at real.ms:4`,
+		`class['A'] realized twice at real.ms:10:4. Previously realized at real.ms:4:4`,
 	},
 
 	{
@@ -1212,7 +1775,7 @@ var badDefsTest = []struct {
 			class { 'A': }
 		}
 		`,
-		`class['A'] realized twice at real.ms:12. Previously realized at real.ms:4`,
+		`class['A'] realized twice at real.ms:12:4. Previously realized at real.ms:4:4`,
 	},
 
 	{
@@ -1226,7 +1789,7 @@ var badDefsTest = []struct {
 			decl { $number: }
 		}
 		`,
-		`Can't realize declaration of type decl with non-string name at real.ms:8`,
+		`Can't realize declaration of type decl with non-string name at real.ms:8:4`,
 	},
 
 	{
@@ -1239,7 +1802,7 @@ var badDefsTest = []struct {
 		}
 		class A {}
 		`,
-		`Unsupported argument 'undefined' sent to type at real.ms:5`,
+		`Unsupported argument 'undefined' sent to type at real.ms:5:5`,
 	},
 
 	{
@@ -1250,7 +1813,7 @@ var badDefsTest = []struct {
 		}
 		class A($required,) {}
 		`,
-		`Required argument 'required' not supplied at real.ms:4`,
+		`Required argument 'required' not supplied at real.ms:4:4`,
 	},
 
 	{
@@ -1266,7 +1829,7 @@ var badDefsTest = []struct {
 			}
 		}
 		`,
-		`Reference keys must be strings (got ast.Array) at real.ms:9`,
+		`Reference keys must be strings (got ast.Array) at real.ms:9:12`,
 	},
 
 	{
@@ -1276,7 +1839,7 @@ var badDefsTest = []struct {
 			myType { 'A': }
 		}
 		`,
-		`Reference to undefined type 'myType' at real.ms:4`,
+		`Reference to undefined type 'myType' at real.ms:4:4`,
 	},
 
 	{
@@ -1290,7 +1853,7 @@ var badDefsTest = []struct {
 			exec { $name: }
 		}
 		`,
-		`exec['bar'] realized twice at real.ms:5. Previously realized at real.ms:8`,
+		`exec['bar'] realized twice at real.ms:5:4. Previously realized at real.ms:8:4`,
 	},
 
 	{
@@ -1298,7 +1861,7 @@ var badDefsTest = []struct {
 		// Single define without name parameter
 		define single testtype($names,) {}
 		`,
-		`Missing required argument $name when defining type 'testtype' at real.ms:3`,
+		`Missing required argument $name when defining type 'testtype' at real.ms:3:3`,
 	},
 
 	{
@@ -1306,7 +1869,7 @@ var badDefsTest = []struct {
 		// Multiple define without names parameter
 		define multiple testtype($name,) {}
 		`,
-		`Missing required argument $names when defining type 'testtype' at real.ms:3`,
+		`Missing required argument $names when defining type 'testtype' at real.ms:3:3`,
 	},
 
 	{
@@ -1315,7 +1878,7 @@ var badDefsTest = []struct {
 		define single x($name,){}
 		define single x($name,){}
 		`,
-		`Can't redefine type 'x' at real.ms:4 which is already defined at real.ms:3`,
+		`Can't redefine type 'x' at real.ms:4:3 which is already defined at real.ms:3:3`,
 	},
 
 	{
@@ -1329,7 +1892,7 @@ var badDefsTest = []struct {
 		}
 		node 'x' { class { 'A': } }
 		`,
-		`'name' may not be passed as an argument in real.ms:6`,
+		`'name' may not be passed as an argument in real.ms:6:5`,
 	},
 
 	{
@@ -1343,7 +1906,7 @@ var badDefsTest = []struct {
 		}
 		node 'x' { class { 'A': } }
 		`,
-		`'names' may not be passed as an argument in real.ms:6`,
+		`'names' may not be passed as an argument in real.ms:6:5`,
 	},
 
 	{
@@ -1360,7 +1923,7 @@ var badDefsTest = []struct {
 		}
 		node 'x' { class { 'A': } }
 		`,
-		`foo['baz'] realized twice at real.ms:7. Previously realized at real.ms:10`,
+		`foo['baz'] realized twice at real.ms:7:4. Previously realized at real.ms:10:4`,
 	},
 
 	{
@@ -1377,7 +1940,7 @@ var badDefsTest = []struct {
 			class { 'A': }
 		}
 		`,
-		`Can't realize classes inside of a define at real.ms:11`,
+		`Can't realize classes inside of a define at real.ms:11:4`,
 	},
 
 	{
@@ -1387,7 +1950,7 @@ var badDefsTest = []struct {
 			if "five" {}
 		}
 		`,
-		`Expressions in if-statements must be boolean at real.ms:4`,
+		`Expressions in if-statements must be boolean at real.ms:4:4`,
 	},
 
 	{
@@ -1399,7 +1962,425 @@ var badDefsTest = []struct {
 			}
 		}
 		`,
-		`Value for parameter 'unless' must be of type string at real.ms:5`,
+		`Value for parameter 'unless' must be of type string at real.ms:5:5`,
+	},
+
+	{
+		`
+		// Missing hash key
+		node 'n' {
+			$h = { 'a' => 1, }
+			$b = $h['b']
+		}
+		`,
+		`Key 'b' not found in hash at real.ms:5:9`,
+	},
+
+	{
+		`
+		// Lookup in something which isn't a hash
+		node 'n' {
+			$a = 5
+			$b = $a['b']
+		}
+		`,
+		`Can't look up a key in value of type int at real.ms:5:9`,
+	},
+
+	{
+		`
+		// Array index which isn't an int
+		node 'n' {
+			$a = [ 1, ]
+			$b = $a['b']
+		}
+		`,
+		`Array indexes must be ints (got ast.QuotedString) at real.ms:5:9`,
+	},
+
+	{
+		`
+		// Array index out of range
+		node 'n' {
+			$a = [ 1, 2, ]
+			$b = $a[-3]
+		}
+		`,
+		`Index -3 out of range for array of length 2 at real.ms:5:9`,
+	},
+
+	{
+		`
+		// Slice out of range
+		node 'n' {
+			$a = [ 1, 2, ]
+			$b = $a[1:3]
+		}
+		`,
+		`Slice bound 3 out of range for array of length 2 at real.ms:5:9`,
+	},
+
+	{
+		`
+		// Slice bounds out of order
+		node 'n' {
+			$a = [ 1, 2, ]
+			$b = $a[-1:0]
+		}
+		`,
+		`Slice starts after its end at real.ms:5:9`,
+	},
+
+	{
+		`
+		// Concatenating an array and a string
+		node 'n' {
+			$a = [ 1, 2, ] + 'three'
+		}
+		`,
+		`Bad types (ast.Array, ast.QuotedString) supplied for operation '+' at real.ms:4:9`,
+	},
+
+	{
+		`
+		// Non-string hash key
+		node 'n' {
+			$h = { 5 => 1, }
+		}
+		`,
+		`Hash keys must be strings (got int) at real.ms:4:11`,
+	},
+
+	{
+		`
+		// Duplicate hash key
+		node 'n' {
+			$h = { 'a' => 1, 'a' => 2, }
+		}
+		`,
+		`Key 'a' defined more than once in hash at real.ms:4:21`,
+	},
+
+	{
+		`
+		// Undefined function
+		node 'n' {
+			$a = 5 + nosuchfunc(1)
+		}
+		`,
+		`Call to undefined function nosuchfunc() at real.ms:4:13`,
+	},
+
+	{
+		`
+		// Recursive function
+		node 'n' {
+			$a = f(1)
+		}
+		func f($x,) {
+			return g($x)
+		}
+		func g($x,) {
+			return f($x)
+		}
+		`,
+		"Recursive call to function f() at real.ms:10:11\n" +
+			"\tin g() called at real.ms:7:11\n" +
+			"\tin f() called at real.ms:4:9",
+	},
+
+	{
+		`
+		// Error inside of a function
+		node 'n' {
+			$a = f(1)
+		}
+		func f($x,) {
+			return $x + $y
+		}
+		`,
+		"Error at real.ms:7:16: Reference to non-defined variable $y\n" +
+			"\tin f() called at real.ms:4:9",
+	},
+
+	{
+		`
+		// Missing argument to function
+		node 'n' {
+			$a = f()
+		}
+		func f($x,) {
+			return $x
+		}
+		`,
+		"Required argument 'x' not supplied at real.ms:4:9\n" +
+			"\tin f() called at real.ms:4:9",
+	},
+
+	{
+		`
+		// Function without return
+		node 'n' {
+			$a = f()
+		}
+		func f() {
+			if false {
+				return 1
+			}
+		}
+		`,
+		"Function f() defined at real.ms:6:3 didn't return a value\n" +
+			"\tin f() called at real.ms:4:9",
+	},
+
+	{
+		`
+		// Declaration in function
+		node 'n' {
+			$a = f()
+		}
+		func f() {
+			exec { 'foo': }
+			return 1
+		}
+		`,
+		"Declarations are not allowed in functions at real.ms:7:4\n" +
+			"\tin f() called at real.ms:4:9",
+	},
+
+	{
+		`
+		// Return outside of function
+		node 'n' {
+			return 5
+		}
+		`,
+		`Return statements are only allowed in functions at real.ms:4:4`,
+	},
+
+	{
+		`
+		// Redefined builtin function
+		node 'n' {}
+		func len($x,) {
+			return 5
+		}
+		`,
+		`Can't redefine builtin function 'len' at real.ms:4:3`,
+	},
+
+	{
+		`
+		// Redefined function
+		node 'n' {}
+		func f() { return 1 }
+		func f() { return 2 }
+		`,
+		`Can't redefine function 'f' at real.ms:5:3 which is already defined at real.ms:4:3`,
+	},
+
+	{
+		`
+		// Facter without define
+		node 'n' {}
+		facter single file($name,) { return true }
+		`,
+		`Facter for undefined type 'file' at real.ms:4:3`,
+	},
+
+	{
+		`
+		// Facter of the wrong type
+		node 'n' {}
+		define single file($name,) {}
+		facter multiple file($name,) { return true }
+		`,
+		`Facter for type 'file' at real.ms:5:3 must be single or multiple like the define at real.ms:4:3`,
+	},
+
+	{
+		`
+		// Facter with the wrong arguments
+		node 'n' {}
+		define single file($name, $content,) {}
+		facter single file($name,) { return true }
+		`,
+		`Facter for type 'file' at real.ms:5:3 must take the same 2 arguments as the define at real.ms:4:3`,
+	},
+
+	{
+		`
+		// Redefined facter
+		node 'n' {}
+		define single file($name,) {}
+		facter single file($name,) { return true }
+		facter single file($name,) { return false }
+		`,
+		`Can't redefine facter 'file' at real.ms:6:3 which is already defined at real.ms:5:3`,
+	},
+
+	{
+		`
+		// Non-boolean elsif
+		node 'n' {
+			if false {
+			} elsif 5 {
+			}
+		}
+		`,
+		`Expressions in if-statements must be boolean at real.ms:5:6`,
+	},
+
+	{
+		`
+		// Declarations in both branches of a case
+		node 'n' {
+			case 'a' {
+				'a', 'b': { exec { 'x': } }
+			}
+			exec { 'x': }
+		}
+		`,
+		`exec['x'] realized twice at real.ms:7:4. Previously realized at real.ms:5:17`,
+	},
+
+	{
+		`
+		// Selector without match
+		node 'n' {
+			$pkg = 'arch' ? { 'debian' => 'apache2', }
+		}
+		`,
+		`No case matches 'arch' in selector without default at real.ms:4:11`,
+	},
+
+	{
+		`
+		// Interpolating an array
+		node 'n' {
+			$pkgs = [ 'a', ]
+			$x = "pkgs: ${ $pkgs }"
+		}
+		`,
+		`Value of type ast.Array can't be interpolated at real.ms:5:19`,
+	},
+
+	{
+		`
+		// Capture variable used outside of its if-statement
+		node 'n' {
+			if 'a' =~ /(a)/ {
+				pkg { $1: }
+			}
+			pkg { $1: }
+		}
+
+		define single pkg($name,) {}
+		`,
+		`Error at real.ms:7:10: Reference to non-defined variable $1`,
+	},
+
+	{
+		`
+		// Bad regex in a string
+		node 'n' {
+			if 'a' =~ '(' {}
+		}
+		`,
+		"Bad regex /(/: error parsing regexp: missing closing ): `(` at real.ms:4:7",
+	},
+
+	{
+		`
+		// Same declaration realized in two iterations
+		node 'n' {
+			for $i in [ 1, 2, ] {
+				pkg { 'same': }
+			}
+		}
+
+		define single pkg($name,) {}
+		`,
+		"pkg['same'] realized twice at real.ms:5:5. Previously realized at real.ms:5:5\n" +
+			"\tin iteration 2 of for loop at real.ms:4:4",
+	},
+
+	{
+		`
+		// Iterating over a string
+		node 'n' {
+			for $c in 'abc' {}
+		}
+		`,
+		`Can't iterate over value of type ast.QuotedString at real.ms:4:4`,
+	},
+
+	{
+		`
+		// Redefining a loop variable
+		node 'n' {
+			for $i in [ 1, ] {
+				$i = 2
+			}
+		}
+		`,
+		"Error at real.ms:5:5: Multiple definition for variable $i\n" +
+			"\tin iteration 1 of for loop at real.ms:4:4",
+	},
+
+	{
+		`
+		// Declaring a class which was included
+		node 'n' {
+			include A
+			include B
+		}
+		class A {}
+		class B {
+			class { 'A': }
+		}
+		`,
+		`class['A'] realized twice at real.ms:9:4. Previously realized at real.ms:4:4`,
+	},
+
+	{
+		`
+		// Including an undefined class
+		node 'n' {
+			include Nope
+		}
+		`,
+		`Reference to undefined class 'Nope' at real.ms:4:4`,
+	},
+
+	{
+		`
+		// Include in a define
+		node 'n' {
+			pkg { 'p': }
+		}
+		class A {}
+		define single pkg($name,) {
+			include A
+		}
+		`,
+		`Can't realize classes inside of a define at real.ms:8:4`,
+	},
+
+	{
+		`
+		// Include in a function
+		node 'n' {
+			$a = f()
+		}
+		class A {}
+		func f() {
+			include A
+			return 1
+		}
+		`,
+		"Includes are not allowed in functions at real.ms:8:4\n" +
+			"\tin f() called at real.ms:4:9",
 	},
 }
 
@@ -17,8 +17,7 @@ const (
 
 type Err struct {
 	Type       ErrorType
-	File       string
-	Line       int
+	Pos        Pos
 	SymbolName string
 }
 
@@ -35,7 +34,7 @@ func (e *Err) Error() string {
 		msg = "Unknown"
 	}
 
-	return fmt.Sprintf("Error at %s:%d: %s", e.File, e.Line, msg)
+	return fmt.Sprintf("Error at %s: %s", e.Pos, msg)
 }
 
 type CyclicError struct {
@@ -53,59 +52,95 @@ func (ce *CyclicError) Error() string {
 // parameters in the returned decalartions will be concrete values. For
 // instance, if called with the following manifest:
 //
-//  node 'localhost' {
-//  	class { 'Webserver':
-//  		docroot => '/home/www',
-//  	}
-//  }
+//	node 'localhost' {
+//		class { 'Webserver':
+//			docroot => '/home/www',
+//		}
+//	}
 //
-//  class Webserver(
-//  	$docroot = '/var/www',
-//  	$workers = 8,
-//  ){
-//  	$server = 'nginx'
+//	class Webserver(
+//		$docroot = '/var/www',
+//		$workers = 8,
+//	){
+//		$server = 'nginx'
 //
-//  	package { $server: ensure => installed }
+//		package { $server: ensure => installed }
 //
-//  	file { '/etc/nginx/conf.d/workers.conf':
-//  		ensure => 'present',
-//  		content => "workers = $workers",
-//  		depends => package[$server],
-//  	}
+//		file { '/etc/nginx/conf.d/workers.conf':
+//			ensure => 'present',
+//			content => "workers = $workers",
+//			depends => package[$server],
+//		}
 //
-//  	file { $docroot: ensure => 'directory', }
+//		file { $docroot: ensure => 'directory', }
+//
+//		service { $server:
+//			ensure => 'running',
+//			depends => [
+//				file['/etc/nginx/conf.d/workers.conf'],
+//				package[$server],
+//			],
+//		}
+//	}
 //
-//  	service { $server:
-//  		ensure => 'running',
-//  		depends => [
-//  			file['/etc/nginx/conf.d/workers.conf'],
-//  			package[$server],
-//  		],
-//  	}
-//  }
 // The following declarations would be returned. Note that all variables are
 // gone:
-//  package { 'nginx': ensure => installed }
 //
-//  file { '/etc/nginx/conf.d/workers.conf':
-//  	ensure => 'present',
-//  	content => "workers = 8",
-//  	depends => package['nginx'],
-//  }
+//	package { 'nginx': ensure => installed }
+//
+//	file { '/etc/nginx/conf.d/workers.conf':
+//		ensure => 'present',
+//		content => "workers = 8",
+//		depends => package['nginx'],
+//	}
 //
-//  file { '/home/www': ensure => 'directory', }
+//	file { '/home/www': ensure => 'directory', }
 //
-//  service { 'nginx':
-//  	ensure => 'running',
-//  	depends => [
-//  		file['/etc/nginx/conf.d/workers.conf'],
-//  		package['nginx'],
-//  	],
-//  }
+//	service { 'nginx':
+//		ensure => 'running',
+//		depends => [
+//			file['/etc/nginx/conf.d/workers.conf'],
+//			package['nginx'],
+//		],
+//	}
 //
+// Any probes in the manifest are run using a new Prober.
 func Resolve(ast *AST) ([]Declaration, error) {
+	decls, _, err := ResolveWithFacters(ast, NewProber())
+	return decls, err
+}
+
+// Works like Resolve(), but also returns the facters of the manifest. They may
+// be used to find out which of the declarations are already satisfied on the
+// target system. Probes in the manifest, and in its facters, are run using
+// prober. If prober is nil, manifests using probes fail to resolve.
+func ResolveWithFacters(ast *AST, prober *Prober) ([]Declaration, *Facters, error) {
+	return ResolveWithAutoloader(ast, nil, prober)
+}
+
+// Loads the definitions of classes, defines and functions on demand, when they
+// are referenced but not defined in the manifest. This is used to load modules
+// from a module path.
+type Autoloader interface {
+	// Returns the manifest which should define name, for instance the file
+	// modules/nginx/manifests/vhost.ms for nginx::vhost. Returns nil if there
+	// is no such manifest. Autoload is called at most once for each name.
+	Autoload(name string) (*AST, error)
+}
+
+// Works like ResolveWithFacters(), but classes, defines and functions which
+// aren't defined in the manifest are loaded using autoloader. If autoloader is
+// nil, nothing is autoloaded.
+func ResolveWithAutoloader(ast *AST, autoloader Autoloader, prober *Prober) ([]Declaration, *Facters, error) {
 	r := newResolver(ast)
-	return r.resolve()
+	r.gs.prober = prober
+	r.gs.autoloader = autoloader
+	decls, err := r.resolve()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return decls, &Facters{gs: r.gs}, nil
 }
 
 // Resolves a whole manifest
@@ -123,10 +158,7 @@ func newResolver(ast *AST) *resolver {
 }
 
 func (r *resolver) resolve() ([]Declaration, error) {
-	if err := r.gs.populateClassesByName(r.ast.Classes); err != nil {
-		return nil, err
-	}
-	if err := r.gs.populateDefinesByName(r.ast.Defines); err != nil {
+	if err := r.gs.populate(r.ast); err != nil {
 		return nil, err
 	}
 
@@ -145,11 +177,11 @@ func (r *resolver) resolve() ([]Declaration, error) {
 
 func (r *resolver) resolveNode(node *Node) error {
 	castedClass := Class(*node)
-	return r.realizeClassesRecursive(&castedClass, nil, "", 0)
+	return r.realizeClassesRecursive(&castedClass, nil, node.Pos)
 }
 
-func (r *resolver) realizeClassesRecursive(c *Class, args []Prop, file string, line int) error {
-	classResolver := newClassResolver(r.gs, c, args, file, line)
+func (r *resolver) realizeClassesRecursive(c *Class, args []Prop, at Pos) error {
+	classResolver := newClassResolver(r.gs, c, args, at)
 	if _, err := classResolver.resolve(); err != nil {
 		return err
 	}
@@ -172,8 +204,8 @@ func checkDeclarationsValidity(d []Declaration) error {
 
 			if _, isString := prop.Value.(QuotedString); !isString {
 				return fmt.Errorf(
-					"Value for parameter 'unless' must be of type string at %s:%d",
-					decl.Filename, prop.LineNum,
+					"Value for parameter 'unless' must be of type string at %s",
+					prop.Pos,
 				)
 			}
 		}
@@ -19,7 +19,7 @@ func Convert(declarations []Declaration) ([]common.Step, error) {
 		for _, prop := range decl.Props {
 			if prop.Name == "depends" {
 				var err error
-				depends, err = propAsReferenceList(decl.Filename, &prop)
+				depends, err = propAsReferenceList(&prop)
 				if err != nil {
 					return nil, err
 				}
@@ -31,6 +31,7 @@ func Convert(declarations []Declaration) ([]common.Step, error) {
 		steps[i] = common.Step{
 			Type:    decl.Type,
 			Item:    string(decl.Scalar.(QuotedString)),
+			Pos:     decl.Pos,
 			Depends: depends,
 			Args:    args,
 		}
@@ -39,7 +40,7 @@ func Convert(declarations []Declaration) ([]common.Step, error) {
 	return steps, nil
 }
 
-func propAsReferenceList(filename string, depends *Prop) (map[string][]string, error) {
+func propAsReferenceList(depends *Prop) (map[string][]string, error) {
 	switch depends.Value.(type) {
 	case Reference:
 		r := depends.Value.(Reference)
@@ -51,8 +52,8 @@ func propAsReferenceList(filename string, depends *Prop) (map[string][]string, e
 		for _, val := range depends.Value.(Array) {
 			if ref, ok := val.(Reference); !ok {
 				return nil, fmt.Errorf(
-					"depends must be a reference or an array of references at %s:%d",
-					filename, depends.LineNum,
+					"depends must be a reference or an array of references at %s",
+					depends.Pos,
 				)
 			} else {
 				if ret[ref.Type] == nil {
@@ -69,8 +70,8 @@ func propAsReferenceList(filename string, depends *Prop) (map[string][]string, e
 		return ret, nil
 	default:
 		return nil, fmt.Errorf(
-			"depends must be a reference or an array of references at %s:%d",
-			filename, depends.LineNum,
+			"depends must be a reference or an array of references at %s",
+			depends.Pos,
 		)
 	}
 }
@@ -42,6 +42,7 @@ var convertTests = []struct {
 		define single package($name,) {}`,
 		[]Step{
 			Step{
+				Pos:     Pos{File: "test.ms", Line: 4, Col: 4},
 				Type:    "package",
 				Item:    "foo",
 				Args:    map[string]interface{}{},
@@ -61,6 +62,7 @@ var convertTests = []struct {
 		define single package($name, $ensure,) {}`,
 		[]Step{
 			Step{
+				Pos:  Pos{File: "test.ms", Line: 4, Col: 4},
 				Type: "package",
 				Item: "foo",
 				Args: map[string]interface{}{
@@ -87,6 +89,7 @@ var convertTests = []struct {
 		`,
 		[]Step{
 			Step{
+				Pos:  Pos{File: "test.ms", Line: 4, Col: 4},
 				Type: "package",
 				Item: "foo",
 				Args: map[string]interface{}{
@@ -123,6 +126,7 @@ var convertTests = []struct {
 		`,
 		[]Step{
 			Step{
+				Pos:  Pos{File: "test.ms", Line: 6, Col: 4},
 				Type: "package",
 				Item: "foo",
 				Args: map[string]interface{}{
@@ -133,6 +137,7 @@ var convertTests = []struct {
 				},
 			},
 			Step{
+				Pos:  Pos{File: "test.ms", Line: 15, Col: 4},
 				Type: "file",
 				Item: "anotherfile",
 				Args: map[string]interface{}{
@@ -185,7 +190,7 @@ var invalidManifests = []struct {
 		}
 		define single file($name,) {}
 		`,
-		`depends must be a reference or an array of references at test.ms:7`,
+		`depends must be a reference or an array of references at test.ms:7:5`,
 	},
 	{
 		`
@@ -202,7 +207,7 @@ var invalidManifests = []struct {
 		}
 		define single file($name,) {}
 		`,
-		`depends must be a reference or an array of references at test.ms:7`,
+		`depends must be a reference or an array of references at test.ms:7:5`,
 	},
 
 	{
@@ -220,7 +225,7 @@ var invalidManifests = []struct {
 		}
 		define single file($name,) {}
 		`,
-		`depends must be a reference or an array of references at test.ms:7`,
+		`depends must be a reference or an array of references at test.ms:7:5`,
 	},
 }
 